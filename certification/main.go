@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"flag"
 	"fmt"
@@ -12,7 +13,7 @@ import (
 )
 
 func run_client(address string) {
-	c, err := varlink.NewConnection(address)
+	c, err := varlink.DialContext(context.Background(), address)
 	if err != nil {
 		fmt.Println("Failed to connect")
 		return
@@ -89,7 +90,7 @@ func run_client(address string) {
 	}
 	fmt.Printf("Test09: '%v'\n", t9)
 
-	receive10, err := orgvarlinkcertification.Test10().Send(c, varlink.More, client_id, t9)
+	receive10, err := orgvarlinkcertification.Test10().Send(c, client_id, t9, varlink.WithMore())
 	if err != nil {
 		fmt.Println("Test10() failed")
 		return
@@ -112,7 +113,7 @@ func run_client(address string) {
 	}
 	fmt.Printf("Test10: '%v'\n", a10)
 
-	_, err = orgvarlinkcertification.Test11().Send(c, varlink.Oneway, client_id, a10)
+	_, err = orgvarlinkcertification.Test11().Send(c, client_id, a10, varlink.WithOneway())
 	if err != nil {
 		fmt.Println("Test11() failed")
 		return
@@ -205,7 +206,7 @@ func run_server(address string) {
 	}
 
 	s.RegisterInterface(orgvarlinkcertification.VarlinkNew(&t))
-	err = s.Listen(address, 0)
+	err = s.RunContext(context.Background(), address)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
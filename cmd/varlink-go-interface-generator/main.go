@@ -1,390 +1,291 @@
 package main
 
 import (
-	"bytes"
+	"flag"
 	"fmt"
-	"go/format"
+	"go/build"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"strings"
 
+	"github.com/varlink/go/pkg/generator"
 	"github.com/varlink/go/varlink/idl"
 )
 
-func writeType(b *bytes.Buffer, t *idl.Type, json bool, ident int) {
-	switch t.Kind {
-	case idl.TypeBool:
-		b.WriteString("bool")
-
-	case idl.TypeInt:
-		b.WriteString("int64")
-
-	case idl.TypeFloat:
-		b.WriteString("float64")
-
-	case idl.TypeString, idl.TypeEnum:
-		b.WriteString("string")
-
-	case idl.TypeObject:
-		b.WriteString("json.RawMessage")
-
-	case idl.TypeArray:
-		b.WriteString("[]")
-		writeType(b, t.ElementType, json, ident)
-
-	case idl.TypeMap:
-		b.WriteString("map[string]")
-		writeType(b, t.ElementType, json, ident)
-
-	case idl.TypeMaybe:
-		b.WriteString("*")
-		writeType(b, t.ElementType, json, ident)
-
-	case idl.TypeAlias:
-		b.WriteString(t.Alias)
-
-	case idl.TypeStruct:
-		if len(t.Fields) == 0 {
-			b.WriteString("struct{}")
-		} else {
-			b.WriteString("struct {\n")
-			for _, field := range t.Fields {
-				for i := 0; i < ident+1; i++ {
-					b.WriteString("\t")
-				}
-
-				b.WriteString(strings.Title(field.Name) + " ")
-				writeType(b, field.Type, json, ident+1)
-				if json {
-					b.WriteString(" `json:\"" + field.Name)
-					if field.Type.Kind == idl.TypeMaybe {
-						b.WriteString(",omitempty")
-					}
-					b.WriteString("\"`")
-				}
-				b.WriteString("\n")
-			}
-			for i := 0; i < ident; i++ {
-				b.WriteString("\t")
-			}
-			b.WriteString("}")
+// writeFile refuses to replace files which were not written by the generator,
+// unless force is set.
+func writeFile(filename string, b []byte, force bool) error {
+	if !force {
+		existing, err := ioutil.ReadFile(filename)
+		if err == nil && !generator.IsGenerated(existing) {
+			return fmt.Errorf("file exists and was not generated by this tool, use -force to overwrite it")
 		}
 	}
-}
 
-func generateTemplate(description string) (string, []byte, error) {
-	description = strings.TrimRight(description, "\n")
+	return ioutil.WriteFile(filename, b, 0660)
+}
 
-	midl, err := idl.New(description)
+// readImport reads an interface description to resolve the types referenced by
+// the other interfaces. Its code is generated into the Go package of the
+// directory of the file. The import path of the package is empty if it cannot
+// be determined, which fails only the interfaces referencing its types.
+func readImport(varlinkFile string) generator.Import {
+	file, err := ioutil.ReadFile(varlinkFile)
 	if err != nil {
-		return "", nil, err
+		fmt.Fprintf(os.Stderr, "Error reading file '%s': %s\n", varlinkFile, err)
+		os.Exit(1)
 	}
 
-	pkgname := strings.Replace(midl.Name, ".", "", -1)
-
-	var b bytes.Buffer
-	b.WriteString("// Generated with github.com/varlink/go/cmd/varlink-go-interface-generator\n")
-	b.WriteString("package " + pkgname + "\n\n")
-	b.WriteString("@IMPORTS@\n\n")
-
-	b.WriteString("// Type declarations\n")
-	for _, a := range midl.Aliases {
-		b.WriteString("type " + a.Name + " ")
-		writeType(&b, a.Type, true, 0)
-		b.WriteString("\n\n")
+	dir, err := filepath.Abs(path.Dir(varlinkFile))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error resolving directory of '%s': %s\n", varlinkFile, err)
+		os.Exit(1)
 	}
 
-	b.WriteString("// Client method calls\n")
-	for _, m := range midl.Methods {
-		b.WriteString("type " + m.Name + "_methods struct{}\n")
-		b.WriteString("func " + m.Name + "() " + m.Name + "_methods { return " + m.Name + "_methods{} }\n\n")
+	return generator.Import{Description: string(file), Path: importPath(dir)}
+}
 
-		b.WriteString("func (m " + m.Name + "_methods) Call(c *varlink.Connection")
-		for _, field := range m.In.Fields {
-			b.WriteString(", " + field.Name + "_in_ ")
-			writeType(&b, field.Type, false, 1)
-		}
-		b.WriteString(") (")
-		for _, field := range m.Out.Fields {
-			b.WriteString(field.Name + "_out_ ")
-			writeType(&b, field.Type, false, 1)
-			b.WriteString(", ")
-		}
-		b.WriteString("err_ error) {\n")
-		b.WriteString("receive, err_ := m.Send(c, 0")
-		for _, field := range m.In.Fields {
-			b.WriteString(", " + field.Name + "_in_ ")
-		}
-		b.WriteString(")\n")
-		b.WriteString("if err_ != nil {\n" +
-			"\treturn\n" +
-			"}\n")
-		b.WriteString("\t")
-		for _, field := range m.Out.Fields {
-			b.WriteString(field.Name + "_out_ ")
-			b.WriteString(", ")
-		}
-		b.WriteString("_, err_ = receive()\n")
-		b.WriteString("\treturn\n" +
-			"}\n\n")
-
-		b.WriteString("func (m " + m.Name + "_methods) Send(c *varlink.Connection, flags uint64")
-		for _, field := range m.In.Fields {
-			b.WriteString(", " + field.Name + "_in_ ")
-			writeType(&b, field.Type, false, 1)
-		}
-		b.WriteString(") (func() (")
-		for _, field := range m.Out.Fields {
-			writeType(&b, field.Type, false, 1)
-			b.WriteString(", ")
-		}
-		b.WriteString("uint64, error), error) {\n")
-		if len(m.In.Fields) > 0 {
-			b.WriteString("\tvar in ")
-			writeType(&b, m.In, true, 1)
-			b.WriteString("\n")
-			for _, field := range m.In.Fields {
-				switch field.Type.Kind {
-				case idl.TypeStruct, idl.TypeArray, idl.TypeMap:
-					b.WriteString("\tin." + strings.Title(field.Name) + " = ")
-					writeType(&b, field.Type, true, 1)
-					b.WriteString("(" + field.Name + "_in_)\n")
-
-				default:
-					b.WriteString("\tin." + strings.Title(field.Name) + " = " + field.Name + "_in_\n")
-				}
+// importPath returns the Go import path of a directory, from the go.mod file
+// of its module, or from GOPATH.
+func importPath(dir string) string {
+	for d := dir; ; d = filepath.Dir(d) {
+		if gomod, err := ioutil.ReadFile(filepath.Join(d, "go.mod")); err == nil {
+			module := modulePath(gomod)
+			rel, err := filepath.Rel(d, dir)
+			if module == "" || err != nil {
+				return ""
 			}
-			b.WriteString("\treceive, err := c.Send(\"" + midl.Name + "." + m.Name + "\", in, flags)\n")
-		} else {
-			b.WriteString("\treceive, err := c.Send(\"" + midl.Name + "." + m.Name + "\", nil, flags)\n")
+			return path.Join(module, filepath.ToSlash(rel))
 		}
-		b.WriteString("if err != nil {\n" +
-			"\treturn nil, err\n" +
-			"}\n")
-		b.WriteString("\treturn func() (")
-		for _, field := range m.Out.Fields {
-			b.WriteString(field.Name + "_out_ ")
-			writeType(&b, field.Type, false, 3)
-			b.WriteString(", ")
+		if filepath.Dir(d) == d {
+			break
 		}
-		b.WriteString("flags uint64, err error) {\n")
-		if len(m.Out.Fields) > 0 {
-			b.WriteString("\t\tvar out ")
-			writeType(&b, m.Out, true, 2)
-			b.WriteString("\n")
-			b.WriteString("\t\tflags, err = receive(&out)\n")
-		} else {
-			b.WriteString("\t\tflags, err = receive(nil)\n")
-		}
-		b.WriteString("\t\tif err != nil {\n" +
-			"\t\t\treturn\n" +
-			"\t\t}\n")
-		for _, field := range m.Out.Fields {
-			b.WriteString("\t\t" + field.Name + "_out_ = ")
-			switch field.Type.Kind {
-			case idl.TypeStruct, idl.TypeArray, idl.TypeMap:
-				writeType(&b, field.Type, false, 2)
-				b.WriteString("(out." + strings.Title(field.Name) + ")\n")
-
-			default:
-				b.WriteString("out." + strings.Title(field.Name) + "\n")
-			}
-		}
-		b.WriteString("\t\treturn\n" +
-			"\t}, nil\n")
-		b.WriteString("}\n\n")
 	}
 
-	b.WriteString("// Service interface with all methods\n")
-	b.WriteString("type " + pkgname + "Interface interface {\n")
-	for _, m := range midl.Methods {
-		b.WriteString("\t" + m.Name + "(c VarlinkCall")
-		for _, field := range m.In.Fields {
-			b.WriteString(", " + field.Name + "_ ")
-			writeType(&b, field.Type, false, 1)
-		}
-		b.WriteString(") error\n")
+	pkg, err := build.ImportDir(dir, build.FindOnly)
+	if err != nil || pkg.ImportPath == "." {
+		return ""
 	}
-	b.WriteString("}\n\n")
-
-	b.WriteString("// Service object with all methods\n")
-	b.WriteString("type VarlinkCall struct{ varlink.Call }\n\n")
+	return pkg.ImportPath
+}
 
-	b.WriteString("// Reply methods for all varlink errors\n")
-	for _, e := range midl.Errors {
-		b.WriteString("func (c *VarlinkCall) Reply" + e.Name + "(")
-		for i, field := range e.Type.Fields {
-			if i > 0 {
-				b.WriteString(", ")
-			}
-			b.WriteString(field.Name + "_ ")
-			writeType(&b, field.Type, false, 1)
-		}
-		b.WriteString(") error {\n")
-		if len(e.Type.Fields) > 0 {
-			b.WriteString("\tvar out ")
-			writeType(&b, e.Type, true, 1)
-			b.WriteString("\n")
-			for _, field := range e.Type.Fields {
-				switch field.Type.Kind {
-				case idl.TypeStruct, idl.TypeArray, idl.TypeMap:
-					b.WriteString("\tout." + strings.Title(field.Name) + " = ")
-					writeType(&b, field.Type, true, 1)
-					b.WriteString("(" + field.Name + "_)\n")
-
-				default:
-					b.WriteString("\tout." + strings.Title(field.Name) + " = " + field.Name + "_\n")
-				}
-			}
-			b.WriteString("\treturn c.ReplyError(\"" + midl.Name + "." + e.Name + "\", &out)\n")
-		} else {
-			b.WriteString("\treturn c.ReplyError(\"" + midl.Name + "." + e.Name + "\", nil)\n")
+// modulePath returns the path of the module directive of a go.mod file.
+func modulePath(gomod []byte) string {
+	for _, line := range strings.Split(string(gomod), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "module" {
+			return strings.Trim(fields[1], "\"`")
 		}
-		b.WriteString("}\n\n")
 	}
+	return ""
+}
 
-	b.WriteString("// Reply methods for all varlink methods\n")
-	for _, m := range midl.Methods {
-		b.WriteString("func (c *VarlinkCall) Reply" + m.Name + "(")
-		for i, field := range m.Out.Fields {
-			if i > 0 {
-				b.WriteString(", ")
-			}
-			b.WriteString(field.Name + "_ ")
-			writeType(&b, field.Type, false, 1)
-		}
-		b.WriteString(") error {\n")
-		if len(m.Out.Fields) > 0 {
-			b.WriteString("\tvar out ")
-			writeType(&b, m.Out, true, 1)
-			b.WriteString("\n")
-			for _, field := range m.Out.Fields {
-				switch field.Type.Kind {
-				case idl.TypeStruct, idl.TypeArray, idl.TypeMap:
-					b.WriteString("\tout." + strings.Title(field.Name) + " = ")
-					writeType(&b, field.Type, true, 1)
-					b.WriteString("(" + field.Name + "_)\n")
-
-				default:
-					b.WriteString("\tout." + strings.Title(field.Name) + " = " + field.Name + "_\n")
-				}
-			}
-			b.WriteString("\treturn c.Reply(&out)\n")
-		} else {
-			b.WriteString("\treturn c.Reply(nil)\n")
-		}
-		b.WriteString("}\n\n")
-	}
+// An emitter generates one kind of output from an interface description
+type emitter struct {
+	generate func(src []byte, opts generator.Options) ([]byte, error)
+	filename func(name string) string
+}
 
-	b.WriteString("// Dummy implementations for all varlink methods\n")
-	for _, m := range midl.Methods {
-		b.WriteString("func (s *VarlinkInterface) " + m.Name + "(c VarlinkCall")
-		for _, field := range m.In.Fields {
-			b.WriteString(", " + field.Name + "_ ")
-			writeType(&b, field.Type, false, 1)
-		}
-		b.WriteString(") error {\n" +
-			"\treturn c.ReplyMethodNotImplemented(\"" + midl.Name + "." + m.Name + "\")\n" +
-			"}\n\n")
-	}
+var emitters = map[string]emitter{
+	"go": {
+		generate: generator.Generate,
+		filename: func(name string) string { return generator.PackageName(name) + ".go" },
+	},
+	"jsonschema": {
+		generate: generator.GenerateJSONSchema,
+		filename: func(name string) string { return name + ".schema.json" },
+	},
+	"markdown": {
+		generate: generator.GenerateMarkdown,
+		filename: func(name string) string { return name + ".md" },
+	},
+	"openapi": {
+		generate: generator.GenerateOpenAPI,
+		filename: func(name string) string { return name + ".openapi.json" },
+	},
+	"proto": {
+		generate: generator.GenerateProto,
+		filename: func(name string) string { return name + ".proto" },
+	},
+}
 
-	b.WriteString("// Method call dispatcher\n")
-	b.WriteString("func (s *VarlinkInterface) VarlinkDispatch(call varlink.Call, methodname string) error {\n" +
-		"\tswitch methodname {\n")
-	for _, m := range midl.Methods {
-		b.WriteString("\tcase \"" + m.Name + "\":\n")
-		if len(m.In.Fields) > 0 {
-			b.WriteString("\t\tvar in ")
-			writeType(&b, m.In, true, 2)
-			b.WriteString("\n")
-			b.WriteString("\t\terr := call.GetParameters(&in)\n" +
-				"\t\tif err != nil {\n" +
-				"\t\t\treturn call.ReplyInvalidParameter(\"parameters\")\n" +
-				"\t\t}\n")
-			b.WriteString("\t\treturn s." + pkgname + "Interface." + m.Name + "(VarlinkCall{call}")
-			if len(m.In.Fields) > 0 {
-				for _, field := range m.In.Fields {
-					switch field.Type.Kind {
-					case idl.TypeStruct, idl.TypeArray, idl.TypeMap:
-						b.WriteString(", ")
-						writeType(&b, field.Type, false, 2)
-						b.WriteString("(in." + strings.Title(field.Name) + ")")
-
-					default:
-						b.WriteString(", in." + strings.Title(field.Name))
-					}
-				}
-			}
-			b.WriteString(")\n")
-		} else {
-			b.WriteString("\t\treturn s." + pkgname + "Interface." + m.Name + "(VarlinkCall{call})\n")
-		}
-		b.WriteString("\n")
-	}
-	b.WriteString("\tdefault:\n" +
-		"\t\treturn call.ReplyMethodNotFound(methodname)\n" +
-		"\t}\n" +
-		"}\n\n")
-
-	b.WriteString("// Varlink interface name\n")
-	b.WriteString("func (s *VarlinkInterface) VarlinkGetName() string {\n" +
-		"\treturn `" + midl.Name + "`\n" + "}\n\n")
-
-	b.WriteString("// Varlink interface description\n")
-	b.WriteString("func (s *VarlinkInterface) VarlinkGetDescription() string {\n" +
-		"\treturn `" + midl.Description + "\n`\n}\n\n")
-
-	b.WriteString("// Service interface\n")
-	b.WriteString("type VarlinkInterface struct {\n" +
-		"\t" + pkgname + "Interface\n" +
-		"}\n\n")
-
-	b.WriteString("func VarlinkNew(m " + pkgname + "Interface) *VarlinkInterface {\n" +
-		"\treturn &VarlinkInterface{m}\n" +
-		"}\n")
-
-	ret_string := b.String()
-
-	if strings.Contains(ret_string, "json.RawMessage") {
-		ret_string = strings.Replace(ret_string, "@IMPORTS@", "import (\n\t\"github.com/varlink/go/varlink\"\n\t\"encoding/json\"\n)", 1)
-	} else {
-		ret_string = strings.Replace(ret_string, "@IMPORTS@", `import "github.com/varlink/go/varlink"`, 1)
+func emitterNames() string {
+	names := make([]string, 0, len(emitters))
+	for name := range emitters {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
 
-	pretty, err := format.Source([]byte(ret_string))
-	if err != nil {
-		return "", nil, err
-	}
+type options struct {
+	outFile        string
+	force          bool
+	templates      string
+	compat         string
+	withExamples   bool
+	withBenchmarks bool
+	conversions    []string
+	emit           emitter
+	imports        []generator.Import
+}
 
-	return pkgname, pretty, nil
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
 }
 
-func generateFile(varlinkFile string) {
+func generateFile(varlinkFile string, o *options) {
 	file, err := ioutil.ReadFile(varlinkFile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error reading file '%s': %s\n", varlinkFile, err)
 		os.Exit(1)
 	}
 
-	pkgname, b, err := generateTemplate(string(file))
+	midl, err := idl.New(string(file))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing file '%s': %s\n", varlinkFile, err)
+		os.Exit(1)
+	}
+
+	opts := generator.Options{Filename: varlinkFile, Imports: o.imports, Compat: o.compat}
+	// The interfaces converted to do not convert back, which would create
+	// an import cycle
+	if !contains(o.conversions, midl.Name) {
+		opts.Conversions = o.conversions
+	}
+	if o.templates != "" {
+		t, err := ioutil.ReadFile(o.templates)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading file '%s': %s\n", o.templates, err)
+			os.Exit(1)
+		}
+		opts.Templates = string(t)
+	}
+
+	b, err := o.emit.generate(file, opts)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error parsing file '%s': %s\n", varlinkFile, err)
 		os.Exit(1)
 	}
 
-	filename := path.Dir(varlinkFile) + "/" + pkgname + ".go"
-	err = ioutil.WriteFile(filename, b, 0660)
+	filename := o.outFile
+	if filename == "" {
+		filename = path.Dir(varlinkFile) + "/" + o.emit.filename(midl.Name)
+	}
+	err = writeFile(filename, b, o.force)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error writing file '%s': %s\n", filename, err)
 		os.Exit(1)
 	}
+
+	if o.withExamples {
+		b, err := generator.GenerateExamples(file, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing file '%s': %s\n", varlinkFile, err)
+			os.Exit(1)
+		}
+
+		examples := strings.TrimSuffix(filename, ".go") + "_example_test.go"
+		err = writeFile(examples, b, o.force)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing file '%s': %s\n", examples, err)
+			os.Exit(1)
+		}
+	}
+
+	if o.withBenchmarks {
+		b, err := generator.GenerateBenchmarks(file, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing file '%s': %s\n", varlinkFile, err)
+			os.Exit(1)
+		}
+
+		benchmarks := strings.TrimSuffix(filename, ".go") + "_bench_test.go"
+		err = writeFile(benchmarks, b, o.force)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing file '%s': %s\n", benchmarks, err)
+			os.Exit(1)
+		}
+	}
 }
 
 func main() {
-	if len(os.Args) != 2 {
-		fmt.Printf("Usage: %s <file>\n", os.Args[0])
+	var o options
+	var emit string
+	var convertTo string
+	var version bool
+
+	flag.StringVar(&o.outFile, "out-file", "", "Write the generated output to `file` instead of <package>.go or <interface>.<ext>")
+	flag.BoolVar(&o.force, "force", false, "Overwrite files which were not generated by this tool")
+	flag.StringVar(&o.templates, "templates", "", "Replace the default code templates with the definitions in `file`")
+	flag.StringVar(&o.compat, "compat", "", "Generate the Go API of an earlier generator `version`: "+generator.CompatV1)
+	flag.BoolVar(&o.withExamples, "with-examples", false, "Write godoc examples for all methods to <file>_example_test.go")
+	flag.BoolVar(&o.withBenchmarks, "with-benchmarks", false, "Write benchmarks for the encoding and dispatching of all methods to <file>_bench_test.go")
+	flag.StringVar(&convertTo, "convert-to", "", "Generate conversions to the identical types of the comma separated `interfaces`")
+	flag.StringVar(&emit, "emit", "go", "Generate `kind` of output: "+emitterNames())
+	flag.BoolVar(&version, "version", false, "Print the generator version")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <file> [<file>...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if version {
+		fmt.Println(generator.Version)
+		return
+	}
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	e, ok := emitters[emit]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: unknown -emit '%s', expected one of: %s\n", emit, emitterNames())
+		os.Exit(1)
+	}
+	o.emit = e
+
+	if o.withExamples && emit != "go" {
+		fmt.Fprintf(os.Stderr, "Error: -with-examples can only be used with -emit go\n")
+		os.Exit(1)
+	}
+
+	if o.withBenchmarks && emit != "go" {
+		fmt.Fprintf(os.Stderr, "Error: -with-benchmarks can only be used with -emit go\n")
 		os.Exit(1)
 	}
-	generateFile(os.Args[1])
+
+	if convertTo != "" {
+		if emit != "go" || flag.NArg() < 2 {
+			fmt.Fprintf(os.Stderr, "Error: -convert-to can only be used with -emit go and the files of the interfaces\n")
+			os.Exit(1)
+		}
+		o.conversions = strings.Split(convertTo, ",")
+	}
+
+	if o.outFile != "" && flag.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "Error: -out-file can only be used with a single file\n")
+		os.Exit(1)
+	}
+
+	// Types referenced by one interface are resolved against the others
+	if flag.NArg() > 1 && emit == "go" {
+		for _, varlinkFile := range flag.Args() {
+			o.imports = append(o.imports, readImport(varlinkFile))
+		}
+	}
+
+	for _, varlinkFile := range flag.Args() {
+		generateFile(varlinkFile, &o)
+	}
 }
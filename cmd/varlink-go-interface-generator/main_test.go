@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "varlink-go-interface-generator")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	generated := []byte("// Generated with github.com/varlink/go/cmd/varlink-go-interface-generator\npackage foo\n")
+
+	filename := dir + "/foo.go"
+	if err := writeFile(filename, generated, false); err != nil {
+		t.Fatalf("writeFile() new file: %v", err)
+	}
+	if err := writeFile(filename, generated, false); err != nil {
+		t.Fatalf("writeFile() generated file: %v", err)
+	}
+
+	if err := ioutil.WriteFile(filename, []byte("package foo\n"), 0660); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	if err := writeFile(filename, generated, false); err == nil {
+		t.Fatal("writeFile() replaced a hand-written file")
+	}
+	if err := writeFile(filename, generated, true); err != nil {
+		t.Fatalf("writeFile() with force: %v", err)
+	}
+}
+
+func TestImportPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "varlink-go-interface-generator")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("// The module\nmodule example.com/mod // comment\n\ngo 1.21\n"), 0660); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "api", "v1"), 0770); err != nil {
+		t.Fatalf("MkdirAll(): %v", err)
+	}
+
+	for sub, expected := range map[string]string{
+		"":                         "example.com/mod",
+		filepath.Join("api", "v1"): "example.com/mod/api/v1",
+	} {
+		if path := importPath(filepath.Join(dir, sub)); path != expected {
+			t.Fatalf("importPath() of '%s': '%s'", sub, path)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("go 1.21\n"), 0660); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	if path := importPath(dir); path != "" {
+		t.Fatalf("importPath() without a module directive: '%s'", path)
+	}
+}
@@ -0,0 +1,319 @@
+package generator
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/varlink/go/varlink/idl"
+)
+
+// A conversion between an alias and the structurally identical alias of an
+// imported interface
+type goConversion struct {
+	Name   string
+	Other  string
+	Method string
+	To     string
+	From   string
+}
+
+// converter finds the structurally identical aliases of the generated
+// interface and of an imported interface, and writes the expressions which
+// convert the values of one to the other.
+type converter struct {
+	local     *idl.IDL
+	other     *idl.IDL
+	qualifier string
+
+	// The results for pairs of local and other alias names. A pair is
+	// assumed to be identical while it is compared, to terminate on
+	// recursive types.
+	identical map[[2]string]bool
+}
+
+// qualifyType returns a copy of t with the aliases qualified by the package
+// of the other interface.
+func (c *converter) qualifyType(t *idl.Type) *idl.Type {
+	q := *t
+	switch t.Kind {
+	case idl.TypeAlias:
+		q.Alias = c.qualifier + "." + t.Alias
+
+	case idl.TypeArray, idl.TypeMaybe, idl.TypeMap:
+		q.ElementType = c.qualifyType(t.ElementType)
+
+	case idl.TypeStruct:
+		q.Fields = make([]idl.TypeField, len(t.Fields))
+		for i, field := range t.Fields {
+			field.Type = c.qualifyType(field.Type)
+			q.Fields[i] = field
+		}
+	}
+	return &q
+}
+
+func (c *converter) goType(t *idl.Type, other bool) string {
+	if other {
+		t = c.qualifyType(t)
+	}
+	return goType(t, true)
+}
+
+// method returns the name of the conversion methods for an alias of the other
+// interface, like OrgexamplecommonPoint for Point of org.example.common.
+func (c *converter) method(name string) string {
+	return strings.Title(c.qualifier) + goAliasName(name)
+}
+
+// sameType reports whether the local type references the alias of the other
+// interface itself.
+func (c *converter) sameType(local, other *idl.Type) bool {
+	return local.Kind == idl.TypeAlias && local.Alias == c.qualifier+"."+other.Alias
+}
+
+func (c *converter) isIdentical(local, other *idl.Type) bool {
+	if c.sameType(local, other) {
+		return true
+	}
+
+	if local.Kind != other.Kind {
+		return false
+	}
+
+	switch local.Kind {
+	case idl.TypeArray, idl.TypeMaybe, idl.TypeMap:
+		return c.isIdentical(local.ElementType, other.ElementType)
+
+	case idl.TypeEnum, idl.TypeStruct:
+		if len(local.Fields) != len(other.Fields) {
+			return false
+		}
+		for i := range local.Fields {
+			l, o := &local.Fields[i], &other.Fields[i]
+			if l.Name != o.Name {
+				return false
+			}
+			if local.Kind == idl.TypeEnum {
+				continue
+			}
+			if typename, _ := goTypeOverride(l); typename != "" {
+				return false
+			}
+			if typename, _ := goTypeOverride(o); typename != "" {
+				return false
+			}
+			if !c.isIdentical(l.Type, o.Type) {
+				return false
+			}
+		}
+		return true
+
+	case idl.TypeAlias:
+		// Aliases of a third interface are not converted
+		if strings.Contains(local.Alias, ".") {
+			return false
+		}
+
+		key := [2]string{local.Alias, other.Alias}
+		if identical, ok := c.identical[key]; ok {
+			return identical
+		}
+
+		l, ok := c.local.Aliases[local.Alias]
+		if !ok {
+			return false
+		}
+		o, ok := c.other.Aliases[other.Alias]
+		if !ok {
+			return false
+		}
+
+		c.identical[key] = true
+		identical := c.isIdentical(l.Type, o.Type)
+		c.identical[key] = identical
+		return identical
+	}
+
+	return true
+}
+
+// convert returns the expression which converts expr of type from to type to.
+// The types are structurally identical, from is the type of the other
+// interface unless toOther is set.
+func (c *converter) convert(expr string, from, to *idl.Type, toOther bool) string {
+	fromType, toType := c.goType(from, !toOther), c.goType(to, toOther)
+	if fromType == toType {
+		return expr
+	}
+
+	local, other := from, to
+	if !toOther {
+		local, other = to, from
+	}
+
+	switch from.Kind {
+	case idl.TypeAlias:
+		if c.local.Aliases[local.Alias].Type.Kind == idl.TypeEnum {
+			return toType + "(" + expr + ")"
+		}
+		if toOther {
+			if strings.HasPrefix(expr, "*") {
+				expr = "(" + expr + ")"
+			}
+			return expr + ".To" + c.method(other.Alias) + "()"
+		}
+		return goAliasName(local.Alias) + "From" + c.method(other.Alias) + "(" + expr + ")"
+
+	case idl.TypeStruct:
+		return c.convertFields(expr, from, to, toType, toOther)
+
+	case idl.TypeMaybe:
+		return "func(v " + fromType + ") " + toType + " {\n" +
+			"if v == nil {\nreturn nil\n}\n" +
+			"r := " + c.convert("*v", from.ElementType, to.ElementType, toOther) + "\n" +
+			"return &r\n" +
+			"}(" + expr + ")"
+
+	case idl.TypeArray:
+		return "func(v " + fromType + ") " + toType + " {\n" +
+			"if v == nil {\nreturn nil\n}\n" +
+			"r := make(" + toType + ", len(v))\n" +
+			"for i := range v {\n" +
+			"r[i] = " + c.convert("v[i]", from.ElementType, to.ElementType, toOther) + "\n" +
+			"}\n" +
+			"return r\n" +
+			"}(" + expr + ")"
+
+	case idl.TypeMap:
+		return "func(v " + fromType + ") " + toType + " {\n" +
+			"if v == nil {\nreturn nil\n}\n" +
+			"r := make(" + toType + ", len(v))\n" +
+			"for k := range v {\n" +
+			"r[k] = " + c.convert("v[k]", from.ElementType, to.ElementType, toOther) + "\n" +
+			"}\n" +
+			"return r\n" +
+			"}(" + expr + ")"
+	}
+
+	return expr
+}
+
+// convertFields returns the composite literal of typename with the converted
+// fields of the struct expr.
+func (c *converter) convertFields(expr string, from, to *idl.Type, typename string, toOther bool) string {
+	if len(from.Fields) == 0 {
+		return typename + "{}"
+	}
+
+	var b bytes.Buffer
+	b.WriteString(typename + "{\n")
+	for i := range from.Fields {
+		b.WriteString(goFieldName(&to.Fields[i]) + ": ")
+		b.WriteString(c.convert(expr+"."+goFieldName(&from.Fields[i]), from.Fields[i].Type, to.Fields[i].Type, toOther))
+		b.WriteString(",\n")
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+// referencedAliases returns the names of the aliases referenced, but not
+// defined, by the interface description.
+func referencedAliases(midl *idl.IDL) map[string]bool {
+	names := make(map[string]bool)
+	collect := func(t *idl.Type) error {
+		if _, ok := midl.Aliases[t.Alias]; !ok {
+			names[t.Alias] = true
+		}
+		return nil
+	}
+
+	for _, member := range midl.Members {
+		switch member := member.(type) {
+		case *idl.Alias:
+			walkAliases(member.Type, collect)
+		case *idl.Method:
+			walkAliases(member.In, collect)
+			walkAliases(member.Out, collect)
+		case *idl.Error:
+			walkAliases(member.Type, collect)
+		}
+	}
+
+	return names
+}
+
+// newConversions returns the conversions between the aliases of midl and the
+// structurally identical aliases of the imported interface with the given name.
+// The generated package imports the package of the other interface, which
+// must therefore not reference the types of midl.
+func newConversions(midl *idl.IDL, imports []Import, name string, pkgpaths map[string]bool) ([]*goConversion, error) {
+	var imp *Import
+	var other *idl.IDL
+	for i := range imports {
+		iidl, err := idl.New(strings.TrimRight(imports[i].Description, "\n"))
+		if err != nil {
+			return nil, err
+		}
+		if iidl.Name == name {
+			imp, other = &imports[i], iidl
+			break
+		}
+	}
+	if other == nil {
+		return nil, fmt.Errorf("no imported interface '%s' to convert types with", name)
+	}
+	if other.Name == midl.Name {
+		return nil, fmt.Errorf("interface '%s' cannot convert types with itself", name)
+	}
+
+	for alias := range referencedAliases(other) {
+		if _, ok := midl.Aliases[alias]; ok {
+			return nil, fmt.Errorf("interface '%s' references type '%s' of '%s', converting types with it would create an import cycle", name, alias, midl.Name)
+		}
+	}
+
+	c := &converter{
+		local:     midl,
+		other:     other,
+		qualifier: PackageName(other.Name),
+		identical: make(map[[2]string]bool),
+	}
+
+	localAliases, _, _ := splitMembers(midl)
+	otherAliases, _, _ := splitMembers(other)
+
+	var conversions []*goConversion
+	for _, l := range localAliases {
+		for _, o := range otherAliases {
+			local := &idl.Type{Kind: idl.TypeAlias, Alias: l.Name}
+			remote := &idl.Type{Kind: idl.TypeAlias, Alias: o.Name}
+			if !c.isIdentical(local, remote) {
+				continue
+			}
+
+			conversion := &goConversion{
+				Name:   goAliasName(l.Name),
+				Other:  c.goType(remote, true),
+				Method: c.method(o.Name),
+			}
+			if l.Type.Kind == idl.TypeEnum {
+				conversion.To = conversion.Other + "(v)"
+				conversion.From = conversion.Name + "(v)"
+			} else {
+				conversion.To = c.convertFields("v", l.Type, o.Type, conversion.Other, true)
+				conversion.From = c.convertFields("v", o.Type, l.Type, conversion.Name, false)
+			}
+			conversions = append(conversions, conversion)
+		}
+	}
+
+	if len(conversions) > 0 {
+		if imp.Path == "" {
+			return nil, fmt.Errorf("interface '%s' has no Go import path to convert types with", name)
+		}
+		pkgpaths[imp.Path] = true
+	}
+
+	return conversions, nil
+}
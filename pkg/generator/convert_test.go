@@ -0,0 +1,87 @@
+package generator
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConversions(t *testing.T) {
+	draw := Import{
+		Description: `
+interface org.example.draw
+
+type Coord (x: int, y: int)
+
+type Colour (red, green)
+
+type Segment (start: Coord, end: Coord, color: ?Colour, path: []Coord)
+
+type Size (w: int, h: int)
+
+method Ping() -> ()
+`,
+		Path: "example.com/draw/orgexampledraw",
+	}
+
+	b, err := Generate([]byte(`
+interface org.example.geo
+
+type Point (x: int, y: int)
+
+type Color (red, green)
+
+type Line (start: Point, end: Point, color: ?Color, path: []Point)
+
+type Size (width: int, height: int)
+
+method Get() -> (line: Line)
+	`), Options{Imports: []Import{draw}, Conversions: []string{"org.example.draw"}})
+	if err != nil {
+		t.Fatalf("Error generating %v", err)
+	}
+
+	src := string(b)
+	for _, s := range []string{
+		"\t\"example.com/draw/orgexampledraw\"\n",
+		"func (v Point) ToOrgexampledrawCoord() orgexampledraw.Coord {",
+		"func PointFromOrgexampledrawCoord(v orgexampledraw.Coord) Point {",
+		"return orgexampledraw.Colour(v)\n",
+		"return Color(v)\n",
+		"Start: v.Start.ToOrgexampledrawCoord(),",
+		"Start: PointFromOrgexampledrawCoord(v.Start),",
+		"r := orgexampledraw.Colour(*v)\n",
+		"r[i] = v[i].ToOrgexampledrawCoord()\n",
+	} {
+		if !strings.Contains(src, s) {
+			t.Fatalf("Generated source is missing `%s`:\n%s", s, src)
+		}
+	}
+	if strings.Contains(src, "ToOrgexampledrawSize") {
+		t.Fatalf("Generated a conversion between types with different fields:\n%s", src)
+	}
+
+	_, err = Generate([]byte(`
+interface org.example.geo
+
+type Coord (x: int, y: int)
+
+method Get() -> ()
+	`), Options{Imports: []Import{{
+		Description: "interface org.example.draw\nmethod Draw(c: Coord) -> ()\n",
+		Path:        "example.com/draw/orgexampledraw",
+	}}, Conversions: []string{"org.example.draw"}})
+	if err == nil {
+		t.Fatal("Generated conversions which create an import cycle")
+	}
+
+	_, err = Generate([]byte("interface org.example.geo\nmethod Get() -> ()\n"), Options{Conversions: []string{"org.example.draw"}})
+	if err == nil {
+		t.Fatal("Generated conversions without the imported interface")
+	}
+
+	draw.Path = ""
+	_, err = Generate([]byte("interface org.example.geo\ntype Point (x: int, y: int)\nmethod Get() -> ()\n"), Options{Imports: []Import{draw}, Conversions: []string{"org.example.draw"}})
+	if err == nil {
+		t.Fatal("Generated conversions without the import path")
+	}
+}
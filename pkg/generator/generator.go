@@ -0,0 +1,974 @@
+// Package generator generates Go code from varlink interface descriptions. It
+// is used by the varlink-go-interface-generator command and can be embedded
+// into other build tools.
+package generator
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"go/format"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/varlink/go/varlink/idl"
+)
+
+func goAnnotations(doc string) map[string]string {
+	annotations := make(map[string]string)
+
+	for _, line := range strings.Split(doc, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "go:") {
+			continue
+		}
+
+		words := strings.SplitN(line[3:], " ", 2)
+		if len(words) != 2 {
+			continue
+		}
+		annotations[words[0]] = strings.TrimSpace(words[1])
+	}
+
+	return annotations
+}
+
+// Go keywords and predeclared identifiers
+var goReserved = map[string]bool{
+	"break": true, "case": true, "chan": true, "const": true, "continue": true,
+	"default": true, "defer": true, "else": true, "fallthrough": true, "for": true,
+	"func": true, "go": true, "goto": true, "if": true, "import": true,
+	"interface": true, "map": true, "package": true, "range": true, "return": true,
+	"select": true, "struct": true, "switch": true, "type": true, "var": true,
+
+	"any": true, "bool": true, "byte": true, "comparable": true, "complex64": true,
+	"complex128": true, "error": true, "float32": true, "float64": true, "int": true,
+	"int8": true, "int16": true, "int32": true, "int64": true, "rune": true,
+	"string": true, "uint": true, "uint8": true, "uint16": true, "uint32": true,
+	"uint64": true, "uintptr": true, "true": true, "false": true, "iota": true,
+	"nil": true, "append": true, "cap": true, "close": true, "complex": true,
+	"copy": true, "delete": true, "imag": true, "len": true, "make": true,
+	"new": true, "panic": true, "print": true, "println": true, "real": true,
+	"recover": true, "clear": true, "min": true, "max": true,
+}
+
+// Declarations of the generated code, and the methods of VarlinkInterface
+var generatorReserved = map[string]bool{
+	"VarlinkCall":              true,
+	"VarlinkInterface":         true,
+	"VarlinkInterfaceMethods":  true,
+	"VarlinkNew":               true,
+	"VarlinkDispatch":          true,
+	"VarlinkGetName":           true,
+	"VarlinkGetDescription":    true,
+	"varlinkDispatchTable":     true,
+	"VarlinkGeneratorVersion":  true,
+	"VarlinkSource":            true,
+	"VarlinkDescriptionSHA256": true,
+	"VarlinkConnect":           true,
+}
+
+// VarlinkCall gets a Reply<name>() method for every varlink method and error,
+// these names would shadow the reply methods of varlink.Call.
+var replyReserved = map[string]bool{
+	"Error":                true,
+	"InterfaceNotFound":    true,
+	"MethodNotFound":       true,
+	"MethodNotImplemented": true,
+	"InvalidParameter":     true,
+}
+
+// sanitizeGoName appends an underscore to names which clash with Go keywords,
+// predeclared identifiers, or the declarations of the generated code.
+func sanitizeGoName(name string) string {
+	if goReserved[name] || generatorReserved[name] {
+		return name + "_"
+	}
+	return name
+}
+
+// Identifiers used by the generated examples
+var exampleReserved = map[string]bool{
+	"c": true, "context": true, "e": true, "err": true, "fmt": true, "os": true,
+	"varlink": true,
+}
+
+func exampleVarName(name string) string {
+	if exampleReserved[name] {
+		return name + "_"
+	}
+	return sanitizeGoName(name)
+}
+
+// goAliasName returns the Go type name of a varlink type, which can be
+// qualified with the package of an imported interface.
+func goAliasName(name string) string {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		return name[:i+1] + sanitizeGoName(name[i+1:])
+	}
+	return sanitizeGoName(name)
+}
+
+func goFieldName(field *idl.TypeField) string {
+	if name, ok := goAnnotations(field.Doc)["name"]; ok {
+		return sanitizeGoName(name)
+	}
+	return strings.Title(field.Name)
+}
+
+func goMethodName(m *idl.Method) string {
+	name := m.Name
+	if n, ok := goAnnotations(m.Doc)["name"]; ok {
+		name = n
+	}
+	if replyReserved[name] {
+		return name + "_"
+	}
+	return sanitizeGoName(name)
+}
+
+func goErrorName(e *idl.Error) string {
+	if replyReserved[e.Name] {
+		return e.Name + "_"
+	}
+	return sanitizeGoName(e.Name)
+}
+
+// goTypeOverride returns the Go type expression of a `go:type` annotation with
+// the package qualifier reduced to its name, and the package import path.
+func goTypeOverride(field *idl.TypeField) (string, string) {
+	typename, ok := goAnnotations(field.Doc)["type"]
+	if !ok {
+		return "", ""
+	}
+
+	// Split off the element type prefix: *T, []T, map[string]T
+	prefix := ""
+	for {
+		switch {
+		case strings.HasPrefix(typename, "*"):
+			prefix += "*"
+			typename = typename[1:]
+			continue
+
+		case strings.HasPrefix(typename, "[]"):
+			prefix += "[]"
+			typename = typename[2:]
+			continue
+
+		case strings.HasPrefix(typename, "map[string]"):
+			prefix += "map[string]"
+			typename = typename[11:]
+			continue
+		}
+		break
+	}
+
+	r := strings.LastIndex(typename, ".")
+	if r <= 0 {
+		return prefix + typename, ""
+	}
+
+	pkgpath := typename[:r]
+	return prefix + path.Base(pkgpath) + typename[r:], pkgpath
+}
+
+func writeFieldType(b *bytes.Buffer, field *idl.TypeField, json bool, ident int) {
+	if typename, _ := goTypeOverride(field); typename != "" {
+		b.WriteString(typename)
+		return
+	}
+	writeType(b, field.Type, json, ident)
+}
+
+func collectImports(t *idl.Type, imports map[string]bool) {
+	if t == nil {
+		return
+	}
+
+	if t.Kind == idl.TypeObject {
+		imports["encoding/json"] = true
+	}
+
+	for i := range t.Fields {
+		if _, pkgpath := goTypeOverride(&t.Fields[i]); pkgpath != "" {
+			imports[pkgpath] = true
+			continue
+		}
+		collectImports(t.Fields[i].Type, imports)
+	}
+
+	collectImports(t.ElementType, imports)
+}
+
+func writeType(b *bytes.Buffer, t *idl.Type, json bool, ident int) {
+	switch t.Kind {
+	case idl.TypeBool:
+		b.WriteString("bool")
+
+	case idl.TypeInt:
+		b.WriteString("int64")
+
+	case idl.TypeFloat:
+		b.WriteString("float64")
+
+	case idl.TypeString, idl.TypeEnum:
+		b.WriteString("string")
+
+	case idl.TypeObject:
+		b.WriteString("json.RawMessage")
+
+	case idl.TypeArray:
+		b.WriteString("[]")
+		writeType(b, t.ElementType, json, ident)
+
+	case idl.TypeMap:
+		b.WriteString("map[string]")
+		writeType(b, t.ElementType, json, ident)
+
+	case idl.TypeMaybe:
+		b.WriteString("*")
+		writeType(b, t.ElementType, json, ident)
+
+	case idl.TypeAlias:
+		b.WriteString(goAliasName(t.Alias))
+
+	case idl.TypeStruct:
+		if len(t.Fields) == 0 {
+			b.WriteString("struct{}")
+		} else {
+			b.WriteString("struct {\n")
+			for _, field := range t.Fields {
+				for i := 0; i < ident+1; i++ {
+					b.WriteString("\t")
+				}
+
+				b.WriteString(goFieldName(&field) + " ")
+				writeFieldType(b, &field, json, ident+1)
+				if json {
+					b.WriteString(" `json:\"" + field.Name)
+					if field.Type.Kind == idl.TypeMaybe {
+						b.WriteString(",omitempty")
+					}
+					b.WriteString("\"`")
+				}
+				b.WriteString("\n")
+			}
+			for i := 0; i < ident; i++ {
+				b.WriteString("\t")
+			}
+			b.WriteString("}")
+		}
+	}
+}
+
+func goType(t *idl.Type, json bool) string {
+	var b bytes.Buffer
+	writeType(&b, t, json, 0)
+	return b.String()
+}
+
+func writeZeroValue(b *bytes.Buffer, midl *idl.IDL, t *idl.Type, json bool) {
+	switch t.Kind {
+	case idl.TypeBool:
+		b.WriteString("false")
+
+	case idl.TypeInt, idl.TypeFloat:
+		b.WriteString("0")
+
+	case idl.TypeString, idl.TypeEnum:
+		b.WriteString(`""`)
+
+	case idl.TypeObject, idl.TypeArray, idl.TypeMap, idl.TypeMaybe:
+		b.WriteString("nil")
+
+	case idl.TypeAlias:
+		if a, ok := midl.Aliases[t.Alias]; ok && a.Type.Kind == idl.TypeEnum {
+			b.WriteString(`""`)
+		} else {
+			b.WriteString(goAliasName(t.Alias) + "{}")
+		}
+
+	case idl.TypeStruct:
+		writeType(b, t, json, 0)
+		b.WriteString("{}")
+	}
+}
+
+// writeSampleValue writes a non-empty value of a type for the benchmarks.
+// Recursive types are written as zero value at their second occurrence.
+func writeSampleValue(b *bytes.Buffer, midl *idl.IDL, t *idl.Type, json bool, seen map[string]bool) {
+	switch t.Kind {
+	case idl.TypeBool:
+		b.WriteString("true")
+
+	case idl.TypeInt:
+		b.WriteString("42")
+
+	case idl.TypeFloat:
+		b.WriteString("1.5")
+
+	case idl.TypeString:
+		b.WriteString(`"example"`)
+
+	case idl.TypeEnum:
+		b.WriteString(strconv.Quote(t.Fields[0].Name))
+
+	case idl.TypeObject:
+		b.WriteString(`json.RawMessage("{}")`)
+
+	case idl.TypeArray:
+		b.WriteString("[]")
+		writeType(b, t.ElementType, json, 0)
+		b.WriteString("{")
+		writeSampleValue(b, midl, t.ElementType, json, seen)
+		b.WriteString("}")
+
+	case idl.TypeMap:
+		b.WriteString("map[string]")
+		writeType(b, t.ElementType, json, 0)
+		b.WriteString(`{"key": `)
+		writeSampleValue(b, midl, t.ElementType, json, seen)
+		b.WriteString("}")
+
+	case idl.TypeMaybe:
+		e := t.ElementType
+		if e.Kind == idl.TypeAlias {
+			if a, ok := midl.Aliases[e.Alias]; !ok || a.Type.Kind != idl.TypeEnum {
+				b.WriteString("&")
+				writeSampleValue(b, midl, e, json, seen)
+				return
+			}
+		}
+		switch e.Kind {
+		case idl.TypeStruct, idl.TypeArray, idl.TypeMap:
+			b.WriteString("&")
+			writeSampleValue(b, midl, e, json, seen)
+		default:
+			typename := goType(e, json)
+			b.WriteString("func() *" + typename + " { v := " + typename + "(")
+			writeSampleValue(b, midl, e, json, seen)
+			b.WriteString("); return &v }()")
+		}
+
+	case idl.TypeAlias:
+		// The fields of imported types reference the names of their interface
+		a, ok := midl.Aliases[t.Alias]
+		if !ok || seen[t.Alias] || strings.Contains(t.Alias, ".") {
+			writeZeroValue(b, midl, t, json)
+			return
+		}
+		if a.Type.Kind == idl.TypeEnum {
+			writeSampleValue(b, midl, a.Type, json, seen)
+			return
+		}
+		seen[t.Alias] = true
+		writeFieldValues(b, midl, goAliasName(t.Alias), a.Type, true, seen)
+		delete(seen, t.Alias)
+
+	case idl.TypeStruct:
+		writeFieldValues(b, midl, goType(t, json), t, json, seen)
+	}
+}
+
+func writeFieldValues(b *bytes.Buffer, midl *idl.IDL, typename string, t *idl.Type, json bool, seen map[string]bool) {
+	b.WriteString(typename + "{")
+	for i := range t.Fields {
+		field := &t.Fields[i]
+		if typename, _ := goTypeOverride(field); typename != "" {
+			continue
+		}
+		b.WriteString(goFieldName(field) + ": ")
+		writeSampleValue(b, midl, field.Type, json, seen)
+		b.WriteString(", ")
+	}
+	b.WriteString("}")
+}
+
+// Version of the generator, it is recorded in the generated code.
+const Version = "0.1.0"
+
+// Header of all generated files
+const (
+	markerText      = "Generated with github.com/varlink/go/cmd/varlink-go-interface-generator"
+	generatedMarker = "// " + markerText
+)
+
+// Options configures the code generation.
+type Options struct {
+	// Filename is the name of the interface description file, it is
+	// referenced by the source comments in the generated code.
+	Filename string
+
+	// Templates contains template definitions which replace the default
+	// templates of the same name, like:
+	//   {{define "header"}}// Code generated by mytool. DO NOT EDIT.{{end}}
+	Templates string
+
+	// Imports are the interfaces which define the types referenced, but
+	// not defined, by the interface description.
+	Imports []Import
+
+	// Compat selects the API of an earlier generator version. CompatV1
+	// generates the free-function client API with anonymous parameter
+	// structs, without getters and enum marshalers.
+	Compat string
+
+	// Conversions are the names of imported interfaces whose structurally
+	// identical types get conversion functions. The imported interfaces
+	// must not reference the types of the interface description.
+	Conversions []string
+}
+
+// CompatV1 is the Options.Compat value for the API of the first generator.
+const CompatV1 = "v1"
+
+// Import is an interface description whose types are generated into another
+// Go package.
+type Import struct {
+	// Description is the varlink interface description.
+	Description string
+
+	// Path is the import path of the Go package generated from Description.
+	// Without it, the interfaces referencing its types fail to generate.
+	Path string
+}
+
+// Dispatch interfaces with many methods through a map instead of a linear switch
+const dispatchTableMethods = 16
+
+// The data passed to the templates
+type goFile struct {
+	Compat        string
+	Marker        string
+	Version       string
+	Source        string
+	SHA256        string
+	Package       string
+	Name          string
+	Description   string
+	Imports       []string
+	Aliases       []*goAlias
+	Conversions   []*goConversion
+	Methods       []*goMethod
+	Errors        []*goError
+	DispatchTable bool
+}
+
+type goAlias struct {
+	Name    string
+	Source  string
+	Type    string
+	Getters []*goGetter
+	Enum    bool
+	Values  []string
+}
+
+type goMethod struct {
+	Name    string
+	GoName  string
+	Method  string
+	Service string
+	Source  string
+	In      *goParameters
+	Out     *goParameters
+}
+
+type goError struct {
+	Name       string
+	Error      string
+	Source     string
+	Parameters *goParameters
+}
+
+type goParameters struct {
+	TypeName string
+	Type     string
+	Fields   []*goField
+	Getters  []*goGetter
+}
+
+type goField struct {
+	Name       string
+	GoName     string
+	Type       string
+	TaggedType string
+	Convert    bool
+
+	// The zero value of Type and a variable name for the examples
+	Zero string
+	Var  string
+
+	// Sample values of Type and TaggedType for the benchmarks
+	Sample       string
+	TaggedSample string
+}
+
+type goGetter struct {
+	Receiver string
+	Name     string
+	Type     string
+	Zero     string
+}
+
+func newGetters(midl *idl.IDL, receiver string, t *idl.Type) []*goGetter {
+	if t.Kind != idl.TypeStruct {
+		return nil
+	}
+
+	var getters []*goGetter
+	for i := range t.Fields {
+		field := &t.Fields[i]
+		if field.Type.Kind != idl.TypeMaybe {
+			continue
+		}
+
+		if typename, _ := goTypeOverride(field); typename != "" {
+			continue
+		}
+
+		var zero bytes.Buffer
+		writeZeroValue(&zero, midl, field.Type.ElementType, true)
+		getters = append(getters, &goGetter{
+			Receiver: receiver,
+			Name:     goFieldName(field),
+			Type:     goType(field.Type.ElementType, true),
+			Zero:     zero.String(),
+		})
+	}
+
+	return getters
+}
+
+// newParameters returns the parameters of a method or error, without a
+// typename they are declared as anonymous struct.
+func newParameters(midl *idl.IDL, typename string, t *idl.Type) *goParameters {
+	p := &goParameters{
+		TypeName: typename,
+		Type:     goType(t, true),
+	}
+	if typename == "" {
+		p.TypeName = p.Type
+	} else {
+		p.Getters = newGetters(midl, typename, t)
+	}
+
+	for i := range t.Fields {
+		field := &t.Fields[i]
+
+		var plain, tagged bytes.Buffer
+		writeFieldType(&plain, field, false, 0)
+		writeFieldType(&tagged, field, true, 0)
+
+		f := &goField{
+			Name:       field.Name,
+			GoName:     goFieldName(field),
+			Type:       plain.String(),
+			TaggedType: tagged.String(),
+			Var:        exampleVarName(field.Name),
+		}
+		if typename, _ := goTypeOverride(field); typename != "" {
+			f.Zero = "*new(" + typename + ")"
+			f.Sample = f.Zero
+			f.TaggedSample = f.Zero
+		} else {
+			var zero, sample, taggedSample bytes.Buffer
+			writeZeroValue(&zero, midl, field.Type, false)
+			writeSampleValue(&sample, midl, field.Type, false, map[string]bool{})
+			writeSampleValue(&taggedSample, midl, field.Type, true, map[string]bool{})
+			f.Zero = zero.String()
+			f.Sample = sample.String()
+			f.TaggedSample = taggedSample.String()
+		}
+		switch field.Type.Kind {
+		case idl.TypeStruct, idl.TypeArray, idl.TypeMap:
+			f.Convert = true
+		}
+		p.Fields = append(p.Fields, f)
+	}
+
+	return p
+}
+
+func walkAliases(t *idl.Type, fn func(t *idl.Type) error) error {
+	switch t.Kind {
+	case idl.TypeAlias:
+		return fn(t)
+
+	case idl.TypeArray, idl.TypeMaybe, idl.TypeMap:
+		return walkAliases(t.ElementType, fn)
+
+	case idl.TypeStruct:
+		for i := range t.Fields {
+			if typename, _ := goTypeOverride(&t.Fields[i]); typename != "" {
+				continue
+			}
+
+			err := walkAliases(t.Fields[i].Type, fn)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// resolveImports qualifies all referenced types which are not defined in
+// midl with the package of the imported interface which defines them. The
+// imported aliases are added to midl.Aliases with their qualified name.
+func resolveImports(midl *idl.IDL, imports []Import, pkgpaths map[string]bool) error {
+	if len(imports) == 0 {
+		return nil
+	}
+
+	type imported struct {
+		alias   *idl.Alias
+		name    string
+		pkgpath string
+		iface   string
+	}
+	types := make(map[string][]imported)
+
+	for _, i := range imports {
+		iidl, err := idl.New(strings.TrimRight(i.Description, "\n"))
+		if err != nil {
+			return err
+		}
+
+		if iidl.Name == midl.Name {
+			continue
+		}
+
+		for _, member := range iidl.Members {
+			if a, ok := member.(*idl.Alias); ok {
+				types[a.Name] = append(types[a.Name], imported{
+					alias:   a,
+					name:    PackageName(iidl.Name) + "." + a.Name,
+					pkgpath: i.Path,
+					iface:   iidl.Name,
+				})
+			}
+		}
+	}
+
+	resolve := func(t *idl.Type) error {
+		if _, ok := midl.Aliases[t.Alias]; ok {
+			return nil
+		}
+
+		candidates := types[t.Alias]
+		switch len(candidates) {
+		case 0:
+			return nil
+
+		case 1:
+			c := candidates[0]
+			if c.pkgpath == "" {
+				return fmt.Errorf("type '%s' of '%s' has no Go import path", t.Alias, c.iface)
+			}
+			t.Alias = c.name
+			midl.Aliases[c.name] = c.alias
+			pkgpaths[c.pkgpath] = true
+			return nil
+
+		default:
+			return fmt.Errorf("type '%s' is defined in '%s' and '%s'", t.Alias, candidates[0].iface, candidates[1].iface)
+		}
+	}
+
+	for _, member := range midl.Members {
+		var err error
+		switch member := member.(type) {
+		case *idl.Alias:
+			err = walkAliases(member.Type, resolve)
+		case *idl.Method:
+			err = walkAliases(member.In, resolve)
+			if err == nil {
+				err = walkAliases(member.Out, resolve)
+			}
+		case *idl.Error:
+			err = walkAliases(member.Type, resolve)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newTemplates(defaults string, funcs template.FuncMap, opts Options) (*template.Template, error) {
+	t, err := template.New("").Funcs(funcs).Parse(defaults)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Templates != "" {
+		if _, err := t.Parse(opts.Templates); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// PackageName returns the name of the generated Go package for a varlink
+// interface name.
+func PackageName(name string) string {
+	return strings.Replace(name, ".", "", -1)
+}
+
+// IsGenerated reports whether src is a file written by the generator. The
+// marker is in the first line of the file, or the second line for formats
+// like JSON which have no comments.
+func IsGenerated(src []byte) bool {
+	lines := bytes.SplitN(src, []byte("\n"), 3)
+	for i := 0; i < len(lines) && i < 2; i++ {
+		if bytes.Contains(lines[i], []byte(markerText)) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitMembers returns the members of the interface description in the order
+// of their definition.
+func splitMembers(midl *idl.IDL) ([]*idl.Alias, []*idl.Method, []*idl.Error) {
+	var aliases []*idl.Alias
+	var methods []*idl.Method
+	var errs []*idl.Error
+	for _, member := range midl.Members {
+		switch member := member.(type) {
+		case *idl.Alias:
+			aliases = append(aliases, member)
+		case *idl.Method:
+			methods = append(methods, member)
+		case *idl.Error:
+			errs = append(errs, member)
+		}
+	}
+
+	return aliases, methods, errs
+}
+
+// newGoFile returns the data for the Go templates.
+func newGoFile(src []byte, opts Options) (*goFile, error) {
+	description := strings.TrimRight(string(src), "\n")
+
+	midl, err := idl.New(description)
+	if err != nil {
+		return nil, err
+	}
+
+	pkgname := PackageName(midl.Name)
+
+	source := midl.Name
+	if opts.Filename != "" {
+		source = path.Base(opts.Filename)
+	}
+
+	imports := map[string]bool{"github.com/varlink/go/varlink": true}
+
+	err = resolveImports(midl, opts.Imports, imports)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Compat != "" && opts.Compat != CompatV1 {
+		return nil, fmt.Errorf("unknown compatibility version '%s'", opts.Compat)
+	}
+	v1 := opts.Compat == CompatV1
+
+	// Generate all members in the order of the interface description
+	aliases, methods, errs := splitMembers(midl)
+
+	f := &goFile{
+		Compat:        opts.Compat,
+		Marker:        generatedMarker,
+		Version:       Version,
+		Source:        source,
+		SHA256:        fmt.Sprintf("%x", sha256.Sum256([]byte(midl.Description+"\n"))),
+		Package:       pkgname,
+		Name:          midl.Name,
+		Description:   midl.Description + "\n",
+		DispatchTable: len(methods) >= dispatchTableMethods,
+	}
+
+	// VarlinkConnect compares the hash of the description of the service
+	if !v1 {
+		imports["context"] = true
+		imports["crypto/sha256"] = true
+		imports["fmt"] = true
+		imports["strings"] = true
+	}
+
+	for _, a := range aliases {
+		ga := &goAlias{
+			Name:   goAliasName(a.Name),
+			Source: source + ":" + strconv.Itoa(a.Line),
+			Type:   goType(a.Type, true),
+		}
+		if !v1 {
+			ga.Getters = newGetters(midl, ga.Name, a.Type)
+		}
+		if a.Type.Kind == idl.TypeEnum && !v1 {
+			ga.Enum = true
+			for _, field := range a.Type.Fields {
+				ga.Values = append(ga.Values, field.Name)
+			}
+			imports["encoding"] = true
+		}
+		collectImports(a.Type, imports)
+		f.Aliases = append(f.Aliases, ga)
+	}
+
+	for _, name := range opts.Conversions {
+		conversions, err := newConversions(midl, opts.Imports, name, imports)
+		if err != nil {
+			return nil, err
+		}
+		f.Conversions = append(f.Conversions, conversions...)
+	}
+
+	for _, m := range methods {
+		in, out := goMethodName(m)+"In", goMethodName(m)+"Out"
+		if v1 {
+			in, out = "", ""
+		}
+
+		for _, name := range []string{goMethodName(m), goMethodName(m) + "_methods", in, out} {
+			if _, ok := midl.Aliases[name]; ok {
+				return nil, fmt.Errorf("type '%s' collides with the generated code of method '%s'", name, m.Name)
+			}
+		}
+
+		collectImports(m.In, imports)
+		collectImports(m.Out, imports)
+		f.Methods = append(f.Methods, &goMethod{
+			Name:    m.Name,
+			GoName:  goMethodName(m),
+			Method:  midl.Name + "." + m.Name,
+			Service: pkgname + "Interface",
+			Source:  source + ":" + strconv.Itoa(m.Line),
+			In:      newParameters(midl, in, m.In),
+			Out:     newParameters(midl, out, m.Out),
+		})
+	}
+
+	for _, e := range errs {
+		collectImports(e.Type, imports)
+		f.Errors = append(f.Errors, &goError{
+			Name:       goErrorName(e),
+			Error:      midl.Name + "." + e.Name,
+			Source:     source + ":" + strconv.Itoa(e.Line),
+			Parameters: newParameters(midl, "", e.Type),
+		})
+	}
+
+	for pkgpath := range imports {
+		f.Imports = append(f.Imports, pkgpath)
+	}
+	sort.Strings(f.Imports)
+
+	return f, nil
+}
+
+func executeGoTemplate(name string, f *goFile, opts Options) ([]byte, error) {
+	t, err := newTemplates(defaultTemplates, template.FuncMap{
+		"raw": func(s string) string { return "`" + s + "`" },
+	}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	err = t.ExecuteTemplate(&b, name, f)
+	if err != nil {
+		return nil, err
+	}
+
+	return format.Source(b.Bytes())
+}
+
+// Generate returns the Go code for the varlink interface description src.
+func Generate(src []byte, opts Options) ([]byte, error) {
+	f, err := newGoFile(src, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return executeGoTemplate("file", f, opts)
+}
+
+// GenerateExamples returns a Go test file with an example for every method
+// of the varlink interface description src, to be placed next to the code
+// returned by Generate.
+func GenerateExamples(src []byte, opts Options) ([]byte, error) {
+	f, err := newGoFile(src, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// The examples only reference the packages of their arguments
+	var values []string
+	for _, m := range f.Methods {
+		for _, field := range m.In.Fields {
+			values = append(values, field.Zero)
+		}
+	}
+	f.Imports = referencedImports(f.Imports, values, "context", "fmt", "os", "github.com/varlink/go/varlink")
+
+	return executeGoTemplate("examples", f, opts)
+}
+
+// GenerateBenchmarks returns a Go test file with benchmarks for the encoding,
+// decoding and dispatching of the parameters of every method of the varlink
+// interface description src, to be placed next to the code returned by
+// Generate.
+func GenerateBenchmarks(src []byte, opts Options) ([]byte, error) {
+	f, err := newGoFile(src, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []string
+	for _, m := range f.Methods {
+		for _, field := range m.In.Fields {
+			values = append(values, field.Sample, field.TaggedSample)
+		}
+	}
+	f.Imports = referencedImports(f.Imports, values,
+		"context", "encoding/json", "io/ioutil", "os", "testing", "time", "github.com/varlink/go/varlink")
+
+	return executeGoTemplate("benchmarks", f, opts)
+}
+
+// referencedImports returns the package paths of imports which are
+// referenced by one of the Go expressions, and the required package paths.
+func referencedImports(imports []string, exprs []string, required ...string) []string {
+	pkgpaths := make(map[string]bool)
+	for _, pkgpath := range required {
+		pkgpaths[pkgpath] = true
+	}
+
+	for _, pkgpath := range imports {
+		qualifier := regexp.MustCompile(`\b` + regexp.QuoteMeta(path.Base(pkgpath)) + `\.`)
+		for _, expr := range exprs {
+			if qualifier.MatchString(expr) {
+				pkgpaths[pkgpath] = true
+			}
+		}
+	}
+
+	var referenced []string
+	for pkgpath := range pkgpaths {
+		referenced = append(referenced, pkgpath)
+	}
+	sort.Strings(referenced)
+	return referenced
+}
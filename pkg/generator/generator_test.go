@@ -0,0 +1,633 @@
+package generator
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func expect(t *testing.T, expected string, returned string) {
+	if strings.Compare(returned, expected) != 0 {
+		t.Fatalf("Expected(%d): `%s`\nGot(%d): `%s`\n",
+			len(expected), expected,
+			len(returned), returned)
+	}
+}
+
+func TestIDLParser(t *testing.T) {
+	b, err := Generate([]byte(`
+# Interface to jump a spacecraft to another point in space. The 
+# FTL Drive is the propulsion system to achieve faster-than-light
+# travel through space. A ship making a properly calculated
+# jump can arrive safely in planetary orbit, or alongside other
+# ships or spaceborne objects.
+interface org.example.ftl
+
+# The current state of the FTL drive and the amount of fuel
+# available to jump.
+type DriveCondition (
+  state: (idle, spooling, busy),
+  booster: bool,
+  active_engines: [](id: int, state: bool),
+  tylium_level: int
+)
+
+# Speed, trajectory and jump duration is calculated prior to
+# activating the FTL drive.
+type DriveConfiguration (
+  speed: int,
+  trajectory: int,
+  duration: int
+)
+
+# The galactic coordinates use the Sun as the origin. Galactic
+# longitude is measured with primary direction from the Sun to
+# the center of the galaxy in the galactic plane, while the
+# galactic latitude measures the angle of the object above the
+# galactic plane.
+type Coordinate (
+  longitude: float,
+  latitude: float,
+  distance: int
+)
+
+# Monitor the drive. The method will reply with an update whenever
+# the drive's state changes
+method Monitor() -> (condition: DriveCondition)
+
+# Calculate the drive's jump parameters from the current
+# position to the target position in the galaxy
+method CalculateConfiguration(
+  current: Coordinate,
+  target: Coordinate
+) -> (configuration: DriveConfiguration)
+
+# Jump to the calculated point in space
+method Jump(configuration: DriveConfiguration) -> ()
+
+# There is not enough tylium to jump with the given parameters
+error NotEnoughEnergy ()
+
+# The supplied parameters are outside the supported range
+error ParameterOutOfRange (field: string)
+
+# some more coverage
+method Foo(interface: string) -> (ret: (go: string, switch: bool, more: (t:bool, f:bool)))
+
+# some more coverage
+method TestMap(map: [string]string) -> (map: [string](i: int, val: string))
+method TestSet(set: [string]()) -> (set: [string]())
+method TestObject(object: object) -> (object: object)
+	`), Options{})
+
+	if err != nil {
+		t.Fatalf("Error parsing %v", err)
+	}
+	expect(t, "orgexampleftl", PackageName("org.example.ftl"))
+	if len(b) <= 0 {
+		t.Fatal("No generated go source")
+	}
+	// FIXME: compare b.String() against expected output
+}
+
+func TestMaybeGetters(t *testing.T) {
+	b, err := Generate([]byte(`
+interface org.example.maybe
+
+type Box (
+  name: ?string,
+  size: ?int,
+  tags: ?[]string,
+  inner: ?Inner,
+  color: ?Color
+)
+
+type Inner (value: bool)
+
+type Color (red, green, blue)
+
+method Get() -> (box: Box)
+	`), Options{})
+	if err != nil {
+		t.Fatalf("Error parsing %v", err)
+	}
+
+	src := string(b)
+	for _, getter := range []string{
+		"func (v *Box) GetName() string {",
+		"func (v *Box) GetSize() int64 {",
+		"func (v *Box) GetTags() []string {",
+		"func (v *Box) GetInner() Inner {",
+		"func (v *Box) GetColor() Color {",
+	} {
+		if !strings.Contains(src, getter) {
+			t.Fatalf("Generated source is missing `%s`:\n%s", getter, src)
+		}
+	}
+	if strings.Contains(src, "func (v *Inner)") {
+		t.Fatal("Generated getters for a type without maybe fields")
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	b, err := Generate([]byte(`
+interface org.example.annotations
+
+type Job (
+  # go:name ID
+  id: string,
+  # The time to wait
+  # go:type time.Duration
+  timeout: int,
+  # go:type *time.Duration
+  retry: ?int
+)
+
+# Start a job
+# go:name StartJob
+method Start(job: Job) -> ()
+	`), Options{})
+	if err != nil {
+		t.Fatalf("Error parsing %v", err)
+	}
+
+	src := string(b)
+	for _, s := range []string{
+		"\t\"time\"\n",
+		"ID      string         `json:\"id\"`",
+		"Timeout time.Duration  `json:\"timeout\"`",
+		"Retry   *time.Duration `json:\"retry,omitempty\"`",
+		"func StartJob() StartJob_methods {",
+		"func (c *VarlinkCall) ReplyStartJob() error {",
+		"c.SendWithOptions(\"org.example.annotations.Start\",",
+		"case \"Start\":",
+	} {
+		if !strings.Contains(src, s) {
+			t.Fatalf("Generated source is missing `%s`:\n%s", s, src)
+		}
+	}
+	if strings.Contains(src, "GetRetry") {
+		t.Fatal("Generated getter for a field with a type override")
+	}
+}
+
+func TestEnumTextMarshaler(t *testing.T) {
+	b, err := Generate([]byte(`
+interface org.example.enum
+
+type Color (red, green, blue)
+
+type Paint (color: (matte, glossy))
+
+method Mix(color: Color) -> (paint: Paint)
+	`), Options{})
+	if err != nil {
+		t.Fatalf("Error parsing %v", err)
+	}
+
+	src := string(b)
+	for _, s := range []string{
+		"func (v Color) MarshalText() ([]byte, error) {",
+		"func (v *Color) UnmarshalText(text []byte) error {\n\t*v = Color(text)\n\treturn nil\n}",
+		"func (v Color) Valid() bool {\n\tswitch v {\n\tcase \"red\", \"green\", \"blue\":\n\t\treturn true\n\t}\n\treturn false\n}",
+	} {
+		if !strings.Contains(src, s) {
+			t.Fatalf("Generated source is missing `%s`:\n%s", s, src)
+		}
+	}
+	if strings.Contains(src, "func (v Paint) MarshalText") {
+		t.Fatal("Generated a text marshaler for a struct type")
+	}
+}
+
+func TestInterfaceAssertions(t *testing.T) {
+	b, err := Generate([]byte(`
+interface org.example.assert
+
+type Color (red, green)
+
+method Ping(color: Color) -> ()
+	`), Options{})
+	if err != nil {
+		t.Fatalf("Error parsing %v", err)
+	}
+
+	src := string(b)
+	for _, s := range []string{
+		"type VarlinkInterfaceMethods = orgexampleassertInterface",
+		"var _ orgexampleassertInterface = (*VarlinkInterface)(nil)",
+		"} = (*VarlinkInterface)(nil)",
+		"var _ encoding.TextMarshaler = Color(\"\")",
+		"var _ encoding.TextUnmarshaler = (*Color)(nil)",
+	} {
+		if !strings.Contains(src, s) {
+			t.Fatalf("Generated source is missing `%s`:\n%s", s, src)
+		}
+	}
+}
+
+func TestDispatchTable(t *testing.T) {
+	description := "interface org.example.large\n"
+	for i := 0; i < dispatchTableMethods; i++ {
+		description += fmt.Sprintf("method Method%d(value: int) -> ()\n", i)
+	}
+
+	b, err := Generate([]byte(description), Options{})
+	if err != nil {
+		t.Fatalf("Error parsing %v", err)
+	}
+
+	src := string(b)
+	for _, s := range []string{
+		"var varlinkDispatchTable = map[string]func(s *VarlinkInterface, call varlink.Call) error{",
+		"\"Method0\": func(s *VarlinkInterface, call varlink.Call) error {",
+		"dispatch, ok := varlinkDispatchTable[methodname]",
+	} {
+		if !strings.Contains(src, s) {
+			t.Fatalf("Generated source is missing `%s`:\n%s", s, src)
+		}
+	}
+	if strings.Contains(src, "switch methodname") {
+		t.Fatal("Generated a switch dispatcher for a large interface")
+	}
+}
+
+func TestSourceComments(t *testing.T) {
+	b, err := Generate([]byte(`interface org.example.source
+
+type Point (x: int, y: int)
+
+# Move a point
+method Move(point: Point) -> (point: Point)
+
+error OutOfBounds ()
+	`), Options{Filename: "testdata/org.example.source.varlink"})
+	if err != nil {
+		t.Fatalf("Error parsing %v", err)
+	}
+
+	src := string(b)
+	for _, s := range []string{
+		"// varlink: org.example.source.varlink:3\ntype Point struct {",
+		"// varlink: org.example.source.varlink:6\ntype Move_methods struct{}",
+		"// varlink: org.example.source.varlink:6\nfunc (c *VarlinkCall) ReplyMove(",
+		"// varlink: org.example.source.varlink:8\nfunc (c *VarlinkCall) ReplyOutOfBounds() error {",
+	} {
+		if !strings.Contains(src, s) {
+			t.Fatalf("Generated source is missing `%s`:\n%s", s, src)
+		}
+	}
+}
+
+func TestParameterTypes(t *testing.T) {
+	b, err := Generate([]byte(`
+interface org.example.params
+
+method Ping(ping: string, count: ?int) -> (pong: string)
+	`), Options{})
+	if err != nil {
+		t.Fatalf("Error parsing %v", err)
+	}
+
+	src := string(b)
+	for _, s := range []string{
+		"type PingIn struct {",
+		"type PingOut struct {",
+		"func (v *PingIn) GetCount() int64 {",
+		"\tvar in PingIn\n",
+		"\tvar out PingOut\n",
+	} {
+		if !strings.Contains(src, s) {
+			t.Fatalf("Generated source is missing `%s`:\n%s", s, src)
+		}
+	}
+
+	_, err = Generate([]byte(`
+interface org.example.params
+
+type PingIn (ping: string)
+
+method Ping(ping: string) -> ()
+	`), Options{})
+	if err == nil {
+		t.Fatal("Generated colliding parameter types")
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	src := []byte(`
+interface org.example.templates
+
+method Ping(ping: string) -> (pong: string)
+	`)
+
+	b, err := Generate(src, Options{
+		Templates: `{{define "header"}}// Code generated by a custom template. DO NOT EDIT.{{end}}`,
+	})
+	if err != nil {
+		t.Fatalf("Error generating %v", err)
+	}
+
+	if !strings.HasPrefix(string(b), "// Code generated by a custom template. DO NOT EDIT.\n") {
+		t.Fatalf("Generated source does not use the custom header:\n%s", b)
+	}
+
+	if !strings.Contains(string(b), "func (m Ping_methods) Call(") {
+		t.Fatalf("Generated source is missing the default templates:\n%s", b)
+	}
+
+	_, err = Generate(src, Options{Templates: `{{define "header"}}{{.Unknown}}{{end}}`})
+	if err == nil {
+		t.Fatal("Generated code with a broken template")
+	}
+}
+
+func TestImports(t *testing.T) {
+	common := Import{
+		Description: `
+interface org.example.common
+
+type Point (x: int, y: int)
+
+type Color (red, green, blue)
+
+method Ping() -> ()
+`,
+		Path: "example.com/common/orgexamplecommon",
+	}
+
+	b, err := Generate([]byte(`
+interface org.example.shapes
+
+type Line (start: Point, end: Point, color: ?Color)
+
+method Draw(line: Line, origin: ?Point) -> ()
+	`), Options{Imports: []Import{common}})
+	if err != nil {
+		t.Fatalf("Error generating %v", err)
+	}
+
+	src := string(b)
+	for _, s := range []string{
+		"\t\"example.com/common/orgexamplecommon\"\n",
+		"func (v *Line) GetColor() orgexamplecommon.Color {",
+		"Origin *orgexamplecommon.Point `json:\"origin,omitempty\"`",
+		"return \"\"\n",
+		"return orgexamplecommon.Point{}\n",
+	} {
+		if !strings.Contains(src, s) {
+			t.Fatalf("Generated source is missing `%s`:\n%s", s, src)
+		}
+	}
+	if strings.Contains(src, "type Point") {
+		t.Fatalf("Generated source duplicates imported types:\n%s", src)
+	}
+
+	_, err = Generate([]byte(`
+interface org.example.shapes
+
+method Draw(point: Point) -> ()
+	`), Options{Imports: []Import{common, {
+		Description: "interface org.example.other\ntype Point (x: float, y: float)\nmethod Ping() -> ()\n",
+		Path:        "example.com/other/orgexampleother",
+	}}})
+	if err == nil {
+		t.Fatal("Generated code for an ambiguous type")
+	}
+
+	// The import path is only needed for referenced types
+	common.Path = ""
+	if _, err := Generate([]byte("interface org.example.shapes\nmethod Draw(x: int) -> ()\n"), Options{Imports: []Import{common}}); err != nil {
+		t.Fatalf("Error generating %v", err)
+	}
+	if _, err := Generate([]byte("interface org.example.shapes\nmethod Draw(point: Point) -> ()\n"), Options{Imports: []Import{common}}); err == nil {
+		t.Fatal("Generated code for a type without import path")
+	}
+}
+
+func TestSanitizeNames(t *testing.T) {
+	b, err := Generate([]byte(`
+interface org.example.sanitize
+
+type VarlinkCall (x: int)
+
+type Item (
+  # go:name type
+  kind: string
+)
+
+method Len(c: int, string: string, error: ?VarlinkCall) -> (len: int)
+
+method Error(item: Item) -> ()
+
+error MethodNotFound (method: string)
+	`), Options{})
+	if err != nil {
+		t.Fatalf("Error generating %v", err)
+	}
+
+	src := string(b)
+	for _, s := range []string{
+		"type VarlinkCall_ struct {",
+		"\ttype_ string `json:\"kind\"`\n",
+		"func (m Len_methods) Call(c varlink.Conn, c_in_ int64, string_in_ string, error_in_ *VarlinkCall_, opts ...varlink.CallOption) (len_out_ int64, err_ error) {",
+		"func (c *VarlinkCall) ReplyError_() error {",
+		"func (c *VarlinkCall) ReplyMethodNotFound_(method_ string) error {",
+	} {
+		if !strings.Contains(src, s) {
+			t.Fatalf("Generated source is missing `%s`:\n%s", s, src)
+		}
+	}
+}
+
+func TestVersionHeader(t *testing.T) {
+	description := "interface org.example.version\n\nmethod Ping() -> ()"
+	b, err := Generate([]byte(description+"\n"), Options{Filename: "org.example.version.varlink"})
+	if err != nil {
+		t.Fatalf("Error generating %v", err)
+	}
+
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(description+"\n")))
+	src := string(b)
+	for _, s := range []string{
+		generatedMarker + "\n// version: " + Version + "\n// source: org.example.version.varlink\n// sha256: " + hash + "\n",
+		"VarlinkGeneratorVersion  = \"" + Version + "\"\n",
+		"VarlinkSource            = \"org.example.version.varlink\"\n",
+		"VarlinkDescriptionSHA256 = \"" + hash + "\"\n",
+	} {
+		if !strings.Contains(src, s) {
+			t.Fatalf("Generated source is missing `%s`:\n%s", s, src)
+		}
+	}
+}
+
+func TestCompatV1(t *testing.T) {
+	src := []byte(`
+interface org.example.compat
+
+type Color (red, green)
+
+method Paint(color: Color, layers: ?int) -> (ok: bool)
+	`)
+
+	b, err := Generate(src, Options{Compat: CompatV1})
+	if err != nil {
+		t.Fatalf("Error generating %v", err)
+	}
+
+	code := string(b)
+	for _, s := range []string{
+		"func Paint() Paint_methods { return Paint_methods{} }",
+		"func (m Paint_methods) Call(c *varlink.Connection, color_in_ Color, layers_in_ *int64) (ok_out_ bool, err_ error) {",
+		"func (m Paint_methods) Send(c *varlink.Connection, flags uint64, color_in_ Color, layers_in_ *int64) (func() (bool, uint64, error), error) {",
+		"\tvar in struct {\n",
+	} {
+		if !strings.Contains(code, s) {
+			t.Fatalf("Generated source is missing `%s`:\n%s", s, code)
+		}
+	}
+	for _, s := range []string{"PaintIn", "PaintOut", "GetLayers", "MarshalText", "\"encoding\""} {
+		if strings.Contains(code, s) {
+			t.Fatalf("Generated source contains `%s`:\n%s", s, code)
+		}
+	}
+
+	_, err = Generate(src, Options{Compat: "v0"})
+	if err == nil {
+		t.Fatal("Generated code for an unknown compatibility version")
+	}
+}
+
+func TestExamples(t *testing.T) {
+	b, err := GenerateExamples([]byte(`
+interface org.example.examples
+
+type Color (red, green)
+
+method Paint(color: Color, layers: ?int) -> (ok: bool, err: ?string)
+
+method Reset() -> ()
+
+error NoPaint (color: Color)
+	`), Options{})
+	if err != nil {
+		t.Fatalf("Error generating %v", err)
+	}
+
+	src := string(b)
+	for _, s := range []string{
+		"package orgexampleexamples\n",
+		"func ExamplePaint() {\n\tc, err := varlink.DialContext(context.Background(), \"unix:/run/org.example.examples\")\n",
+		"\tok, err_, err := Paint().Call(c, \"\", nil)\n",
+		"\t\t\tcase \"org.example.examples.NoPaint\":\n",
+		"\tfmt.Println(ok)\n\tfmt.Println(err_)\n}\n",
+		"func ExampleReset() {\n",
+		"\terr = Reset().Call(c)\n",
+	} {
+		if !strings.Contains(src, s) {
+			t.Fatalf("Generated examples are missing `%s`:\n%s", s, src)
+		}
+	}
+}
+
+func TestStreamReplies(t *testing.T) {
+	b, err := Generate([]byte(`
+interface org.example.stream
+
+method Watch(path: string) -> (event: string)
+	`), Options{})
+	if err != nil {
+		t.Fatalf("Error generating %v", err)
+	}
+
+	src := string(b)
+	for _, s := range []string{
+		"func (c *VarlinkCall) StreamWatch() (chan<- WatchOut, func() error) {\n",
+		"\tcall := c.Call\n\tgo func() {\n\t\tdone <- call.ReplyStream(func() (interface{}, bool) {\n\t\t\tout, ok := <-replies\n\t\t\treturn &out, ok\n",
+	} {
+		if !strings.Contains(src, s) {
+			t.Fatalf("Generated source is missing `%s`:\n%s", s, src)
+		}
+	}
+
+	b, err = Generate([]byte("interface org.example.stream\nmethod Watch(path: string) -> (event: string)\n"), Options{Compat: CompatV1})
+	if err != nil {
+		t.Fatalf("Error generating %v", err)
+	}
+	if strings.Contains(string(b), "StreamWatch") {
+		t.Fatalf("Generated streaming replies for the v1 API:\n%s", b)
+	}
+}
+
+func TestBenchmarks(t *testing.T) {
+	b, err := GenerateBenchmarks([]byte(`
+interface org.example.benchmarks
+
+type Color (red, green)
+
+type Node (value: int, next: ?Node)
+
+method Paint(color: Color, layers: ?int, node: Node, tags: [string]?Color) -> (ok: bool)
+
+method Reset() -> ()
+	`), Options{})
+	if err != nil {
+		t.Fatalf("Error generating %v", err)
+	}
+
+	src := string(b)
+	for _, s := range []string{
+		"package orgexamplebenchmarks\n",
+		"\t\"io/ioutil\"\n",
+		"func BenchmarkPaintEncode(b *testing.B) {\n\tin := PaintIn{\n",
+		"\t\tLayers: func() *int64 { v := int64(42); return &v }(),\n",
+		"\t\tNode:   Node{Value: 42, Next: &Node{}},\n",
+		"\t\tTags:   map[string]*Color{\"key\": func() *Color { v := Color(\"red\"); return &v }()},\n",
+		"func BenchmarkPaintDecode(b *testing.B) {\n",
+		"func BenchmarkPaintDispatch(b *testing.B) {\n",
+		"\t\t_, err := Paint().Call(c, \"red\", ",
+		"func BenchmarkResetDispatch(b *testing.B) {\n",
+		"\t\terr := Reset().Call(c)\n",
+	} {
+		if !strings.Contains(src, s) {
+			t.Fatalf("Generated benchmarks are missing `%s`:\n%s", s, src)
+		}
+	}
+}
+
+func TestVarlinkConnect(t *testing.T) {
+	description := "interface org.example.connect\nmethod Ping() -> ()\n"
+	b, err := Generate([]byte(description), Options{})
+	if err != nil {
+		t.Fatalf("Error generating %v", err)
+	}
+
+	src := string(b)
+	for _, s := range []string{
+		"func VarlinkConnect(ctx context.Context, address string, checkDescription bool) (*varlink.Connection, error) {\n",
+		"\t\tif name == \"org.example.connect\" {\n",
+		"\t\tdescription, err := c.GetInterfaceDescription(\"org.example.connect\")\n",
+		"\t\tif hash != VarlinkDescriptionSHA256 {\n",
+	} {
+		if !strings.Contains(src, s) {
+			t.Fatalf("Generated source is missing `%s`:\n%s", s, src)
+		}
+	}
+
+	b, err = Generate([]byte("interface org.example.connect\ntype VarlinkConnect (x: int)\nmethod Ping() -> ()\n"), Options{})
+	if err != nil {
+		t.Fatalf("Error generating %v", err)
+	}
+	if !strings.Contains(string(b), "type VarlinkConnect_ struct {") {
+		t.Fatalf("Generated source does not rename the type VarlinkConnect:\n%s", b)
+	}
+
+	b, err = Generate([]byte(description), Options{Compat: CompatV1})
+	if err != nil {
+		t.Fatalf("Error generating %v", err)
+	}
+	if strings.Contains(string(b), "VarlinkConnect") {
+		t.Fatalf("Generated VarlinkConnect for the v1 API:\n%s", b)
+	}
+}
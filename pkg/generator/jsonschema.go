@@ -0,0 +1,155 @@
+package generator
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/varlink/go/varlink/idl"
+)
+
+// jsonObject is a JSON object which keeps the order of its members.
+type jsonObject []jsonMember
+
+type jsonMember struct {
+	Key   string
+	Value interface{}
+}
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString("{")
+	for i, m := range o {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		key, err := json.Marshal(m.Key)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteString(":")
+		value, err := json.Marshal(m.Value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(value)
+	}
+	b.WriteString("}")
+	return b.Bytes(), nil
+}
+
+func (o jsonObject) add(key string, value interface{}) jsonObject {
+	return append(o, jsonMember{key, value})
+}
+
+// jsonSchema returns the JSON Schema of a varlink type, references to named
+// types are prefixed with ref.
+func jsonSchema(t *idl.Type, ref string) jsonObject {
+	switch t.Kind {
+	case idl.TypeBool:
+		return jsonObject{{"type", "boolean"}}
+
+	case idl.TypeInt:
+		return jsonObject{{"type", "integer"}}
+
+	case idl.TypeFloat:
+		return jsonObject{{"type", "number"}}
+
+	case idl.TypeString:
+		return jsonObject{{"type", "string"}}
+
+	case idl.TypeObject:
+		return jsonObject{}
+
+	case idl.TypeArray:
+		return jsonObject{{"type", "array"}, {"items", jsonSchema(t.ElementType, ref)}}
+
+	case idl.TypeMap:
+		return jsonObject{{"type", "object"}, {"additionalProperties", jsonSchema(t.ElementType, ref)}}
+
+	case idl.TypeMaybe:
+		return jsonObject{{"anyOf", []jsonObject{jsonSchema(t.ElementType, ref), {{"type", "null"}}}}}
+
+	case idl.TypeAlias:
+		return jsonObject{{"$ref", ref + t.Alias}}
+
+	case idl.TypeEnum:
+		values := make([]string, 0, len(t.Fields))
+		for _, field := range t.Fields {
+			values = append(values, field.Name)
+		}
+		return jsonObject{{"type", "string"}, {"enum", values}}
+
+	case idl.TypeStruct:
+		properties := jsonObject{}
+		required := []string{}
+		for _, field := range t.Fields {
+			properties = properties.add(field.Name, withDescription(jsonSchema(field.Type, ref), field.Doc))
+			if field.Type.Kind != idl.TypeMaybe {
+				required = append(required, field.Name)
+			}
+		}
+
+		schema := jsonObject{{"type", "object"}, {"properties", properties}}
+		if len(required) > 0 {
+			schema = schema.add("required", required)
+		}
+		return schema
+	}
+
+	return jsonObject{}
+}
+
+func withDescription(schema jsonObject, doc string) jsonObject {
+	if doc == "" {
+		return schema
+	}
+	return schema.add("description", doc)
+}
+
+// jsonSchemaDefinitions returns the schemas of all types of the interface
+// description, the parameters of method Foo are named Foo.In and Foo.Out, the
+// parameters of error Bar are named Bar.Error.
+func jsonSchemaDefinitions(midl *idl.IDL, ref string) jsonObject {
+	aliases, methods, errs := splitMembers(midl)
+
+	definitions := jsonObject{}
+	for _, a := range aliases {
+		definitions = definitions.add(a.Name, withDescription(jsonSchema(a.Type, ref), a.Doc))
+	}
+	for _, m := range methods {
+		definitions = definitions.add(m.Name+".In", withDescription(jsonSchema(m.In, ref), m.Doc))
+		definitions = definitions.add(m.Name+".Out", jsonSchema(m.Out, ref))
+	}
+	for _, e := range errs {
+		definitions = definitions.add(e.Name+".Error", withDescription(jsonSchema(e.Type, ref), e.Doc))
+	}
+
+	return definitions
+}
+
+// GenerateJSONSchema returns a JSON Schema document with the definitions of
+// all types, method parameters and error parameters of the varlink interface
+// description src.
+func GenerateJSONSchema(src []byte, opts Options) ([]byte, error) {
+	midl, err := idl.New(strings.TrimRight(string(src), "\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	schema := jsonObject{
+		{"$comment", markerText},
+		{"$schema", "http://json-schema.org/draft-07/schema#"},
+		{"title", midl.Name},
+	}
+	schema = withDescription(schema, midl.Doc)
+	schema = schema.add("definitions", jsonSchemaDefinitions(midl, "#/definitions/"))
+
+	b, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(b, '\n'), nil
+}
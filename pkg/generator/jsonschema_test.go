@@ -0,0 +1,60 @@
+package generator
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestJSONSchema(t *testing.T) {
+	b, err := GenerateJSONSchema([]byte(`
+interface org.example.schema
+
+type Color (red, green)
+
+# Paint the wall
+method Paint(color: Color, layers: ?int, labels: [string]string) -> (colors: []Color)
+
+error NoPaint (color: Color)
+	`), Options{})
+	if err != nil {
+		t.Fatalf("Error generating %v", err)
+	}
+
+	if !IsGenerated(b) {
+		t.Fatalf("Generated schema is missing the marker:\n%s", b)
+	}
+
+	var schema struct {
+		Title       string                            `json:"title"`
+		Definitions map[string]map[string]interface{} `json:"definitions"`
+	}
+	err = json.Unmarshal(b, &schema)
+	if err != nil {
+		t.Fatalf("Error parsing schema %v:\n%s", err, b)
+	}
+
+	if schema.Title != "org.example.schema" {
+		t.Fatalf("Unexpected title '%s'", schema.Title)
+	}
+
+	for name, expected := range map[string]string{
+		"Color": `{"enum":["red","green"],"type":"string"}`,
+		"Paint.In": `{"description":"Paint the wall","properties":{` +
+			`"color":{"$ref":"#/definitions/Color"},` +
+			`"labels":{"additionalProperties":{"type":"string"},"type":"object"},` +
+			`"layers":{"anyOf":[{"type":"integer"},{"type":"null"}]}},` +
+			`"required":["color","labels"],"type":"object"}`,
+		"Paint.Out":     `{"properties":{"colors":{"items":{"$ref":"#/definitions/Color"},"type":"array"}},"required":["colors"],"type":"object"}`,
+		"NoPaint.Error": `{"properties":{"color":{"$ref":"#/definitions/Color"}},"required":["color"],"type":"object"}`,
+	} {
+		var e map[string]interface{}
+		if err := json.Unmarshal([]byte(expected), &e); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(schema.Definitions[name], e) {
+			got, _ := json.Marshal(schema.Definitions[name])
+			t.Fatalf("Definition '%s': expected %s, got %s", name, expected, got)
+		}
+	}
+}
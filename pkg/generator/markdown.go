@@ -0,0 +1,207 @@
+package generator
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+
+	"github.com/varlink/go/varlink/idl"
+)
+
+// The default templates for the Markdown reference page. They can be replaced
+// with Options.Templates like the templates for the Go code.
+const markdownTemplates = `
+{{- define "file" -}}
+<!-- {{.Marker}} -->
+# {{.Name}}
+{{if .Doc}}
+{{.Doc}}
+{{end}}
+{{- if .Methods}}
+## Methods
+{{range .Methods}}{{template "method" .}}{{end}}
+{{- end}}
+{{- if .Aliases}}
+## Types
+{{range .Aliases}}{{template "alias" .}}{{end}}
+{{- end}}
+{{- if .Errors}}
+## Errors
+{{range .Errors}}{{template "error" .}}{{end}}
+{{- end}}
+{{- end}}
+
+{{- define "method"}}
+### {{.Name}}
+
+` + "```" + `
+method {{.Name}}{{vtype .In}} -> {{vtype .Out}}
+` + "```" + `
+{{if .Doc}}
+{{.Doc}}
+{{end}}
+{{- if .In.Fields}}
+**Parameters**
+
+{{template "fields" .In.Fields}}
+{{- end}}
+{{- if .Out.Fields}}
+**Returns**
+
+{{template "fields" .Out.Fields}}
+{{- end}}
+{{- end}}
+
+{{- define "alias"}}
+### {{.Name}}
+
+` + "```" + `
+type {{.Name}} {{vtype .Type}}
+` + "```" + `
+{{if .Doc}}
+{{.Doc}}
+{{end}}
+{{- if enum .Type}}
+| Value | Description |
+|-------|-------------|
+{{- range .Type.Fields}}
+| ` + "`{{.Name}}`" + ` | {{cell .Doc}} |
+{{- end}}
+{{else if .Type.Fields}}
+{{template "fields" .Type.Fields}}
+{{- end}}
+{{- end}}
+
+{{- define "error"}}
+### {{.Name}}
+
+` + "```" + `
+error {{.Name}} {{vtype .Type}}
+` + "```" + `
+{{if .Doc}}
+{{.Doc}}
+{{end}}
+{{- if .Type.Fields}}
+{{template "fields" .Type.Fields}}
+{{- end}}
+{{- end}}
+
+{{- define "fields" -}}
+| Name | Type | Description |
+|------|------|-------------|
+{{- range .}}
+| ` + "`{{.Name}}`" + ` | ` + "`{{vtype .Type}}`" + ` | {{cell .Doc}} |
+{{- end}}
+{{end}}
+`
+
+// The data passed to the Markdown templates
+type markdownFile struct {
+	Marker  string
+	Name    string
+	Doc     string
+	Aliases []*idl.Alias
+	Methods []*idl.Method
+	Errors  []*idl.Error
+}
+
+// idlType returns the varlink syntax of a type.
+func idlType(t *idl.Type) string {
+	var b bytes.Buffer
+	writeIDLType(&b, t)
+	return b.String()
+}
+
+func writeIDLType(b *bytes.Buffer, t *idl.Type) {
+	switch t.Kind {
+	case idl.TypeBool:
+		b.WriteString("bool")
+
+	case idl.TypeInt:
+		b.WriteString("int")
+
+	case idl.TypeFloat:
+		b.WriteString("float")
+
+	case idl.TypeString:
+		b.WriteString("string")
+
+	case idl.TypeObject:
+		b.WriteString("object")
+
+	case idl.TypeArray:
+		b.WriteString("[]")
+		writeIDLType(b, t.ElementType)
+
+	case idl.TypeMap:
+		b.WriteString("[string]")
+		writeIDLType(b, t.ElementType)
+
+	case idl.TypeMaybe:
+		b.WriteString("?")
+		writeIDLType(b, t.ElementType)
+
+	case idl.TypeAlias:
+		b.WriteString(t.Alias)
+
+	case idl.TypeEnum:
+		b.WriteString("(")
+		for i, field := range t.Fields {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(field.Name)
+		}
+		b.WriteString(")")
+
+	case idl.TypeStruct:
+		b.WriteString("(")
+		for i, field := range t.Fields {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(field.Name + ": ")
+			writeIDLType(b, field.Type)
+		}
+		b.WriteString(")")
+	}
+}
+
+// markdownCell folds a doc comment into a single table cell.
+func markdownCell(doc string) string {
+	doc = strings.Replace(doc, "|", "\\|", -1)
+	return strings.Join(strings.Fields(doc), " ")
+}
+
+// GenerateMarkdown returns a Markdown reference page for the varlink interface
+// description src.
+func GenerateMarkdown(src []byte, opts Options) ([]byte, error) {
+	midl, err := idl.New(strings.TrimRight(string(src), "\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	f := &markdownFile{
+		Marker: markerText,
+		Name:   midl.Name,
+		Doc:    midl.Doc,
+	}
+	f.Aliases, f.Methods, f.Errors = splitMembers(midl)
+
+	t, err := newTemplates(markdownTemplates, template.FuncMap{
+		"vtype": idlType,
+		"cell":  markdownCell,
+		"enum":  func(t *idl.Type) bool { return t.Kind == idl.TypeEnum },
+	}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	err = t.ExecuteTemplate(&b, "file", f)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
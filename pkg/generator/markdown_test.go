@@ -0,0 +1,52 @@
+package generator
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMarkdown(t *testing.T) {
+	b, err := GenerateMarkdown([]byte(`
+# Example interface
+interface org.example.markdown
+
+# A color
+type Color (
+  # The red one
+  red,
+  green
+)
+
+# Paint the wall
+method Paint(
+  # The | color
+  color: Color,
+  layers: ?int
+) -> (ok: bool)
+
+# No paint left
+error NoPaint (color: Color)
+	`), Options{})
+	if err != nil {
+		t.Fatalf("Error generating %v", err)
+	}
+
+	if !IsGenerated(b) {
+		t.Fatalf("Generated page is missing the marker:\n%s", b)
+	}
+
+	src := string(b)
+	for _, s := range []string{
+		"# org.example.markdown\n\nExample interface\n",
+		"### Paint\n\n```\nmethod Paint(color: Color, layers: ?int) -> (ok: bool)\n```\n\nPaint the wall\n",
+		"| `color` | `Color` | The \\| color |\n| `layers` | `?int` |  |\n",
+		"**Returns**\n\n| Name | Type | Description |\n|------|------|-------------|\n| `ok` | `bool` |  |\n",
+		"## Types\n\n### Color\n\n```\ntype Color (red, green)\n```\n\nA color\n",
+		"| `red` | The red one |\n",
+		"## Errors\n\n### NoPaint\n\n```\nerror NoPaint (color: Color)\n```\n\nNo paint left\n",
+	} {
+		if !strings.Contains(src, s) {
+			t.Fatalf("Generated page is missing `%s`:\n%s", s, src)
+		}
+	}
+}
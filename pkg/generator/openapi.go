@@ -0,0 +1,100 @@
+package generator
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/varlink/go/varlink/idl"
+)
+
+// The schema of the error replies of all operations
+const openAPIErrorSchema = "varlink.Error"
+
+func openAPIContent(ref string) jsonObject {
+	return jsonObject{
+		{"application/json", jsonObject{
+			{"schema", jsonObject{{"$ref", ref}}},
+		}},
+	}
+}
+
+// GenerateOpenAPI returns an OpenAPI 3.1 document for the varlink interface
+// description src. Every method is a POST operation on the path of its fully
+// qualified name, which takes the method parameters as request body and replies
+// with the method output, or a varlink error.
+func GenerateOpenAPI(src []byte, opts Options) ([]byte, error) {
+	description := strings.TrimRight(string(src), "\n")
+
+	midl, err := idl.New(description)
+	if err != nil {
+		return nil, err
+	}
+
+	_, methods, errs := splitMembers(midl)
+
+	// The interface description has no version, it is identified by its hash
+	info := jsonObject{
+		{"title", midl.Name},
+		{"version", fmt.Sprintf("%x", sha256.Sum256([]byte(description+"\n")))[:12]},
+	}
+	info = withDescription(info, midl.Doc)
+
+	paths := jsonObject{}
+	for _, m := range methods {
+		operation := jsonObject{{"operationId", m.Name}}
+		operation = withDescription(operation, m.Doc)
+		operation = operation.add("requestBody", jsonObject{
+			{"required", true},
+			{"content", openAPIContent("#/components/schemas/" + m.Name + ".In")},
+		})
+		operation = operation.add("responses", jsonObject{
+			{"200", jsonObject{
+				{"description", "The reply of " + midl.Name + "." + m.Name},
+				{"content", openAPIContent("#/components/schemas/" + m.Name + ".Out")},
+			}},
+			{"default", jsonObject{
+				{"description", "A varlink error"},
+				{"content", openAPIContent("#/components/schemas/" + openAPIErrorSchema)},
+			}},
+		})
+
+		paths = paths.add("/"+midl.Name+"."+m.Name, jsonObject{{"post", operation}})
+	}
+
+	names := []string{}
+	for _, e := range errs {
+		names = append(names, midl.Name+"."+e.Name)
+	}
+	errorName := jsonObject{{"type", "string"}}
+	if len(names) > 0 {
+		errorName = errorName.add("description", "The errors of this interface, or the errors of other interfaces like org.varlink.service")
+		errorName = errorName.add("examples", names)
+	}
+
+	schemas := jsonSchemaDefinitions(midl, "#/components/schemas/")
+	schemas = schemas.add(openAPIErrorSchema, jsonObject{
+		{"type", "object"},
+		{"properties", jsonObject{
+			{"error", errorName},
+			{"parameters", jsonObject{{"type", "object"}}},
+		}},
+		{"required", []string{"error"}},
+	})
+
+	doc := jsonObject{
+		{"x-generator", markerText},
+		{"openapi", "3.1.0"},
+		{"info", info},
+		{"paths", paths},
+		{"components", jsonObject{{"schemas", schemas}}},
+	}
+
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(b, '\n'), nil
+}
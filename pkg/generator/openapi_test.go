@@ -0,0 +1,77 @@
+package generator
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestOpenAPI(t *testing.T) {
+	b, err := GenerateOpenAPI([]byte(`
+# Painting
+interface org.example.openapi
+
+type Color (red, green)
+
+# Paint the wall
+method Paint(color: Color) -> (ok: bool)
+
+error NoPaint (color: Color)
+	`), Options{})
+	if err != nil {
+		t.Fatalf("Error generating %v", err)
+	}
+
+	if !IsGenerated(b) {
+		t.Fatalf("Generated document is missing the marker:\n%s", b)
+	}
+
+	type content map[string]struct {
+		Schema struct {
+			Ref string `json:"$ref"`
+		} `json:"schema"`
+	}
+	var doc struct {
+		OpenAPI string `json:"openapi"`
+		Info    struct {
+			Title       string `json:"title"`
+			Description string `json:"description"`
+		} `json:"info"`
+		Paths map[string]map[string]struct {
+			OperationID string `json:"operationId"`
+			Description string `json:"description"`
+			RequestBody struct {
+				Content content `json:"content"`
+			} `json:"requestBody"`
+			Responses map[string]struct {
+				Content content `json:"content"`
+			} `json:"responses"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]json.RawMessage `json:"schemas"`
+		} `json:"components"`
+	}
+	err = json.Unmarshal(b, &doc)
+	if err != nil {
+		t.Fatalf("Error parsing document %v:\n%s", err, b)
+	}
+
+	expect(t, "3.1.0", doc.OpenAPI)
+	expect(t, "org.example.openapi", doc.Info.Title)
+	expect(t, "Painting", doc.Info.Description)
+
+	op, ok := doc.Paths["/org.example.openapi.Paint"]["post"]
+	if !ok {
+		t.Fatalf("Missing POST operation for Paint:\n%s", b)
+	}
+	expect(t, "Paint", op.OperationID)
+	expect(t, "Paint the wall", op.Description)
+	expect(t, "#/components/schemas/Paint.In", op.RequestBody.Content["application/json"].Schema.Ref)
+	expect(t, "#/components/schemas/Paint.Out", op.Responses["200"].Content["application/json"].Schema.Ref)
+	expect(t, "#/components/schemas/varlink.Error", op.Responses["default"].Content["application/json"].Schema.Ref)
+
+	for _, name := range []string{"Color", "Paint.In", "Paint.Out", "NoPaint.Error", "varlink.Error"} {
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			t.Fatalf("Missing schema '%s':\n%s", name, b)
+		}
+	}
+}
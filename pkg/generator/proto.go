@@ -0,0 +1,222 @@
+package generator
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/varlink/go/varlink/idl"
+)
+
+// protoEnumPrefix returns the prefix of the values of an enum, like
+// OUT_OF_BOUNDS_ for OutOfBounds.
+func protoEnumPrefix(name string) string {
+	var b bytes.Buffer
+	for i, r := range name {
+		if i > 0 && unicode.IsUpper(r) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	b.WriteByte('_')
+	return b.String()
+}
+
+func writeProtoComment(b *bytes.Buffer, doc string, indent string) {
+	if doc == "" {
+		return
+	}
+	for _, line := range strings.Split(doc, "\n") {
+		b.WriteString(strings.TrimRight(indent+"// "+line, " ") + "\n")
+	}
+}
+
+type protoWriter struct {
+	b       bytes.Buffer
+	imports map[string]bool
+}
+
+// fieldType returns the label and the type of a message field. Anonymous
+// structs and enums are declared as nested types named nested. Nestings of
+// arrays, maps and maybes which have no protobuf equivalent are represented
+// as google.protobuf.Value.
+func (p *protoWriter) fieldType(t *idl.Type, nested string) (string, string) {
+	switch t.Kind {
+	case idl.TypeBool:
+		return "", "bool"
+
+	case idl.TypeInt:
+		return "", "int64"
+
+	case idl.TypeFloat:
+		return "", "double"
+
+	case idl.TypeString:
+		return "", "string"
+
+	case idl.TypeAlias:
+		return "", t.Alias
+
+	case idl.TypeStruct, idl.TypeEnum:
+		return "", nested
+
+	case idl.TypeArray, idl.TypeMaybe, idl.TypeMap:
+		switch t.ElementType.Kind {
+		case idl.TypeArray, idl.TypeMaybe, idl.TypeMap:
+			break
+
+		default:
+			_, element := p.fieldType(t.ElementType, nested)
+			switch t.Kind {
+			case idl.TypeArray:
+				return "repeated ", element
+			case idl.TypeMaybe:
+				return "optional ", element
+			default:
+				return "", "map<string, " + element + ">"
+			}
+		}
+	}
+
+	p.imports["google/protobuf/struct.proto"] = true
+	return "", "google.protobuf.Value"
+}
+
+// anonymousType returns the anonymous struct or enum of a field type.
+func anonymousType(t *idl.Type) *idl.Type {
+	switch t.Kind {
+	case idl.TypeStruct, idl.TypeEnum:
+		return t
+
+	case idl.TypeArray, idl.TypeMaybe, idl.TypeMap:
+		switch t.ElementType.Kind {
+		case idl.TypeStruct, idl.TypeEnum:
+			return t.ElementType
+		}
+	}
+
+	return nil
+}
+
+func (p *protoWriter) writeEnum(name string, doc string, t *idl.Type, indent string) {
+	writeProtoComment(&p.b, doc, indent)
+	prefix := protoEnumPrefix(name)
+	p.b.WriteString(indent + "enum " + name + " {\n")
+	p.b.WriteString(indent + "  " + prefix + "UNSPECIFIED = 0;\n")
+	for i, field := range t.Fields {
+		writeProtoComment(&p.b, field.Doc, indent+"  ")
+		p.b.WriteString(indent + "  " + prefix + strings.ToUpper(field.Name) + " = " + strconv.Itoa(i+1) + ";\n")
+	}
+	p.b.WriteString(indent + "}\n")
+}
+
+func (p *protoWriter) writeMessage(name string, doc string, t *idl.Type, indent string) {
+	writeProtoComment(&p.b, doc, indent)
+	p.b.WriteString(indent + "message " + name + " {\n")
+
+	for _, field := range t.Fields {
+		nested := strings.Title(field.Name)
+		if a := anonymousType(field.Type); a != nil {
+			if a.Kind == idl.TypeEnum {
+				p.writeEnum(nested, "", a, indent+"  ")
+			} else {
+				p.writeMessage(nested, "", a, indent+"  ")
+			}
+		}
+	}
+
+	for i, field := range t.Fields {
+		label, typ := p.fieldType(field.Type, strings.Title(field.Name))
+		writeProtoComment(&p.b, field.Doc, indent+"  ")
+		if typ == "google.protobuf.Value" && field.Type.Kind != idl.TypeObject {
+			p.b.WriteString(indent + "  // varlink type: " + idlType(field.Type) + "\n")
+		}
+		p.b.WriteString(indent + "  " + label + typ + " " + field.Name + " = " + strconv.Itoa(i+1) + ";\n")
+	}
+
+	p.b.WriteString(indent + "}\n")
+}
+
+// GenerateProto returns a protobuf definition equivalent to the varlink
+// interface description src. The parameters of method Foo are the messages
+// FooRequest and FooResponse of the rpc Foo, the parameters of error Bar are
+// the message BarError, to be sent as gRPC error details.
+func GenerateProto(src []byte, opts Options) ([]byte, error) {
+	midl, err := idl.New(strings.TrimRight(string(src), "\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	aliases, methods, errs := splitMembers(midl)
+
+	for _, m := range methods {
+		for _, name := range []string{m.Name + "Request", m.Name + "Response"} {
+			if _, ok := midl.Aliases[name]; ok {
+				return nil, fmt.Errorf("type '%s' collides with the messages of method '%s'", name, m.Name)
+			}
+		}
+	}
+	for _, e := range errs {
+		if _, ok := midl.Aliases[e.Name+"Error"]; ok {
+			return nil, fmt.Errorf("type '%s' collides with the message of error '%s'", e.Name+"Error", e.Name)
+		}
+	}
+
+	p := &protoWriter{imports: make(map[string]bool)}
+
+	for _, a := range aliases {
+		p.b.WriteString("\n")
+		if a.Type.Kind == idl.TypeEnum {
+			p.writeEnum(a.Name, a.Doc, a.Type, "")
+		} else {
+			p.writeMessage(a.Name, a.Doc, a.Type, "")
+		}
+	}
+
+	for _, m := range methods {
+		p.b.WriteString("\n")
+		p.writeMessage(m.Name+"Request", "", m.In, "")
+		p.b.WriteString("\n")
+		p.writeMessage(m.Name+"Response", "", m.Out, "")
+	}
+
+	for _, e := range errs {
+		p.b.WriteString("\n")
+		p.writeMessage(e.Name+"Error", e.Doc, e.Type, "")
+	}
+
+	names := strings.Split(midl.Name, ".")
+	p.b.WriteString("\nservice " + strings.Title(names[len(names)-1]) + " {\n")
+	for i, m := range methods {
+		if i > 0 {
+			p.b.WriteString("\n")
+		}
+		writeProtoComment(&p.b, m.Doc, "  ")
+		p.b.WriteString("  rpc " + m.Name + "(" + m.Name + "Request) returns (" + m.Name + "Response);\n")
+	}
+	p.b.WriteString("}\n")
+
+	var b bytes.Buffer
+	b.WriteString(generatedMarker + "\n")
+	writeProtoComment(&b, midl.Doc, "")
+	b.WriteString("syntax = \"proto3\";\n\n")
+	b.WriteString("package " + midl.Name + ";\n")
+
+	imports := make([]string, 0, len(p.imports))
+	for i := range p.imports {
+		imports = append(imports, i)
+	}
+	sort.Strings(imports)
+	if len(imports) > 0 {
+		b.WriteString("\n")
+	}
+	for _, i := range imports {
+		b.WriteString("import \"" + i + "\";\n")
+	}
+
+	b.Write(p.b.Bytes())
+	return b.Bytes(), nil
+}
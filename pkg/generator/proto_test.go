@@ -0,0 +1,64 @@
+package generator
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProto(t *testing.T) {
+	b, err := GenerateProto([]byte(`
+interface org.example.proto
+
+# A color
+type Color (red, green)
+
+type Wall (
+  color: Color,
+  size: (width: float, height: float),
+  layers: ?int,
+  marks: []string,
+  labels: [string]string,
+  grid: [][]int
+)
+
+# Paint the wall
+method Paint(wall: Wall) -> ()
+
+error NoPaint (color: Color)
+	`), Options{})
+	if err != nil {
+		t.Fatalf("Error generating %v", err)
+	}
+
+	if !IsGenerated(b) {
+		t.Fatalf("Generated file is missing the marker:\n%s", b)
+	}
+
+	src := string(b)
+	for _, s := range []string{
+		"syntax = \"proto3\";\n\npackage org.example.proto;\n\nimport \"google/protobuf/struct.proto\";\n",
+		"// A color\nenum Color {\n  COLOR_UNSPECIFIED = 0;\n  COLOR_RED = 1;\n  COLOR_GREEN = 2;\n}\n",
+		"  message Size {\n    double width = 1;\n    double height = 2;\n  }\n",
+		"  Color color = 1;\n  Size size = 2;\n  optional int64 layers = 3;\n  repeated string marks = 4;\n  map<string, string> labels = 5;\n",
+		"  // varlink type: [][]int\n  google.protobuf.Value grid = 6;\n",
+		"message PaintRequest {\n  Wall wall = 1;\n}\n",
+		"message PaintResponse {\n}\n",
+		"message NoPaintError {\n  Color color = 1;\n}\n",
+		"service Proto {\n  // Paint the wall\n  rpc Paint(PaintRequest) returns (PaintResponse);\n}\n",
+	} {
+		if !strings.Contains(src, s) {
+			t.Fatalf("Generated file is missing `%s`:\n%s", s, src)
+		}
+	}
+
+	_, err = GenerateProto([]byte(`
+interface org.example.proto
+
+type PaintRequest (color: string)
+
+method Paint(color: string) -> ()
+	`), Options{})
+	if err == nil {
+		t.Fatal("Generated colliding messages")
+	}
+}
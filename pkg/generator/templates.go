@@ -0,0 +1,583 @@
+package generator
+
+// The default templates for the generated Go code. Every template can be
+// replaced with Options.Templates by defining a template with the same name.
+//
+// The "file" template is executed with a *goFile, the templates for single
+// members with the *goAlias, *goConversion, *goMethod or *goError they
+// generate.
+const defaultTemplates = `
+{{- define "file" -}}
+{{template "header" .}}
+package {{.Package}}
+
+{{template "imports" .}}
+
+// Type declarations
+{{range .Aliases}}{{template "alias" .}}{{end -}}
+{{if .Conversions -}}
+// Conversions to the structurally identical types of other interfaces
+{{range .Conversions}}{{template "conversion" .}}{{end -}}
+{{end -}}
+{{if ne .Compat "v1" -}}
+// Method parameter types
+{{range .Methods}}{{template "parameters" .}}{{end -}}
+{{end -}}
+// Client method calls
+{{range .Methods}}{{if eq $.Compat "v1"}}{{template "client_v1" .}}{{else}}{{template "client" .}}{{end}}{{end -}}
+// Service interface with all methods
+{{template "interface" .}}
+
+// Service object with all methods
+type VarlinkCall struct{ varlink.Call }
+
+// Reply methods for all varlink errors
+{{range .Errors}}{{template "error" .}}{{end -}}
+// Reply methods for all varlink methods
+{{range .Methods}}{{template "reply" .}}{{end -}}
+{{if ne .Compat "v1" -}}
+// Streaming reply methods for all varlink methods
+{{range .Methods}}{{template "stream" .}}{{end -}}
+{{end -}}
+// Dummy implementations for all varlink methods
+{{range .Methods}}{{template "dummy" .}}{{end -}}
+{{template "dispatcher" .}}
+
+// Varlink interface name
+func (s *VarlinkInterface) VarlinkGetName() string {
+	return {{raw .Name}}
+}
+
+// Varlink interface description
+func (s *VarlinkInterface) VarlinkGetDescription() string {
+	return {{raw .Description}}
+}
+
+// The generator version, the source file and the SHA-256 hash of the interface
+// description the code was generated from. Clients can compare the hash with the
+// hash of the description returned by a service to detect mismatching bindings.
+const (
+	VarlinkGeneratorVersion  = {{printf "%q" .Version}}
+	VarlinkSource            = {{printf "%q" .Source}}
+	VarlinkDescriptionSHA256 = {{printf "%q" .SHA256}}
+)
+{{if ne .Compat "v1"}}
+{{template "connect" .}}
+{{end}}
+{{template "service" .}}
+
+{{template "checks" .}}
+{{end}}
+
+{{- define "header" -}}
+{{.Marker}}
+// version: {{.Version}}
+// source: {{.Source}}
+// sha256: {{.SHA256}}
+{{- end}}
+
+{{- define "imports" -}}
+import (
+{{- range .Imports}}
+	"{{.}}"
+{{- end}}
+)
+{{- end}}
+
+{{- define "source" -}}
+// varlink: {{.}}
+{{- end}}
+
+{{- define "alias" -}}
+{{template "source" .Source}}
+type {{.Name}} {{.Type}}
+
+{{template "getters" .Getters}}
+{{- if .Enum}}{{template "enum" .}}{{end}}
+{{- end}}
+
+{{- define "getters" -}}
+{{range .}}func (v *{{.Receiver}}) Get{{.Name}}() {{.Type}} {
+	if v == nil || v.{{.Name}} == nil {
+		return {{.Zero}}
+	}
+	return *v.{{.Name}}
+}
+
+{{end}}
+{{- end}}
+
+{{- define "enum" -}}
+func (v {{.Name}}) MarshalText() ([]byte, error) {
+	return []byte(v), nil
+}
+
+// UnmarshalText accepts unknown values, like the values of a newer version
+// of the interface.
+func (v *{{.Name}}) UnmarshalText(text []byte) error {
+	*v = {{.Name}}(text)
+	return nil
+}
+
+// Valid reports whether v is one of the values of {{.Name}}.
+func (v {{.Name}}) Valid() bool {
+	switch v {
+	case {{range $i, $v := .Values}}{{if $i}}, {{end}}"{{$v}}"{{end}}:
+		return true
+	}
+	return false
+}
+
+{{end}}
+
+{{- define "conversion" -}}
+// To{{.Method}} converts v to the structurally identical {{.Other}}.
+func (v {{.Name}}) To{{.Method}}() {{.Other}} {
+	return {{.To}}
+}
+
+// {{.Name}}From{{.Method}} converts the structurally identical {{.Other}} to {{.Name}}.
+func {{.Name}}From{{.Method}}(v {{.Other}}) {{.Name}} {
+	return {{.From}}
+}
+
+{{end}}
+
+{{- define "parameters" -}}
+{{template "source" .Source}}
+type {{.In.TypeName}} {{.In.Type}}
+
+{{template "getters" .In.Getters}}
+{{- template "source" .Source}}
+type {{.Out.TypeName}} {{.Out.Type}}
+
+{{template "getters" .Out.Getters}}
+{{- end}}
+
+{{- define "client" -}}
+{{template "source" .Source}}
+type {{.GoName}}_methods struct{}
+
+func {{.GoName}}() {{.GoName}}_methods { return {{.GoName}}_methods{} }
+
+func (m {{.GoName}}_methods) Call(c varlink.Conn{{range .In.Fields}}, {{.Name}}_in_ {{.Type}}{{end}}, opts ...varlink.CallOption) ({{range .Out.Fields}}{{.Name}}_out_ {{.Type}}, {{end}}err_ error) {
+	receive, err_ := m.Send(c{{range .In.Fields}}, {{.Name}}_in_{{end}}, opts...)
+	if err_ != nil {
+		return
+	}
+	{{range .Out.Fields}}{{.Name}}_out_, {{end}}_, err_ = receive()
+	return
+}
+
+func (m {{.GoName}}_methods) Send(c varlink.Conn{{range .In.Fields}}, {{.Name}}_in_ {{.Type}}{{end}}, opts ...varlink.CallOption) (func() ({{range .Out.Fields}}{{.Type}}, {{end}}uint64, error), error) {
+{{- if .In.Fields}}
+	var in {{.In.TypeName}}
+{{- range .In.Fields}}
+	in.{{.GoName}} = {{if .Convert}}{{.TaggedType}}({{.Name}}_in_){{else}}{{.Name}}_in_{{end}}
+{{- end}}
+	receive, err := c.SendWithOptions("{{.Method}}", in, opts...)
+{{- else}}
+	receive, err := c.SendWithOptions("{{.Method}}", nil, opts...)
+{{- end}}
+	if err != nil {
+		return nil, err
+	}
+	return func() ({{range .Out.Fields}}{{.Name}}_out_ {{.Type}}, {{end}}flags uint64, err error) {
+{{- if .Out.Fields}}
+		var out {{.Out.TypeName}}
+		flags, err = receive(&out)
+{{- else}}
+		flags, err = receive(nil)
+{{- end}}
+		if err != nil {
+			return
+		}
+{{- range .Out.Fields}}
+		{{.Name}}_out_ = {{if .Convert}}{{.Type}}(out.{{.GoName}}){{else}}out.{{.GoName}}{{end}}
+{{- end}}
+		return
+	}, nil
+}
+
+{{end}}
+
+{{- define "client_v1" -}}
+{{template "source" .Source}}
+type {{.GoName}}_methods struct{}
+
+func {{.GoName}}() {{.GoName}}_methods { return {{.GoName}}_methods{} }
+
+func (m {{.GoName}}_methods) Call(c *varlink.Connection{{range .In.Fields}}, {{.Name}}_in_ {{.Type}}{{end}}) ({{range .Out.Fields}}{{.Name}}_out_ {{.Type}}, {{end}}err_ error) {
+	receive, err_ := m.Send(c, 0{{range .In.Fields}}, {{.Name}}_in_{{end}})
+	if err_ != nil {
+		return
+	}
+	{{range .Out.Fields}}{{.Name}}_out_, {{end}}_, err_ = receive()
+	return
+}
+
+func (m {{.GoName}}_methods) Send(c *varlink.Connection, flags uint64{{range .In.Fields}}, {{.Name}}_in_ {{.Type}}{{end}}) (func() ({{range .Out.Fields}}{{.Type}}, {{end}}uint64, error), error) {
+{{- if .In.Fields}}
+	var in {{.In.TypeName}}
+{{- range .In.Fields}}
+	in.{{.GoName}} = {{if .Convert}}{{.TaggedType}}({{.Name}}_in_){{else}}{{.Name}}_in_{{end}}
+{{- end}}
+	receive, err := c.Send("{{.Method}}", in, flags)
+{{- else}}
+	receive, err := c.Send("{{.Method}}", nil, flags)
+{{- end}}
+	if err != nil {
+		return nil, err
+	}
+	return func() ({{range .Out.Fields}}{{.Name}}_out_ {{.Type}}, {{end}}flags uint64, err error) {
+{{- if .Out.Fields}}
+		var out {{.Out.TypeName}}
+		flags, err = receive(&out)
+{{- else}}
+		flags, err = receive(nil)
+{{- end}}
+		if err != nil {
+			return
+		}
+{{- range .Out.Fields}}
+		{{.Name}}_out_ = {{if .Convert}}{{.Type}}(out.{{.GoName}}){{else}}out.{{.GoName}}{{end}}
+{{- end}}
+		return
+	}, nil
+}
+
+{{end}}
+
+{{- define "interface" -}}
+type {{.Package}}Interface interface {
+{{- range .Methods}}
+	{{template "source" .Source}}
+	{{.GoName}}(c VarlinkCall{{range .In.Fields}}, {{.Name}}_ {{.Type}}{{end}}) error
+{{- end}}
+}
+
+// VarlinkInterfaceMethods is the set of methods a service has to implement. Services
+// which do not embed VarlinkInterface can assert it at build time with:
+//
+//	var _ {{.Package}}.VarlinkInterfaceMethods = (*MyService)(nil)
+type VarlinkInterfaceMethods = {{.Package}}Interface
+{{- end}}
+
+{{- define "error" -}}
+{{template "source" .Source}}
+func (c *VarlinkCall) Reply{{.Name}}({{range $i, $f := .Parameters.Fields}}{{if $i}}, {{end}}{{.Name}}_ {{.Type}}{{end}}) error {
+{{- if .Parameters.Fields}}
+	var out {{.Parameters.Type}}
+{{- range .Parameters.Fields}}
+	out.{{.GoName}} = {{if .Convert}}{{.TaggedType}}({{.Name}}_){{else}}{{.Name}}_{{end}}
+{{- end}}
+	return c.ReplyError("{{.Error}}", &out)
+{{- else}}
+	return c.ReplyError("{{.Error}}", nil)
+{{- end}}
+}
+
+{{end}}
+
+{{- define "reply" -}}
+{{template "source" .Source}}
+func (c *VarlinkCall) Reply{{.GoName}}({{range $i, $f := .Out.Fields}}{{if $i}}, {{end}}{{.Name}}_ {{.Type}}{{end}}) error {
+{{- if .Out.Fields}}
+	var out {{.Out.TypeName}}
+{{- range .Out.Fields}}
+	out.{{.GoName}} = {{if .Convert}}{{.TaggedType}}({{.Name}}_){{else}}{{.Name}}_{{end}}
+{{- end}}
+	return c.Reply(&out)
+{{- else}}
+	return c.Reply(nil)
+{{- end}}
+}
+
+{{end}}
+
+{{- define "stream" -}}
+{{template "source" .Source}}
+// Stream{{.GoName}} returns a channel for the replies to a call with more. The
+// values sent on it are replied with continues, closing the channel sends the
+// last value as final reply. The returned function waits for the final reply
+// and returns the first error, it must be called before the method returns.
+func (c *VarlinkCall) Stream{{.GoName}}() (chan<- {{.Out.TypeName}}, func() error) {
+	replies := make(chan {{.Out.TypeName}})
+	done := make(chan error, 1)
+	// The replies are sent with a copy of the call, which the method can
+	// keep using
+	call := c.Call
+	go func() {
+		done <- call.ReplyStream(func() (interface{}, bool) {
+			out, ok := <-replies
+			return &out, ok
+		})
+	}()
+	return replies, func() error { return <-done }
+}
+
+{{end}}
+
+{{- define "dummy" -}}
+{{template "source" .Source}}
+func (s *VarlinkInterface) {{.GoName}}(c VarlinkCall{{range .In.Fields}}, {{.Name}}_ {{.Type}}{{end}}) error {
+	return c.ReplyMethodNotImplemented("{{.Method}}")
+}
+
+{{end}}
+
+{{- define "dispatcher" -}}
+{{- if .DispatchTable -}}
+// Method call dispatch table
+var varlinkDispatchTable = map[string]func(s *VarlinkInterface, call varlink.Call) error{
+{{- range .Methods}}
+	"{{.Name}}": func(s *VarlinkInterface, call varlink.Call) error {
+{{- template "dispatch" .}}
+	},
+{{- end}}
+}
+
+// Method call dispatcher
+func (s *VarlinkInterface) VarlinkDispatch(call varlink.Call, methodname string) error {
+	dispatch, ok := varlinkDispatchTable[methodname]
+	if !ok {
+		return call.ReplyMethodNotFound(methodname)
+	}
+	return dispatch(s, call)
+}
+{{- else -}}
+// Method call dispatcher
+func (s *VarlinkInterface) VarlinkDispatch(call varlink.Call, methodname string) error {
+	switch methodname {
+{{- range .Methods}}
+	case "{{.Name}}":
+{{- template "dispatch" .}}
+{{end}}
+	default:
+		return call.ReplyMethodNotFound(methodname)
+	}
+}
+{{- end}}
+{{- end}}
+
+{{- define "dispatch" -}}
+{{- if .In.Fields}}
+		var in {{.In.TypeName}}
+		err := call.GetParameters(&in)
+		if err != nil {
+			return call.ReplyInvalidParameterError(err)
+		}
+		return s.{{.Service}}.{{.GoName}}(VarlinkCall{call}{{range .In.Fields}}, {{if .Convert}}{{.Type}}(in.{{.GoName}}){{else}}in.{{.GoName}}{{end}}{{end}})
+{{- else}}
+		return s.{{.Service}}.{{.GoName}}(VarlinkCall{call})
+{{- end}}
+{{- end}}
+
+{{- define "connect" -}}
+// VarlinkConnect returns a connection to the service at address, after
+// verifying that the service implements {{.Name}}. It fails right away
+// instead of with MethodNotFound at the first call. With checkDescription,
+// the interface description of the service must also match the description
+// the code was generated from.
+func VarlinkConnect(ctx context.Context, address string, checkDescription bool) (*varlink.Connection, error) {
+	c, err := varlink.DialContext(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	var interfaces []string
+	err = c.GetInfo(nil, nil, nil, nil, &interfaces)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("unable to get the interfaces of the service at '%s': %v", address, err)
+	}
+
+	found := false
+	for _, name := range interfaces {
+		if name == {{printf "%q" .Name}} {
+			found = true
+			break
+		}
+	}
+	if !found {
+		c.Close()
+		return nil, fmt.Errorf("the service at '%s' does not implement '{{.Name}}'", address)
+	}
+
+	if checkDescription {
+		description, err := c.GetInterfaceDescription({{printf "%q" .Name}})
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("unable to get the description of '{{.Name}}' from the service at '%s': %v", address, err)
+		}
+
+		hash := fmt.Sprintf("%x", sha256.Sum256([]byte(strings.TrimRight(description, "\n")+"\n")))
+		if hash != VarlinkDescriptionSHA256 {
+			c.Close()
+			return nil, fmt.Errorf("the service at '%s' implements a different description of '{{.Name}}', sha256 %s instead of %s", address, hash, VarlinkDescriptionSHA256)
+		}
+	}
+
+	return c, nil
+}
+{{- end}}
+
+{{- define "service" -}}
+// Service interface
+type VarlinkInterface struct {
+	{{.Package}}Interface
+}
+
+func VarlinkNew(m {{.Package}}Interface) *VarlinkInterface {
+	return &VarlinkInterface{m}
+}
+{{- end}}
+
+{{- define "checks" -}}
+// Compile-time interface checks
+var _ {{.Package}}Interface = (*VarlinkInterface)(nil)
+var _ interface {
+	VarlinkDispatch(call varlink.Call, methodname string) error
+	VarlinkGetName() string
+	VarlinkGetDescription() string
+} = (*VarlinkInterface)(nil)
+{{- range .Aliases}}
+{{- if .Enum}}
+var _ encoding.TextMarshaler = {{.Name}}("")
+var _ encoding.TextUnmarshaler = (*{{.Name}})(nil)
+{{- end}}
+{{- end}}
+{{- end}}
+
+{{- define "examples" -}}
+{{template "header" .}}
+
+package {{.Package}}
+
+{{template "imports" .}}
+{{range $m := .Methods}}
+func Example{{.GoName}}() {
+	c, err := varlink.DialContext(context.Background(), "unix:/run/{{$.Name}}")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	defer c.Close()
+
+	{{range .Out.Fields}}{{.Var}}, {{end}}err {{if .Out.Fields}}:{{end}}= {{.GoName}}().Call(c{{range .In.Fields}}, {{.Zero}}{{end}})
+	if err != nil {
+{{- if $.Errors}}
+		if e, ok := err.(*varlink.Error); ok {
+			switch e.Name {
+{{- range $.Errors}}
+			case "{{.Error}}":
+				fmt.Fprintln(os.Stderr, "{{$m.Name}} failed with {{.Name}}:", string(e.Parameters))
+				return
+{{- end}}
+			}
+		}
+{{- end}}
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+{{- range .Out.Fields}}
+	fmt.Println({{.Var}})
+{{- end}}
+}
+
+{{end}}
+{{- end}}
+
+{{- define "benchmarks" -}}
+{{template "header" .}}
+
+package {{.Package}}
+
+{{template "imports" .}}
+
+// benchmarkConnection returns a connection to a service with the dummy
+// implementations of all methods, and a function which stops the service.
+func benchmarkConnection(b *testing.B) (*varlink.Connection, func()) {
+	dir, err := ioutil.TempDir("", "varlink-benchmark")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	service, err := varlink.NewService("Varlink", "Benchmark", "1", "https://github.com/varlink/go")
+	if err == nil {
+		err = service.RegisterInterface(VarlinkNew(&VarlinkInterface{}))
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		b.Fatal(err)
+	}
+
+	address := "unix:" + dir + "/socket"
+	ctx, cancel := context.WithCancel(context.Background())
+	go service.RunContext(ctx, address)
+
+	for i := 0; ; i++ {
+		c, err := varlink.DialContext(context.Background(), address)
+		if err == nil {
+			return c, func() {
+				c.Close()
+				cancel()
+				os.RemoveAll(dir)
+			}
+		}
+		if i == 100 {
+			cancel()
+			os.RemoveAll(dir)
+			b.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+{{range .Methods}}
+func Benchmark{{.Name}}Encode(b *testing.B) {
+	in := {{.In.TypeName}}{
+{{- range .In.Fields}}
+		{{.GoName}}: {{.TaggedSample}},
+{{- end}}
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(&in); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark{{.Name}}Decode(b *testing.B) {
+	data, err := json.Marshal(&{{.In.TypeName}}{
+{{- range .In.Fields}}
+		{{.GoName}}: {{.TaggedSample}},
+{{- end}}
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var in {{.In.TypeName}}
+		if err := json.Unmarshal(data, &in); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark{{.Name}}Dispatch(b *testing.B) {
+	c, stop := benchmarkConnection(b)
+	defer stop()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		{{range .Out.Fields}}_, {{end}}err := {{.GoName}}().Call(c{{range .In.Fields}}, {{.Sample}}{{end}})
+		if e, ok := err.(*varlink.Error); !ok || e.Name != "org.varlink.service.MethodNotImplemented" {
+			b.Fatal(err)
+		}
+	}
+}
+{{end}}
+{{- end}}
+`
@@ -0,0 +1,147 @@
+package varlink
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The first file descriptor which systemd passes to the process
+const listenFdsStart = 3
+
+// activatedSocket is a socket which systemd passed to the process, with the
+// name of the FileDescriptorName= of its socket unit.
+type activatedSocket struct {
+	fd   int
+	name string
+}
+
+func (a activatedSocket) file() *os.File {
+	closeOnExec(a.fd)
+
+	return os.NewFile(uintptr(a.fd), a.name)
+}
+
+// activationSockets returns the sockets which systemd passed to the process.
+// Without LISTEN_FDNAMES, the sockets are named "unknown", like with
+// sd_listen_fds_with_names().
+func activationSockets() []activatedSocket {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds < 1 {
+		return nil
+	}
+
+	var names []string
+	if fdnames, set := os.LookupEnv("LISTEN_FDNAMES"); set {
+		names = strings.Split(fdnames, ":")
+		if len(names) != nfds {
+			return nil
+		}
+	}
+
+	sockets := make([]activatedSocket, nfds)
+	for i := range sockets {
+		sockets[i] = activatedSocket{fd: listenFdsStart + i, name: "unknown"}
+		if names != nil {
+			sockets[i].name = names[i]
+		}
+	}
+
+	return sockets
+}
+
+func activationListener() net.Listener {
+	file := activationFile()
+	if file == nil {
+		return nil
+	}
+
+	listener, err := fileListener(file)
+	if err != nil {
+		return nil
+	}
+
+	return listener
+}
+
+// fileListener returns a listener on a duplicate of the listening socket of
+// the file. It supports the AF_VSOCK sockets, which the net package does not.
+func fileListener(file *os.File) (net.Listener, error) {
+	listener, err := net.FileListener(file)
+	if err == nil {
+		return listener, nil
+	}
+	if vsock, verr := fileVsockListener(file); verr == nil {
+		return vsock, nil
+	}
+	return nil, err
+}
+
+// activationFile returns the socket which systemd passed to the process, or
+// nil. If more than one socket is passed, it is the socket with the name
+// "varlink".
+func activationFile() *os.File {
+	sockets := activationSockets()
+	if len(sockets) == 1 {
+		return sockets[0].file()
+	}
+
+	for _, socket := range sockets {
+		if socket.name == "varlink" {
+			return socket.file()
+		}
+	}
+
+	return nil
+}
+
+// activationListeners returns the listeners of the sockets with the names,
+// or of all sockets without names. The other sockets are kept open.
+func activationListeners(names []string) ([]serviceListener, error) {
+	sockets := activationSockets()
+	if len(sockets) == 0 {
+		return nil, fmt.Errorf("no socket was passed by systemd")
+	}
+
+	selected := make(map[string]bool)
+	for _, name := range names {
+		selected[name] = false
+	}
+	for _, socket := range sockets {
+		if _, ok := selected[socket.name]; ok {
+			selected[socket.name] = true
+		}
+	}
+	for _, name := range names {
+		if !selected[name] {
+			return nil, fmt.Errorf("no socket with the name '%s' was passed by systemd", name)
+		}
+	}
+
+	var listeners []serviceListener
+	for _, socket := range sockets {
+		if len(names) > 0 && !selected[socket.name] {
+			continue
+		}
+
+		file := socket.file()
+		l, err := fileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.listener.Close()
+			}
+			return nil, fmt.Errorf("socket '%s' is not a listening socket: %v", socket.name, err)
+		}
+		listeners = append(listeners, serviceListener{listener: l, accept: l, address: socket.name})
+	}
+
+	return listeners, nil
+}
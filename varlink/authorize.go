@@ -0,0 +1,75 @@
+package varlink
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+)
+
+// Peer is the client of a method call, like for the authorization of the
+// call.
+type Peer struct {
+	// The credentials of a client which connected over a unix socket,
+	// or nil
+	Credentials *PeerCredentials
+
+	// The state of the TLS connection of a client which connected to a
+	// tcp+tls: address, with its verified certificates, or nil
+	TLS *tls.ConnectionState
+}
+
+// Authorizer authorizes a method call of the peer before it is dispatched,
+// like with the peer credentials of a local client. The parameters are the
+// JSON parameters of the call, or nil. The context is the one of
+// Call.Context(), it is done when the connection is closed. An error denies
+// the call, a *Error is sent as the error reply, the other errors as
+// org.varlink.service.PermissionDenied.
+type Authorizer func(ctx context.Context, peer Peer, interfaceName string, method string, parameters json.RawMessage) error
+
+// SetAuthorizer sets the authorizer of the method calls of the service. It is
+// called for all calls, including the calls of org.varlink.service.
+func (s *Service) SetAuthorizer(authorize Authorizer) error {
+	if s.running {
+		return fmt.Errorf("service is already running")
+	}
+	s.authorizer = authorize
+
+	return nil
+}
+
+// Peer returns the client of the method call.
+func (c *Call) Peer() Peer {
+	var peer Peer
+	if c.conn != nil {
+		peer.Credentials = c.conn.credentials
+
+		// The handshake is completed by the read of the call
+		if conn, ok := c.conn.conn.(*tls.Conn); ok {
+			state := conn.ConnectionState()
+			peer.TLS = &state
+		}
+	}
+	return peer
+}
+
+// authorize returns false, after the error reply of the authorizer, if the
+// call is denied.
+func (s *Service) authorize(c *Call, interfaceName string, method string) (bool, error) {
+	if s.authorizer == nil {
+		return true, nil
+	}
+
+	err := s.authorizer(c.Context(), c.Peer(), interfaceName, method, c.Parameters())
+	if err == nil {
+		return true, nil
+	}
+	if e, ok := err.(*Error); ok {
+		var parameters interface{}
+		if len(e.Parameters) > 0 {
+			parameters = e.Parameters
+		}
+		return false, doReplyError(c, e.Name, parameters)
+	}
+	return false, c.ReplyPermissionDenied()
+}
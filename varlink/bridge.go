@@ -0,0 +1,189 @@
+package varlink
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// commandAddr is the address of a connection to the standard input and output
+// of a process.
+type commandAddr struct {
+	protocol string
+	command  string
+}
+
+func (a commandAddr) Network() string {
+	return a.protocol
+}
+
+func (a commandAddr) String() string {
+	return a.command
+}
+
+// commandConn sends the method calls to the standard input of a process, and
+// reads the replies from its standard output.
+type commandConn struct {
+	net.Conn
+	cmd  *exec.Cmd
+	addr commandAddr
+
+	closeOnce sync.Once
+}
+
+// Close closes the standard input and output of the process, and terminates
+// it.
+func (c *commandConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.Conn.Close()
+		c.cmd.Process.Kill()
+		c.cmd.Wait()
+	})
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *commandConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// pipeConn is a connection over the pipes of the standard input and output of
+// a process.
+type pipeConn struct {
+	reader *os.File
+	writer *os.File
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	n, err := c.reader.Read(b)
+	return n, pipeError(err)
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	n, err := c.writer.Write(b)
+	return n, pipeError(err)
+}
+
+// pipeError returns a net.Error for an expired deadline of a pipe, like the
+// errors of network connections.
+func pipeError(err error) error {
+	if e, ok := err.(interface{ Timeout() bool }); ok && e.Timeout() {
+		return timeoutError{}
+	}
+	return err
+}
+
+func (c *pipeConn) Close() error {
+	c.writer.Close()
+	return c.reader.Close()
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return commandAddr{}
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return commandAddr{}
+}
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	if err := c.reader.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.writer.SetWriteDeadline(t)
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	return c.reader.SetReadDeadline(t)
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	return c.writer.SetWriteDeadline(t)
+}
+
+// commandPipes returns a connection over pipes, and the ends of the pipes of
+// the standard input and output of the process.
+func commandPipes() (net.Conn, *os.File, *os.File, error) {
+	stdin, writer, err := os.Pipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	reader, stdout, err := os.Pipe()
+	if err != nil {
+		stdin.Close()
+		writer.Close()
+		return nil, nil, nil, err
+	}
+
+	return &pipeConn{reader: reader, writer: writer}, stdin, stdout, nil
+}
+
+// dialCommand starts the process of an exec: or bridge: address and returns
+// a connection to its standard input and output. An exec: address is the path
+// of an executable, followed by its arguments separated by spaces, a bridge:
+// address is a command line which is run by /bin/sh, like
+// "ssh host varlink bridge". The standard input and output of the process are
+// one end of a socket pair, a service serves it with Service.ServeStdio(). The
+// standard error of the process is the one of the calling process. The
+// process is terminated when the connection is closed.
+func dialCommand(ctx context.Context, protocol string, address string) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var cmd *exec.Cmd
+	switch protocol {
+	case "exec":
+		args := strings.Fields(address)
+		if len(args) == 0 {
+			return nil, fmt.Errorf("invalid address 'exec:%s', expected an executable", address)
+		}
+		cmd = exec.Command(args[0], args[1:]...)
+
+	case "bridge":
+		if strings.TrimSpace(address) == "" {
+			return nil, fmt.Errorf("invalid address 'bridge:%s', expected a command", address)
+		}
+		cmd = exec.Command("/bin/sh", "-c", address)
+
+	default:
+		return nil, fmt.Errorf("unknown protocol '%s'", protocol)
+	}
+
+	// The standard input and output of the process is a socket, unless
+	// the system has no socket pairs
+	conn, stdin, stdout, err := commandSocket()
+	if err != nil {
+		conn, stdin, stdout, err = commandPipes()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+
+	// The process has its own copies of its ends
+	stdin.Close()
+	stdout.Close()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &commandConn{
+		Conn: conn,
+		cmd:  cmd,
+		addr: commandAddr{protocol: protocol, command: address},
+	}, nil
+}
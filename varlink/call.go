@@ -2,18 +2,108 @@ package varlink
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"os"
 	"strings"
+	"sync"
 )
 
 // Call is a method call retrieved by a Service. The connection from the
 // client can be terminated by returning an error from the call instead
 // of sending a reply or error reply.
 type Call struct {
-	writer    *bufio.Writer
-	in        *serviceCall
-	Continues bool
+	writer     *bufio.Writer
+	writeMutex *sync.Mutex
+	in         *serviceCall
+	encoder    *EncoderOptions
+	conn       *serviceConn
+	ctx        context.Context
+	replies    *callReplies
+	Continues  bool
+}
+
+// callReplies counts the replies which were sent for a call, and records the
+// name of its error reply, like for the logging of the call, and whether the
+// final reply was sent. It is shared by the copies of the Call.
+type callReplies struct {
+	count int
+	err   string
+	final bool
+}
+
+// ErrReplied is returned by the replies to a method call which already got its
+// final reply, like a second Reply() without Continues, or a reply after an
+// error reply. The reply is not sent.
+var ErrReplied = errors.New("method call already got its final reply")
+
+// ErrOneway is returned by the replies to a oneway method call, the client
+// does not read them. The reply is not sent. A method which returns it does
+// not close the connection.
+var ErrOneway = errors.New("oneway method call does not get replies")
+
+// Method returns the name of the called method with its interface, like
+// "org.example.ping.Ping".
+func (c *Call) Method() string {
+	return c.in.Method
+}
+
+// Interface returns the name of the interface of the called method, like
+// "org.example.ping".
+func (c *Call) Interface() string {
+	if r := strings.LastIndex(c.in.Method, "."); r > 0 {
+		return c.in.Method[:r]
+	}
+	return ""
+}
+
+// MethodName returns the name of the called method without its interface,
+// like "Ping".
+func (c *Call) MethodName() string {
+	return c.in.Method[strings.LastIndex(c.in.Method, ".")+1:]
+}
+
+// Parameters returns the JSON parameters of the method call, or nil. They
+// must not be modified.
+func (c *Call) Parameters() json.RawMessage {
+	if c.in.Parameters == nil {
+		return nil
+	}
+	return *c.in.Parameters
+}
+
+// LocalAddr returns the address of the listener which accepted the
+// connection of the call, or nil for a call without a connection.
+func (c *Call) LocalAddr() net.Addr {
+	if c.conn == nil || c.conn.conn == nil {
+		return nil
+	}
+	return c.conn.conn.LocalAddr()
+}
+
+// RemoteAddr returns the address of the client of the call, or nil for a
+// call without a connection. The address of a unix socket client is mostly
+// empty, see Peer().
+func (c *Call) RemoteAddr() net.Addr {
+	if c.conn == nil || c.conn.conn == nil {
+		return nil
+	}
+	return c.conn.conn.RemoteAddr()
+}
+
+// Context returns the context of the method call, it is done when the client
+// closed the connection or a reply could not be sent, like for a client which
+// stopped reading a stream, and when the call returned. It carries the values
+// which the interceptors of the service added.
+func (c *Call) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
 }
 
 // WantsMore indicates if the calling client accepts more than one reply to this method call.
@@ -23,7 +113,7 @@ func (c *Call) WantsMore() bool {
 
 // IsOneShot indicate that the calling client does not expect a reply.
 func (c *Call) IsOneShot() bool {
-	return c.in.OneShot
+	return c.in.Oneway
 }
 
 // GetParameters retrieves the method call parameters.
@@ -35,24 +125,56 @@ func (c *Call) GetParameters(p interface{}) error {
 }
 
 func (c *Call) sendMessage(r *serviceReply) error {
-	if c.in.OneShot {
+	if c.in.Oneway {
+		if c.replies != nil {
+			return fmt.Errorf("%s: %w", c.in.Method, ErrOneway)
+		}
 		return nil
 	}
 
-	b, e := json.Marshal(r)
+	r.Parameters = c.encoder.parameters(r.Parameters)
+	var b bytes.Buffer
+	e := c.encoder.encode(&b, r)
 	if e != nil {
 		return e
 	}
 
-	b = append(b, 0)
-	_, e = c.writer.Write(b)
-	if e != nil {
-		return e
+	if c.writeMutex != nil {
+		c.writeMutex.Lock()
+		defer c.writeMutex.Unlock()
+	}
+
+	if c.replies != nil && c.replies.final {
+		return fmt.Errorf("%s: %w", c.in.Method, ErrReplied)
+	}
+
+	if len(r.files) > 0 {
+		e = c.writer.Flush()
+		if e == nil {
+			e = c.conn.writeWithFiles(b.Bytes(), r.files)
+		}
+	} else {
+		_, e = c.writer.Write(b.Bytes())
+		if e == nil {
+			e = c.writer.Flush()
+		}
+	}
+	if e == nil && c.replies != nil {
+		c.replies.count++
+		if r.Error != "" {
+			c.replies.err = r.Error
+		}
+		c.replies.final = !r.Continues
 	}
-	return c.writer.Flush()
+	if e != nil && c.conn != nil {
+		// The client is gone, the method can stop its work
+		c.conn.cancelCallContext()
+	}
+	return e
 }
 
-// Reply sends a reply to this method call.
+// Reply sends a reply to this method call. It fails with ErrReplied after the
+// final reply, and with ErrOneway for a oneway call.
 func (c *Call) Reply(parameters interface{}) error {
 	if !c.Continues {
 		return c.sendMessage(&serviceReply{
@@ -70,6 +192,61 @@ func (c *Call) Reply(parameters interface{}) error {
 	})
 }
 
+// ReplyWithFiles sends a reply to this method call like Reply(), and passes the
+// files along with it, like a tty, a pipe or a sealed memfd. Files can only be
+// passed over unix: connections. The files remain owned by the method.
+func (c *Call) ReplyWithFiles(parameters interface{}, files ...*os.File) error {
+	if c.conn == nil || c.conn.conn == nil {
+		return fmt.Errorf("call has no connection")
+	}
+	if _, ok := c.conn.conn.(fileTransport); !ok {
+		return fmt.Errorf("files can only be passed over unix sockets")
+	}
+	if c.Continues && !c.in.More {
+		return fmt.Errorf("call did not set more, it does not expect continues")
+	}
+
+	return c.sendMessage(&serviceReply{
+		Parameters: parameters,
+		Continues:  c.Continues,
+		files:      files,
+	})
+}
+
+// ReplyStream sends the values returned by next as replies to this method
+// call, until next reports that there are no more values. All values but the
+// last one are sent with continues, the last value is the final reply. After
+// a failed reply, the remaining values are discarded and the error is returned.
+// Without any value, the final reply has no parameters.
+func (c *Call) ReplyStream(next func() (interface{}, bool)) error {
+	var err error
+
+	last, ok := next()
+	if !ok {
+		c.Continues = false
+		return c.Reply(nil)
+	}
+
+	for {
+		value, ok := next()
+		if !ok {
+			break
+		}
+
+		if err == nil {
+			c.Continues = true
+			err = c.Reply(last)
+		}
+		last = value
+	}
+
+	c.Continues = false
+	if err != nil {
+		return err
+	}
+	return c.Reply(last)
+}
+
 // ReplyError sends an error reply to this method call.
 func (c *Call) ReplyError(name string, parameters interface{}) error {
 	r := strings.LastIndex(name, ".")
@@ -0,0 +1,26 @@
+package varlink
+
+import "net"
+
+// Conn is a connection to a varlink service, which the generated client code
+// sends its method calls with. It is implemented by Connection, tests can
+// replace it with their own implementation, or use NewPipe() to call a
+// service in memory.
+type Conn interface {
+	SendWithOptions(method string, parameters interface{}, opts ...CallOption) (func(interface{}) (uint64, error), error)
+	CallWithOptions(method string, parameters interface{}, out_parameters interface{}, opts ...CallOption) error
+	Close() error
+}
+
+var _ Conn = (*Connection)(nil)
+
+// NewPipe returns a connection to the service over an in-memory pipe, like
+// for the unit tests of a client with a service of fake methods. The service
+// does not need to listen, the calls are handled by its registered
+// interfaces. Closing the connection closes the pipe.
+func NewPipe(s *Service) *Connection {
+	client, server := net.Pipe()
+	go s.ServeConn(server)
+
+	return NewConnectionFromConn(client)
+}
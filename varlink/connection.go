@@ -2,24 +2,38 @@ package varlink
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"net"
+	"net/url"
+	"os"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/varlink/go/varlink/idl"
 )
 
 // Message flags for Send(). More indicates that the client accepts more than one method
 // reply to this call. Oneway requests, that the service must not send a method reply to
-// this call. Continues indicates that the service will send more than one reply.
+// this call. Continues indicates that the service will send more than one reply. Upgrade
+// requests, that the connection is handed over to a different protocol after the reply,
+// it is sent with Upgrade().
 const (
 	More      = 1 << iota
 	Oneway    = 1 << iota
 	Continues = 1 << iota
+	Upgrade   = 1 << iota
 )
 
-// Error is a varlink error returned from a method call.
+// Error is a varlink error returned from a method call, with the
+// fully-qualified name and the parameters of the error reply.
 type Error struct {
 	Name       string
-	Parameters interface{}
+	Parameters json.RawMessage
 }
 
 // Error returns the fully-qualified varlink error name.
@@ -27,107 +41,515 @@ func (e *Error) Error() string {
 	return e.Name
 }
 
-// Connection is a connection from a client to a service.
+// Is reports whether the target is a varlink error with the same name, like
+// errors.Is(err, &varlink.Error{Name: "org.varlink.service.MethodNotFound"}).
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Name == e.Name
+}
+
+// DecodeParameters decodes the parameters of the error reply into v.
+func (e *Error) DecodeParameters(v interface{}) error {
+	if e.Parameters == nil {
+		return fmt.Errorf("error %s has no parameters", e.Name)
+	}
+	return json.Unmarshal(e.Parameters, v)
+}
+
+// Connection is a connection from a client to a service. It can be used by
+// multiple goroutines, their calls are pipelined over the connection.
 type Connection struct {
 	address string
 	conn    net.Conn
 	reader  *bufio.Reader
 	writer  *bufio.Writer
+
+	// The sizes of the buffers of the reader and the writer, zero for
+	// the default size
+	readBufferSize  int
+	writeBufferSize int
+
+	// The maximum size of a reply, zero for no limit
+	maxMessageSize int
+
+	// Calls are encoded in buffers of callBuffers, unless pooling is
+	// disabled
+	disableBufferPool bool
+
+	// Replies with fields which the parameters of the call do not have
+	// fail, see WithDisallowUnknownFields()
+	disallowUnknownFields bool
+
+	// Numbers of the replies are decoded into interface{} values as
+	// json.Number, see WithUseNumber()
+	useNumber bool
+
+	// The options of the encoding of the calls, nil for the encoding of
+	// encoding/json
+	encoder *EncoderOptions
+
+	// The options to re-dial the address, for connections which reconnect
+	// after a failure. The generation counts the re-established transports.
+	dialOptions *dialOptions
+	broken      bool
+	closed      bool
+	generation  uint64
+
+	// The writes of the calls are serialized, the mutex protects the queue
+	// of the calls waiting for replies and the state of the transport.
+	writeMutex sync.Mutex
+	mutex      sync.Mutex
+	pipeline
+
+	// After Shutdown(), new calls fail
+	shutdown bool
+
+	// After an upgraded call, the transport belongs to the protocol of the
+	// service until it is released
+	upgraded bool
+
+	keepalive     *keepalive
+	lastUsed      time.Time
+	keepaliveErr  error
+	stopKeepalive chan struct{}
+
+	interceptors []Interceptor
+	tracers      []Tracer
+	logger       eventLogger
+	retry        *Retry
+	validator    *validator
+
+	stateHook func(state ConnectionState, err error)
+	state     ConnectionState
+	states    []stateChange
+}
+
+// CallOption configures a method call sent with SendWithOptions().
+type CallOption func(*callOptions)
+
+type callOptions struct {
+	flags    uint64
+	timeout  time.Duration
+	deadline time.Time
+	ctx      context.Context
+
+	files         []*os.File
+	receivedFiles func(files []*os.File)
+	idempotent    bool
+	unknownFields func(fields map[string]json.RawMessage)
+	traceContext  map[string]string
+
+	// The size of the messages of the call, for the tracers
+	sentBytes     int
+	receivedBytes int
+}
+
+// deadlineFrom returns the deadline of the next read or write started at now,
+// or the zero time without a deadline.
+func (o *callOptions) deadlineFrom(now time.Time) time.Time {
+	deadline := o.deadline
+	if o.timeout > 0 {
+		if d := now.Add(o.timeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	if o.ctx != nil {
+		if d, ok := o.ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+			deadline = d
+		}
+	}
+	return deadline
+}
+
+// WithMore requests multiple replies to the call, see the `More` flag.
+func WithMore() CallOption {
+	return func(o *callOptions) {
+		o.flags |= More
+	}
+}
+
+// WithOneway requests that the service does not reply to the call, see the `Oneway` flag.
+func WithOneway() CallOption {
+	return func(o *callOptions) {
+		o.flags |= Oneway
+	}
+}
+
+// WithFlags adds message flags to the call.
+func WithFlags(flags uint64) CallOption {
+	return func(o *callOptions) {
+		o.flags |= flags
+	}
+}
+
+// WithTimeout limits the time to send the call and the time to receive every
+// single reply. A call which timed out while it was sent leaves the connection
+// unusable. After a timeout while receiving, the remaining replies of the call
+// are discarded.
+func WithTimeout(timeout time.Duration) CallOption {
+	return func(o *callOptions) {
+		o.timeout = timeout
+	}
+}
+
+// WithDeadline limits the time until the call is sent and all its replies are
+// received, with the same effects on the connection as WithTimeout.
+func WithDeadline(deadline time.Time) CallOption {
+	return func(o *callOptions) {
+		o.deadline = deadline
+	}
+}
+
+// WithContext limits the call to the deadline of the context, and aborts the
+// sending and receiving when the context is canceled, like a timeout. The
+// error of an aborted call is the error of the context.
+func WithContext(ctx context.Context) CallOption {
+	return func(o *callOptions) {
+		o.ctx = ctx
+	}
+}
+
+// contextError returns the error of the context of an aborted call instead of
+// the timeout of the connection.
+func (o *callOptions) contextError(err error) error {
+	if o.ctx != nil && o.ctx.Err() != nil {
+		return o.ctx.Err()
+	}
+	return err
 }
 
 // Send sends a method call. It returns a receive() function which is called to retrieve the method reply.
 // If Send() is called with the `More`flag and the receive() function carries the `Continues` flag, receive()
 // can be called multiple times to retrieve multiple replies.
 func (c *Connection) Send(method string, parameters interface{}, flags uint64) (func(interface{}) (uint64, error), error) {
+	return c.SendWithOptions(method, parameters, WithFlags(flags))
+}
+
+// SendWithOptions sends a method call like Send(), the call is configured with
+// CallOption values instead of message flags. Calls can be sent from multiple
+// goroutines, one call is written at a time and the replies are routed to the
+// receive() functions of their calls.
+func (c *Connection) SendWithOptions(method string, parameters interface{}, opts ...CallOption) (func(interface{}) (uint64, error), error) {
+	var o callOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	c.mutex.Lock()
+	interceptors := c.interceptors
+	c.mutex.Unlock()
+	if len(interceptors) > 0 {
+		return c.intercept(interceptors, method, parameters, o)
+	}
+
+	return c.sendWithOptions(method, parameters, &o)
+}
+
+// Receiver is the receive() function of a method call returned by Send() and
+// SendWithOptions(), like varlink.Receiver(receive).
+type Receiver func(out_parameters interface{}) (uint64, error)
+
+// ReceiveContext receives the next reply of the call like receive(), and
+// aborts the waiting for the reply when the context is done, also when
+// another call reads from the transport. The error of an aborted receive is
+// the error of the context, the call is abandoned and its remaining replies
+// are discarded, like with WithContext(). Unlike WithContext(), the context
+// only limits the waiting for this reply.
+func (r Receiver) ReceiveContext(ctx context.Context, out_parameters interface{}) (uint64, error) {
+	return r(&contextParameters{ctx: ctx, out: out_parameters})
+}
+
+// contextParameters passes the context of ReceiveContext() through the
+// receive() functions of the interceptors, the tracers and the retry policy
+// to the receiving of the reply.
+type contextParameters struct {
+	ctx context.Context
+	out interface{}
+}
+
+func (c *Connection) sendWithOptions(method string, parameters interface{}, o *callOptions) (func(interface{}) (uint64, error), error) {
+	if c.validator != nil {
+		if err := c.validator.validate(c, method, parameters, o); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.retry != nil && o.idempotent {
+		return c.retryCall(method, parameters, o)
+	}
+
+	return c.traceCall(method, parameters, o)
+}
+
+func (c *Connection) sendCall(method string, parameters interface{}, o *callOptions) (func(interface{}) (uint64, error), error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if o.flags&Upgrade != 0 {
+		return nil, fmt.Errorf("upgraded calls are sent with Upgrade()")
+	}
+
+	c.mutex.Lock()
+	err := c.usable()
+	c.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.send(method, parameters, o)
+}
+
+// usable returns the error for a call which cannot be sent over the
+// connection. It is called with the mutex held.
+func (c *Connection) usable() error {
+	switch {
+	case c.closed, c.shutdown:
+		return errConnectionClosed
+	case c.upgraded:
+		return errConnectionUpgraded
+	}
+	return c.keepaliveErr
+}
+
+// send writes the method call to the transport and returns the function which
+// reads its replies. It is called with the write mutex held.
+func (c *Connection) send(method string, parameters interface{}, o *callOptions) (func(interface{}) (uint64, error), error) {
+	flags := o.flags
+
 	type call struct {
 		Method     string      `json:"method"`
 		Parameters interface{} `json:"parameters,omitempty"`
 		More       bool        `json:"more,omitempty"`
 		Oneway     bool        `json:"oneway,omitempty"`
+		Upgrade    bool        `json:"upgrade,omitempty"`
 	}
 
 	if (flags&More != 0) && (flags&Oneway != 0) {
 		return nil, &Error{
 			Name:       "org.varlink.InvalidParameter",
-			Parameters: "oneway",
+			Parameters: json.RawMessage(`{"parameter":"oneway"}`),
 		}
 	}
 
+	parameters = c.encoder.parameters(parameters)
+	if o.traceContext != nil {
+		parameters = traceParameters{parameters: parameters, carrier: o.traceContext, encoder: c.encoder}
+	}
+
 	m := call{
 		Method:     method,
 		Parameters: parameters,
 		More:       flags&More != 0,
 		Oneway:     flags&Oneway != 0,
+		Upgrade:    flags&Upgrade != 0,
 	}
-	b, err := json.Marshal(m)
+	buf := c.callBuffer()
+	defer c.releaseBuffer(buf)
+	err := c.encoder.encode(buf, m)
 	if err != nil {
 		return nil, err
 	}
+	b := buf.Bytes()
 
-	b = append(b, 0)
-	_, err = c.writer.Write(b)
-	if err != nil {
-		return nil, err
+	if o.ctx != nil && o.ctx.Err() != nil {
+		return nil, o.ctx.Err()
 	}
 
-	err = c.writer.Flush()
-	if err != nil {
-		return nil, err
+	c.mutex.Lock()
+	broken := c.broken && !c.closed
+	c.mutex.Unlock()
+	if broken {
+		if err := c.redial(o); err != nil {
+			return nil, err
+		}
 	}
 
-	receive := func(out_parameters interface{}) (uint64, error) {
-		type reply struct {
-			Parameters *json.RawMessage `json:"parameters"`
-			Continues  bool             `json:"continues"`
-			Error      string           `json:"error"`
-		}
+	// The call is queued before it is written, the reply might be read by
+	// the caller of another goroutine before the write returns.
+	c.mutex.Lock()
+	conn, writer, generation := c.conn, c.writer, c.generation
+	t, ok := conn.(fileTransport)
+	if len(o.files) > 0 && !ok {
+		c.mutex.Unlock()
+		return nil, fmt.Errorf("files can only be passed over unix sockets")
+	}
+	var p *pendingCall
+	if !m.Oneway {
+		p = c.enqueue(m.More)
+	}
+	c.mutex.Unlock()
 
-		out, err := c.reader.ReadBytes('\x00')
-		if err != nil {
-			return 0, err
-		}
+	deadline := o.deadlineFrom(time.Now())
+	if !deadline.IsZero() {
+		conn.SetWriteDeadline(deadline)
+	}
+	stop := abortOnDone(o.ctx, conn.SetWriteDeadline)
 
-		var m reply
-		err = json.Unmarshal(out[:len(out)-1], &m)
-		if err != nil {
-			return 0, err
+	if len(o.files) > 0 {
+		err = writer.Flush()
+		if err == nil {
+			err = t.writeWithFiles(b, o.files)
 		}
-
-		if m.Error != "" {
-			err = &Error{
-				Name:       m.Error,
-				Parameters: m.Parameters,
-			}
-			return 0, err
+	} else {
+		_, err = writer.Write(b)
+		if err == nil {
+			err = writer.Flush()
 		}
+	}
+	stop()
+	if !deadline.IsZero() || o.ctx != nil {
+		conn.SetWriteDeadline(time.Time{})
+	}
 
-		if m.Parameters != nil {
-			json.Unmarshal(*m.Parameters, out_parameters)
+	// A partially written call leaves the connection unusable
+	if err != nil {
+		c.mutex.Lock()
+		if generation == c.generation {
+			c.failCalls(err)
 		}
-
-		if m.Continues {
-			return Continues, nil
+		if c.closed {
+			err = errConnectionClosed
 		}
+		c.mutex.Unlock()
+		return nil, o.contextError(err)
+	}
+	o.sentBytes = len(b)
+
+	if p == nil {
+		return func(interface{}) (uint64, error) {
+			return 0, fmt.Errorf("oneway call does not receive replies")
+		}, nil
+	}
+
+	return func(out_parameters interface{}) (uint64, error) {
+		return c.receive(p, o, out_parameters)
+	}, nil
+}
+
+// callBuffers are the buffers to encode method calls, shared by all
+// connections. Buffers larger than maxPooledBuffer are not returned to the
+// pool, to not keep the memory of occasional large calls.
+var callBuffers = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
 
-		return 0, nil
+const maxPooledBuffer = 64 * 1024
+
+// callBuffer returns an empty buffer to encode a method call.
+func (c *Connection) callBuffer() *bytes.Buffer {
+	if c.disableBufferPool {
+		return new(bytes.Buffer)
 	}
 
-	return receive, nil
+	buf := callBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
 }
 
-// Call sends a method call and returns the method reply.
+// releaseBuffer returns the buffer of a sent method call to the pool.
+func (c *Connection) releaseBuffer(buf *bytes.Buffer) {
+	if c.disableBufferPool || buf.Cap() > maxPooledBuffer {
+		return
+	}
+	callBuffers.Put(buf)
+}
+
+// Call sends a method call and returns the method reply. An error reply of the
+// service is returned as *Error.
 func (c *Connection) Call(method string, parameters interface{}, out_parameters interface{}) error {
-	receive, err := c.Send(method, &parameters, 0)
+	return c.CallWithOptions(method, parameters, out_parameters)
+}
+
+// CallWithOptions sends a method call configured with CallOption values like
+// SendWithOptions(), and returns the method reply like Call(). A call with the
+// Oneway flag returns after it was sent, calls with the More flag need to
+// receive their replies with SendWithOptions().
+func (c *Connection) CallWithOptions(method string, parameters interface{}, out_parameters interface{}, opts ...CallOption) error {
+	var o callOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.flags&More != 0 {
+		return fmt.Errorf("call with more replies, use SendWithOptions()")
+	}
+
+	receive, err := c.SendWithOptions(method, parameters, opts...)
+	if err != nil || o.flags&Oneway != 0 {
+		return err
+	}
+
+	flags, err := receive(out_parameters)
+	if err != nil || flags&Continues == 0 {
+		return err
+	}
+
+	// The remaining replies are discarded, they would be read by the
+	// following calls otherwise
+	for err == nil && flags&Continues != 0 {
+		var discard json.RawMessage
+		flags, err = receive(&discard)
+	}
 	if err != nil {
 		return err
 	}
+	return fmt.Errorf("service sent more than one reply to the call of %s", method)
+}
 
-	_, err = receive(out_parameters)
-	return err
+// Stream sends a method call with the More flag and returns a channel with
+// the parameters of the replies. The channel is closed after the last reply,
+// or after an error, which is sent to the error channel before it is closed.
+// Canceling the context stops the stream and discards its remaining replies,
+// AbortStream() stops a service which streams its replies without end.
+func (c *Connection) Stream(ctx context.Context, method string, parameters interface{}, opts ...CallOption) (<-chan json.RawMessage, <-chan error) {
+	replies := make(chan json.RawMessage)
+	errs := make(chan error, 1)
+
+	receive, err := c.SendWithOptions(method, parameters, append(opts[:len(opts):len(opts)], WithMore(), WithContext(ctx))...)
+	if err != nil {
+		close(replies)
+		errs <- err
+		close(errs)
+		return replies, errs
+	}
+
+	go func() {
+		defer close(errs)
+		defer close(replies)
+
+		for {
+			var reply json.RawMessage
+			flags, err := receive(&reply)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			select {
+			case replies <- reply:
+			case <-ctx.Done():
+				// The canceled call discards its replies
+				receive(nil)
+				errs <- ctx.Err()
+				return
+			}
+
+			if flags&Continues == 0 {
+				return
+			}
+		}
+	}()
+
+	return replies, errs
 }
 
 // GetInterfaceDescription requests the interface description string from the service.
 func (c *Connection) GetInterfaceDescription(name string) (string, error) {
+	return c.getInterfaceDescription(name)
+}
+
+func (c *Connection) getInterfaceDescription(name string, opts ...CallOption) (string, error) {
 	type request struct {
 		Interface string `json:"interface"`
 	}
@@ -136,7 +558,7 @@ func (c *Connection) GetInterfaceDescription(name string) (string, error) {
 	}
 
 	var r reply
-	err := c.Call("org.varlink.service.GetInterfaceDescription", request{Interface: name}, &r)
+	err := c.CallWithOptions("org.varlink.service.GetInterfaceDescription", request{Interface: name}, &r, opts...)
 	if err != nil {
 		return "", err
 	}
@@ -144,36 +566,67 @@ func (c *Connection) GetInterfaceDescription(name string) (string, error) {
 	return r.Description, nil
 }
 
-// GetInfo requests information about the service.
-func (c *Connection) GetInfo(vendor *string, product *string, version *string, url *string, interfaces *[]string) error {
-	type reply struct {
-		Vendor     string   `json:"vendor"`
-		Product    string   `json:"product"`
-		Version    string   `json:"version"`
-		URL        string   `json:"url"`
-		Interfaces []string `json:"interfaces"`
+// GetInterface requests the description of the interface from the service and
+// returns the parsed interface. A description which cannot be parsed, or which
+// describes another interface, returns an error.
+func (c *Connection) GetInterface(name string, opts ...CallOption) (*idl.IDL, error) {
+	description, err := c.getInterfaceDescription(name, opts...)
+	if err != nil {
+		return nil, err
 	}
 
-	var r reply
-	err := c.Call("org.varlink.service.GetInfo", nil, &r)
+	i, err := idl.New(strings.TrimRight(description, "\n"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid description of interface %s: %v", name, err)
+	}
+	if i.Name != name {
+		return nil, fmt.Errorf("service returned the description of interface %s for %s", i.Name, name)
+	}
+	return i, nil
+}
+
+// ServiceInfo is the information about a service and the interfaces it
+// implements.
+type ServiceInfo struct {
+	Vendor     string   `json:"vendor"`
+	Product    string   `json:"product"`
+	Version    string   `json:"version"`
+	URL        string   `json:"url"`
+	Interfaces []string `json:"interfaces"`
+}
+
+// GetServiceInfo requests information about the service.
+func (c *Connection) GetServiceInfo(opts ...CallOption) (*ServiceInfo, error) {
+	var info ServiceInfo
+	err := c.CallWithOptions("org.varlink.service.GetInfo", nil, &info, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// GetInfo requests information about the service.
+func (c *Connection) GetInfo(vendor *string, product *string, version *string, url *string, interfaces *[]string) error {
+	info, err := c.GetServiceInfo()
 	if err != nil {
 		return err
 	}
 
 	if vendor != nil {
-		*vendor = r.Vendor
+		*vendor = info.Vendor
 	}
 	if product != nil {
-		*product = r.Product
+		*product = info.Product
 	}
 	if version != nil {
-		*version = r.Version
+		*version = info.Version
 	}
 	if url != nil {
-		*url = r.URL
+		*url = info.URL
 	}
 	if interfaces != nil {
-		*interfaces = r.Interfaces
+		*interfaces = info.Interfaces
 	}
 
 	return nil
@@ -181,40 +634,467 @@ func (c *Connection) GetInfo(vendor *string, product *string, version *string, u
 
 // Close terminates the connection.
 func (c *Connection) Close() error {
-	return c.conn.Close()
+	c.mutex.Lock()
+	conn := c.conn
+	if !c.closed && c.stopKeepalive != nil {
+		close(c.stopKeepalive)
+	}
+	c.closed = true
+	c.setState(StateClosed, nil)
+	c.mutex.Unlock()
+
+	return conn.Close()
 }
 
-// NewConnection returns a new connection to the given address.
-func NewConnection(address string) (*Connection, error) {
+// Shutdown closes the connection after the calls which wait for replies
+// received their last reply. New calls fail like on a closed connection. The
+// remaining replies of the calls are read while their callers are not
+// receiving them, the replies remain to be received after the connection is
+// closed. If the context is done before, the remaining calls fail, the
+// connection is closed, and the error of the context is returned.
+func (c *Connection) Shutdown(ctx context.Context) error {
+	c.mutex.Lock()
+	c.shutdown = true
 	var err error
+	for len(c.calls) > 0 && !c.closed && err == nil {
+		if !c.reading {
+			o := callOptions{ctx: ctx}
+			if rerr := c.readReply(&o); rerr != nil {
+				err = o.contextError(rerr)
+				if e, ok := err.(net.Error); ok && e.Timeout() {
+					// The read deadline of the context passed before
+					// the context is done
+					if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+						err = context.DeadlineExceeded
+					}
+				}
+				break
+			}
+			continue
+		}
+
+		changed := c.waitChannel()
+		c.mutex.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		c.mutex.Lock()
+	}
+	if err == nil && len(c.calls) > 0 {
+		err = errConnectionClosed
+	}
+	c.mutex.Unlock()
+
+	c.Close()
+	return err
+}
+
+// DialOption configures a connection established with DialContext().
+type DialOption func(*dialOptions)
+
+type dialOptions struct {
+	tlsConfig     *tls.Config
+	dial          DialFunc
+	reconnect     *backoff
+	reconnectHook func(attempt int, err error)
+	keepalive     *keepalive
+	interceptors  []Interceptor
+	tracers       []Tracer
+	logger        eventLogger
+	retry         *Retry
+	validator     *validator
+	recorder      *recorder
+	proxy         *url.URL
+	stateHook     func(state ConnectionState, err error)
+
+	readBufferSize        int
+	writeBufferSize       int
+	maxMessageSize        int
+	disableBufferPool     bool
+	disallowUnknownFields bool
+	useNumber             bool
+	encoder               *EncoderOptions
+}
+
+// DialFunc establishes the transport of a connection. It is called with the
+// protocol and the address of a varlink address like "unix:/run/org.example",
+// the protocol of tcp+tls: addresses is "tcp".
+type DialFunc func(ctx context.Context, protocol string, address string) (net.Conn, error)
+
+// WithDialFunc replaces the dialer of the unix, tcp, vsock, npipe, exec and
+// bridge protocols, and of the protocols of RegisterTransport(). With a
+// DialFunc, any protocol can be used in the address, like for serial lines,
+// QUIC streams or test pipes.
+func WithDialFunc(dial DialFunc) DialOption {
+	return func(o *dialOptions) {
+		o.dial = dial
+	}
+}
+
+// WithBufferSizes sets the sizes of the buffers to read the replies and to
+// write the calls of the connection, a size of zero keeps the default size of
+// 4096 bytes. Larger buffers reduce the number of reads and writes of large
+// messages.
+func WithBufferSizes(read int, write int) DialOption {
+	return func(o *dialOptions) {
+		o.readBufferSize = read
+		o.writeBufferSize = write
+	}
+}
+
+// WithMaxMessageSize limits the size of a single reply received by the
+// connection, without the limit a service can send replies of any size. A
+// larger reply fails the calls waiting for replies, and the transport is
+// closed.
+func WithMaxMessageSize(size int) DialOption {
+	return func(o *dialOptions) {
+		o.maxMessageSize = size
+	}
+}
+
+// WithBufferPool enables or disables the pooling of the buffers which encode
+// the method calls of the connection. The buffers are pooled by default, to
+// not allocate a new buffer for every call of clients with a high rate of
+// calls. Without pooling, every call is encoded in a new buffer, which can
+// help to debug the memory of the calls.
+func WithBufferPool(enabled bool) DialOption {
+	return func(o *dialOptions) {
+		o.disableBufferPool = !enabled
+	}
+}
+
+// WithDisallowUnknownFields enables the strict decoding of the replies of the
+// connection. A reply with a field which the parameters of the call do not
+// have, or with a parameter of the wrong type, fails the call, instead of
+// being silently dropped. The strict mode catches the drift between the
+// replies of a service and the structs of its client, like in integration
+// tests.
+func WithDisallowUnknownFields() DialOption {
+	return func(o *dialOptions) {
+		o.disallowUnknownFields = true
+	}
+}
+
+// WithUseNumber decodes the numbers of the replies into the interface{}
+// values of the parameters, like the values of a map[string]interface{}, as
+// json.Number instead of float64. The integers above 2^53, like IDs and
+// sizes, keep their precision; Int64() and Uint64() convert the values.
+func WithUseNumber() DialOption {
+	return func(o *dialOptions) {
+		o.useNumber = true
+	}
+}
+
+// WithTLSConfig sets the configuration of the TLS client for tcp+tls:
+// addresses. The client authenticates with the Certificates of the
+// configuration, if the service requests it. Without a configuration, the
+// certificate of the service is verified with the system roots.
+func WithTLSConfig(config *tls.Config) DialOption {
+	return func(o *dialOptions) {
+		o.tlsConfig = config
+	}
+}
+
+// DialContext returns a new connection to the given address. The context
+// limits the time to establish the connection, including the TLS handshake,
+// it does not affect the method calls on the returned connection. On Linux,
+// unix:@name addresses connect to sockets in the abstract namespace. On
+// Windows, npipe: addresses connect to named pipes, like
+// npipe:org.example.service for \\.\pipe\org.example.service.
+//
+// The exec:path args and bridge:command addresses start a process and send
+// the method calls over its standard input and output. The bridge command is
+// run by /bin/sh, like bridge:ssh host varlink bridge to call the services of
+// a remote host. The process is terminated when the connection is closed.
+//
+// A bridge: address which is followed by another address, like
+// bridge:unix:/run/hostproxy, connects to a bridge service at the address,
+// which forwards the calls to the services it reaches, like a proxy which
+// passes the calls of a container to the services of the host.
+func DialContext(ctx context.Context, address string, opts ...DialOption) (*Connection, error) {
+	var o dialOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	conn, err := dialTransport(ctx, address, &o)
+	logResult(o.logger, connectionEvent, "varlink dial", err, "address", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDialedConnection(conn, address, &o), nil
+}
+
+// The last address of the addresses of DialAny() which was dialed, by the
+// addresses
+var dialedAddresses sync.Map
+
+// DialAny returns a new connection to the first of the addresses which can be
+// dialed, like the abstract and the filesystem socket of a service, and a tcp
+// address, which differ between the installations of a service. The address of
+// the connection is the one which was dialed, it is re-dialed by
+// WithReconnect(). The address is remembered, later calls with the same
+// addresses try it first. If no address can be dialed, the error lists the
+// errors of all addresses.
+func DialAny(ctx context.Context, addresses []string, opts ...DialOption) (*Connection, error) {
+	var o dialOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no address to dial")
+	}
+
+	key := strings.Join(addresses, "\n")
+	candidates := addresses
+	if last, ok := dialedAddresses.Load(key); ok {
+		candidates = append([]string{last.(string)}, addresses...)
+	}
 
+	var errs []string
+	tried := make(map[string]bool)
+	for _, address := range candidates {
+		if tried[address] {
+			continue
+		}
+		tried[address] = true
+
+		conn, err := dialTransport(ctx, address, &o)
+		logResult(o.logger, connectionEvent, "varlink dial", err, "address", address)
+		if err == nil {
+			dialedAddresses.Store(key, address)
+			return newDialedConnection(conn, address, &o), nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", address, err))
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+
+	return nil, fmt.Errorf("cannot dial any address: %s", strings.Join(errs, "; "))
+}
+
+// Address returns the address which the connection was dialed with, or "" for
+// the connections of NewConnectionFromConn().
+func (c *Connection) Address() string {
+	return c.address
+}
+
+// newDialedConnection returns the connection of the dialed transport,
+// configured with the dial options.
+func newDialedConnection(conn net.Conn, address string, o *dialOptions) *Connection {
+	c := NewConnectionFromConn(conn)
+	c.address = address
+	if o.readBufferSize > 0 || o.writeBufferSize > 0 {
+		c.readBufferSize = o.readBufferSize
+		c.writeBufferSize = o.writeBufferSize
+		c.reader, c.writer = c.newBuffers(c.conn)
+	}
+	c.maxMessageSize = o.maxMessageSize
+	c.disableBufferPool = o.disableBufferPool
+	c.disallowUnknownFields = o.disallowUnknownFields
+	c.useNumber = o.useNumber
+	c.encoder = o.encoder
+	if o.reconnect != nil {
+		c.dialOptions = o
+	}
+	c.interceptors = o.interceptors
+	c.tracers = o.tracers
+	c.logger = o.logger
+	c.retry = o.retry
+	c.validator = o.validator
+	if o.stateHook != nil {
+		c.stateHook = o.stateHook
+		c.mutex.Lock()
+		c.queueState(StateConnected, nil)
+		c.mutex.Unlock()
+	}
+	if o.keepalive != nil {
+		c.startKeepalive(o.keepalive)
+	}
+
+	return c
+}
+
+// dialTransport establishes the transport of a connection to the address.
+func dialTransport(ctx context.Context, address string, o *dialOptions) (net.Conn, error) {
 	words := strings.SplitN(address, ":", 2)
+	if len(words) != 2 {
+		return nil, fmt.Errorf("invalid address '%s'", address)
+	}
 	protocol := words[0]
 	addr := words[1]
 
-	// Ignore parameters after ';'
-	words = strings.SplitN(addr, ";", 2)
-	if words != nil {
+	// The calls to a bridge:address are forwarded by the bridge service
+	// at the address
+	if protocol == "bridge" && isAddress(addr) {
+		return dialTransport(ctx, addr, o)
+	}
+
+	// Ignore parameters after ';', the command line of a bridge may
+	// contain it
+	if protocol != "bridge" {
+		words = strings.SplitN(addr, ";", 2)
 		addr = words[0]
 	}
 
+	network := protocol
 	switch protocol {
 	case "unix":
-		break
+		if err := checkUnixAddress(addr); err != nil {
+			return nil, err
+		}
 
-	case "tcp":
-		break
+	case "tcp+tls":
+		network = "tcp"
 	}
 
-	c := Connection{}
-	c.conn, err = net.Dial(protocol, addr)
+	dial := o.dial
+	if dial == nil {
+		dial = registeredTransport(protocol)
+	}
+	if dial == nil {
+		switch protocol {
+		case "vsock":
+			dial = dialVsock
+		case "npipe":
+			dial = dialPipe
+		case "exec", "bridge":
+			dial = dialCommand
+		default:
+			var d net.Dialer
+			dial = d.DialContext
+		}
+	}
+
+	var conn net.Conn
+	var err error
+	if o.proxy != nil && network == "tcp" {
+		conn, err = dialProxy(ctx, o.proxy, dial, addr)
+	} else {
+		conn, err = dial(ctx, network, addr)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	c.address = address
-	c.reader = bufio.NewReader(c.conn)
-	c.writer = bufio.NewWriter(c.conn)
+	if protocol == "tcp+tls" {
+		conn, err = tlsHandshake(ctx, conn, addr, o.tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if o.recorder != nil {
+		conn = o.recorder.wrap(conn)
+	}
+
+	return conn, nil
+}
 
-	return &c, nil
+// NewConnectionFromConn returns a new connection which sends the method calls
+// over conn. The connection takes ownership of conn, it is closed with the
+// connection.
+func NewConnectionFromConn(conn net.Conn) *Connection {
+	c := &Connection{
+		conn: newTransport(conn),
+	}
+	c.reader, c.writer = c.newBuffers(c.conn)
+
+	return c
+}
+
+// newBuffers returns the buffered reader and writer of the transport.
+func (c *Connection) newBuffers(conn net.Conn) (*bufio.Reader, *bufio.Writer) {
+	reader := bufio.NewReader(conn)
+	if c.readBufferSize > 0 {
+		reader = bufio.NewReaderSize(conn, c.readBufferSize)
+	}
+	writer := bufio.NewWriter(conn)
+	if c.writeBufferSize > 0 {
+		writer = bufio.NewWriterSize(conn, c.writeBufferSize)
+	}
+
+	return reader, writer
+}
+
+// NewConnectionFromFd returns a new connection which sends the method calls
+// over the socket with the file descriptor fd, like one end of a socketpair
+// shared with a child process, or an inherited socket. The connection takes
+// ownership of fd, it is closed with the connection, or when the connection
+// cannot be created.
+func NewConnectionFromFd(fd uintptr) (*Connection, error) {
+	file := os.NewFile(fd, "varlink")
+	if file == nil {
+		return nil, fmt.Errorf("invalid file descriptor %d", int(fd))
+	}
+	defer file.Close()
+
+	conn, err := net.FileConn(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewConnectionFromConn(conn), nil
+}
+
+// tlsHandshake returns the TLS client connection on top of conn after the
+// handshake, or closes conn if the handshake fails.
+func tlsHandshake(ctx context.Context, conn net.Conn, addr string, config *tls.Config) (net.Conn, error) {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// Abort the handshake when the context is canceled
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	t := tls.Client(conn, config)
+	err := t.Handshake()
+	close(stop)
+	<-stopped
+
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return t, nil
+}
+
+// NewConnection returns a new connection to the given address.
+//
+// Deprecated: NewConnection can neither be canceled nor time out, use
+// DialContext.
+func NewConnection(address string) (*Connection, error) {
+	return DialContext(context.Background(), address)
 }
@@ -0,0 +1,37 @@
+package varlink
+
+import (
+	"crypto/x509"
+	"fmt"
+)
+
+// PeerCredentials are the credentials of the process which connected to a
+// unix socket of the service, at the time it connected, like for the
+// authorization of local clients.
+type PeerCredentials struct {
+	UID uint32
+	GID uint32
+	PID int32
+}
+
+// PeerCredentials returns the credentials of the process which connected to
+// the service over a unix socket. It fails for the other connections, and on
+// the systems without SO_PEERCRED.
+func (c *Call) PeerCredentials() (*PeerCredentials, error) {
+	if c.conn == nil || c.conn.conn == nil {
+		return nil, fmt.Errorf("call has no connection")
+	}
+	return c.conn.credentials, c.conn.credentialsError
+}
+
+// PeerCertificate returns the verified certificate of a client which connected
+// to a tcp+tls: address, if the TLS configuration of the service verifies the
+// client certificates, like with tls.RequireAndVerifyClientCert. It returns
+// nil for the other connections.
+func (c *Call) PeerCertificate() *x509.Certificate {
+	state := c.Peer().TLS
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package varlink
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+func peerCredentials(conn net.Conn) (*PeerCredentials, error) {
+	return nil, fmt.Errorf("peer credentials are not supported on %s", runtime.GOOS)
+}
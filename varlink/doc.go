@@ -58,6 +58,12 @@ Service implementing the interface and its method:
 	)
 
 	service.RegisterInterface(orgexamplethis.VarlinkNew(&data))
-	err := service.Listen("unix:/run/org.example.this", 0)
+	err := service.RunContext(context.Background(), "unix:/run/org.example.this")
+
+A Connection is safe for concurrent use by multiple goroutines. Every call is
+written as a whole, and the replies are routed to the receive() function of
+their call, in the order the calls were sent. The service handles the calls of
+one connection one after the other; a Pool spreads the calls of concurrent
+clients over multiple connections.
 */
 package varlink
@@ -0,0 +1,266 @@
+package varlink
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// The error of the streaming calls which are aborted by ShutdownContext()
+const errorServiceShutdown = "org.varlink.ServiceShutdown"
+
+// serviceConn is a connection of a service.
+type serviceConn struct {
+	conn   net.Conn
+	writer *bufio.Writer
+
+	// Serializes the replies of the call with the error reply of
+	// ShutdownContext()
+	writeMutex sync.Mutex
+
+	// Whether a method call is handled, and whether it wants more than one
+	// reply. They are protected by the mutex of the service.
+	busy bool
+	more bool
+
+	// The writer of the write limits, or nil
+	connWriter *connWriter
+
+	// The credentials of the peer of a unix socket, when it connected
+	credentials      *PeerCredentials
+	credentialsError error
+
+	// The context of the connection, it is canceled when the connection
+	// is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// The context of the handled call, it is canceled when the client
+	// closed the connection or a reply failed. They are protected by the
+	// writeMutex.
+	callCtx    context.Context
+	cancelCall context.CancelFunc
+
+	// The files passed along with the handled call, which the method did
+	// not take. They are protected by the writeMutex.
+	files []*os.File
+
+	// The reader of the requests, and the channel which is closed when
+	// the watch of the handled call stopped reading it
+	reader  *bufio.Reader
+	watched <-chan struct{}
+
+	// Whether the connection belongs to the protocol of an upgraded
+	// call, it is protected by the writeMutex, and the channel which is
+	// closed when the connection is closed
+	upgraded  bool
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *Service) addConn(conn net.Conn) *serviceConn {
+	// The transport receives the files passed along with the calls
+	transport := newTransport(conn)
+	w := newConnWriter(transport, s.limits)
+	sc := &serviceConn{conn: transport, writer: bufio.NewWriter(w), closed: make(chan struct{})}
+	sc.connWriter, _ = w.(*connWriter)
+	sc.credentials, sc.credentialsError = peerCredentials(conn)
+	sc.ctx, sc.cancel = context.WithCancel(context.Background())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.conns == nil {
+		s.conns = make(map[*serviceConn]bool)
+	}
+	s.conns[sc] = true
+	return sc
+}
+
+func (s *Service) removeConn(sc *serviceConn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sc.cancel()
+	delete(s.conns, sc)
+	s.conncounter--
+	if s.conncounter == 0 && s.idleTimer != nil {
+		s.idleTimer.Reset(s.idleDuration)
+	}
+	s.notifyChanged()
+}
+
+// close closes the connection, after the buffered replies are written.
+func (sc *serviceConn) close() {
+	if sc.connWriter != nil {
+		sc.connWriter.close()
+	}
+	sc.closeConn()
+}
+
+// closeConn closes the connection right away.
+func (sc *serviceConn) closeConn() {
+	sc.closeOnce.Do(func() {
+		sc.conn.Close()
+		close(sc.closed)
+	})
+}
+
+// watchCall creates the context of the call which is handled next, and
+// cancels it when the client closes the connection while the call is handled,
+// like a client which gave up on a stream. The returned channel is closed when
+// the next request can be read from the reader.
+func (s *Service) watchCall(sc *serviceConn, reader *bufio.Reader) <-chan struct{} {
+	ctx, cancel := context.WithCancel(sc.ctx)
+	watched := make(chan struct{})
+	sc.writeMutex.Lock()
+	sc.callCtx, sc.cancelCall = ctx, cancel
+	sc.reader, sc.watched = reader, watched
+	sc.writeMutex.Unlock()
+
+	go func() {
+		defer close(watched)
+		if _, err := reader.Peek(1); err != nil {
+			cancel()
+		}
+	}()
+	return watched
+}
+
+// callContext returns the context of the handled call.
+func (sc *serviceConn) callContext() context.Context {
+	sc.writeMutex.Lock()
+	defer sc.writeMutex.Unlock()
+
+	if sc.callCtx != nil {
+		return sc.callCtx
+	}
+	return sc.ctx
+}
+
+// cancelCallContext cancels the context of the handled call, after one of its
+// replies could not be sent. It is called with the writeMutex held.
+func (sc *serviceConn) cancelCallContext() {
+	if sc.cancelCall != nil {
+		sc.cancelCall()
+	}
+}
+
+// endCall cancels the context of the call, after it was handled.
+func (sc *serviceConn) endCall() {
+	sc.writeMutex.Lock()
+	defer sc.writeMutex.Unlock()
+
+	sc.cancelCallContext()
+	sc.callCtx, sc.cancelCall = nil, nil
+	closeFiles(sc.files)
+	sc.files = nil
+}
+
+// beginCall marks the connection as busy with a method call. It returns false
+// if the service is shutting down, the connection is closed instead.
+func (s *Service) beginCall(sc *serviceConn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.draining {
+		return false
+	}
+	sc.busy = true
+	return true
+}
+
+// endCall marks the connection as waiting for a method call. It returns false
+// if the service is shutting down.
+func (s *Service) endCall(sc *serviceConn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sc.busy = false
+	sc.more = false
+	s.notifyChanged()
+	return !s.draining
+}
+
+// notifyChanged wakes up ShutdownContext(), and the connections and calls
+// which wait for the limits. It is called with the mutex held.
+func (s *Service) notifyChanged() {
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+}
+
+// ShutdownContext shuts down the service gracefully. It closes the listeners,
+// which removes the socket file of a unix: address, and the connections
+// which wait for a method call. The connections which handle a method call
+// are closed after the call is handled. When ctx is done before all calls are
+// handled, the calls which stream their replies get the error reply
+// org.varlink.ServiceShutdown, all connections are closed, and the error of
+// ctx is returned.
+func (s *Service) ShutdownContext(ctx context.Context) error {
+	s.mutex.Lock()
+	s.draining = true
+	s.running = false
+	s.notifyChanged()
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	for sc := range s.conns {
+		if !sc.busy {
+			sc.closeConn()
+		}
+	}
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		s.draining = false
+		s.mutex.Unlock()
+	}()
+
+	for {
+		s.mutex.Lock()
+		if len(s.conns) == 0 {
+			s.mutex.Unlock()
+			return nil
+		}
+		if s.changed == nil {
+			s.changed = make(chan struct{})
+		}
+		changed := s.changed
+		s.mutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			s.abortConns()
+			return ctx.Err()
+		}
+	}
+}
+
+// abortConns sends the error reply to the streaming calls, and closes all
+// connections. The reply waits up to a second for a blocked writer.
+func (s *Service) abortConns() {
+	s.mutex.Lock()
+	var streams []*serviceConn
+	for sc := range s.conns {
+		if sc.busy && sc.more {
+			streams = append(streams, sc)
+		} else {
+			sc.closeConn()
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, sc := range streams {
+		sc.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c := Call{writer: sc.writer, writeMutex: &sc.writeMutex, in: &serviceCall{}, encoder: s.encoder}
+		c.sendMessage(&serviceReply{Error: errorServiceShutdown})
+		sc.closeConn()
+	}
+}
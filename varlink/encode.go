@@ -0,0 +1,228 @@
+package varlink
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// EncoderOptions change the JSON encoding of the messages of a connection or
+// a service, for the peers which depend on the exact bytes of the messages.
+// The zero value is the encoding of encoding/json.
+type EncoderOptions struct {
+	// Keep the characters <, > and & of strings, instead of escaping
+	// them as \u003c, \u003e and \u0026
+	DisableHTMLEscaping bool
+
+	// Indent the messages with the string, like for the dumps of the
+	// messages while debugging
+	Indent string
+
+	// The layout of the time.Time fields of the parameters with the tag
+	// `varlink:"time"`, like time.RFC1123. The structs in interface{}
+	// values are not searched for the fields. Without a layout, times are
+	// encoded in RFC 3339 format.
+	TimeFormat string
+}
+
+// WithEncoderOptions sets the options of the JSON encoding of the method
+// calls of the connection.
+func WithEncoderOptions(options EncoderOptions) DialOption {
+	return func(o *dialOptions) {
+		o.encoder = &options
+	}
+}
+
+// encode writes the JSON message v, terminated by the zero byte, to buf.
+func (o *EncoderOptions) encode(buf *bytes.Buffer, v interface{}) error {
+	e := json.NewEncoder(buf)
+	if o != nil {
+		e.SetEscapeHTML(!o.DisableHTMLEscaping)
+		if o.Indent != "" {
+			e.SetIndent("", o.Indent)
+		}
+	}
+	if err := e.Encode(v); err != nil {
+		return err
+	}
+
+	// The newline of the encoder is replaced by the zero byte which
+	// terminates the message
+	b := buf.Bytes()
+	b[len(b)-1] = 0
+	return nil
+}
+
+// parameters returns the parameters with the TimeFormat of their annotated
+// time.Time fields.
+func (o *EncoderOptions) parameters(parameters interface{}) interface{} {
+	if o == nil || o.TimeFormat == "" || parameters == nil {
+		return parameters
+	}
+
+	v := reflect.ValueOf(parameters)
+	t := timeFormatType(v.Type(), make(map[reflect.Type]bool))
+	if t == v.Type() {
+		return parameters
+	}
+	return formatTimes(v, t, o.TimeFormat).Interface()
+}
+
+// formattedTime is the type of the annotated time.Time fields in the types of
+// timeFormatType(), it encodes the time with the layout.
+type formattedTime struct {
+	time   time.Time
+	layout string
+}
+
+func (t formattedTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.time.Format(t.layout))
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	formattedTimeType = reflect.TypeOf(formattedTime{})
+	marshalerType     = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+	// The types of timeFormatType(), by the type of the parameters
+	timeFormatTypes sync.Map
+)
+
+// timeFormatType returns the type with the annotated time.Time fields of the
+// structs of t replaced by formattedTime, or t if it has none. The structs
+// are replaced by structs with their exported fields. The types which are
+// marshalers, and the structs which embed unexported structs, are kept.
+// The types in visiting are recursive, they are kept.
+func timeFormatType(t reflect.Type, visiting map[reflect.Type]bool) reflect.Type {
+	if cached, ok := timeFormatTypes.Load(t); ok {
+		return cached.(reflect.Type)
+	}
+	if visiting[t] || t.Implements(marshalerType) || reflect.PtrTo(t).Implements(marshalerType) {
+		return t
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+
+	to := t
+	switch t.Kind() {
+	case reflect.Ptr:
+		if e := timeFormatType(t.Elem(), visiting); e != t.Elem() {
+			to = reflect.PtrTo(e)
+		}
+
+	case reflect.Slice:
+		if e := timeFormatType(t.Elem(), visiting); e != t.Elem() {
+			to = reflect.SliceOf(e)
+		}
+
+	case reflect.Array:
+		if e := timeFormatType(t.Elem(), visiting); e != t.Elem() {
+			to = reflect.ArrayOf(t.Len(), e)
+		}
+
+	case reflect.Map:
+		if e := timeFormatType(t.Elem(), visiting); e != t.Elem() {
+			to = reflect.MapOf(t.Key(), e)
+		}
+
+	case reflect.Struct:
+		var fields []reflect.StructField
+		changed := false
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				if f.Anonymous {
+					return t
+				}
+				continue
+			}
+
+			switch {
+			case f.Tag.Get("varlink") == "time" && f.Type == timeType:
+				f.Type = formattedTimeType
+			case f.Tag.Get("varlink") == "time" && f.Type == reflect.PtrTo(timeType):
+				f.Type = reflect.PtrTo(formattedTimeType)
+			default:
+				f.Type = timeFormatType(f.Type, visiting)
+			}
+			if f.Type != t.Field(i).Type {
+				changed = true
+			}
+			f.Index = nil
+			f.Offset = 0
+			fields = append(fields, f)
+		}
+		if changed {
+			to = reflect.StructOf(fields)
+		}
+	}
+
+	if len(visiting) == 1 {
+		timeFormatTypes.Store(t, to)
+	}
+	return to
+}
+
+// formatTimes returns the value v converted to the type of timeFormatType().
+func formatTimes(v reflect.Value, to reflect.Type, layout string) reflect.Value {
+	if v.Type() == to {
+		return v
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return reflect.Zero(to)
+		}
+		p := reflect.New(to.Elem())
+		p.Elem().Set(formatTimes(v.Elem(), to.Elem(), layout))
+		return p
+
+	case reflect.Slice:
+		if v.IsNil() {
+			return reflect.Zero(to)
+		}
+		s := reflect.MakeSlice(to, v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			s.Index(i).Set(formatTimes(v.Index(i), to.Elem(), layout))
+		}
+		return s
+
+	case reflect.Array:
+		a := reflect.New(to).Elem()
+		for i := 0; i < v.Len(); i++ {
+			a.Index(i).Set(formatTimes(v.Index(i), to.Elem(), layout))
+		}
+		return a
+
+	case reflect.Map:
+		if v.IsNil() {
+			return reflect.Zero(to)
+		}
+		m := reflect.MakeMapWithSize(to, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			m.SetMapIndex(iter.Key(), formatTimes(iter.Value(), to.Elem(), layout))
+		}
+		return m
+
+	case reflect.Struct:
+		if to == formattedTimeType {
+			return reflect.ValueOf(formattedTime{time: v.Interface().(time.Time), layout: layout})
+		}
+		s := reflect.New(to).Elem()
+		j := 0
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath != "" {
+				continue
+			}
+			s.Field(j).Set(formatTimes(v.Field(i), to.Field(j).Type, layout))
+			j++
+		}
+		return s
+	}
+
+	return v
+}
@@ -3,9 +3,32 @@ package varlink_test
 // test with no internal access
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"github.com/varlink/go/varlink"
+	"github.com/varlink/go/varlink/idl"
+	"log"
+	"math/big"
+	"net"
 	"os"
+	"os/exec"
+	"reflect"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -68,8 +91,8 @@ func TestRegisterService(t *testing.T) {
 
 	n := new(VarlinkInterface2)
 
-	if err := service.RegisterInterface(n); err == nil {
-		t.Fatal("Could register service while running")
+	if err := service.RegisterInterface(n); err != nil {
+		t.Fatalf("Couldn't register service while running: %v", err)
 	}
 	time.Sleep(time.Second / 5)
 	service.Shutdown()
@@ -110,6 +133,84 @@ func TestUnix(t *testing.T) {
 	}
 }
 
+func TestUnixOptions(t *testing.T) {
+	service, err := varlink.NewService("Varlink", "Varlink Test", "1", "https://github.com/varlink/go/varlink")
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+	if err := service.SetUnixOptions(varlink.UnixOptions{Mode: os.ModeSocket}); err == nil {
+		t.Fatal("SetUnixOptions() accepted an invalid mode")
+	}
+	err = service.SetUnixOptions(varlink.UnixOptions{
+		Mode:          0600,
+		Owner:         strconv.Itoa(os.Getuid()),
+		Group:         strconv.Itoa(os.Getgid()),
+		DirectoryMode: 0700,
+	})
+	if err != nil {
+		t.Fatalf("SetUnixOptions(): %v", err)
+	}
+
+	dir := "varlinkexternal_TestUnixOptions"
+	path := dir + "/socket"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	// The socket file of a crashed service is replaced
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatalf("Mkdir(): %v", err)
+	}
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- service.RunContext(ctx, "unix:"+path) }()
+	time.Sleep(time.Second / 5)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat(): %v", err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Fatalf("mode of the socket file: %v", info.Mode())
+	}
+
+	// The socket file of a running service is not replaced
+	other, err := varlink.NewService("Varlink", "Varlink Test", "1", "https://github.com/varlink/go/varlink")
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+	if err := other.RunContext(context.Background(), "unix:"+path); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("RunContext() on the socket of a running service: %v", err)
+	}
+	c, err := varlink.DialContext(context.Background(), "unix:"+path)
+	if err != nil {
+		t.Fatalf("DialContext(): %v", err)
+	}
+	if err := c.GetInfo(nil, nil, nil, nil, nil); err != nil {
+		t.Fatalf("GetInfo(): %v", err)
+	}
+	c.Close()
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("RunContext(): %v", err)
+	}
+
+	// Other files are not replaced
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	if err := other.RunContext(context.Background(), "unix:"+path); err == nil {
+		t.Fatal("RunContext() replaced a file which is not a socket")
+	}
+}
+
 func TestAnonUnix(t *testing.T) {
 	if runtime.GOOS != "linux" {
 		return
@@ -162,7 +263,7 @@ func TestListenFDSNotInt(t *testing.T) {
 		t.Fatalf("Couldn't register service: %v", err)
 	}
 	os.Setenv("LISTEN_FDS", "foo")
-	os.Setenv("LISTEN_PID", string(os.Getpid()))
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
 
 	servererror := make(chan error)
 
@@ -179,3 +280,2199 @@ func TestListenFDSNotInt(t *testing.T) {
 		t.Fatalf("service.Run(): %v", err)
 	}
 }
+
+func TestDialContext(t *testing.T) {
+	if _, err := varlink.DialContext(context.Background(), "varlinkexternal_TestDialContext"); err == nil {
+		t.Fatal("DialContext() accepted an address without protocol")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := varlink.DialContext(ctx, "tcp:127.0.0.1:1"); err == nil {
+		t.Fatal("DialContext() connected with a canceled context")
+	}
+
+	service, err := varlink.NewService(
+		"Varlink",
+		"Varlink Test",
+		"1",
+		"https://github.com/varlink/go/varlink",
+	)
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+
+	servererror := make(chan error)
+
+	go func() {
+		servererror <- service.Listen("unix:varlinkexternal_TestDialContext", 0)
+	}()
+
+	time.Sleep(time.Second / 5)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c, err := varlink.DialContext(ctx, "unix:varlinkexternal_TestDialContext")
+	if err != nil {
+		t.Fatalf("DialContext(): %v", err)
+	}
+	var vendor string
+	if err := c.GetInfo(&vendor, nil, nil, nil, nil); err != nil || vendor != "Varlink" {
+		t.Fatalf("GetInfo(): '%s' %v", vendor, err)
+	}
+	c.Close()
+
+	service.Shutdown()
+
+	if err := <-servererror; err != nil {
+		t.Fatalf("service.Listen(): %v", err)
+	}
+}
+
+// drainInterface has a method which replies after the release, and a method
+// which streams replies until the connection fails.
+type drainInterface struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *drainInterface) VarlinkDispatch(call varlink.Call, methodname string) error {
+	d.started <- struct{}{}
+	switch methodname {
+	case "Slow":
+		<-d.release
+		return call.Reply(nil)
+	case "Stream":
+		call.Continues = true
+		for {
+			if err := call.Reply(nil); err != nil {
+				return err
+			}
+			time.Sleep(time.Second / 100)
+		}
+	}
+	return call.ReplyMethodNotFound(methodname)
+}
+
+func (d *drainInterface) VarlinkGetName() string {
+	return `org.example.drain`
+}
+
+func (d *drainInterface) VarlinkGetDescription() string {
+	return "interface org.example.drain\nmethod Slow() -> ()\nmethod Stream() -> ()"
+}
+
+func TestShutdownContext(t *testing.T) {
+	newService := func(address string) (*varlink.Service, *drainInterface, chan error) {
+		service, err := varlink.NewService("Varlink", "Varlink Test", "1", "https://github.com/varlink/go/varlink")
+		if err != nil {
+			t.Fatalf("NewService(): %v", err)
+		}
+		d := &drainInterface{started: make(chan struct{}, 1), release: make(chan struct{})}
+		if err := service.RegisterInterface(d); err != nil {
+			t.Fatalf("RegisterInterface(): %v", err)
+		}
+		servererror := make(chan error, 1)
+		go func() {
+			servererror <- service.Listen(address, 0)
+		}()
+		time.Sleep(time.Second / 5)
+		return service, d, servererror
+	}
+
+	service, d, servererror := newService("unix:varlinkexternal_TestShutdownContext")
+	idle, err := varlink.DialContext(context.Background(), "unix:varlinkexternal_TestShutdownContext")
+	if err != nil {
+		t.Fatalf("DialContext(): %v", err)
+	}
+	defer idle.Close()
+	busy, err := varlink.DialContext(context.Background(), "unix:varlinkexternal_TestShutdownContext")
+	if err != nil {
+		t.Fatalf("DialContext(): %v", err)
+	}
+	defer busy.Close()
+	if err := idle.GetInfo(nil, nil, nil, nil, nil); err != nil {
+		t.Fatalf("GetInfo(): %v", err)
+	}
+
+	receive, err := busy.SendWithOptions("org.example.drain.Slow", nil)
+	if err != nil {
+		t.Fatalf("SendWithOptions(): %v", err)
+	}
+	<-d.started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- service.ShutdownContext(context.Background())
+	}()
+
+	// The listener and the waiting connection are closed, the call is
+	// still handled
+	time.Sleep(time.Second / 10)
+	if _, err := os.Stat("varlinkexternal_TestShutdownContext"); !os.IsNotExist(err) {
+		t.Fatalf("socket file exists after ShutdownContext(): %v", err)
+	}
+	if err := idle.GetInfo(nil, nil, nil, nil, nil); err == nil {
+		t.Fatal("GetInfo() succeeded on a connection closed by ShutdownContext()")
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("ShutdownContext() returned before the call was handled: %v", err)
+	default:
+	}
+
+	close(d.release)
+	if _, err := receive(nil); err != nil {
+		t.Fatalf("receive(): %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("ShutdownContext(): %v", err)
+	}
+	if err := <-servererror; err != nil {
+		t.Fatalf("service.Listen(): %v", err)
+	}
+
+	t.Run("Stream", func(t *testing.T) {
+		service, d, servererror := newService("unix:varlinkexternal_TestShutdownContextStream")
+		c, err := varlink.DialContext(context.Background(), "unix:varlinkexternal_TestShutdownContextStream")
+		if err != nil {
+			t.Fatalf("DialContext(): %v", err)
+		}
+		defer c.Close()
+
+		receive, err := c.SendWithOptions("org.example.drain.Stream", nil, varlink.WithMore())
+		if err != nil {
+			t.Fatalf("SendWithOptions(): %v", err)
+		}
+		<-d.started
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second/5)
+		defer cancel()
+		if err := service.ShutdownContext(ctx); err != context.DeadlineExceeded {
+			t.Fatalf("ShutdownContext(): %v", err)
+		}
+
+		for {
+			flags, err := receive(nil)
+			if err != nil {
+				if !errors.Is(err, &varlink.Error{Name: "org.varlink.ServiceShutdown"}) {
+					t.Fatalf("receive(): %v", err)
+				}
+				break
+			}
+			if flags&varlink.Continues == 0 {
+				t.Fatal("stream ended without an error")
+			}
+		}
+		if err := <-servererror; err != nil {
+			t.Fatalf("service.Listen(): %v", err)
+		}
+	})
+}
+
+func TestRunContext(t *testing.T) {
+	service, err := varlink.NewService("Varlink", "Varlink Test", "1", "https://github.com/varlink/go/varlink")
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	servererror := make(chan error, 1)
+	go func() {
+		servererror <- service.RunContext(ctx, "unix:varlinkexternal_TestRunContext")
+	}()
+	time.Sleep(time.Second / 5)
+
+	c, err := varlink.DialContext(context.Background(), "unix:varlinkexternal_TestRunContext")
+	if err != nil {
+		t.Fatalf("DialContext(): %v", err)
+	}
+	defer c.Close()
+	if err := c.GetInfo(nil, nil, nil, nil, nil); err != nil {
+		t.Fatalf("GetInfo(): %v", err)
+	}
+
+	cancel()
+	if err := <-servererror; err != nil {
+		t.Fatalf("RunContext(): %v", err)
+	}
+	if err := c.GetInfo(nil, nil, nil, nil, nil); err == nil {
+		t.Fatal("GetInfo() succeeded after RunContext() returned")
+	}
+	if _, err := os.Stat("varlinkexternal_TestRunContext"); !os.IsNotExist(err) {
+		t.Fatalf("socket file exists after RunContext() returned: %v", err)
+	}
+
+	if err := service.RunContext(ctx, "unix:varlinkexternal_TestRunContext"); err != context.Canceled {
+		t.Fatalf("RunContext() with a canceled context: %v", err)
+	}
+
+	if err := service.SetIdleTimeout(time.Second / 5); err != nil {
+		t.Fatalf("SetIdleTimeout(): %v", err)
+	}
+	start := time.Now()
+	if err := service.RunContext(context.Background(), "unix:varlinkexternal_TestRunContext"); err != nil {
+		t.Fatalf("RunContext() with an idle timeout: %v", err)
+	}
+	if d := time.Since(start); d < time.Second/5 {
+		t.Fatalf("RunContext() returned before the idle timeout after %v", d)
+	}
+
+	// An open connection keeps the service running, the timeout starts
+	// when it is closed
+	go func() {
+		servererror <- service.RunContext(context.Background(), "unix:varlinkexternal_TestRunContext")
+	}()
+	time.Sleep(time.Second / 10)
+	c, err = varlink.DialContext(context.Background(), "unix:varlinkexternal_TestRunContext")
+	if err != nil {
+		t.Fatalf("DialContext(): %v", err)
+	}
+	time.Sleep(time.Second / 2)
+	if err := c.GetInfo(nil, nil, nil, nil, nil); err != nil {
+		t.Fatalf("GetInfo() of an open connection after the idle timeout: %v", err)
+	}
+	c.Close()
+	closed := time.Now()
+	select {
+	case err := <-servererror:
+		if err != nil {
+			t.Fatalf("RunContext() with an idle timeout: %v", err)
+		}
+		if d := time.Since(closed); d < time.Second/10 {
+			t.Fatalf("RunContext() returned %v after the connection was closed", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunContext() did not return after the idle timeout")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	busyError := &varlink.Error{Name: "org.varlink.ServiceBusy"}
+	newService := func(limits varlink.Limits) (*varlink.Service, *drainInterface) {
+		service, err := varlink.NewService("Varlink", "Varlink Test", "1", "https://github.com/varlink/go/varlink")
+		if err != nil {
+			t.Fatalf("NewService(): %v", err)
+		}
+		d := &drainInterface{started: make(chan struct{}, 1), release: make(chan struct{})}
+		if err := service.RegisterInterface(d); err != nil {
+			t.Fatalf("RegisterInterface(): %v", err)
+		}
+		if err := service.SetLimits(limits); err != nil {
+			t.Fatalf("SetLimits(): %v", err)
+		}
+		return service, d
+	}
+
+	// A call above the limit is rejected
+	service, d := newService(varlink.Limits{MaxCalls: 1, Reject: true})
+	slow := varlink.NewPipe(service)
+	defer slow.Close()
+	receive, err := slow.SendWithOptions("org.example.drain.Slow", nil)
+	if err != nil {
+		t.Fatalf("SendWithOptions(): %v", err)
+	}
+	<-d.started
+	c := varlink.NewPipe(service)
+	defer c.Close()
+	if err := c.GetInfo(nil, nil, nil, nil, nil); !errors.Is(err, busyError) {
+		t.Fatalf("GetInfo() above the limit: %v", err)
+	}
+	d.release <- struct{}{}
+	if _, err := receive(nil); err != nil {
+		t.Fatalf("receive(): %v", err)
+	}
+
+	// A call above the limit waits
+	service, d = newService(varlink.Limits{MaxCalls: 1})
+	slow = varlink.NewPipe(service)
+	defer slow.Close()
+	receive, err = slow.SendWithOptions("org.example.drain.Slow", nil)
+	if err != nil {
+		t.Fatalf("SendWithOptions(): %v", err)
+	}
+	<-d.started
+	c = varlink.NewPipe(service)
+	defer c.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.GetInfo(nil, nil, nil, nil, nil)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("GetInfo() above the limit did not wait: %v", err)
+	case <-time.After(time.Second / 10):
+	}
+	d.release <- struct{}{}
+	if _, err := receive(nil); err != nil {
+		t.Fatalf("receive(): %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("GetInfo() after the wait: %v", err)
+	}
+
+	// A connection above the limit is rejected
+	service, _ = newService(varlink.Limits{MaxConnections: 1, Reject: true})
+	first := varlink.NewPipe(service)
+	defer first.Close()
+	if err := first.GetInfo(nil, nil, nil, nil, nil); err != nil {
+		t.Fatalf("GetInfo(): %v", err)
+	}
+	c = varlink.NewPipe(service)
+	defer c.Close()
+	if err := c.GetInfo(nil, nil, nil, nil, nil); !errors.Is(err, busyError) {
+		t.Fatalf("GetInfo() of a connection above the limit: %v", err)
+	}
+
+	if err := service.SetLimits(varlink.Limits{MaxCalls: -1}); err == nil {
+		t.Fatal("SetLimits() accepted a negative limit")
+	}
+}
+
+// upgradeInterface echoes the lines of an upgraded call.
+type upgradeInterface struct{}
+
+func (upgradeInterface) VarlinkDispatch(call varlink.Call, methodname string) error {
+	if !call.WantsUpgrade() {
+		return call.ReplyError("org.example.upgrade.NotUpgraded", nil)
+	}
+	conn, err := call.ReplyUpgrade(map[string]bool{"ok": true})
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil || line == "quit\n" {
+				return
+			}
+			conn.Write([]byte(line))
+		}
+	}()
+	return nil
+}
+
+func (upgradeInterface) VarlinkGetName() string {
+	return `org.example.upgrade`
+}
+
+func (upgradeInterface) VarlinkGetDescription() string {
+	return "interface org.example.upgrade\nmethod Echo() -> (ok: bool)\nerror NotUpgraded ()"
+}
+
+func TestServiceUpgrade(t *testing.T) {
+	service, err := varlink.NewService("Varlink", "Varlink Test", "1", "https://github.com/varlink/go/varlink")
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+	if err := service.RegisterInterface(upgradeInterface{}); err != nil {
+		t.Fatalf("RegisterInterface(): %v", err)
+	}
+	done := make(chan error)
+	go func() { done <- service.RunContext(context.Background(), "unix:varlinkexternal_TestServiceUpgrade") }()
+	time.Sleep(time.Second / 5)
+
+	c, err := varlink.DialContext(context.Background(), "unix:varlinkexternal_TestServiceUpgrade")
+	if err != nil {
+		t.Fatalf("DialContext(): %v", err)
+	}
+	defer c.Close()
+	if err := c.Call("org.example.upgrade.Echo", nil, nil); !errors.Is(err, &varlink.Error{Name: "org.example.upgrade.NotUpgraded"}) {
+		t.Fatalf("Call() without upgrade: %v", err)
+	}
+
+	var out struct{ Ok bool }
+	u, err := c.Upgrade("org.example.upgrade.Echo", nil, &out)
+	if err != nil || !out.Ok {
+		t.Fatalf("Upgrade(): %v %v", out.Ok, err)
+	}
+	reader := bufio.NewReader(u)
+	for _, line := range []string{"hello\n", "world\n"} {
+		if _, err := u.Write([]byte(line)); err != nil {
+			t.Fatalf("Write(): %v", err)
+		}
+		if echo, err := reader.ReadString('\n'); err != nil || echo != line {
+			t.Fatalf("ReadString(): '%s' %v", echo, err)
+		}
+	}
+
+	// The upgraded connection is closed when the shutdown gives up
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second/5)
+	defer cancel()
+	if err := service.ShutdownContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("ShutdownContext() with an upgraded connection: %v", err)
+	}
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Fatal("upgraded connection is open after ShutdownContext()")
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("RunContext(): %v", err)
+	}
+}
+
+// credentialsInterface replies with the peer credentials of the call.
+// floodInterface streams replies until a reply fails.
+type floodInterface struct {
+	failed chan error
+}
+
+func (f floodInterface) VarlinkDispatch(call varlink.Call, methodname string) error {
+	call.Continues = true
+	for {
+		if err := call.Reply(map[string]string{"data": strings.Repeat("x", 100)}); err != nil {
+			<-call.Context().Done()
+			f.failed <- err
+			return err
+		}
+	}
+}
+
+func (floodInterface) VarlinkGetName() string {
+	return `org.example.flood`
+}
+
+func (floodInterface) VarlinkGetDescription() string {
+	return "interface org.example.flood\nmethod Stream() -> (data: string)"
+}
+
+func TestWriteLimits(t *testing.T) {
+	for _, limits := range []varlink.Limits{
+		{WriteTimeout: time.Second / 10},
+		{WriteBuffer: 1024},
+	} {
+		service, err := varlink.NewService("Varlink", "Varlink Test", "1", "https://github.com/varlink/go/varlink")
+		if err != nil {
+			t.Fatalf("NewService(): %v", err)
+		}
+		iface := floodInterface{failed: make(chan error, 1)}
+		if err := service.RegisterInterface(iface); err != nil {
+			t.Fatalf("RegisterInterface(): %v", err)
+		}
+		if err := service.SetLimits(limits); err != nil {
+			t.Fatalf("SetLimits(): %v", err)
+		}
+
+		// The client sends the call, and does not read the replies
+		client, server := net.Pipe()
+		served := make(chan struct{})
+		go func() {
+			service.ServeConn(server)
+			close(served)
+		}()
+		if _, err := client.Write([]byte(`{"method":"org.example.flood.Stream","more":true}` + "\000")); err != nil {
+			t.Fatalf("Write(): %v", err)
+		}
+
+		select {
+		case err := <-iface.failed:
+			if err == nil {
+				t.Fatalf("Reply() with %+v did not fail", limits)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Reply() with %+v waits for the client", limits)
+		}
+		select {
+		case <-served:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("ServeConn() with %+v did not close the connection", limits)
+		}
+		client.Close()
+	}
+}
+
+type credentialsInterface struct{}
+
+func (credentialsInterface) VarlinkDispatch(call varlink.Call, methodname string) error {
+	creds, err := call.PeerCredentials()
+	if err != nil {
+		return call.ReplyError("org.example.credentials.NoCredentials", nil)
+	}
+	return call.Reply(creds)
+}
+
+func (credentialsInterface) VarlinkGetName() string {
+	return `org.example.credentials`
+}
+
+func (credentialsInterface) VarlinkGetDescription() string {
+	return "interface org.example.credentials\nmethod Get() -> (UID: int, GID: int, PID: int)\nerror NoCredentials ()"
+}
+
+func TestPeerCredentials(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+
+	service, err := varlink.NewService("Varlink", "Varlink Test", "1", "https://github.com/varlink/go/varlink")
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+	if err := service.RegisterInterface(credentialsInterface{}); err != nil {
+		t.Fatalf("RegisterInterface(): %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go service.RunContext(ctx, "unix:varlinkexternal_TestPeerCredentials")
+	time.Sleep(time.Second / 5)
+
+	c, err := varlink.DialContext(context.Background(), "unix:varlinkexternal_TestPeerCredentials")
+	if err != nil {
+		t.Fatalf("DialContext(): %v", err)
+	}
+	defer c.Close()
+	var creds varlink.PeerCredentials
+	if err := c.Call("org.example.credentials.Get", nil, &creds); err != nil {
+		t.Fatalf("Call(): %v", err)
+	}
+	if creds.UID != uint32(os.Getuid()) || creds.GID != uint32(os.Getgid()) || creds.PID != int32(os.Getpid()) {
+		t.Fatalf("PeerCredentials(): %+v", creds)
+	}
+
+	// A pipe has no credentials
+	pipe := varlink.NewPipe(service)
+	defer pipe.Close()
+	err = pipe.Call("org.example.credentials.Get", nil, &creds)
+	if !errors.Is(err, &varlink.Error{Name: "org.example.credentials.NoCredentials"}) {
+		t.Fatalf("Call() over a pipe: %v", err)
+	}
+}
+
+func TestAuthorizer(t *testing.T) {
+	service, err := varlink.NewService("Varlink", "Varlink Test", "1", "https://github.com/varlink/go/varlink")
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+	if err := service.RegisterInterface(credentialsInterface{}); err != nil {
+		t.Fatalf("RegisterInterface(): %v", err)
+	}
+
+	var authorized []string
+	err = service.SetAuthorizer(func(ctx context.Context, peer varlink.Peer, interfaceName string, method string, parameters json.RawMessage) error {
+		authorized = append(authorized, interfaceName+"."+method+string(parameters))
+		if peer.Credentials != nil {
+			return fmt.Errorf("pipe has credentials")
+		}
+		switch method {
+		case "GetInfo":
+			return nil
+		case "GetInterfaceDescription":
+			return &varlink.Error{Name: "org.example.credentials.NoCredentials"}
+		}
+		return fmt.Errorf("denied")
+	})
+	if err != nil {
+		t.Fatalf("SetAuthorizer(): %v", err)
+	}
+
+	c := varlink.NewPipe(service)
+	defer c.Close()
+	if err := c.GetInfo(nil, nil, nil, nil, nil); err != nil {
+		t.Fatalf("GetInfo(): %v", err)
+	}
+	_, err = c.GetInterfaceDescription("org.example.credentials")
+	if !errors.Is(err, &varlink.Error{Name: "org.example.credentials.NoCredentials"}) {
+		t.Fatalf("GetInterfaceDescription(): %v", err)
+	}
+	err = c.Call("org.example.credentials.Get", map[string]int{"n": 1}, nil)
+	if !errors.Is(err, &varlink.Error{Name: "org.varlink.service.PermissionDenied"}) {
+		t.Fatalf("Call() of a denied method: %v", err)
+	}
+
+	expected := []string{
+		"org.varlink.service.GetInfo",
+		`org.varlink.service.GetInterfaceDescription{"interface":"org.example.credentials"}`,
+		`org.example.credentials.Get{"n":1}`,
+	}
+	if !reflect.DeepEqual(authorized, expected) {
+		t.Fatalf("authorized calls: %q", authorized)
+	}
+}
+
+// contextKey is the key of the context value of the interceptors.
+type contextKey struct{}
+
+// contextInterface replies with the context value of the interceptors.
+type contextInterface struct{}
+
+func (contextInterface) VarlinkDispatch(call varlink.Call, methodname string) error {
+	value, _ := call.Context().Value(contextKey{}).(string)
+	return call.Reply(map[string]string{"value": value})
+}
+
+func (contextInterface) VarlinkGetName() string {
+	return `org.example.context`
+}
+
+func (contextInterface) VarlinkGetDescription() string {
+	return "interface org.example.context\nmethod Get() -> (value: string)\nmethod Denied() -> ()"
+}
+
+func TestServiceInterceptors(t *testing.T) {
+	service, err := varlink.NewService("Varlink", "Varlink Test", "1", "https://github.com/varlink/go/varlink")
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+	if err := service.RegisterInterface(contextInterface{}); err != nil {
+		t.Fatalf("RegisterInterface(): %v", err)
+	}
+
+	// The interceptors return after the reply was sent
+	var mutex sync.Mutex
+	var calls []string
+	record := func(call string) {
+		mutex.Lock()
+		calls = append(calls, call)
+		mutex.Unlock()
+	}
+	err = service.Use(
+		func(ctx context.Context, call *varlink.Call, next varlink.CallHandler) error {
+			record("first " + call.Method())
+			err := next(context.WithValue(ctx, contextKey{}, "first"), call)
+			record("first done")
+			return err
+		},
+		func(ctx context.Context, call *varlink.Call, next varlink.CallHandler) error {
+			record("second " + ctx.Value(contextKey{}).(string))
+			if call.Method() == "org.example.context.Denied" {
+				return call.ReplyError("org.example.context.Denied", nil)
+			}
+			return next(ctx, call)
+		},
+	)
+	if err != nil {
+		t.Fatalf("Use(): %v", err)
+	}
+	err = service.SetAuthorizer(func(ctx context.Context, peer varlink.Peer, interfaceName string, method string, parameters json.RawMessage) error {
+		record("authorizer " + ctx.Value(contextKey{}).(string))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("SetAuthorizer(): %v", err)
+	}
+
+	c := varlink.NewPipe(service)
+	defer c.Close()
+	var out struct{ Value string }
+	if err := c.Call("org.example.context.Get", nil, &out); err != nil || out.Value != "first" {
+		t.Fatalf("Call(): %+v %v", out, err)
+	}
+	err = c.Call("org.example.context.Denied", nil, nil)
+	if !errors.Is(err, &varlink.Error{Name: "org.example.context.Denied"}) {
+		t.Fatalf("Call() of a denied method: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := c.GetInfo(nil, nil, nil, nil, nil); err != nil {
+			t.Fatalf("GetInfo(): %v", err)
+		}
+	}
+
+	expected := []string{
+		"first org.example.context.Get", "second first", "authorizer first", "first done",
+		"first org.example.context.Denied", "second first", "first done",
+		"first org.varlink.service.GetInfo", "second first", "authorizer first", "first done",
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !reflect.DeepEqual(calls[:len(expected)], expected) {
+		t.Fatalf("calls: %q", calls)
+	}
+}
+
+// panicInterface panics in its method Panic.
+type panicInterface struct{}
+
+func (panicInterface) VarlinkDispatch(call varlink.Call, methodname string) error {
+	if methodname == "Panic" {
+		var m map[string]int
+		m["panic"] = 1
+	}
+	return call.Reply(nil)
+}
+
+func (panicInterface) VarlinkGetName() string {
+	return `org.example.panic`
+}
+
+func (panicInterface) VarlinkGetDescription() string {
+	return "interface org.example.panic\nmethod Panic() -> ()\nmethod Ping() -> ()"
+}
+
+func TestPanic(t *testing.T) {
+	service, err := varlink.NewService("Varlink", "Varlink Test", "1", "https://github.com/varlink/go/varlink")
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+	if err := service.RegisterInterface(panicInterface{}); err != nil {
+		t.Fatalf("RegisterInterface(): %v", err)
+	}
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	c := varlink.NewPipe(service)
+	defer c.Close()
+	err = c.Call("org.example.panic.Panic", nil, nil)
+	if !errors.Is(err, &varlink.Error{Name: "org.varlink.InternalError"}) {
+		t.Fatalf("Call() of a panicking method: %v", err)
+	}
+	if err := c.Call("org.example.panic.Ping", nil, nil); err != nil {
+		t.Fatalf("Call() after a panic: %v", err)
+	}
+
+	if !strings.Contains(logged.String(), "panic in method call org.example.panic.Panic: assignment to entry in nil map") || !strings.Contains(logged.String(), "panicInterface.VarlinkDispatch") {
+		t.Fatalf("logged panic: %s", logged.String())
+	}
+}
+
+// metadataInterface replies with the metadata of the call.
+type metadataInterface struct{}
+
+func (metadataInterface) VarlinkDispatch(call varlink.Call, methodname string) error {
+	return call.Reply(map[string]interface{}{
+		"interface":  call.Interface(),
+		"method":     call.MethodName(),
+		"parameters": string(call.Parameters()),
+		"more":       call.WantsMore(),
+		"local":      call.LocalAddr().String(),
+	})
+}
+
+func (metadataInterface) VarlinkGetName() string {
+	return `org.example.metadata`
+}
+
+func (metadataInterface) VarlinkGetDescription() string {
+	return "interface org.example.metadata\nmethod Get(value: int) -> (interface: string, method: string, parameters: string, more: bool, local: string)"
+}
+
+func TestCallMetadata(t *testing.T) {
+	service, err := varlink.NewService("Varlink", "Varlink Test", "1", "https://github.com/varlink/go/varlink")
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+	if err := service.RegisterInterface(metadataInterface{}); err != nil {
+		t.Fatalf("RegisterInterface(): %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go service.RunContext(ctx, "unix:varlinkexternal_TestCallMetadata")
+	time.Sleep(time.Second / 5)
+
+	c, err := varlink.DialContext(context.Background(), "unix:varlinkexternal_TestCallMetadata")
+	if err != nil {
+		t.Fatalf("DialContext(): %v", err)
+	}
+	defer c.Close()
+
+	var out struct {
+		Interface  string
+		Method     string
+		Parameters string
+		More       bool
+		Local      string
+	}
+	if err := c.Call("org.example.metadata.Get", map[string]int{"value": 1}, &out); err != nil {
+		t.Fatalf("Call(): %v", err)
+	}
+	if out.Interface != "org.example.metadata" || out.Method != "Get" || out.Parameters != `{"value":1}` || out.More {
+		t.Fatalf("metadata of the call: %+v", out)
+	}
+	if out.Local != "varlinkexternal_TestCallMetadata" {
+		t.Fatalf("local address of the call: %s", out.Local)
+	}
+}
+
+// cancelInterface streams until the context of the call is done.
+type cancelInterface struct {
+	started  chan struct{}
+	canceled chan error
+}
+
+func (c cancelInterface) VarlinkDispatch(call varlink.Call, methodname string) error {
+	c.started <- struct{}{}
+	select {
+	case <-call.Context().Done():
+		c.canceled <- call.Context().Err()
+	case <-time.After(5 * time.Second):
+		c.canceled <- nil
+	}
+	return nil
+}
+
+func (cancelInterface) VarlinkGetName() string {
+	return `org.example.cancel`
+}
+
+func (cancelInterface) VarlinkGetDescription() string {
+	return "interface org.example.cancel\nmethod Stream() -> ()"
+}
+
+func TestCancelOnDisconnect(t *testing.T) {
+	service, err := varlink.NewService("Varlink", "Varlink Test", "1", "https://github.com/varlink/go/varlink")
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+	iface := cancelInterface{started: make(chan struct{}, 1), canceled: make(chan error, 1)}
+	if err := service.RegisterInterface(iface); err != nil {
+		t.Fatalf("RegisterInterface(): %v", err)
+	}
+
+	client, server := net.Pipe()
+	served := make(chan struct{})
+	go func() {
+		service.ServeConn(server)
+		close(served)
+	}()
+
+	c := varlink.NewConnectionFromConn(client)
+	if _, err := c.SendWithOptions("org.example.cancel.Stream", nil, varlink.WithMore()); err != nil {
+		t.Fatalf("SendWithOptions(): %v", err)
+	}
+	<-iface.started
+	c.Close()
+
+	if err := <-iface.canceled; err != context.Canceled {
+		t.Fatalf("context of the call after the client closed the connection: %v", err)
+	}
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeConn() did not return after the connection was closed")
+	}
+}
+
+func TestRegisterInterfaceRunning(t *testing.T) {
+	service, err := varlink.NewService("Varlink", "Varlink Test", "1", "https://github.com/varlink/go/varlink")
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go service.RunContext(ctx, "unix:varlinkexternal_TestRegisterInterfaceRunning")
+	time.Sleep(time.Second / 5)
+
+	c, err := varlink.DialContext(context.Background(), "unix:varlinkexternal_TestRegisterInterfaceRunning")
+	if err != nil {
+		t.Fatalf("DialContext(): %v", err)
+	}
+	defer c.Close()
+	interfaces := func() []string {
+		var names []string
+		if err := c.GetInfo(nil, nil, nil, nil, &names); err != nil {
+			t.Fatalf("GetInfo(): %v", err)
+		}
+		return names
+	}
+
+	if err := service.RegisterInterface(contextInterface{}); err != nil {
+		t.Fatalf("RegisterInterface(): %v", err)
+	}
+	if names := interfaces(); !reflect.DeepEqual(names, []string{"org.varlink.service", "org.example.context"}) {
+		t.Fatalf("GetInfo(): %v", names)
+	}
+	if err := c.Call("org.example.context.Get", nil, nil); err != nil {
+		t.Fatalf("Call(): %v", err)
+	}
+	if err := service.RegisterInterface(contextInterface{}); err == nil {
+		t.Fatal("RegisterInterface() of a registered interface succeeded")
+	}
+
+	if err := service.UnregisterInterface("org.example.context"); err != nil {
+		t.Fatalf("UnregisterInterface(): %v", err)
+	}
+	if names := interfaces(); !reflect.DeepEqual(names, []string{"org.varlink.service"}) {
+		t.Fatalf("GetInfo(): %v", names)
+	}
+	err = c.Call("org.example.context.Get", nil, nil)
+	if !errors.Is(err, &varlink.Error{Name: "org.varlink.service.InterfaceNotFound"}) {
+		t.Fatalf("Call() of an unregistered interface: %v", err)
+	}
+	if _, err := c.GetInterfaceDescription("org.example.context"); err == nil {
+		t.Fatal("GetInterfaceDescription() of an unregistered interface succeeded")
+	}
+	if err := service.UnregisterInterface("org.example.context"); err == nil {
+		t.Fatal("UnregisterInterface() of a missing interface succeeded")
+	}
+	if err := service.UnregisterInterface("org.varlink.service"); err == nil {
+		t.Fatal("UnregisterInterface() of org.varlink.service succeeded")
+	}
+}
+
+func TestRunAddresses(t *testing.T) {
+	service, err := varlink.NewService("Varlink", "Varlink Test", "1", "https://github.com/varlink/go/varlink")
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+
+	addresses := []string{"unix:varlinkexternal_TestRunAddresses1", "unix:varlinkexternal_TestRunAddresses2"}
+	err = service.RunAddresses(context.Background(), addresses[0], "tcp+tls:127.0.0.1:0")
+	if err == nil || !strings.Contains(err.Error(), "TLS") {
+		t.Fatalf("RunAddresses() without a TLS configuration: %v", err)
+	}
+	if _, err := os.Stat("varlinkexternal_TestRunAddresses1"); !os.IsNotExist(err) {
+		t.Fatalf("socket of a failed RunAddresses() was not removed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- service.RunAddresses(ctx, addresses...) }()
+	time.Sleep(time.Second / 5)
+
+	for _, address := range addresses {
+		c, err := varlink.DialContext(context.Background(), address)
+		if err != nil {
+			t.Fatalf("DialContext(%s): %v", address, err)
+		}
+		if err := c.GetInfo(nil, nil, nil, nil, nil); err != nil {
+			t.Fatalf("GetInfo(%s): %v", address, err)
+		}
+		c.Close()
+	}
+	if err := service.RunContext(context.Background(), "unix:varlinkexternal_TestRunAddresses3"); err == nil {
+		t.Fatal("RunContext() of a running service succeeded")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("RunAddresses(): %v", err)
+	}
+	for _, address := range addresses {
+		if _, err := varlink.DialContext(context.Background(), address); err == nil {
+			t.Fatalf("DialContext(%s) of a stopped service succeeded", address)
+		}
+	}
+}
+
+func TestServiceInfo(t *testing.T) {
+	service, err := varlink.NewService(
+		"Varlink",
+		"Varlink Test",
+		"1",
+		"https://github.com/varlink/go/varlink",
+	)
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+
+	servererror := make(chan error)
+
+	go func() {
+		servererror <- service.Listen("unix:varlinkexternal_TestServiceInfo", 0)
+	}()
+
+	time.Sleep(time.Second / 5)
+
+	c, err := varlink.NewConnection("unix:varlinkexternal_TestServiceInfo")
+	if err != nil {
+		t.Fatalf("NewConnection(): %v", err)
+	}
+
+	info, err := c.GetServiceInfo(varlink.WithTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("GetServiceInfo(): %v", err)
+	}
+	if info.Vendor != "Varlink" || info.Product != "Varlink Test" || info.Version != "1" ||
+		info.URL != "https://github.com/varlink/go/varlink" ||
+		len(info.Interfaces) != 1 || info.Interfaces[0] != "org.varlink.service" {
+		t.Fatalf("GetServiceInfo(): %+v", info)
+	}
+
+	i, err := c.GetInterface("org.varlink.service")
+	if err != nil {
+		t.Fatalf("GetInterface(): %v", err)
+	}
+	if i.Name != "org.varlink.service" || i.Members == nil || i.Methods["GetInfo"] == nil {
+		t.Fatalf("GetInterface(): %+v", i)
+	}
+
+	_, err = c.GetInterface("org.example.missing")
+	if _, ok := err.(*varlink.Error); !ok {
+		t.Fatalf("GetInterface() of a missing interface: %v", err)
+	}
+	c.Close()
+
+	service.Shutdown()
+
+	if err := <-servererror; err != nil {
+		t.Fatalf("service.Listen(): %v", err)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	service, err := varlink.NewService(
+		"Varlink",
+		"Varlink Test",
+		"1",
+		"https://github.com/varlink/go/varlink",
+	)
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+
+	servererror := make(chan error)
+
+	go func() {
+		servererror <- service.Listen("unix:varlinkexternal_TestValidation", 0)
+	}()
+
+	time.Sleep(time.Second / 5)
+
+	example, err := idl.New("interface org.example.valid\nmethod Ping(n: int) -> ()")
+	if err != nil {
+		t.Fatalf("idl.New(): %v", err)
+	}
+	c, err := varlink.DialContext(context.Background(), "unix:varlinkexternal_TestValidation", varlink.WithValidation(example))
+	if err != nil {
+		t.Fatalf("DialContext(): %v", err)
+	}
+
+	var e *idl.ValidationError
+	err = c.Call("org.varlink.service.GetInterfaceDescription", map[string]int{"interface": 1}, nil)
+	if !errors.As(err, &e) || e.Field != "interface" {
+		t.Fatalf("Call() with invalid parameters: %v", err)
+	}
+	if _, err := c.GetInterface("org.varlink.service"); err != nil {
+		t.Fatalf("GetInterface(): %v", err)
+	}
+
+	// The invalid call of the passed interface is not sent, the service
+	// would reply that it does not implement the interface
+	err = c.Call("org.example.valid.Ping", map[string]string{"n": "1"}, nil)
+	if !errors.As(err, &e) || e.Field != "n" {
+		t.Fatalf("Call() with invalid parameters: %v", err)
+	}
+	err = c.Call("org.example.valid.Ping", map[string]int{"n": 1}, nil)
+	if _, ok := err.(*varlink.Error); !ok {
+		t.Fatalf("Call() with valid parameters: %v", err)
+	}
+
+	// The description of the missing interface cannot be requested
+	err = c.Call("org.example.missing.Ping", nil, nil)
+	if _, ok := err.(*varlink.Error); !ok {
+		t.Fatalf("Call() of a missing interface: %v", err)
+	}
+	c.Close()
+
+	service.Shutdown()
+
+	if err := <-servererror; err != nil {
+		t.Fatalf("service.Listen(): %v", err)
+	}
+}
+
+// strictInterface replies to the calls which passed the validation.
+type strictInterface struct{}
+
+func (strictInterface) VarlinkDispatch(call varlink.Call, methodname string) error {
+	return call.Reply(nil)
+}
+
+func (strictInterface) VarlinkGetName() string {
+	return `org.example.strict`
+}
+
+func (strictInterface) VarlinkGetDescription() string {
+	return `interface org.example.strict
+type Disk (name: string, mode: (ro, rw))
+method Attach(disks: []Disk, label: ?string) -> ()`
+}
+
+func TestServiceValidation(t *testing.T) {
+	service, err := varlink.NewService("Varlink", "Varlink Test", "1", "https://github.com/varlink/go/varlink")
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+	if err := service.RegisterInterface(strictInterface{}); err != nil {
+		t.Fatalf("RegisterInterface(): %v", err)
+	}
+	if err := service.SetValidation(true); err != nil {
+		t.Fatalf("SetValidation(): %v", err)
+	}
+
+	client, server := net.Pipe()
+	go service.ServeConn(server)
+	c := varlink.NewConnectionFromConn(client)
+	defer c.Close()
+
+	disk := map[string]string{"name": "a", "mode": "ro"}
+	if err := c.Call("org.example.strict.Attach", map[string]interface{}{"disks": []interface{}{disk}}, nil); err != nil {
+		t.Fatalf("Call() with valid parameters: %v", err)
+	}
+
+	for _, test := range []struct {
+		parameters interface{}
+		field      string
+	}{
+		{nil, "disks"},
+		{map[string]interface{}{"disks": "a"}, "disks"},
+		{map[string]interface{}{"disks": []interface{}{disk, map[string]string{"name": "b", "mode": "rx"}}}, "disks[1].mode"},
+		{map[string]interface{}{"disks": []interface{}{map[string]string{"mode": "rw"}}}, "disks[0].name"},
+		{map[string]interface{}{"disks": []interface{}{}, "size": 1}, "size"},
+		{[]int{1}, "parameters"},
+	} {
+		err := c.Call("org.example.strict.Attach", test.parameters, nil)
+		var e *varlink.Error
+		if !errors.As(err, &e) || e.Name != "org.varlink.service.InvalidParameter" || string(e.Parameters) != `{"parameter":"`+test.field+`"}` {
+			t.Fatalf("Call(%v): %v", test.parameters, err)
+		}
+	}
+}
+
+func TestAbstractUnix(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract unix sockets are only supported on Linux")
+	}
+
+	service, err := varlink.NewService(
+		"Varlink",
+		"Varlink Test",
+		"1",
+		"https://github.com/varlink/go/varlink",
+	)
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+
+	// The longest abstract name uses all of sun_path
+	address := "unix:@varlinkexternal_TestAbstractUnix" + strings.Repeat("x", 108-len("@varlinkexternal_TestAbstractUnix"))
+
+	if err := service.Listen(address+"x", 0); err == nil {
+		t.Fatal("Listen() accepted an abstract name longer than sun_path")
+	}
+	if _, err := varlink.DialContext(context.Background(), address+"x"); err == nil {
+		t.Fatal("DialContext() accepted an abstract name longer than sun_path")
+	}
+	if _, err := varlink.DialContext(context.Background(), "unix:@"); err == nil {
+		t.Fatal("DialContext() accepted an empty abstract name")
+	}
+
+	servererror := make(chan error)
+
+	go func() {
+		servererror <- service.Listen(address, 0)
+	}()
+
+	time.Sleep(time.Second / 5)
+
+	c, err := varlink.DialContext(context.Background(), address+";mode=0666")
+	if err != nil {
+		t.Fatalf("DialContext(): %v", err)
+	}
+	var vendor string
+	if err := c.GetInfo(&vendor, nil, nil, nil, nil); err != nil || vendor != "Varlink" {
+		t.Fatalf("GetInfo(): '%s' %v", vendor, err)
+	}
+	c.Close()
+
+	service.Shutdown()
+
+	if err := <-servererror; err != nil {
+		t.Fatalf("service.Listen(): %v", err)
+	}
+}
+
+func TestPool(t *testing.T) {
+	service, err := varlink.NewService(
+		"Varlink",
+		"Varlink Test",
+		"1",
+		"https://github.com/varlink/go/varlink",
+	)
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+
+	servererror := make(chan error)
+
+	go func() {
+		servererror <- service.Listen("unix:varlinkexternal_TestPool", 0)
+	}()
+
+	time.Sleep(time.Second / 5)
+
+	if _, err := varlink.NewPool("unix:varlinkexternal_TestPool", 0); err == nil {
+		t.Fatal("NewPool() accepted an empty pool")
+	}
+
+	var mutex sync.Mutex
+	var conns []net.Conn
+	dial := func(ctx context.Context, protocol, address string) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, protocol, address)
+		if err == nil {
+			mutex.Lock()
+			conns = append(conns, conn)
+			mutex.Unlock()
+		}
+		return conn, err
+	}
+	dials := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(conns)
+	}
+
+	pool, err := varlink.NewPool("unix:varlinkexternal_TestPool", 2,
+		varlink.WithPoolDialOptions(varlink.WithDialFunc(dial)),
+		varlink.WithHealthCheck(0))
+	if err != nil {
+		t.Fatalf("NewPool(): %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errors := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var info struct {
+				Vendor string `json:"vendor"`
+			}
+			err := pool.Call(context.Background(), "org.varlink.service.GetInfo", nil, &info)
+			if err == nil && info.Vendor != "Varlink" {
+				err = fmt.Errorf("unexpected vendor '%s'", info.Vendor)
+			}
+			errors <- err
+		}()
+	}
+	wg.Wait()
+	close(errors)
+	for err := range errors {
+		if err != nil {
+			t.Fatalf("Call(): %v", err)
+		}
+	}
+	if n := dials(); n < 1 || n > 2 {
+		t.Fatalf("Pool of 2 dialed %d connections", n)
+	}
+
+	// A call to an unknown method does not discard the connection
+	c, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get(): %v", err)
+	}
+	err = c.Call("org.varlink.service.Unknown", nil, nil)
+	if _, ok := err.(*varlink.Error); !ok {
+		t.Fatalf("Call(): %v", err)
+	}
+	pool.Put(c, err)
+
+	// The pool is full while both connections are checked out
+	c1, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get(): %v", err)
+	}
+	c2, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get(): %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second/10)
+	if _, err := pool.Get(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Get() of a full pool: %v", err)
+	}
+	cancel()
+	pool.Put(c1, nil)
+
+	// A broken connection is replaced
+	n := dials()
+	pool.Put(c2, fmt.Errorf("broken"))
+	c1, err = pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get(): %v", err)
+	}
+	c2, err = pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get(): %v", err)
+	}
+	if d := dials(); d != n+1 {
+		t.Fatalf("Pool dialed %d connections, expected %d", d, n+1)
+	}
+	if err := c2.Call("org.varlink.service.GetInfo", nil, nil); err != nil {
+		t.Fatalf("Call(): %v", err)
+	}
+	pool.Put(c1, nil)
+	pool.Put(c2, nil)
+	pool.Close()
+
+	// The health check replaces idle connections closed by the service
+	pool, err = varlink.NewPool("unix:varlinkexternal_TestPool", 1,
+		varlink.WithPoolDialOptions(varlink.WithDialFunc(dial)),
+		varlink.WithHealthCheck(time.Nanosecond))
+	if err != nil {
+		t.Fatalf("NewPool(): %v", err)
+	}
+	if err := pool.Call(context.Background(), "org.varlink.service.GetInfo", nil, nil); err != nil {
+		t.Fatalf("Call(): %v", err)
+	}
+	mutex.Lock()
+	conns[len(conns)-1].Close()
+	n = len(conns)
+	mutex.Unlock()
+	if err := pool.Call(context.Background(), "org.varlink.service.GetInfo", nil, nil); err != nil {
+		t.Fatalf("Call() after the health check: %v", err)
+	}
+	if d := dials(); d != n+1 {
+		t.Fatalf("Pool dialed %d connections, expected %d", d, n+1)
+	}
+
+	pool.Close()
+	if _, err := pool.Get(context.Background()); err == nil {
+		t.Fatal("Get() of a closed pool succeeded")
+	}
+
+	service.Shutdown()
+
+	if err := <-servererror; err != nil {
+		t.Fatalf("service.Listen(): %v", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	service, err := varlink.NewService(
+		"Varlink",
+		"Varlink Test",
+		"1",
+		"https://github.com/varlink/go/varlink",
+	)
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+
+	servererror := make(chan error)
+
+	go func() {
+		servererror <- service.Listen("unix:varlinkexternal_TestReconnect", 0)
+	}()
+
+	time.Sleep(time.Second / 5)
+
+	var conn net.Conn
+	failures := 0
+	dial := func(ctx context.Context, protocol, address string) (net.Conn, error) {
+		if failures > 0 {
+			failures--
+			return nil, fmt.Errorf("dial failed")
+		}
+		var d net.Dialer
+		var err error
+		conn, err = d.DialContext(ctx, protocol, address)
+		return conn, err
+	}
+
+	type attempt struct {
+		n   int
+		err error
+	}
+	var attempts []attempt
+	hook := func(n int, err error) {
+		attempts = append(attempts, attempt{n, err})
+	}
+
+	c, err := varlink.DialContext(context.Background(), "unix:varlinkexternal_TestReconnect",
+		varlink.WithDialFunc(dial),
+		varlink.WithReconnect(time.Millisecond, 4*time.Millisecond),
+		varlink.WithReconnectHook(hook))
+	if err != nil {
+		t.Fatalf("DialContext(): %v", err)
+	}
+	defer c.Close()
+
+	if err := c.GetInfo(nil, nil, nil, nil, nil); err != nil {
+		t.Fatalf("GetInfo(): %v", err)
+	}
+
+	// The call which notices the broken transport fails, the next one
+	// reconnects after the failed attempts
+	pending, err := c.Send("org.varlink.service.GetInfo", nil, 0)
+	if err != nil {
+		t.Fatalf("Send(): %v", err)
+	}
+	conn.Close()
+	if err := c.GetInfo(nil, nil, nil, nil, nil); err == nil {
+		t.Fatal("GetInfo() succeeded on a closed transport")
+	}
+	failures = 2
+	if err := c.GetInfo(nil, nil, nil, nil, nil); err != nil {
+		t.Fatalf("GetInfo() after the reconnect: %v", err)
+	}
+	if len(attempts) != 3 || attempts[0].err == nil || attempts[1].err == nil || attempts[2].n != 3 || attempts[2].err != nil {
+		t.Fatalf("Unexpected reconnect attempts: %v", attempts)
+	}
+	if _, err := pending(nil); err == nil {
+		t.Fatal("Received a reply of a call sent before the reconnect")
+	}
+
+	// The reconnect attempts are limited by the context of the call
+	conn.Close()
+	c.GetInfo(nil, nil, nil, nil, nil)
+	failures = 1000
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second/10)
+	defer cancel()
+	if _, err := c.SendWithOptions("org.varlink.service.GetInfo", nil, varlink.WithContext(ctx)); err != context.DeadlineExceeded {
+		t.Fatalf("SendWithOptions(): %v", err)
+	}
+
+	// A closed connection does not reconnect
+	failures = 0
+	n := len(attempts)
+	c.Close()
+	if err := c.GetInfo(nil, nil, nil, nil, nil); err == nil {
+		t.Fatal("GetInfo() succeeded on a closed connection")
+	}
+	if err := c.GetInfo(nil, nil, nil, nil, nil); err == nil || len(attempts) != n {
+		t.Fatalf("Closed connection reconnected: %v", err)
+	}
+
+	service.Shutdown()
+
+	if err := <-servererror; err != nil {
+		t.Fatalf("service.Listen(): %v", err)
+	}
+}
+
+func TestConcurrentCalls(t *testing.T) {
+	service, err := varlink.NewService(
+		"Varlink",
+		"Varlink Test",
+		"1",
+		"https://github.com/varlink/go/varlink",
+	)
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+
+	servererror := make(chan error)
+
+	go func() {
+		servererror <- service.Listen("unix:varlinkexternal_TestConcurrentCalls", 0)
+	}()
+
+	time.Sleep(time.Second / 5)
+
+	c, err := varlink.DialContext(context.Background(), "unix:varlinkexternal_TestConcurrentCalls")
+	if err != nil {
+		t.Fatalf("DialContext(): %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errors := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				switch (i + n) % 3 {
+				case 0:
+					var vendor string
+					if err := c.GetInfo(&vendor, nil, nil, nil, nil); err != nil || vendor != "Varlink" {
+						errors <- fmt.Errorf("GetInfo(): '%s' %v", vendor, err)
+						return
+					}
+				case 1:
+					description, err := c.GetInterfaceDescription("org.varlink.service")
+					if err != nil || !strings.HasPrefix(description, "# The Varlink Service Interface") {
+						errors <- fmt.Errorf("GetInterfaceDescription(): %v", err)
+						return
+					}
+				case 2:
+					err := c.Call("org.varlink.service.Unknown", nil, nil)
+					if e, ok := err.(*varlink.Error); !ok || e.Name != "org.varlink.service.MethodNotFound" {
+						errors <- fmt.Errorf("Call(): %v", err)
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errors)
+	for err := range errors {
+		t.Fatal(err)
+	}
+
+	c.Close()
+	if err := c.GetInfo(nil, nil, nil, nil, nil); err == nil || err.Error() != "connection is closed" {
+		t.Fatalf("GetInfo() of a closed connection: %v", err)
+	}
+
+	service.Shutdown()
+
+	if err := <-servererror; err != nil {
+		t.Fatalf("service.Listen(): %v", err)
+	}
+}
+
+// countingConn counts the writes to a connection.
+type countingConn struct {
+	net.Conn
+	writes *int32
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func TestKeepalive(t *testing.T) {
+	service, err := varlink.NewService(
+		"Varlink",
+		"Varlink Test",
+		"1",
+		"https://github.com/varlink/go/varlink",
+	)
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+
+	servererror := make(chan error)
+
+	go func() {
+		servererror <- service.Listen("unix:varlinkexternal_TestKeepalive", 0)
+	}()
+
+	time.Sleep(time.Second / 5)
+
+	var writes int32
+	conns := make(chan net.Conn, 2)
+	dial := func(ctx context.Context, protocol, address string) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, protocol, address)
+		if err != nil {
+			return nil, err
+		}
+		conns <- conn
+		return countingConn{conn, &writes}, nil
+	}
+
+	failures := make(chan error, 10)
+	hook := func(err error) {
+		failures <- err
+	}
+
+	c, err := varlink.DialContext(context.Background(), "unix:varlinkexternal_TestKeepalive",
+		varlink.WithDialFunc(dial),
+		varlink.WithKeepalive(20*time.Millisecond, "org.example.Unknown"),
+		varlink.WithKeepaliveHook(hook))
+	if err != nil {
+		t.Fatalf("DialContext(): %v", err)
+	}
+	defer c.Close()
+
+	time.Sleep(time.Second / 5)
+	if atomic.LoadInt32(&writes) == 0 {
+		t.Fatal("No keepalive call was sent on the idle connection")
+	}
+	if err := c.GetInfo(nil, nil, nil, nil, nil); err != nil {
+		t.Fatalf("GetInfo(): %v", err)
+	}
+
+	// The failed keepalive call is returned by the next call
+	(<-conns).Close()
+	select {
+	case <-failures:
+	case <-time.After(time.Second):
+		t.Fatal("The failed keepalive call was not reported")
+	}
+	if err := c.GetInfo(nil, nil, nil, nil, nil); err == nil || !strings.Contains(err.Error(), "keepalive") {
+		t.Fatalf("GetInfo() after the keepalive failure: %v", err)
+	}
+
+	// A reconnecting connection re-dials after the failure
+	r, err := varlink.DialContext(context.Background(), "unix:varlinkexternal_TestKeepalive",
+		varlink.WithDialFunc(dial),
+		varlink.WithReconnect(time.Millisecond, time.Millisecond),
+		varlink.WithKeepalive(20*time.Millisecond, ""),
+		varlink.WithKeepaliveHook(hook))
+	if err != nil {
+		t.Fatalf("DialContext(): %v", err)
+	}
+	defer r.Close()
+
+	(<-conns).Close()
+	select {
+	case <-failures:
+	case <-time.After(time.Second):
+		t.Fatal("The failed keepalive call was not reported")
+	}
+	if err := r.GetInfo(nil, nil, nil, nil, nil); err != nil {
+		t.Fatalf("GetInfo() after the reconnect: %v", err)
+	}
+
+	r.Close()
+	service.Shutdown()
+
+	if err := <-servererror; err != nil {
+		t.Fatalf("service.Listen(): %v", err)
+	}
+}
+
+// testCertificate returns a self-signed certificate for 127.0.0.1 which
+// authenticates servers and clients.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %v", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "varlink test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate(): %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate(): %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// certificateInterface replies with the common name of the verified client
+// certificate.
+type certificateInterface struct{}
+
+func (certificateInterface) VarlinkDispatch(call varlink.Call, methodname string) error {
+	var out struct {
+		Name string `json:"name"`
+	}
+	if cert := call.PeerCertificate(); cert != nil {
+		out.Name = cert.Subject.CommonName
+	}
+	return call.Reply(&out)
+}
+
+func (certificateInterface) VarlinkGetName() string {
+	return `org.example.certificate`
+}
+
+func (certificateInterface) VarlinkGetDescription() string {
+	return "interface org.example.certificate\nmethod Get() -> (name: string)"
+}
+
+func TestTLS(t *testing.T) {
+	cert, pool := testCertificate(t)
+
+	service, err := varlink.NewService(
+		"Varlink",
+		"Varlink Test",
+		"1",
+		"https://github.com/varlink/go/varlink",
+	)
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+
+	if err := service.Listen("tcp+tls:127.0.0.1:0", 0); err == nil {
+		t.Fatal("Listen() accepted tcp+tls without a TLS configuration")
+	}
+	if err := service.RegisterInterface(certificateInterface{}); err != nil {
+		t.Fatalf("RegisterInterface(): %v", err)
+	}
+
+	err = service.SetTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatalf("SetTLSConfig(): %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	address := "tcp+tls:" + l.Addr().String()
+	l.Close()
+
+	servererror := make(chan error)
+
+	go func() {
+		servererror <- service.Listen(address, 0)
+	}()
+
+	time.Sleep(time.Second / 5)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := varlink.DialContext(ctx, address, varlink.WithTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+	}))
+	if err != nil {
+		t.Fatalf("DialContext(): %v", err)
+	}
+	var vendor string
+	if err := c.GetInfo(&vendor, nil, nil, nil, nil); err != nil || vendor != "Varlink" {
+		t.Fatalf("GetInfo(): '%s' %v", vendor, err)
+	}
+	var out struct {
+		Name string `json:"name"`
+	}
+	if err := c.Call("org.example.certificate.Get", nil, &out); err != nil || out.Name != "varlink test" {
+		t.Fatalf("PeerCertificate(): '%s' %v", out.Name, err)
+	}
+	c.Close()
+
+	// The client does not trust the certificate of the service
+	if _, err := varlink.DialContext(ctx, address); err == nil {
+		t.Fatal("DialContext() accepted an unknown certificate")
+	}
+
+	// The service does not accept clients without certificate
+	c, err = varlink.DialContext(ctx, address, varlink.WithTLSConfig(&tls.Config{RootCAs: pool}))
+	if err == nil {
+		err = c.GetInfo(&vendor, nil, nil, nil, nil)
+		c.Close()
+	}
+	if err == nil {
+		t.Fatal("Service accepted a client without certificate")
+	}
+
+	service.Shutdown()
+
+	if err := <-servererror; err != nil {
+		t.Fatalf("service.Listen(): %v", err)
+	}
+}
+
+func TestDialFunc(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		// Reply to GetInfo
+		b := make([]byte, 1024)
+		if _, err := server.Read(b); err != nil {
+			return
+		}
+		server.Write([]byte(`{"parameters":{"vendor":"Pipe"}}` + "\000"))
+	}()
+
+	var protocol, address string
+	dial := func(ctx context.Context, p string, a string) (net.Conn, error) {
+		protocol, address = p, a
+		return client, nil
+	}
+
+	c, err := varlink.DialContext(context.Background(), "pipe:test;x=1", varlink.WithDialFunc(dial))
+	if err != nil {
+		t.Fatalf("DialContext(): %v", err)
+	}
+	defer c.Close()
+	if protocol != "pipe" || address != "test" {
+		t.Fatalf("DialFunc called with '%s' '%s'", protocol, address)
+	}
+
+	var vendor string
+	if err := c.GetInfo(&vendor, nil, nil, nil, nil); err != nil || vendor != "Pipe" {
+		t.Fatalf("GetInfo(): '%s' %v", vendor, err)
+	}
+}
+
+func TestNewConnectionFromConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		b := make([]byte, 1024)
+		if _, err := server.Read(b); err != nil {
+			return
+		}
+		server.Write([]byte(`{"parameters":{"description":"interface org.example.pipe"}}` + "\000"))
+	}()
+
+	c := varlink.NewConnectionFromConn(client)
+	defer c.Close()
+
+	description, err := c.GetInterfaceDescription("org.example.pipe")
+	if err != nil || description != "interface org.example.pipe" {
+		t.Fatalf("GetInterfaceDescription(): '%s' %v", description, err)
+	}
+}
+
+func TestPipe(t *testing.T) {
+	service, err := varlink.NewService(
+		"Varlink",
+		"Varlink Test",
+		"1",
+		"https://github.com/varlink/go/varlink",
+	)
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+	if err := service.RegisterInterface(&VarlinkInterface{}); err != nil {
+		t.Fatalf("RegisterInterface(): %v", err)
+	}
+
+	var c varlink.Conn = varlink.NewPipe(service)
+	defer c.Close()
+
+	var info varlink.ServiceInfo
+	if err := c.CallWithOptions("org.varlink.service.GetInfo", nil, &info); err != nil || info.Vendor != "Varlink" {
+		t.Fatalf("GetInfo(): %+v %v", info, err)
+	}
+
+	err = c.CallWithOptions("org.example.test.Ping", nil, nil)
+	if !errors.Is(err, &varlink.Error{Name: "org.varlink.service.MethodNotImplemented"}) {
+		t.Fatalf("CallWithOptions(): %v", err)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no /bin/sh")
+	}
+
+	type echo struct {
+		Echo string `json:"echo"`
+	}
+
+	// cat sends the method call back, it is read as a reply with the
+	// parameters of the call
+	for _, address := range []string{"exec:cat", "exec:cat -u", "bridge:true; cat | cat"} {
+		c, err := varlink.DialContext(context.Background(), address)
+		if err != nil {
+			t.Fatalf("DialContext(%s): %v", address, err)
+		}
+
+		for _, s := range []string{"a", "b"} {
+			var out echo
+			if err := c.Call("org.example.test.Echo", echo{Echo: s}, &out); err != nil || out.Echo != s {
+				t.Fatalf("Call() over %s: '%s' %v", address, out.Echo, err)
+			}
+		}
+		if err := c.Close(); err != nil {
+			t.Fatalf("Close(): %v", err)
+		}
+	}
+
+	c, err := varlink.DialContext(context.Background(), "bridge:exec sleep 10")
+	if err != nil {
+		t.Fatalf("DialContext(): %v", err)
+	}
+	err = c.CallWithOptions("org.example.test.Echo", nil, nil, varlink.WithTimeout(time.Second/10))
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Fatalf("Call() to a silent command: %v", err)
+	}
+	c.Close()
+
+	c, err = varlink.DialContext(context.Background(), "bridge:exit 1")
+	if err != nil {
+		t.Fatalf("DialContext(): %v", err)
+	}
+	if err := c.Call("org.example.test.Echo", nil, nil); err == nil {
+		t.Fatal("Call() to an exited command succeeded")
+	}
+	c.Close()
+
+	for _, address := range []string{"exec:", "bridge: ", "exec:/nonexistent/varlink"} {
+		if _, err := varlink.DialContext(context.Background(), address); err == nil {
+			t.Fatalf("DialContext(%s) succeeded", address)
+		}
+	}
+}
+
+func TestServeStdio(t *testing.T) {
+	service, err := varlink.NewService(
+		"Varlink",
+		"Varlink Test",
+		"1",
+		"https://github.com/varlink/go/varlink",
+	)
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+
+	// The test binary started by the exec: address serves the socket of
+	// its standard input
+	if flag.Arg(0) == "serve-stdio" {
+		if err := service.ServeStdio(); err != nil {
+			t.Fatalf("ServeStdio(): %v", err)
+		}
+		os.Exit(0)
+	}
+
+	c, err := varlink.DialContext(context.Background(), "exec:"+os.Args[0]+" -test.run=^TestServeStdio$ serve-stdio")
+	if err != nil {
+		t.Fatalf("DialContext(): %v", err)
+	}
+	defer c.Close()
+
+	var vendor string
+	if err := c.GetInfo(&vendor, nil, nil, nil, nil); err != nil || vendor != "Varlink" {
+		t.Fatalf("GetInfo(): '%s' %v", vendor, err)
+	}
+}
+
+func TestOnewayCall(t *testing.T) {
+	service, err := varlink.NewService("Varlink", "Varlink Test", "1", "https://github.com/varlink/go/varlink")
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+	if err := service.RegisterInterface(metadataInterface{}); err != nil {
+		t.Fatalf("RegisterInterface(): %v", err)
+	}
+
+	client, server := net.Pipe()
+	go service.ServeConn(server)
+	c := varlink.NewConnectionFromConn(client)
+	defer c.Close()
+
+	// The reply of the oneway call is not sent, the next call gets its
+	// own reply
+	if _, err := c.SendWithOptions("org.example.metadata.Get", map[string]int{"value": 1}, varlink.WithOneway()); err != nil {
+		t.Fatalf("SendWithOptions(): %v", err)
+	}
+	var out struct {
+		Parameters string
+	}
+	if err := c.CallWithOptions("org.example.metadata.Get", map[string]int{"value": 2}, &out, varlink.WithTimeout(5*time.Second)); err != nil {
+		t.Fatalf("CallWithOptions(): %v", err)
+	}
+	if out.Parameters != `{"value":2}` {
+		t.Fatalf("CallWithOptions() after a oneway call got the reply of: %s", out.Parameters)
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	service, err := varlink.NewService(
+		"Varlink",
+		"Varlink Test",
+		"1",
+		"https://github.com/varlink/go/varlink",
+	)
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+
+	client, server := net.Pipe()
+	served := make(chan struct{})
+	go func() {
+		service.ServeConn(server)
+		close(served)
+	}()
+
+	c := varlink.NewConnectionFromConn(client)
+	var vendor string
+	if err := c.GetInfo(&vendor, nil, nil, nil, nil); err != nil || vendor != "Varlink" {
+		t.Fatalf("GetInfo(): '%s' %v", vendor, err)
+	}
+	c.Close()
+
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeConn() did not return after the connection was closed")
+	}
+
+	os.Setenv("LISTEN_PID", "1")
+	if err := service.ServeActivatedConn(); err == nil {
+		t.Fatal("ServeActivatedConn() succeeded without a socket")
+	}
+}
+
+func TestRunActivated(t *testing.T) {
+	service, err := varlink.NewService(
+		"Varlink",
+		"Varlink Test",
+		"1",
+		"https://github.com/varlink/go/varlink",
+	)
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+
+	// The test binary started below serves the sockets it was passed
+	// like by systemd
+	if flag.Arg(0) == "run-activated" {
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		if err := service.RunActivated(context.Background(), "varlink", "api"); err != nil {
+			t.Fatalf("RunActivated(): %v", err)
+		}
+		os.Exit(0)
+	}
+
+	os.Setenv("LISTEN_PID", "1")
+	if err := service.RunActivated(context.Background()); err == nil {
+		t.Fatal("RunActivated() succeeded without sockets")
+	}
+
+	unixListener, err := net.Listen("unix", "varlinkexternal_TestRunActivated")
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	defer unixListener.Close()
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	defer tcpListener.Close()
+
+	var files []*os.File
+	for _, l := range []interface{ File() (*os.File, error) }{unixListener.(*net.UnixListener), tcpListener.(*net.TCPListener)} {
+		file, err := l.File()
+		if err != nil {
+			t.Fatalf("File(): %v", err)
+		}
+		defer file.Close()
+		files = append(files, file)
+	}
+
+	// The third socket is not served
+	unused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	defer unused.Close()
+	file, err := unused.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("File(): %v", err)
+	}
+	defer file.Close()
+	files = append(files, file)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRunActivated$", "run-activated")
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), "LISTEN_FDS=3", "LISTEN_FDNAMES=varlink:api:other")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start(): %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	for _, address := range []string{"unix:varlinkexternal_TestRunActivated", "tcp:" + tcpListener.Addr().String()} {
+		c, err := varlink.NewConnection(address)
+		if err != nil {
+			t.Fatalf("NewConnection(): %v", err)
+		}
+		var vendor string
+		if err := c.GetInfo(&vendor, nil, nil, nil, nil); err != nil || vendor != "Varlink" {
+			t.Fatalf("GetInfo(%s): '%s' %v", address, vendor, err)
+		}
+		c.Close()
+	}
+
+	// Nobody accepts the connections of the unused socket
+	conn, err := net.Dial("tcp", unused.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(`{"method":"org.varlink.service.GetInfo"}` + "\000"))
+	conn.SetReadDeadline(time.Now().Add(time.Second / 5))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("unused socket was served")
+	}
+}
+
+// filesInterface writes to the passed files, and passes a pipe with its reply.
+type filesInterface struct{}
+
+func (filesInterface) VarlinkDispatch(call varlink.Call, methodname string) error {
+	switch methodname {
+	case "Write":
+		files := call.TakeFiles()
+		for _, f := range files {
+			f.Write([]byte("hello"))
+			f.Close()
+		}
+		return call.Reply(map[string]int{"n": len(files)})
+
+	case "Open":
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		w.Write([]byte("pipe"))
+		w.Close()
+		return call.ReplyWithFiles(map[string]int{"n": 1}, r)
+	}
+	return call.ReplyMethodNotFound(methodname)
+}
+
+func (filesInterface) VarlinkGetName() string {
+	return `org.example.files`
+}
+
+func (filesInterface) VarlinkGetDescription() string {
+	return "interface org.example.files\nmethod Write() -> (n: int)\nmethod Open() -> (n: int)"
+}
+
+func TestServiceFiles(t *testing.T) {
+	for _, limits := range []varlink.Limits{{}, {WriteBuffer: 4096}} {
+		service, err := varlink.NewService("Varlink", "Varlink Test", "1", "https://github.com/varlink/go/varlink")
+		if err != nil {
+			t.Fatalf("NewService(): %v", err)
+		}
+		if err := service.RegisterInterface(filesInterface{}); err != nil {
+			t.Fatalf("RegisterInterface(): %v", err)
+		}
+		if err := service.SetLimits(limits); err != nil {
+			t.Fatalf("SetLimits(): %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- service.RunContext(ctx, "unix:varlinkexternal_TestServiceFiles") }()
+		time.Sleep(time.Second / 5)
+
+		c, err := varlink.DialContext(context.Background(), "unix:varlinkexternal_TestServiceFiles")
+		if err != nil {
+			t.Fatalf("DialContext(): %v", err)
+		}
+
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatalf("Pipe(): %v", err)
+		}
+		var out struct{ N int }
+		err = c.CallWithOptions("org.example.files.Write", nil, &out, varlink.WithFiles(w))
+		w.Close()
+		if err != nil || out.N != 1 {
+			t.Fatalf("CallWithOptions(): %d %v", out.N, err)
+		}
+		b := make([]byte, 16)
+		if n, err := r.Read(b); err != nil || string(b[:n]) != "hello" {
+			t.Fatalf("Read(): '%s' %v", b[:n], err)
+		}
+		r.Close()
+
+		var received []*os.File
+		err = c.CallWithOptions("org.example.files.Open", nil, &out, varlink.WithReceivedFiles(func(files []*os.File) {
+			received = files
+		}))
+		if err != nil || len(received) != 1 {
+			t.Fatalf("CallWithOptions(): %v %v", received, err)
+		}
+		if n, err := received[0].Read(b); err != nil || string(b[:n]) != "pipe" {
+			t.Fatalf("Read(): '%s' %v", b[:n], err)
+		}
+		received[0].Close()
+		c.Close()
+
+		cancel()
+		if err := <-done; err != nil {
+			t.Fatalf("RunContext(): %v", err)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+//go:build !windows
+// +build !windows
+
+package varlink_test
+
+import (
+	"fmt"
+	"github.com/varlink/go/varlink"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNewConnectionFromFd(t *testing.T) {
+	l, err := net.Listen("unix", "varlinkexternal_TestNewConnectionFromFd")
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b := make([]byte, 1024)
+		if _, err := conn.Read(b); err != nil {
+			return
+		}
+		conn.Write([]byte(`{"parameters":{"vendor":"Fd"}}` + "\000"))
+	}()
+
+	conn, err := net.Dial("unix", "varlinkexternal_TestNewConnectionFromFd")
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	file, err := conn.(*net.UnixConn).File()
+	conn.Close()
+	if err != nil {
+		t.Fatalf("File(): %v", err)
+	}
+	fd, err := syscall.Dup(int(file.Fd()))
+	file.Close()
+	if err != nil {
+		t.Fatalf("Dup(): %v", err)
+	}
+
+	c, err := varlink.NewConnectionFromFd(uintptr(fd))
+	if err != nil {
+		t.Fatalf("NewConnectionFromFd(): %v", err)
+	}
+	defer c.Close()
+
+	var vendor string
+	if err := c.GetInfo(&vendor, nil, nil, nil, nil); err != nil || vendor != "Fd" {
+		t.Fatalf("GetInfo(): '%s' %v", vendor, err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe(): %v", err)
+	}
+	defer w.Close()
+	fd, err = syscall.Dup(int(r.Fd()))
+	r.Close()
+	if err != nil {
+		t.Fatalf("Dup(): %v", err)
+	}
+	if _, err := varlink.NewConnectionFromFd(uintptr(fd)); err == nil {
+		t.Fatal("NewConnectionFromFd() accepted a pipe")
+	}
+}
+
+func TestFiles(t *testing.T) {
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: "varlinkexternal_TestFiles", Net: "unix"})
+	if err != nil {
+		t.Fatalf("ListenUnix(): %v", err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		b := make([]byte, 4096)
+		oob := make([]byte, syscall.CmsgSpace(4*4))
+		for {
+			n, oobn, _, _, err := conn.ReadMsgUnix(b, oob)
+			if err != nil {
+				return
+			}
+			call := string(b[:n])
+
+			switch {
+			case strings.Contains(call, "org.example.test.Write"):
+				// Write to the passed pipe
+				messages, _ := syscall.ParseSocketControlMessage(oob[:oobn])
+				for _, m := range messages {
+					fds, _ := syscall.ParseUnixRights(&m)
+					for _, fd := range fds {
+						syscall.Write(fd, []byte("hello"))
+						syscall.Close(fd)
+					}
+				}
+				conn.Write([]byte(`{"parameters":{}}` + "\000"))
+
+			case strings.Contains(call, "org.example.test.Open"):
+				// Three replies, the last two with a pipe
+				conn.Write([]byte(`{"parameters":{"n":1},"continues":true}` + "\000"))
+				for i, reply := range []string{`{"parameters":{"n":2},"continues":true}`, `{"parameters":{"n":3}}`} {
+					r, w, _ := os.Pipe()
+					fmt.Fprintf(w, "pipe%d", i+2)
+					w.Close()
+					conn.WriteMsgUnix([]byte(reply+"\000"), syscall.UnixRights(int(r.Fd())), nil)
+					r.Close()
+				}
+			}
+		}
+	}()
+
+	c, err := varlink.NewConnection("unix:varlinkexternal_TestFiles")
+	if err != nil {
+		t.Fatalf("NewConnection(): %v", err)
+	}
+	defer c.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe(): %v", err)
+	}
+	err = c.CallWithOptions("org.example.test.Write", nil, nil, varlink.WithFiles(w), varlink.WithTimeout(time.Second))
+	w.Close()
+	if err != nil {
+		t.Fatalf("CallWithOptions(): %v", err)
+	}
+	b := make([]byte, 16)
+	if n, err := r.Read(b); err != nil || string(b[:n]) != "hello" {
+		t.Fatalf("Read(): '%s' %v", b[:n], err)
+	}
+	r.Close()
+
+	var received [][]*os.File
+	receive, err := c.SendWithOptions("org.example.test.Open", nil, varlink.WithMore(),
+		varlink.WithReceivedFiles(func(files []*os.File) {
+			received = append(received, files)
+		}))
+	if err != nil {
+		t.Fatalf("SendWithOptions(): %v", err)
+	}
+	for n := 1; n <= 3; n++ {
+		var out struct {
+			N int `json:"n"`
+		}
+		if _, err := receive(&out); err != nil || out.N != n {
+			t.Fatalf("receive(): %d %v", out.N, err)
+		}
+		if n == 1 && len(received) != 0 {
+			t.Fatalf("reply %d received %d files", n, len(received))
+		}
+		if n > 1 {
+			if len(received) != n-1 || len(received[n-2]) != 1 {
+				t.Fatalf("reply %d received the files %v", n, received)
+			}
+			f := received[n-2][0]
+			m, _ := f.Read(b)
+			f.Close()
+			if string(b[:m]) != fmt.Sprintf("pipe%d", n) {
+				t.Fatalf("reply %d received the pipe '%s'", n, b[:m])
+			}
+		}
+	}
+
+	client, server := net.Pipe()
+	defer server.Close()
+	p := varlink.NewConnectionFromConn(client)
+	defer p.Close()
+	if err := p.CallWithOptions("org.example.test.Write", nil, nil, varlink.WithFiles(os.Stdin)); err == nil {
+		t.Fatal("Call() passed files over a pipe")
+	}
+}
@@ -0,0 +1,117 @@
+package varlink
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"time"
+)
+
+// fileTransport is a transport which passes files along with the messages,
+// like unix sockets with SCM_RIGHTS.
+type fileTransport interface {
+	// writeWithFiles writes the message and passes the files along with
+	// its first byte.
+	writeWithFiles(b []byte, files []*os.File) error
+
+	// readOffset returns the number of bytes read from the transport.
+	readOffset() int64
+
+	// takeFiles returns the files passed along with the bytes before the
+	// offset.
+	takeFiles(offset int64) []*os.File
+}
+
+// WithFiles passes the files along with the method call, like a tty, a pipe
+// or a sealed memfd. Files can only be passed over unix: connections. The
+// files remain owned by the caller.
+func WithFiles(files ...*os.File) CallOption {
+	return func(o *callOptions) {
+		o.files = append(o.files, files...)
+	}
+}
+
+// WithReceivedFiles sets the function which is called with the files the
+// service passes along with a reply, before the reply is returned. The function
+// takes ownership of the files; without a function, the received files are
+// closed.
+func WithReceivedFiles(f func(files []*os.File)) CallOption {
+	return func(o *callOptions) {
+		o.receivedFiles = f
+	}
+}
+
+// handOverFiles passes the received files of a reply to the function of the
+// call, or closes them.
+func handOverFiles(m *reply, o *callOptions) {
+	if len(m.files) == 0 {
+		return
+	}
+
+	if o.receivedFiles != nil {
+		o.receivedFiles(m.files)
+	} else {
+		closeFiles(m.files)
+	}
+	m.files = nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// TakeFiles returns the files which the client passed along with the method
+// call, and hands them over to the method. The files which are not taken are
+// closed after the method returned.
+func (c *Call) TakeFiles() []*os.File {
+	if c.conn == nil || c.writeMutex == nil {
+		return nil
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	files := c.conn.files
+	c.conn.files = nil
+	return files
+}
+
+// receiveFiles takes the files which were passed along with the call which
+// was read from the reader.
+func (sc *serviceConn) receiveFiles(reader *bufio.Reader) {
+	t, ok := sc.conn.(fileTransport)
+	if !ok {
+		return
+	}
+	files := t.takeFiles(t.readOffset() - int64(reader.Buffered()))
+
+	sc.writeMutex.Lock()
+	sc.files = files
+	sc.writeMutex.Unlock()
+}
+
+// writeWithFiles writes the reply and passes the files along with it, after
+// the buffered replies are written. It is called with the writeMutex held.
+func (sc *serviceConn) writeWithFiles(b []byte, files []*os.File) error {
+	t, ok := sc.conn.(fileTransport)
+	if !ok {
+		return fmt.Errorf("files can only be passed over unix sockets")
+	}
+
+	if w := sc.connWriter; w != nil {
+		if err := w.drain(); err != nil {
+			return err
+		}
+		if w.timeout > 0 {
+			sc.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+		}
+	}
+
+	err := t.writeWithFiles(b, files)
+	if err != nil && sc.connWriter != nil {
+		sc.conn.Close()
+	}
+	return err
+}
@@ -0,0 +1,176 @@
+//go:build !windows
+// +build !windows
+
+package varlink
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// The maximum number of files passed along with a single read
+const maxReceivedFiles = 253
+
+type receivedFiles struct {
+	// The offset of the last byte read along with the files
+	offset int64
+	files  []*os.File
+}
+
+// unixConn is a unix socket connection which receives the files passed along
+// with the messages. The kernel ends a read after the data which carries
+// files, so the files belong to the message with the last byte of the read.
+type unixConn struct {
+	*net.UnixConn
+
+	// Only the reading caller accesses the state of the reads, the
+	// mutex protects the received files from Close()
+	offset int64
+	oob    []byte
+	mutex  sync.Mutex
+	files  []receivedFiles
+}
+
+// commandSocket returns a connection over a socket pair, and the other end of
+// the pair as the standard input and output of a process.
+func commandSocket() (net.Conn, *os.File, *os.File, error) {
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	local := os.NewFile(uintptr(fds[0]), "varlink")
+	defer local.Close()
+	remote := os.NewFile(uintptr(fds[1]), "varlink")
+
+	conn, err := net.FileConn(local)
+	if err != nil {
+		remote.Close()
+		return nil, nil, nil, err
+	}
+	return conn, remote, remote, nil
+}
+
+// newTransport returns the transport of a connection over conn.
+func newTransport(conn net.Conn) net.Conn {
+	if u, ok := conn.(*net.UnixConn); ok {
+		return &unixConn{UnixConn: u}
+	}
+	return conn
+}
+
+func (u *unixConn) Read(b []byte) (int, error) {
+	if u.oob == nil {
+		u.oob = make([]byte, syscall.CmsgSpace(maxReceivedFiles*4))
+	}
+
+	n, oobn, _, _, err := u.ReadMsgUnix(b, u.oob)
+	if n < 0 {
+		// The read of a closed socket
+		n = 0
+	}
+	u.offset += int64(n)
+	if oobn > 0 {
+		if files := parseFiles(u.oob[:oobn]); len(files) > 0 {
+			u.mutex.Lock()
+			u.files = append(u.files, receivedFiles{offset: u.offset - 1, files: files})
+			u.mutex.Unlock()
+		}
+	}
+
+	return n, err
+}
+
+// parseFiles returns the files of the SCM_RIGHTS control messages.
+func parseFiles(oob []byte) []*os.File {
+	messages, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+
+	var files []*os.File
+	for i := range messages {
+		fds, err := syscall.ParseUnixRights(&messages[i])
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			syscall.CloseOnExec(fd)
+			files = append(files, os.NewFile(uintptr(fd), "varlink"))
+		}
+	}
+
+	return files
+}
+
+func (u *unixConn) readOffset() int64 {
+	return u.offset
+}
+
+func (u *unixConn) takeFiles(offset int64) []*os.File {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	var files []*os.File
+	for len(u.files) > 0 && u.files[0].offset < offset {
+		files = append(files, u.files[0].files...)
+		u.files = u.files[1:]
+	}
+	return files
+}
+
+func (u *unixConn) writeWithFiles(b []byte, files []*os.File) error {
+	return withFds(files, nil, func(fds []int) error {
+		n, _, err := u.WriteMsgUnix(b, syscall.UnixRights(fds...), nil)
+		if err == nil && n < len(b) {
+			_, err = u.Write(b[n:])
+		}
+		return err
+	})
+}
+
+// withFds calls f with the file descriptors of the files. Unlike Fd(), it
+// leaves the files in non-blocking mode.
+func withFds(files []*os.File, fds []int, f func(fds []int) error) error {
+	if len(files) == 0 {
+		return f(fds)
+	}
+
+	rc, err := files[0].SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	err = rc.Control(func(fd uintptr) {
+		ferr = withFds(files[1:], append(fds, int(fd)), f)
+	})
+	if err != nil {
+		return err
+	}
+	return ferr
+}
+
+// Close closes the socket and the received files no call took.
+func (u *unixConn) Close() error {
+	u.mutex.Lock()
+	for _, r := range u.files {
+		closeFiles(r.files)
+	}
+	u.files = nil
+	u.mutex.Unlock()
+
+	return u.UnixConn.Close()
+}
+
+// closeOnExec sets FD_CLOEXEC of the file descriptor.
+func closeOnExec(fd int) {
+	syscall.CloseOnExec(fd)
+}
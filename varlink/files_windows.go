@@ -0,0 +1,23 @@
+package varlink
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// commandSocket fails, the processes on Windows are started with pipes.
+func commandSocket() (net.Conn, *os.File, *os.File, error) {
+	return nil, nil, nil, fmt.Errorf("socket pairs are not supported on Windows")
+}
+
+// newTransport returns the transport of a connection over conn, files cannot
+// be passed on Windows.
+func newTransport(conn net.Conn) net.Conn {
+	return conn
+}
+
+// closeOnExec does nothing, the handles on Windows are not inherited by
+// default.
+func closeOnExec(fd int) {
+}
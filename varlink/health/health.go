@@ -0,0 +1,122 @@
+// Package health implements the org.varlink.health interface, a uniform
+// liveness and readiness probe of varlink services for orchestrators and
+// monitoring. A service registers it with
+//
+//	service.RegisterInterface(health.New())
+//
+// and adds the checks of its dependencies, like its database, with
+// AddCheck().
+package health
+
+import (
+	"context"
+	"sync"
+
+	"github.com/varlink/go/varlink"
+)
+
+const description = `# The health of a varlink service, like for the probes of orchestrators.
+interface org.varlink.health
+
+# The result of a health check of the service.
+type Check (
+  name: string,
+  healthy: bool,
+  message: ?string
+)
+
+# Replies while the service accepts and dispatches method calls.
+method Ping() -> ()
+
+# Runs the health checks of the service. It is healthy if all its checks are
+# healthy.
+method Status() -> (healthy: bool, checks: []Check)
+`
+
+// Check reports the health of a part of the service, like the connection to
+// its database. It returns nil if the part is healthy, or the error which is
+// the message of the check. The context is done when the connection of the
+// call is closed.
+type Check func(ctx context.Context) error
+
+// Interface is the org.varlink.health interface of a service. It can be used
+// by multiple goroutines.
+type Interface struct {
+	mutex  sync.Mutex
+	names  []string
+	checks map[string]Check
+}
+
+// New returns the org.varlink.health interface without checks, whose status
+// is healthy.
+func New() *Interface {
+	return &Interface{checks: make(map[string]Check)}
+}
+
+// AddCheck adds the check of the name to the status, or replaces the check of
+// the name. The checks are run in the order they were added.
+func (i *Interface) AddCheck(name string, check Check) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if _, ok := i.checks[name]; !ok {
+		i.names = append(i.names, name)
+	}
+	i.checks[name] = check
+}
+
+type checkResult struct {
+	Name    string  `json:"name"`
+	Healthy bool    `json:"healthy"`
+	Message *string `json:"message,omitempty"`
+}
+
+type status struct {
+	Healthy bool          `json:"healthy"`
+	Checks  []checkResult `json:"checks"`
+}
+
+// status runs the checks, and returns the status of the service.
+func (i *Interface) status(ctx context.Context) status {
+	i.mutex.Lock()
+	names := append([]string(nil), i.names...)
+	checks := make([]Check, len(names))
+	for n, name := range names {
+		checks[n] = i.checks[name]
+	}
+	i.mutex.Unlock()
+
+	s := status{Healthy: true, Checks: []checkResult{}}
+	for n, check := range checks {
+		result := checkResult{Name: names[n], Healthy: true}
+		if err := check(ctx); err != nil {
+			message := err.Error()
+			result.Healthy = false
+			result.Message = &message
+			s.Healthy = false
+		}
+		s.Checks = append(s.Checks, result)
+	}
+	return s
+}
+
+func (i *Interface) VarlinkDispatch(call varlink.Call, methodname string) error {
+	switch methodname {
+	case "Ping":
+		return call.Reply(nil)
+
+	case "Status":
+		return call.Reply(i.status(call.Context()))
+
+	default:
+		return call.ReplyMethodNotFound(methodname)
+	}
+}
+
+func (i *Interface) VarlinkGetName() string {
+	return "org.varlink.health"
+}
+
+func (i *Interface) VarlinkGetDescription() string {
+	return description
+}
@@ -0,0 +1,54 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/varlink/go/varlink"
+	"github.com/varlink/go/varlink/idl"
+)
+
+func TestHealth(t *testing.T) {
+	if _, err := idl.New(description); err != nil {
+		t.Fatalf("idl.New(): %v", err)
+	}
+
+	service, err := varlink.NewService("Varlink", "Varlink Test", "1", "https://github.com/varlink/go/varlink")
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+	health := New()
+	if err := service.RegisterInterface(health); err != nil {
+		t.Fatalf("RegisterInterface(): %v", err)
+	}
+
+	c := varlink.NewPipe(service)
+	defer c.Close()
+	if err := c.Call("org.varlink.health.Ping", nil, nil); err != nil {
+		t.Fatalf("Ping(): %v", err)
+	}
+
+	var out status
+	if err := c.Call("org.varlink.health.Status", nil, &out); err != nil || !reflect.DeepEqual(out, status{Healthy: true, Checks: []checkResult{}}) {
+		t.Fatalf("Status(): %+v %v", out, err)
+	}
+
+	health.AddCheck("database", func(ctx context.Context) error { return nil })
+	health.AddCheck("cache", func(ctx context.Context) error { return nil })
+	health.AddCheck("database", func(ctx context.Context) error { return fmt.Errorf("connection refused") })
+	message := "connection refused"
+	expected := status{Checks: []checkResult{
+		{Name: "database", Message: &message},
+		{Name: "cache", Healthy: true},
+	}}
+	out = status{}
+	if err := c.Call("org.varlink.health.Status", nil, &out); err != nil || !reflect.DeepEqual(out, expected) {
+		t.Fatalf("Status(): %+v %v", out, err)
+	}
+
+	if err := c.Call("org.varlink.health.Missing", nil, nil); err == nil {
+		t.Fatal("Call() of a missing method succeeded")
+	}
+}
@@ -37,6 +37,7 @@ type Type struct {
 // TypeField is a named member of a TypeStruct.
 type TypeField struct {
 	Name string
+	Doc  string
 	Type *Type
 }
 
@@ -44,6 +45,7 @@ type TypeField struct {
 type Alias struct {
 	Name string
 	Doc  string
+	Line int
 	Type *Type
 }
 
@@ -51,6 +53,7 @@ type Alias struct {
 type Method struct {
 	Name string
 	Doc  string
+	Line int
 	In   *Type
 	Out  *Type
 }
@@ -58,6 +61,8 @@ type Method struct {
 // Error represents an error defined in the interface description.
 type Error struct {
 	Name string
+	Doc  string
+	Line int
 	Type *Type
 }
 
@@ -76,6 +81,7 @@ type IDL struct {
 type parser struct {
 	input       string
 	position    int
+	line        int
 	lineStart   int
 	lastComment bytes.Buffer
 }
@@ -100,6 +106,7 @@ func (p *parser) advance() bool {
 		char := p.next()
 
 		if char == '\n' {
+			p.line++
 			p.lineStart = p.position
 			p.lastComment.Reset()
 
@@ -120,7 +127,10 @@ func (p *parser) advance() bool {
 				p.lastComment.WriteByte('\n')
 			}
 			p.lastComment.WriteString(p.input[start:p.position])
-			p.next()
+			if p.next() == '\n' {
+				p.line++
+				p.lineStart = p.position
+			}
 
 		} else {
 			p.backup()
@@ -221,6 +231,9 @@ func (p *parser) readStructType() *Type {
 	t := &Type{Kind: TypeStruct}
 	t.Fields = make([]TypeField, 0)
 
+	// Comments in front of the opening bracket belong to the enclosing member
+	p.lastComment.Reset()
+
 	char := p.next()
 	if char != ')' {
 		p.backup()
@@ -229,6 +242,8 @@ func (p *parser) readStructType() *Type {
 			field := TypeField{}
 
 			p.advance()
+			field.Doc = p.lastComment.String()
+			p.lastComment.Reset()
 			field.Name = p.readFieldName()
 			if field.Name == "" {
 				return nil
@@ -393,6 +408,7 @@ func (p *parser) readError(idl *IDL) (*Error, error) {
 	e := &Error{}
 
 	p.advance()
+	e.Doc = p.lastComment.String()
 	e.Name = p.readTypeName()
 	if e.Name == "" {
 		return nil, fmt.Errorf("missing error name")
@@ -428,6 +444,9 @@ func (p *parser) readIDL() (*IDL, error) {
 			break
 		}
 
+		// Line numbers start at 1
+		line := p.line + 1
+
 		switch keyword := p.readKeyword(); keyword {
 		case "type":
 			a, err := p.readAlias(idl)
@@ -435,6 +454,7 @@ func (p *parser) readIDL() (*IDL, error) {
 				return nil, err
 			}
 
+			a.Line = line
 			idl.Members = append(idl.Members, a)
 			idl.Aliases[a.Name] = a
 
@@ -444,6 +464,7 @@ func (p *parser) readIDL() (*IDL, error) {
 				return nil, err
 			}
 
+			m.Line = line
 			idl.Members = append(idl.Members, m)
 			if _, ok := idl.Methods[m.Name]; ok {
 				return nil, fmt.Errorf("method `%s` already defined", m.Name)
@@ -456,6 +477,7 @@ func (p *parser) readIDL() (*IDL, error) {
 				return nil, err
 			}
 
+			e.Line = line
 			idl.Members = append(idl.Members, e)
 			idl.Errors[e.Name] = e
 
@@ -148,3 +148,115 @@ interface foo.example
 	method F() -> ()
 `)
 }
+
+func TestFieldDoc(t *testing.T) {
+	midl, err := New(`
+interface foo.bar
+
+# The type
+type I (
+  # The first field
+  # spans two lines
+  a: bool, b: bool,
+
+  c: (
+    # nested
+    d: int
+  )
+)
+
+# The method
+method F(x: int) -> ()
+
+# The error
+error E ()
+`)
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+
+	fields := midl.Aliases["I"].Type.Fields
+	for i, doc := range []string{"The first field\nspans two lines", "", ""} {
+		if fields[i].Doc != doc {
+			t.Fatalf("field '%s': expected doc `%s`, got `%s`", fields[i].Name, doc, fields[i].Doc)
+		}
+	}
+	if doc := fields[2].Type.Fields[0].Doc; doc != "nested" {
+		t.Fatalf("nested field: expected doc `nested`, got `%s`", doc)
+	}
+	if doc := midl.Methods["F"].In.Fields[0].Doc; doc != "" {
+		t.Fatalf("method parameter: expected no doc, got `%s`", doc)
+	}
+	if doc := midl.Errors["E"].Doc; doc != "The error" {
+		t.Fatalf("error: expected doc `The error`, got `%s`", doc)
+	}
+}
+
+func TestLineNumbers(t *testing.T) {
+	midl, err := New(`interface foo.bar
+
+# A type
+# with a long description
+type I (
+  a: bool
+)
+
+method F(i: I) -> ()
+error E ()`)
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+
+	if line := midl.Aliases["I"].Line; line != 5 {
+		t.Fatalf("type I: expected line 5, got %d", line)
+	}
+	if line := midl.Methods["F"].Line; line != 9 {
+		t.Fatalf("method F: expected line 9, got %d", line)
+	}
+	if line := midl.Errors["E"].Line; line != 10 {
+		t.Fatalf("error E: expected line 10, got %d", line)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	midl, err := New(`interface org.example.validate
+type Disk (name: string, size: int, mode: (ro, rw))
+method Create(disks: []Disk, labels: [string]string, ratio: float, force: ?bool, data: object) -> ()`)
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+
+	for _, test := range []struct {
+		parameters string
+		field      string
+	}{
+		{`{"disks":[{"name":"a","size":1,"mode":"ro"}],"labels":{"x":"y"},"ratio":0.5,"data":{"any":[1]}}`, ""},
+		{`{"disks":[],"labels":{},"ratio":1,"force":null,"data":null}`, ""},
+		{`{"disks":[],"labels":{},"ratio":1,"force":true,"data":1}`, ""},
+		{`{"disks":[{"name":"a","size":1.5,"mode":"ro"}],"labels":{},"ratio":1,"data":1}`, "disks[0].size"},
+		{`{"disks":[{"name":"a","size":1,"mode":"rx"}],"labels":{},"ratio":1,"data":1}`, "disks[0].mode"},
+		{`{"disks":[{"name":"a","mode":"ro"}],"labels":{},"ratio":1,"data":1}`, "disks[0].size"},
+		{`{"disks":[],"labels":{"x":1},"ratio":1,"data":1}`, `labels["x"]`},
+		{`{"disks":[],"labels":{},"ratio":"1","data":1}`, "ratio"},
+		{`{"disks":[],"labels":{},"ratio":1,"force":"yes","data":1}`, "force"},
+		{`{"disks":[],"labels":{},"ratio":1,"data":1,"other":1}`, "other"},
+		{`{"disks":{},"labels":{},"ratio":1,"data":1}`, "disks"},
+		{`null`, "disks"},
+	} {
+		err := midl.ValidateIn("Create", []byte(test.parameters))
+		if test.field == "" {
+			if err != nil {
+				t.Fatalf("ValidateIn(`%s`): %v", test.parameters, err)
+			}
+			continue
+		}
+		e, ok := err.(*ValidationError)
+		if !ok || e.Field != test.field {
+			t.Fatalf("ValidateIn(`%s`): %v, expected an error of %s", test.parameters, err, test.field)
+		}
+	}
+
+	if err := midl.ValidateIn("Delete", nil); err == nil {
+		t.Fatal("ValidateIn() of an unknown method succeeded")
+	}
+}
@@ -0,0 +1,167 @@
+package idl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// ValidationError describes a value which does not match its type.
+type ValidationError struct {
+	// The path of the invalid field, like "disks[2].name", or "" for the
+	// value itself
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Field == "" {
+		return e.Reason
+	}
+	return fmt.Sprintf("%s: %s", e.Field, e.Reason)
+}
+
+// Validate checks the JSON value against the type, with the aliases of the
+// interface. A value which does not match the type returns a
+// *ValidationError. Fields of optional types can be missing or null, unknown
+// fields of structs are invalid.
+func (idl *IDL) Validate(t *Type, value []byte) error {
+	d := json.NewDecoder(bytes.NewReader(value))
+	d.UseNumber()
+
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return &ValidationError{Reason: fmt.Sprintf("invalid JSON: %v", err)}
+	}
+	return idl.validate(t, v, "")
+}
+
+// ValidateIn checks the JSON input parameters of the method. Parameters
+// which are null are the empty set of parameters.
+func (idl *IDL) ValidateIn(method string, parameters []byte) error {
+	m, ok := idl.Methods[method]
+	if !ok {
+		return fmt.Errorf("method `%s` is not defined by %s", method, idl.Name)
+	}
+	if len(parameters) == 0 || string(parameters) == "null" {
+		parameters = []byte("{}")
+	}
+	return idl.Validate(m.In, parameters)
+}
+
+func (idl *IDL) validate(t *Type, v interface{}, field string) error {
+	invalid := func(format string, args ...interface{}) error {
+		return &ValidationError{Field: field, Reason: fmt.Sprintf(format, args...)}
+	}
+
+	if t.Kind == TypeMaybe {
+		if v == nil {
+			return nil
+		}
+		return idl.validate(t.ElementType, v, field)
+	}
+	if v == nil && t.Kind != TypeObject && t.Kind != TypeAlias {
+		return invalid("missing value")
+	}
+
+	switch t.Kind {
+	case TypeBool:
+		if _, ok := v.(bool); !ok {
+			return invalid("expected a bool")
+		}
+
+	case TypeInt:
+		n, ok := v.(json.Number)
+		if !ok {
+			return invalid("expected an int")
+		}
+		if _, err := n.Int64(); err != nil {
+			return invalid("expected an int, got %s", n)
+		}
+
+	case TypeFloat:
+		if _, ok := v.(json.Number); !ok {
+			return invalid("expected a float")
+		}
+
+	case TypeString:
+		if _, ok := v.(string); !ok {
+			return invalid("expected a string")
+		}
+
+	case TypeObject:
+
+	case TypeArray:
+		a, ok := v.([]interface{})
+		if !ok {
+			return invalid("expected an array")
+		}
+		for i, e := range a {
+			if err := idl.validate(t.ElementType, e, fmt.Sprintf("%s[%d]", field, i)); err != nil {
+				return err
+			}
+		}
+
+	case TypeMap:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return invalid("expected a map")
+		}
+		for key, e := range m {
+			if err := idl.validate(t.ElementType, e, field+"["+strconv.Quote(key)+"]"); err != nil {
+				return err
+			}
+		}
+
+	case TypeEnum:
+		s, ok := v.(string)
+		if !ok {
+			return invalid("expected a string")
+		}
+		for _, f := range t.Fields {
+			if f.Name == s {
+				return nil
+			}
+		}
+		return invalid("unknown value '%s'", s)
+
+	case TypeStruct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return invalid("expected an object")
+		}
+		known := make(map[string]bool, len(t.Fields))
+		for _, f := range t.Fields {
+			known[f.Name] = true
+			e, ok := m[f.Name]
+			if !ok && f.Type.Kind != TypeMaybe {
+				return &ValidationError{Field: join(field, f.Name), Reason: "missing field"}
+			}
+			if err := idl.validate(f.Type, e, join(field, f.Name)); err != nil {
+				return err
+			}
+		}
+		for name := range m {
+			if !known[name] {
+				return &ValidationError{Field: join(field, name), Reason: "unknown field"}
+			}
+		}
+
+	case TypeAlias:
+		a, ok := idl.Aliases[t.Alias]
+		if !ok {
+			return invalid("unknown type %s", t.Alias)
+		}
+		return idl.validate(a.Type, v, field)
+	}
+
+	return nil
+}
+
+func join(field string, name string) string {
+	if field == "" {
+		return name
+	}
+	return field + "." + name
+}
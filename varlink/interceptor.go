@@ -0,0 +1,96 @@
+package varlink
+
+import (
+	"context"
+	"fmt"
+)
+
+// Invoker sends a method call and returns the receive() function of its
+// replies, like SendWithOptions().
+type Invoker func(ctx context.Context, method string, parameters interface{}) (func(interface{}) (uint64, error), error)
+
+// Interceptor is called for every method call sent with SendWithOptions() and
+// the calls built on it. It sends the call with next, and returns the
+// receive() function of the replies, which it can wrap to inspect the
+// replies. An interceptor can modify the context, the method and the
+// parameters of the call, like to add an authentication token, log or measure
+// the calls, or retry a failed call by calling next again.
+type Interceptor func(ctx context.Context, method string, parameters interface{}, next Invoker) (func(interface{}) (uint64, error), error)
+
+// WithInterceptors adds interceptors for the calls of the connection. The
+// first interceptor is called first, the last one calls the connection.
+func WithInterceptors(interceptors ...Interceptor) DialOption {
+	return func(o *dialOptions) {
+		o.interceptors = append(o.interceptors, interceptors...)
+	}
+}
+
+// Intercept adds interceptors for the calls of the connection, after the
+// interceptors of WithInterceptors(). The calls already sent are not
+// intercepted.
+func (c *Connection) Intercept(interceptors ...Interceptor) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.interceptors = append(c.interceptors[:len(c.interceptors):len(c.interceptors)], interceptors...)
+}
+
+// intercept sends the call through the interceptors of the connection. The
+// context of the call is the one of WithContext(), or the background context.
+func (c *Connection) intercept(interceptors []Interceptor, method string, parameters interface{}, o callOptions) (func(interface{}) (uint64, error), error) {
+	background := o.ctx
+	if background == nil {
+		background = context.Background()
+	}
+
+	var invoke Invoker = func(ctx context.Context, method string, parameters interface{}) (func(interface{}) (uint64, error), error) {
+		o := o
+		if ctx != background {
+			o.ctx = ctx
+		}
+		return c.sendWithOptions(method, parameters, &o)
+	}
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoke
+		invoke = func(ctx context.Context, method string, parameters interface{}) (func(interface{}) (uint64, error), error) {
+			return interceptor(ctx, method, parameters, next)
+		}
+	}
+
+	return invoke(background, method, parameters)
+}
+
+// CallHandler handles a method call of a service and sends its replies. An
+// error closes the connection, like the error of a method.
+type CallHandler func(ctx context.Context, call *Call) error
+
+// ServiceInterceptor is called for every method call which a service
+// dispatches, including the calls of org.varlink.service. It handles the call
+// with next, which authorizes the call with the authorizer of SetAuthorizer()
+// and calls the method. An interceptor can wrap the context of the call, which
+// the methods get with Call.Context(), send an error reply instead of calling
+// next, like to deny the call, or log and measure the calls.
+type ServiceInterceptor func(ctx context.Context, call *Call, next CallHandler) error
+
+// Use adds interceptors for the method calls of the service. The first
+// interceptor is called first, the last one calls the method.
+func (s *Service) Use(interceptors ...ServiceInterceptor) error {
+	if s.running {
+		return fmt.Errorf("service is already running")
+	}
+	s.interceptors = append(s.interceptors, interceptors...)
+
+	return nil
+}
+
+// intercept handles the call through the interceptors of the service.
+func (s *Service) intercept(c *Call, handle CallHandler) error {
+	for i := len(s.interceptors) - 1; i >= 0; i-- {
+		interceptor, next := s.interceptors[i], handle
+		handle = func(ctx context.Context, c *Call) error {
+			return interceptor(ctx, c, next)
+		}
+	}
+
+	return handle(c.Context(), c)
+}
@@ -0,0 +1,80 @@
+//go:build go1.18
+// +build go1.18
+
+package varlink
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Invoke sends a method call with the typed parameters over the connection and
+// returns the typed method reply. The call is limited by the context, like
+// with WithContext().
+func Invoke[In, Out any](ctx context.Context, c *Connection, method string, in In, opts ...CallOption) (Out, error) {
+	var out Out
+
+	receive, err := c.SendWithOptions(method, in, append(opts[:len(opts):len(opts)], WithContext(ctx))...)
+	if err != nil {
+		return out, err
+	}
+
+	_, err = receive(&out)
+	return out, err
+}
+
+// InvokeMore sends a method call with the typed parameters and the More flag.
+// The returned function receives the typed replies one after the other, it
+// reports whether the service continues with more replies.
+func InvokeMore[In, Out any](ctx context.Context, c *Connection, method string, in In, opts ...CallOption) (func() (Out, bool, error), error) {
+	receive, err := c.SendWithOptions(method, in, append(opts[:len(opts):len(opts)], WithMore(), WithContext(ctx))...)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() (Out, bool, error) {
+		var out Out
+		flags, err := receive(&out)
+		return out, flags&Continues != 0, err
+	}, nil
+}
+
+// InvokeStream sends a method call with the typed parameters like Stream(), and
+// returns a channel with the typed replies.
+func InvokeStream[In, Out any](ctx context.Context, c *Connection, method string, in In, opts ...CallOption) (<-chan Out, <-chan error) {
+	ctx, cancel := context.WithCancel(ctx)
+	replies, errs := c.Stream(ctx, method, in, opts...)
+
+	out := make(chan Out)
+	outErrs := make(chan error, 1)
+	go func() {
+		defer close(outErrs)
+		defer close(out)
+		defer cancel()
+
+		for reply := range replies {
+			var v Out
+			if reply != nil {
+				if err := json.Unmarshal(reply, &v); err != nil {
+					// Stop the stream and wait for its end
+					cancel()
+					for range replies {
+					}
+					outErrs <- err
+					return
+				}
+			}
+
+			select {
+			case out <- v:
+			case <-ctx.Done():
+			}
+		}
+
+		if err := <-errs; err != nil {
+			outErrs <- err
+		}
+	}()
+
+	return out, outErrs
+}
@@ -0,0 +1,112 @@
+//go:build go1.18
+// +build go1.18
+
+package varlink
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+)
+
+func TestInvoke(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := NewConnectionFromConn(client)
+	defer c.Close()
+
+	type ping struct {
+		Ping string `json:"ping"`
+	}
+	type pong struct {
+		Pong string `json:"pong"`
+	}
+
+	replies := make(chan string, 1)
+	go func() {
+		r := bufio.NewReader(server)
+		for {
+			b, err := r.ReadBytes(0)
+			if err != nil {
+				return
+			}
+			replies <- string(b)
+			switch string(b) {
+			case `{"method":"org.example.test.Ping","parameters":{"ping":"a"}}` + "\000":
+				server.Write([]byte(`{"parameters":{"pong":"a"}}` + "\000"))
+			case `{"method":"org.example.test.Ping","parameters":{"ping":"b"},"more":true}` + "\000":
+				server.Write([]byte(`{"parameters":{"pong":"b1"},"continues":true}` + "\000"))
+				server.Write([]byte(`{"parameters":{"pong":"b2"}}` + "\000"))
+			default:
+				server.Write([]byte(`{"error":"org.example.test.Failed"}` + "\000"))
+			}
+		}
+	}()
+
+	out, err := Invoke[ping, pong](context.Background(), c, "org.example.test.Ping", ping{Ping: "a"})
+	if err != nil || out.Pong != "a" {
+		t.Fatalf("Invoke(): '%s' %v", out.Pong, err)
+	}
+	<-replies
+
+	receive, err := InvokeMore[ping, pong](context.Background(), c, "org.example.test.Ping", ping{Ping: "b"})
+	if err != nil {
+		t.Fatalf("InvokeMore(): %v", err)
+	}
+	for _, expected := range []string{"b1", "b2"} {
+		out, continues, err := receive()
+		if err != nil || out.Pong != expected || continues != (expected == "b1") {
+			t.Fatalf("receive(): '%s' %v %v", out.Pong, continues, err)
+		}
+	}
+	<-replies
+
+	_, err = Invoke[struct{}, pong](context.Background(), c, "org.example.test.Fail", struct{}{})
+	if e, ok := err.(*Error); !ok || e.Name != "org.example.test.Failed" {
+		t.Fatalf("Invoke(): %v", err)
+	}
+	expect(t, `{"method":"org.example.test.Fail","parameters":{}}`+"\000", <-replies)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Invoke[ping, pong](ctx, c, "org.example.test.Ping", ping{Ping: "a"}); err != context.Canceled {
+		t.Fatalf("Invoke() with a canceled context: %v", err)
+	}
+}
+
+func TestInvokeStream(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := NewConnectionFromConn(client)
+	defer c.Close()
+
+	go countingService(server)
+
+	type count struct {
+		Count int `json:"count"`
+	}
+	type number struct {
+		N int `json:"n"`
+	}
+
+	replies, errs := InvokeStream[count, number](context.Background(), c, "org.example.test.Count", count{3})
+	n := 0
+	for reply := range replies {
+		n++
+		if reply.N != n {
+			t.Fatalf("InvokeStream(): reply %d of %d", reply.N, n)
+		}
+	}
+	if err := <-errs; err != nil || n != 3 {
+		t.Fatalf("InvokeStream(): %d replies, %v", n, err)
+	}
+
+	_, errs = InvokeStream[count, []string](context.Background(), c, "org.example.test.Count", count{100})
+	if err := <-errs; err == nil {
+		t.Fatal("InvokeStream() decoded a reply of the wrong type")
+	}
+	if out, err := Invoke[count, number](context.Background(), c, "org.example.test.Count", count{1}); err != nil || out.N != 1 {
+		t.Fatalf("Invoke() after the failed stream: %v %v", out, err)
+	}
+}
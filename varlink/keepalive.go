@@ -0,0 +1,118 @@
+package varlink
+
+import (
+	"fmt"
+	"time"
+)
+
+type keepalive struct {
+	interval time.Duration
+	method   string
+	hook     func(err error)
+}
+
+// WithKeepalive calls the method, or org.varlink.service.GetInfo without a
+// method, when the connection was idle for the interval. The service must
+// reply within the interval, any reply, including an error reply, shows that
+// the connection is alive. After a failure the transport is closed, the next
+// call returns the error of the keepalive call, or re-dials the address with
+// WithReconnect().
+func WithKeepalive(interval time.Duration, method string) DialOption {
+	if method == "" {
+		method = "org.varlink.service.GetInfo"
+	}
+	return func(o *dialOptions) {
+		if o.keepalive == nil {
+			o.keepalive = &keepalive{}
+		}
+		o.keepalive.interval = interval
+		o.keepalive.method = method
+	}
+}
+
+// WithKeepaliveHook sets a function which is called with the error of every
+// failed keepalive call of a connection configured with WithKeepalive().
+func WithKeepaliveHook(hook func(err error)) DialOption {
+	return func(o *dialOptions) {
+		if o.keepalive == nil {
+			o.keepalive = &keepalive{}
+		}
+		o.keepalive.hook = hook
+	}
+}
+
+func (c *Connection) startKeepalive(k *keepalive) {
+	if k.interval <= 0 {
+		return
+	}
+
+	c.keepalive = k
+	c.lastUsed = time.Now()
+	c.stopKeepalive = make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(k.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-c.stopKeepalive:
+				return
+			}
+
+			if err := c.ping(); err != nil {
+				if k.hook != nil {
+					k.hook(err)
+				}
+				if c.dialOptions == nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// ping sends the keepalive call, if no call waits for replies and the
+// connection was idle for the interval.
+func (c *Connection) ping() error {
+	c.writeMutex.Lock()
+	c.mutex.Lock()
+	idle := c.usable() == nil && !c.broken && len(c.calls) == 0 &&
+		time.Since(c.lastUsed) >= c.keepalive.interval
+	c.mutex.Unlock()
+	if !idle {
+		c.writeMutex.Unlock()
+		return nil
+	}
+
+	o := callOptions{timeout: c.keepalive.interval}
+	receive, err := c.send(c.keepalive.method, nil, &o)
+	c.writeMutex.Unlock()
+	if err == nil {
+		var out struct{}
+		_, err = receive(&out)
+		if _, ok := err.(*Error); ok {
+			err = nil
+		}
+	}
+	if err == nil {
+		return nil
+	}
+
+	err = fmt.Errorf("keepalive call %s failed: %v", c.keepalive.method, err)
+	logResult(c.logger, connectionEvent, "varlink keepalive", err, "address", c.address)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.failCalls(err)
+	if c.dialOptions == nil {
+		c.keepaliveErr = err
+	}
+
+	return err
+}
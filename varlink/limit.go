@@ -0,0 +1,243 @@
+package varlink
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// The error of the connections and calls which are rejected by the limits of
+// SetLimits()
+const errorServiceBusy = "org.varlink.ServiceBusy"
+
+// Limits limit the connections and the method calls of a service, like to
+// protect it from a client which opens connections in a loop. The zero value
+// has no limits.
+type Limits struct {
+	// The maximum number of connections which are served at the same
+	// time. The connections above it wait for a served connection to be
+	// closed, before their calls are read.
+	MaxConnections int
+
+	// The maximum number of method calls which are handled at the same
+	// time, by all connections. The calls above it wait for a handled call
+	// to return.
+	MaxCalls int
+
+	// Reject the connections and calls above the limits with the error
+	// org.varlink.ServiceBusy, instead of waiting. A rejected connection
+	// gets the error for its first call and is closed.
+	Reject bool
+
+	// The time the write of a reply may take. A client which does not
+	// read its replies for the timeout, like a stalled reader of a
+	// stream, is disconnected, and the context of its call is canceled.
+	// Zero waits for the client.
+	WriteTimeout time.Duration
+
+	// The bytes of the replies which are buffered for a connection, so
+	// that the methods do not wait for a slow client. When the client does
+	// not read the replies and the buffer is full, the connection is closed.
+	// Zero writes the replies right away.
+	WriteBuffer int
+}
+
+// SetLimits sets the limits of the connections and method calls of the
+// service.
+func (s *Service) SetLimits(limits Limits) error {
+	if s.running {
+		return fmt.Errorf("service is already running")
+	}
+	if limits.MaxConnections < 0 || limits.MaxCalls < 0 || limits.WriteTimeout < 0 || limits.WriteBuffer < 0 {
+		return fmt.Errorf("invalid limits")
+	}
+	s.limits = limits
+
+	return nil
+}
+
+// acquire counts a connection or call in count, if it is below the max, or
+// after waiting for it to go below. It returns false if the limits reject
+// it. While the service shuts down, it does not wait.
+func (s *Service) acquire(count *int, max int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for max > 0 && *count >= max && !s.draining {
+		if s.limits.Reject {
+			return false
+		}
+		if s.changed == nil {
+			s.changed = make(chan struct{})
+		}
+		changed := s.changed
+		s.mutex.Unlock()
+		<-changed
+		s.mutex.Lock()
+	}
+	*count++
+	return true
+}
+
+func (s *Service) release(count *int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	*count--
+	s.notifyChanged()
+}
+
+// rejectConn replies to the first call of a connection above the limit with
+// the error.
+func (s *Service) rejectConn(sc *serviceConn, reader *bufio.Reader) {
+	logResult(s.logger, connectionEvent, "varlink connection", fmt.Errorf("too many connections"), "remote", sc.conn.RemoteAddr().String())
+
+	request, err := reader.ReadBytes('\x00')
+	if err != nil {
+		return
+	}
+	s.rejectCall(sc, request[:len(request)-1])
+}
+
+// rejectCall replies to a call above the limit with the error.
+func (s *Service) rejectCall(sc *serviceConn, request []byte) error {
+	in, err := parseCall(request)
+	if err != nil {
+		return err
+	}
+
+	c := Call{writer: sc.writer, writeMutex: &sc.writeMutex, in: &in, encoder: s.encoder}
+	return c.sendMessage(&serviceReply{Error: errorServiceBusy})
+}
+
+// connWriter writes the replies of a connection with the write timeout of the
+// limits. With a buffer, the replies are written in the background. A
+// connection whose write fails is closed.
+type connWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+	buffer  int
+
+	// The buffered replies, the error of the failed write, and whether
+	// the background writer returned after the close
+	mutex   sync.Mutex
+	wake    *sync.Cond
+	pending []byte
+	writing bool
+	err     error
+	closed  bool
+	done    chan struct{}
+}
+
+// newConnWriter returns the writer of the connection, or the connection if
+// it has no limits.
+func newConnWriter(conn net.Conn, limits Limits) io.Writer {
+	if limits.WriteTimeout == 0 && limits.WriteBuffer == 0 {
+		return conn
+	}
+
+	w := &connWriter{conn: conn, timeout: limits.WriteTimeout, buffer: limits.WriteBuffer}
+	if w.buffer > 0 {
+		w.wake = sync.NewCond(&w.mutex)
+		w.done = make(chan struct{})
+		go w.run()
+	}
+	return w
+}
+
+func (w *connWriter) Write(b []byte) (int, error) {
+	if w.buffer == 0 {
+		return w.write(b)
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	}
+	if len(w.pending)+len(b) > w.buffer {
+		w.err = fmt.Errorf("client does not read the replies, %d bytes are buffered", len(w.pending))
+		w.conn.Close()
+		return 0, w.err
+	}
+	w.pending = append(w.pending, b...)
+	w.wake.Broadcast()
+	return len(b), nil
+}
+
+// write writes to the connection with the timeout.
+func (w *connWriter) write(b []byte) (int, error) {
+	if w.timeout > 0 {
+		w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	}
+	n, err := w.conn.Write(b)
+	if err != nil {
+		w.conn.Close()
+	}
+	return n, err
+}
+
+// run writes the buffered replies, until the writer is closed and all
+// replies are written, or a write failed.
+func (w *connWriter) run() {
+	defer close(w.done)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for {
+		for len(w.pending) == 0 && !w.closed {
+			w.wake.Wait()
+		}
+		if len(w.pending) == 0 {
+			return
+		}
+
+		b := w.pending
+		w.pending = nil
+		w.writing = true
+		w.mutex.Unlock()
+		_, err := w.write(b)
+		w.mutex.Lock()
+		w.writing = false
+		if err != nil {
+			w.err = err
+		}
+		w.wake.Broadcast()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// drain waits until the buffered replies are written.
+func (w *connWriter) drain() error {
+	if w.buffer == 0 {
+		return nil
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for (len(w.pending) > 0 || w.writing) && w.err == nil {
+		w.wake.Wait()
+	}
+	return w.err
+}
+
+// close waits until the buffered replies are written.
+func (w *connWriter) close() {
+	if w.buffer == 0 {
+		return
+	}
+
+	w.mutex.Lock()
+	w.closed = true
+	w.wake.Broadcast()
+	w.mutex.Unlock()
+	<-w.done
+}
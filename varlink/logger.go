@@ -0,0 +1,30 @@
+package varlink
+
+// The kinds of logged events, their levels are configured with the LogLevels
+// of WithLogger().
+type eventKind int
+
+const (
+	callEvent eventKind = iota
+	connectionEvent
+	errorEvent
+)
+
+// eventLogger logs the events of connections and services, the arguments are
+// alternating keys and values.
+type eventLogger interface {
+	log(kind eventKind, msg string, args ...interface{})
+}
+
+// logResult logs the event of the kind, or the failure of the event at the
+// level of errors. The logger can be nil.
+func logResult(l eventLogger, kind eventKind, msg string, err error, args ...interface{}) {
+	if l == nil {
+		return
+	}
+	if err != nil {
+		l.log(errorEvent, msg+" failed", append(args, "error", err)...)
+		return
+	}
+	l.log(kind, msg, args...)
+}
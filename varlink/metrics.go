@@ -0,0 +1,172 @@
+package varlink
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultLatencyBuckets are the upper bounds in seconds of the latency
+// histogram buckets of NewMetrics().
+var DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Metrics collects metrics of the method calls of connections: the calls by
+// method, the errors by name, the latency of the calls by method and the sent
+// and received bytes. It is a Tracer, the connections are monitored with
+// WithTracer(). The metrics are written in the Prometheus text format with
+// WritePrometheus(), like for a /metrics HTTP handler.
+type Metrics struct {
+	buckets []float64
+
+	mutex         sync.Mutex
+	calls         map[string]uint64
+	errors        map[string]uint64
+	latency       map[string]*histogram
+	bytesSent     uint64
+	bytesReceived uint64
+}
+
+// NewMetrics returns a new collector of call metrics, with the upper bounds in
+// seconds of the latency histogram buckets, or DefaultLatencyBuckets.
+func NewMetrics(buckets ...float64) *Metrics {
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	return &Metrics{
+		buckets: buckets,
+		calls:   make(map[string]uint64),
+		errors:  make(map[string]uint64),
+		latency: make(map[string]*histogram),
+	}
+}
+
+// StartCall starts to measure a method call.
+func (m *Metrics) StartCall(ctx context.Context, call *CallInfo) CallSpan {
+	return m
+}
+
+// End records a finished method call. Varlink errors are counted by name,
+// other errors by "transport".
+func (m *Metrics) End(call *CallInfo) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.calls[call.Method]++
+	if call.Err != nil {
+		name := "transport"
+		if e, ok := call.Err.(*Error); ok {
+			name = e.Name
+		}
+		m.errors[name]++
+	}
+
+	h := m.latency[call.Method]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		m.latency[call.Method] = h
+	}
+	seconds := call.Duration.Seconds()
+	for i, bound := range m.buckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+
+	m.bytesSent += uint64(call.BytesSent)
+	m.bytesReceived += uint64(call.BytesReceived)
+}
+
+// Calls returns the number of calls of the method.
+func (m *Metrics) Calls(method string) uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.calls[method]
+}
+
+// Errors returns the number of calls which failed with the error name.
+func (m *Metrics) Errors(name string) uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.errors[name]
+}
+
+// WritePrometheus writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	b := bufio.NewWriter(w)
+
+	fmt.Fprintf(b, "# HELP varlink_client_calls_total Method calls sent by the client.\n")
+	fmt.Fprintf(b, "# TYPE varlink_client_calls_total counter\n")
+	for _, method := range sortedKeys(m.calls) {
+		fmt.Fprintf(b, "varlink_client_calls_total{method=\"%s\"} %d\n", escapeLabel(method), m.calls[method])
+	}
+
+	fmt.Fprintf(b, "# HELP varlink_client_errors_total Method calls which failed, by error name.\n")
+	fmt.Fprintf(b, "# TYPE varlink_client_errors_total counter\n")
+	for _, name := range sortedKeys(m.errors) {
+		fmt.Fprintf(b, "varlink_client_errors_total{error=\"%s\"} %d\n", escapeLabel(name), m.errors[name])
+	}
+
+	fmt.Fprintf(b, "# HELP varlink_client_call_duration_seconds Duration of the method calls until their last reply.\n")
+	fmt.Fprintf(b, "# TYPE varlink_client_call_duration_seconds histogram\n")
+	methods := make([]string, 0, len(m.latency))
+	for method := range m.latency {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		h := m.latency[method]
+		label := escapeLabel(method)
+		for i, bound := range m.buckets {
+			fmt.Fprintf(b, "varlink_client_call_duration_seconds_bucket{method=\"%s\",le=\"%s\"} %d\n",
+				label, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(b, "varlink_client_call_duration_seconds_bucket{method=\"%s\",le=\"+Inf\"} %d\n", label, h.count)
+		fmt.Fprintf(b, "varlink_client_call_duration_seconds_sum{method=\"%s\"} %s\n", label, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(b, "varlink_client_call_duration_seconds_count{method=\"%s\"} %d\n", label, h.count)
+	}
+
+	fmt.Fprintf(b, "# HELP varlink_client_sent_bytes_total Bytes of the method calls sent by the client.\n")
+	fmt.Fprintf(b, "# TYPE varlink_client_sent_bytes_total counter\n")
+	fmt.Fprintf(b, "varlink_client_sent_bytes_total %d\n", m.bytesSent)
+	fmt.Fprintf(b, "# HELP varlink_client_received_bytes_total Bytes of the replies received by the client.\n")
+	fmt.Fprintf(b, "# TYPE varlink_client_received_bytes_total counter\n")
+	fmt.Fprintf(b, "varlink_client_received_bytes_total %d\n", m.bytesReceived)
+
+	return b.Flush()
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,72 @@
+package varlink
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// The integers of a float64 are exact below 2^53, above it they may be
+// rounded.
+const maxExactFloat = 1 << 53
+
+// Int64 returns the integer of a decoded JSON number, like a value of a
+// map[string]interface{} of the parameters. It accepts json.Number, the
+// values of WithUseNumber(), and the integer types. A float64 is only accepted
+// below 2^53, from there on the integer may have lost its precision.
+func Int64(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case json.Number:
+		i, err := strconv.ParseInt(string(n), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("number %s is not an int64", n)
+		}
+		return i, nil
+	case float64:
+		if n != math.Trunc(n) || math.Abs(n) >= maxExactFloat {
+			return 0, fmt.Errorf("number %v is not an exact int64", n)
+		}
+		return int64(n), nil
+	case int:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	case int32:
+		return int64(n), nil
+	case uint64:
+		if n > math.MaxInt64 {
+			return 0, fmt.Errorf("number %d is not an int64", n)
+		}
+		return int64(n), nil
+	case uint32:
+		return int64(n), nil
+	}
+	return 0, fmt.Errorf("value of type %T is not a number", v)
+}
+
+// Uint64 returns the unsigned integer of a decoded JSON number, like
+// Int64().
+func Uint64(v interface{}) (uint64, error) {
+	switch n := v.(type) {
+	case json.Number:
+		u, err := strconv.ParseUint(string(n), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("number %s is not a uint64", n)
+		}
+		return u, nil
+	case uint64:
+		return n, nil
+	case uint32:
+		return uint64(n), nil
+	}
+
+	i, err := Int64(v)
+	if err != nil {
+		return 0, err
+	}
+	if i < 0 {
+		return 0, fmt.Errorf("number %d is not a uint64", i)
+	}
+	return uint64(i), nil
+}
@@ -1,5 +1,14 @@
 package varlink
 
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/varlink/go/varlink/idl"
+)
+
 func doReplyError(c *Call, name string, parameters interface{}) error {
 	return c.sendMessage(&serviceReply{
 		Error:      name,
@@ -43,6 +52,48 @@ func (c *Call) ReplyInvalidParameter(parameter string) error {
 	return doReplyError(c, "org.varlink.service.InvalidParameter", &out)
 }
 
+// ReplyInvalidParameterError sends the org.varlink.service.InvalidParameter
+// error reply for the error of GetParameters(), with the path of the field
+// which could not be decoded, like "disks[2].name". The parameter is
+// "parameters" if the error has no field, like for invalid JSON.
+func (c *Call) ReplyInvalidParameterError(err error) error {
+	return c.ReplyInvalidParameter(invalidField(err))
+}
+
+// invalidField returns the path of the invalid field of the decoding or
+// validation error.
+func invalidField(err error) string {
+	var field string
+	var typeError *json.UnmarshalTypeError
+	var validationError *idl.ValidationError
+	switch {
+	case errors.As(err, &typeError):
+		// The elements of arrays are numbers in the path of the
+		// decoder, like "disks.2.name"
+		for _, name := range strings.Split(typeError.Field, ".") {
+			if _, err := strconv.Atoi(name); err == nil && field != "" {
+				field += "[" + name + "]"
+			} else if field != "" {
+				field += "." + name
+			} else {
+				field = name
+			}
+		}
+	case errors.As(err, &validationError):
+		field = validationError.Field
+	}
+
+	if field == "" {
+		return "parameters"
+	}
+	return field
+}
+
+// ReplyPermissionDenied sends a org.varlink.service errror reply to this method call
+func (c *Call) ReplyPermissionDenied() error {
+	return doReplyError(c, "org.varlink.service.PermissionDenied", nil)
+}
+
 func (c *Call) replyGetInfo(vendor string, product string, version string, url string, interfaces []string) error {
 	var out struct {
 		Vendor     string   `json:"vendor,omitempty"`
@@ -77,7 +128,7 @@ func (s *Service) orgvarlinkserviceDispatch(c Call, methodname string) error {
 		}
 		err := c.GetParameters(&in)
 		if err != nil {
-			return c.ReplyInvalidParameter("parameters")
+			return c.ReplyInvalidParameterError(err)
 		}
 		return s.getInterfaceDescription(c, in.Interface)
 
@@ -123,7 +174,10 @@ error MethodNotFound (method: string)
 error MethodNotImplemented (method: string)
 
 # One of the passed parameters is invalid.
-error InvalidParameter (parameter: string)`
+error InvalidParameter (parameter: string)
+
+# The client is denied access.
+error PermissionDenied ()`
 }
 
 type orgvarlinkserviceInterface struct{}
@@ -0,0 +1,17 @@
+package varlink
+
+import "fmt"
+
+// SetPipeSecurity sets the security descriptor of the named pipe of an
+// npipe: address on Windows, in the SDDL format, like "D:P(A;;GA;;;AU)"
+// which allows the authenticated users to connect. Without it, the pipe gets
+// the default security descriptor, which allows only the administrators, the
+// local system and the user of the service to call its methods.
+func (s *Service) SetPipeSecurity(sddl string) error {
+	if s.running {
+		return fmt.Errorf("service is already running")
+	}
+	s.pipeSecurity = sddl
+
+	return nil
+}
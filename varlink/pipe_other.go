@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package varlink
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+)
+
+func dialPipe(ctx context.Context, protocol string, address string) (net.Conn, error) {
+	return nil, fmt.Errorf("named pipes are not supported on %s", runtime.GOOS)
+}
+
+func listenPipe(address string, sddl string) (net.Listener, error) {
+	return nil, fmt.Errorf("named pipes are not supported on %s", runtime.GOOS)
+}
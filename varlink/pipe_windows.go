@@ -0,0 +1,516 @@
+package varlink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// The named pipe functions which the syscall package does not provide
+var (
+	modkernel32 = syscall.NewLazyDLL("kernel32.dll")
+	modadvapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procCreateNamedPipeW    = modkernel32.NewProc("CreateNamedPipeW")
+	procConnectNamedPipe    = modkernel32.NewProc("ConnectNamedPipe")
+	procCreateEventW        = modkernel32.NewProc("CreateEventW")
+	procGetOverlappedResult = modkernel32.NewProc("GetOverlappedResult")
+
+	procConvertStringSecurityDescriptorToSecurityDescriptorW = modadvapi32.NewProc("ConvertStringSecurityDescriptorToSecurityDescriptorW")
+)
+
+const (
+	pipeAccessDuplex          = 0x3
+	fileFlagFirstPipeInstance = 0x80000
+	pipeRejectRemoteClients   = 0x8
+	pipeUnlimitedInstances    = 255
+	pipeBufferSize            = 65536
+	sddlRevision1             = 1
+
+	// The service can identify the client, but not impersonate it
+	securitySQOSPresent    = 0x100000
+	securityIdentification = 0x10000
+
+	errorPipeBusy         = syscall.Errno(231)
+	errorNoData           = syscall.Errno(232)
+	errorPipeNotConnected = syscall.Errno(233)
+	errorPipeConnected    = syscall.Errno(535)
+)
+
+var errPipeClosed = errors.New("use of closed named pipe")
+
+// npipeAddr is the path of a named pipe, like \\.\pipe\org.example.service.
+type npipeAddr string
+
+func (a npipeAddr) Network() string {
+	return "npipe"
+}
+
+func (a npipeAddr) String() string {
+	return string(a)
+}
+
+// pipePath returns the path of the pipe of an npipe: address. A name without
+// a path is a pipe of the local machine.
+func pipePath(address string) npipeAddr {
+	if strings.HasPrefix(address, `\\`) {
+		return npipeAddr(address)
+	}
+	return npipeAddr(`\\.\pipe\` + address)
+}
+
+func createNamedPipe(path *uint16, flags uint32, sa *syscall.SecurityAttributes) (syscall.Handle, error) {
+	r, _, err := procCreateNamedPipeW.Call(
+		uintptr(unsafe.Pointer(path)),
+		uintptr(pipeAccessDuplex|syscall.FILE_FLAG_OVERLAPPED|flags),
+		pipeRejectRemoteClients,
+		pipeUnlimitedInstances,
+		pipeBufferSize,
+		pipeBufferSize,
+		0,
+		uintptr(unsafe.Pointer(sa)))
+	if syscall.Handle(r) == syscall.InvalidHandle {
+		return syscall.InvalidHandle, os.NewSyscallError("CreateNamedPipe", err)
+	}
+	return syscall.Handle(r), nil
+}
+
+func connectNamedPipe(h syscall.Handle, o *syscall.Overlapped) error {
+	r, _, err := procConnectNamedPipe.Call(uintptr(h), uintptr(unsafe.Pointer(o)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func createEvent() (syscall.Handle, error) {
+	r, _, err := procCreateEventW.Call(0, 1, 0, 0)
+	if r == 0 {
+		return 0, os.NewSyscallError("CreateEvent", err)
+	}
+	return syscall.Handle(r), nil
+}
+
+func getOverlappedResult(h syscall.Handle, o *syscall.Overlapped, n *uint32) error {
+	r, _, err := procGetOverlappedResult.Call(uintptr(h), uintptr(unsafe.Pointer(o)), uintptr(unsafe.Pointer(n)), 1)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// securityDescriptor returns the security descriptor of the SDDL string, it is
+// freed with LocalFree().
+func securityDescriptor(sddl string) (uintptr, error) {
+	s, err := syscall.UTF16PtrFromString(sddl)
+	if err != nil {
+		return 0, fmt.Errorf("invalid security descriptor '%s'", sddl)
+	}
+	var sd uintptr
+	r, _, err := procConvertStringSecurityDescriptorToSecurityDescriptorW.Call(uintptr(unsafe.Pointer(s)), sddlRevision1, uintptr(unsafe.Pointer(&sd)), 0)
+	if r == 0 {
+		return 0, fmt.Errorf("invalid security descriptor '%s': %v", sddl, err)
+	}
+	return sd, nil
+}
+
+// npipeIO is the state of the reads or of the writes of a pipe. The operations
+// are overlapped, their deadline cancels the pending one.
+type npipeIO struct {
+	mutex sync.Mutex
+	event syscall.Handle
+
+	// The deadline, and the pending operation which it cancels
+	deadlineMutex sync.Mutex
+	deadline      time.Time
+	timer         *time.Timer
+	pending       *syscall.Overlapped
+	timedOut      bool
+}
+
+// arm cancels the pending operation at the deadline, it is called with the
+// deadline mutex held.
+func (p *npipeIO) arm(h syscall.Handle) {
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	if p.pending == nil || p.deadline.IsZero() {
+		return
+	}
+
+	o := p.pending
+	d := time.Until(p.deadline)
+	if d <= 0 {
+		p.timedOut = true
+		syscall.CancelIoEx(h, o)
+		return
+	}
+	p.timer = time.AfterFunc(d, func() {
+		p.deadlineMutex.Lock()
+		defer p.deadlineMutex.Unlock()
+		if p.pending == o {
+			p.timedOut = true
+			syscall.CancelIoEx(h, o)
+		}
+	})
+}
+
+// npipeConn is a connected instance of a named pipe, of the service or of the
+// client. It supports deadlines like the connections of the net package.
+type npipeConn struct {
+	handle syscall.Handle
+	addr   npipeAddr
+	read   npipeIO
+	write  npipeIO
+
+	// Close cancels the pending operations, and waits for them to return
+	// before it closes the handle
+	closed  int32
+	closing sync.RWMutex
+}
+
+func newNpipeConn(h syscall.Handle, addr npipeAddr) (*npipeConn, error) {
+	c := &npipeConn{handle: h, addr: addr}
+
+	var err error
+	c.read.event, err = createEvent()
+	if err == nil {
+		c.write.event, err = createEvent()
+		if err != nil {
+			syscall.CloseHandle(c.read.event)
+		}
+	}
+	if err != nil {
+		syscall.CloseHandle(h)
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// do starts the overlapped operation and waits for its result.
+func (c *npipeConn) do(p *npipeIO, op func(o *syscall.Overlapped) error) (uint32, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	c.closing.RLock()
+	defer c.closing.RUnlock()
+
+	if atomic.LoadInt32(&c.closed) != 0 {
+		return 0, errPipeClosed
+	}
+	p.deadlineMutex.Lock()
+	expired := !p.deadline.IsZero() && !time.Now().Before(p.deadline)
+	p.deadlineMutex.Unlock()
+	if expired {
+		return 0, timeoutError{}
+	}
+
+	o := &syscall.Overlapped{HEvent: p.event}
+	err := op(o)
+	if err != nil && err != syscall.ERROR_IO_PENDING {
+		return 0, err
+	}
+
+	p.deadlineMutex.Lock()
+	p.pending = o
+	p.timedOut = false
+	p.arm(c.handle)
+	p.deadlineMutex.Unlock()
+
+	// Close() might have missed the operation
+	if atomic.LoadInt32(&c.closed) != 0 {
+		syscall.CancelIoEx(c.handle, o)
+	}
+
+	var n uint32
+	err = getOverlappedResult(c.handle, o, &n)
+
+	p.deadlineMutex.Lock()
+	p.pending = nil
+	p.arm(c.handle)
+	timedOut := p.timedOut
+	p.deadlineMutex.Unlock()
+
+	if err == syscall.ERROR_OPERATION_ABORTED {
+		if timedOut {
+			return n, timeoutError{}
+		}
+		return n, errPipeClosed
+	}
+	return n, err
+}
+
+func (c *npipeConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "npipe", Addr: c.addr, Err: err}
+}
+
+func (c *npipeConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	n, err := c.do(&c.read, func(o *syscall.Overlapped) error {
+		var done uint32
+		return syscall.ReadFile(c.handle, b, &done, o)
+	})
+	switch {
+	case err == nil:
+		return int(n), nil
+	case err == syscall.ERROR_BROKEN_PIPE, err == errorPipeNotConnected:
+		return int(n), io.EOF
+	default:
+		return int(n), c.opError("read", err)
+	}
+}
+
+func (c *npipeConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n, err := c.do(&c.write, func(o *syscall.Overlapped) error {
+			var done uint32
+			return syscall.WriteFile(c.handle, b[written:], &done, o)
+		})
+		written += int(n)
+		if err != nil {
+			return written, c.opError("write", err)
+		}
+	}
+	return written, nil
+}
+
+func (c *npipeConn) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return c.opError("close", errPipeClosed)
+	}
+
+	syscall.CancelIoEx(c.handle, nil)
+	c.closing.Lock()
+	defer c.closing.Unlock()
+
+	syscall.CloseHandle(c.read.event)
+	syscall.CloseHandle(c.write.event)
+	return syscall.CloseHandle(c.handle)
+}
+
+func (c *npipeConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *npipeConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *npipeConn) setDeadline(p *npipeIO, t time.Time) {
+	p.deadlineMutex.Lock()
+	defer p.deadlineMutex.Unlock()
+	p.deadline = t
+	p.arm(c.handle)
+}
+
+func (c *npipeConn) SetDeadline(t time.Time) error {
+	c.setDeadline(&c.read, t)
+	c.setDeadline(&c.write, t)
+	return nil
+}
+
+func (c *npipeConn) SetReadDeadline(t time.Time) error {
+	c.setDeadline(&c.read, t)
+	return nil
+}
+
+func (c *npipeConn) SetWriteDeadline(t time.Time) error {
+	c.setDeadline(&c.write, t)
+	return nil
+}
+
+func dialPipe(ctx context.Context, protocol string, address string) (net.Conn, error) {
+	addr := pipePath(address)
+	opError := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "npipe", Addr: addr, Err: err}
+	}
+
+	path, err := syscall.UTF16PtrFromString(string(addr))
+	if err != nil {
+		return nil, opError(err)
+	}
+
+	for {
+		h, err := syscall.CreateFile(path,
+			syscall.GENERIC_READ|syscall.GENERIC_WRITE,
+			0,
+			nil,
+			syscall.OPEN_EXISTING,
+			syscall.FILE_FLAG_OVERLAPPED|securitySQOSPresent|securityIdentification,
+			0)
+		if err == nil {
+			c, err := newNpipeConn(h, addr)
+			if err != nil {
+				return nil, opError(err)
+			}
+			return c, nil
+		}
+		if err != errorPipeBusy {
+			return nil, opError(os.NewSyscallError("CreateFile", err))
+		}
+
+		// All instances of the pipe are connected, until the service
+		// creates the next one
+		select {
+		case <-ctx.Done():
+			return nil, opError(ctx.Err())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// npipeListener accepts the clients of a named pipe. It keeps an instance of
+// the pipe which waits for the next client, its remote clients are rejected.
+type npipeListener struct {
+	addr npipeAddr
+	path *uint16
+	sa   *syscall.SecurityAttributes
+
+	accept sync.Mutex
+	mutex  sync.Mutex
+	next   *npipeConn
+	closed bool
+}
+
+func listenPipe(address string, sddl string) (net.Listener, error) {
+	addr := pipePath(address)
+	opError := func(err error) error {
+		return &net.OpError{Op: "listen", Net: "npipe", Addr: addr, Err: err}
+	}
+
+	path, err := syscall.UTF16PtrFromString(string(addr))
+	if err != nil {
+		return nil, opError(err)
+	}
+	l := &npipeListener{addr: addr, path: path}
+
+	if sddl != "" {
+		sd, err := securityDescriptor(sddl)
+		if err != nil {
+			return nil, opError(err)
+		}
+		l.sa = &syscall.SecurityAttributes{SecurityDescriptor: sd}
+		l.sa.Length = uint32(unsafe.Sizeof(*l.sa))
+	}
+
+	// The first instance fails if the pipe exists, like if another
+	// service listens on it
+	l.next, err = l.newInstance(fileFlagFirstPipeInstance)
+	if err != nil {
+		l.freeSecurity()
+		return nil, opError(err)
+	}
+
+	return l, nil
+}
+
+// newInstance creates an instance of the pipe, it is called with the mutex
+// held.
+func (l *npipeListener) newInstance(flags uint32) (*npipeConn, error) {
+	h, err := createNamedPipe(l.path, flags, l.sa)
+	if err != nil {
+		return nil, err
+	}
+	return newNpipeConn(h, l.addr)
+}
+
+func (l *npipeListener) freeSecurity() {
+	if l.sa != nil {
+		syscall.LocalFree(syscall.Handle(l.sa.SecurityDescriptor))
+		l.sa = nil
+	}
+}
+
+func (l *npipeListener) opError(err error) error {
+	return &net.OpError{Op: "accept", Net: "npipe", Addr: l.addr, Err: err}
+}
+
+func (l *npipeListener) Accept() (net.Conn, error) {
+	l.accept.Lock()
+	defer l.accept.Unlock()
+
+	for {
+		l.mutex.Lock()
+		if l.closed {
+			l.mutex.Unlock()
+			return nil, l.opError(errPipeClosed)
+		}
+		if l.next == nil {
+			c, err := l.newInstance(0)
+			if err != nil {
+				l.mutex.Unlock()
+				return nil, l.opError(err)
+			}
+			l.next = c
+		}
+		c := l.next
+		l.mutex.Unlock()
+
+		// A client which connected before ConnectNamedPipe() is
+		// connected already
+		_, err := c.do(&c.read, func(o *syscall.Overlapped) error {
+			return connectNamedPipe(c.handle, o)
+		})
+		if err == errorPipeConnected {
+			err = nil
+		}
+
+		l.mutex.Lock()
+		if l.closed {
+			l.mutex.Unlock()
+			return nil, l.opError(errPipeClosed)
+		}
+		l.next = nil
+		if err != nil {
+			l.mutex.Unlock()
+			c.Close()
+
+			// The client closed the pipe already
+			if err == errorNoData {
+				continue
+			}
+			return nil, l.opError(os.NewSyscallError("ConnectNamedPipe", err))
+		}
+
+		// The next Accept() creates the instance, if it fails here
+		l.next, _ = l.newInstance(0)
+		l.mutex.Unlock()
+
+		return c, nil
+	}
+}
+
+func (l *npipeListener) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return l.opError(errPipeClosed)
+	}
+	l.closed = true
+	if l.next != nil {
+		l.next.Close()
+		l.next = nil
+	}
+	l.freeSecurity()
+
+	return nil
+}
+
+func (l *npipeListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,445 @@
+package varlink
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// reply is a method reply read from the connection. When it is read, only
+// the fields to route the reply are decoded, the parameters are skipped. They
+// are decoded in one pass over the message when the reply is received,
+// directly into the parameters of the call.
+type reply struct {
+	Continues bool   `json:"continues"`
+	Error     string `json:"error"`
+
+	// The message without its zero byte, the files passed along with the
+	// reply and the size of the message
+	message []byte
+	files   []*os.File
+	size    int
+}
+
+// pendingCall is a call waiting for its replies.
+type pendingCall struct {
+	replies   []*reply
+	more      bool
+	done      bool
+	abandoned bool
+	err       error
+}
+
+// The service answers the calls of a connection in the order they were sent.
+// Every call which waits for replies is queued; whichever caller reads from
+// the connection routes the replies to the first call in the queue, until its
+// last reply. Callers of other goroutines wait until a reply for their call
+// arrives, or until the reading caller has finished and they can read
+// themselves.
+type pipeline struct {
+	calls   []*pendingCall
+	reading bool
+	changed chan struct{}
+
+	// The beginning of a reply, when a read timed out in the middle of it
+	partial []byte
+}
+
+// errConnectionClosed is returned by the calls of a closed connection.
+var errConnectionClosed = fmt.Errorf("connection is closed")
+
+// errStreamAborted is returned by the queued calls of AbortStream().
+var errStreamAborted = fmt.Errorf("stream was aborted, the transport is closed")
+
+// timeoutError is returned by a call which timed out while another caller
+// was reading from the connection.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// enqueue adds a call waiting for replies. It is called with the mutex held.
+func (c *Connection) enqueue(more bool) *pendingCall {
+	p := &pendingCall{more: more}
+	c.calls = append(c.calls, p)
+	c.lastUsed = time.Now()
+	return p
+}
+
+// waitChannel returns the channel which is closed at the next change of the
+// pipeline. It is called with the mutex held.
+func (c *Connection) waitChannel() chan struct{} {
+	if c.changed == nil {
+		c.changed = make(chan struct{})
+	}
+	return c.changed
+}
+
+// notify wakes up the waiting callers. It is called with the mutex held.
+func (c *Connection) notify() {
+	if c.changed != nil {
+		close(c.changed)
+		c.changed = nil
+	}
+}
+
+// failCalls fails all queued calls after an error of the transport, which is
+// closed. It is called with the mutex held.
+func (c *Connection) failCalls(err error) {
+	if c.closed {
+		err = errConnectionClosed
+	}
+	for _, p := range c.calls {
+		p.err = err
+	}
+	c.calls = nil
+	c.partial = nil
+	c.conn.Close()
+	if c.dialOptions != nil && !c.closed {
+		c.broken = true
+	}
+	c.setState(StateDisconnected, err)
+	c.notify()
+}
+
+// abandon drops the remaining replies of a call which timed out or was
+// canceled.
+func (c *Connection) abandon(p *pendingCall) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !p.done && p.err == nil {
+		p.abandoned = true
+	}
+	for _, m := range p.replies {
+		closeFiles(m.files)
+	}
+	p.replies = nil
+}
+
+// AbortStream stops the calls with the More flag which did not receive their
+// last reply, like a canceled Stream() of a service which streams its replies
+// without end. Varlink has no message to stop a call, the transport is closed
+// and all queued calls fail. A connection configured with WithReconnect()
+// re-dials its address for the next call, other connections are unusable
+// like after a failure of the transport. Without streamed calls, AbortStream
+// does nothing.
+func (c *Connection) AbortStream() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, p := range c.calls {
+		if p.more {
+			c.failCalls(errStreamAborted)
+			return
+		}
+	}
+}
+
+// deliver routes a reply to the first queued call. It is called with the
+// mutex held.
+func (c *Connection) deliver(m *reply) {
+	p := c.calls[0]
+	if !p.abandoned {
+		p.replies = append(p.replies, m)
+	} else {
+		closeFiles(m.files)
+	}
+
+	if !m.Continues || m.Error != "" {
+		p.done = true
+		c.calls[0] = nil
+		c.calls = c.calls[1:]
+		c.lastUsed = time.Now()
+	}
+	c.notify()
+}
+
+// receive returns the next reply of the call.
+func (c *Connection) receive(p *pendingCall, o *callOptions, out_parameters interface{}) (uint64, error) {
+	if r, ok := out_parameters.(*contextParameters); ok {
+		// The reply is received with the options of the call and the
+		// context of ReceiveContext(), the received bytes are counted
+		// for the call
+		ctx, cancel := mergeContext(o.ctx, r.ctx)
+		defer cancel()
+		ro := *o
+		ro.ctx = ctx
+		flags, err := c.receive(p, &ro, r.out)
+		o.receivedBytes = ro.receivedBytes
+		if err != nil && err == ctx.Err() && o.ctx != nil && o.ctx.Err() != nil {
+			err = o.ctx.Err()
+		}
+		return flags, err
+	}
+
+	if o.ctx != nil && o.ctx.Err() != nil {
+		c.abandon(p)
+		return 0, o.ctx.Err()
+	}
+
+	var timeout <-chan time.Time
+	if deadline := o.deadlineFrom(time.Now()); !deadline.IsZero() {
+		timer := time.NewTimer(deadline.Sub(time.Now()))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var done <-chan struct{}
+	if o.ctx != nil {
+		done = o.ctx.Done()
+	}
+
+	c.mutex.Lock()
+	for {
+		if len(p.replies) > 0 {
+			m := p.replies[0]
+			p.replies = p.replies[1:]
+			c.mutex.Unlock()
+			o.receivedBytes += m.size
+			handOverFiles(m, o)
+			flags, err := decodeReply(m, out_parameters, replyDecoding{strict: c.disallowUnknownFields, useNumber: c.useNumber})
+			if err != nil && m.Continues {
+				// The caller stops receiving after the error
+				c.abandon(p)
+			}
+			if err == nil && o.unknownFields != nil {
+				reportUnknownFields(m, out_parameters, o.unknownFields)
+			}
+			return flags, err
+		}
+
+		switch {
+		case p.err != nil:
+			c.mutex.Unlock()
+			return 0, p.err
+
+		case p.abandoned:
+			c.mutex.Unlock()
+			return 0, fmt.Errorf("call timed out or was canceled, its replies are discarded")
+
+		case p.done:
+			c.mutex.Unlock()
+			return 0, fmt.Errorf("call received its last reply")
+		}
+
+		if !c.reading {
+			if err := c.readReply(o); err != nil {
+				if p.err != nil {
+					err = p.err
+				}
+				c.mutex.Unlock()
+				if e, ok := err.(net.Error); ok && e.Timeout() {
+					c.abandon(p)
+				}
+				return 0, o.contextError(err)
+			}
+			continue
+		}
+
+		changed := c.waitChannel()
+		c.mutex.Unlock()
+		select {
+		case <-changed:
+		case <-timeout:
+			c.abandon(p)
+			return 0, timeoutError{}
+		case <-done:
+			c.abandon(p)
+			return 0, o.ctx.Err()
+		}
+		c.mutex.Lock()
+	}
+}
+
+// readReply reads the next reply from the transport and routes it to its call.
+// It is called with the mutex held, which is released while reading. After a
+// timeout, the beginning of a partially read reply is kept for the next read,
+// other errors fail all queued calls.
+func (c *Connection) readReply(o *callOptions) error {
+	c.reading = true
+	conn, reader, generation, partial := c.conn, c.reader, c.generation, c.partial
+	c.partial = nil
+	c.mutex.Unlock()
+
+	deadline := o.deadlineFrom(time.Now())
+	if !deadline.IsZero() {
+		conn.SetReadDeadline(deadline)
+	}
+	stop := abortOnDone(o.ctx, conn.SetReadDeadline)
+
+	out, err := readMessage(reader, len(partial), c.maxMessageSize)
+	stop()
+	var files []*os.File
+	if t, ok := conn.(fileTransport); ok && err == nil {
+		files = t.takeFiles(t.readOffset() - int64(reader.Buffered()))
+	}
+	if !deadline.IsZero() || o.ctx != nil {
+		conn.SetReadDeadline(time.Time{})
+	}
+	if len(partial) > 0 {
+		out = append(partial, out...)
+	}
+
+	m := reply{files: files, size: len(out)}
+	if err == nil {
+		m.message = out[:len(out)-1]
+		err = json.Unmarshal(m.message, &m)
+	}
+
+	c.mutex.Lock()
+	c.notify()
+
+	// The transport was replaced after a failure, the queued calls
+	// already received the error
+	if generation != c.generation {
+		closeFiles(files)
+		return nil
+	}
+	c.reading = false
+
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		c.partial = out
+		return err
+	}
+	if err == nil && len(c.calls) == 0 {
+		err = fmt.Errorf("received a reply without a call: %s", bytes.TrimRight(out, "\x00"))
+	}
+	if err != nil {
+		closeFiles(files)
+		c.failCalls(err)
+		return err
+	}
+
+	c.deliver(&m)
+	return nil
+}
+
+// readMessage reads the next message up to its zero byte, like ReadBytes().
+// The size of the message includes the bytes of an earlier partial read.
+// Unless the limit is zero, messages larger than the limit fail.
+func readMessage(reader *bufio.Reader, partial int, limit int) ([]byte, error) {
+	if limit <= 0 {
+		return reader.ReadBytes('\x00')
+	}
+
+	var out []byte
+	for {
+		b, err := reader.ReadSlice('\x00')
+		out = append(out, b...)
+
+		size := partial + len(out)
+		if err == nil {
+			size--
+		}
+		if size > limit {
+			return nil, fmt.Errorf("reply exceeds the maximum message size of %d bytes", limit)
+		}
+
+		if err != bufio.ErrBufferFull {
+			return out, err
+		}
+	}
+}
+
+// replyDecoding are the options of decodeReply().
+type replyDecoding struct {
+	strict    bool
+	useNumber bool
+}
+
+// decodeReply decodes the parameters of the reply into out_parameters. Unless
+// it is strict, parameters which cannot be decoded are ignored. Strict
+// decoding fails for such parameters, and for fields which out_parameters
+// does not have.
+func decodeReply(m *reply, out_parameters interface{}, o replyDecoding) (uint64, error) {
+	if m.Error != "" {
+		var r struct {
+			Parameters *json.RawMessage `json:"parameters"`
+		}
+		json.Unmarshal(m.message, &r)
+
+		e := &Error{Name: m.Error}
+		if r.Parameters != nil {
+			e.Parameters = *r.Parameters
+		}
+		return 0, e
+	}
+
+	if out_parameters != nil {
+		r := struct {
+			Parameters interface{} `json:"parameters"`
+			Continues  bool        `json:"continues"`
+			Error      string      `json:"error"`
+		}{Parameters: out_parameters}
+
+		if o.strict || o.useNumber {
+			d := json.NewDecoder(bytes.NewReader(m.message))
+			if o.strict {
+				d.DisallowUnknownFields()
+			}
+			if o.useNumber {
+				d.UseNumber()
+			}
+			if err := d.Decode(&r); err != nil && o.strict {
+				return 0, fmt.Errorf("cannot decode the reply parameters: %v", err)
+			}
+		} else {
+			json.Unmarshal(m.message, &r)
+		}
+	}
+
+	if m.Continues {
+		return Continues, nil
+	}
+
+	return 0, nil
+}
+
+// mergeContext returns a context which is done when ctx or the context of the
+// call is done. The context of the call can be nil.
+func mergeContext(call context.Context, ctx context.Context) (context.Context, func()) {
+	if call == nil || call.Done() == nil {
+		return ctx, func() {}
+	}
+
+	merged, cancel := context.WithCancel(ctx)
+	stop := abortOnDone(call, func(time.Time) error {
+		cancel()
+		return nil
+	})
+	return merged, func() {
+		stop()
+		cancel()
+	}
+}
+
+// abortOnDone sets a past read or write deadline with setDeadline when ctx is
+// done, to abort a blocked read or write. The returned function stops watching
+// ctx.
+func abortOnDone(ctx context.Context, setDeadline func(time.Time) error) func() {
+	if ctx == nil || ctx.Done() == nil {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			setDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
@@ -0,0 +1,464 @@
+package polkit
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The types of the D-Bus messages
+const (
+	typeMethodCall   = 1
+	typeMethodReturn = 2
+	typeError        = 3
+	typeSignal       = 4
+)
+
+// The codes of the D-Bus header fields
+const (
+	fieldPath        = 1
+	fieldInterface   = 2
+	fieldMember      = 3
+	fieldErrorName   = 4
+	fieldReplySerial = 5
+	fieldDestination = 6
+	fieldSender      = 7
+	fieldSignature   = 8
+)
+
+// The largest message which is read, the limit of the D-Bus specification
+const maxMessageSize = 1 << 27
+
+// message is a D-Bus message, its body is marshalled with the signature.
+type message struct {
+	kind        byte
+	serial      uint32
+	replySerial uint32
+	path        string
+	iface       string
+	member      string
+	errorName   string
+	destination string
+	sender      string
+	signature   string
+	body        []byte
+	order       binary.ByteOrder
+}
+
+// encoder marshals D-Bus values in little endian. The alignment is relative
+// to the start of the buffer, which is the start of the message or of its
+// body.
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) align(n int) {
+	for len(e.b)%n != 0 {
+		e.b = append(e.b, 0)
+	}
+}
+
+func (e *encoder) byte(v byte) {
+	e.b = append(e.b, v)
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.align(4)
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	e.b = append(e.b, b[:]...)
+}
+
+func (e *encoder) uint64(v uint64) {
+	e.align(8)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	e.b = append(e.b, b[:]...)
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.uint32(1)
+	} else {
+		e.uint32(0)
+	}
+}
+
+func (e *encoder) string(s string) {
+	e.uint32(uint32(len(s)))
+	e.b = append(append(e.b, s...), 0)
+}
+
+func (e *encoder) signature(s string) {
+	e.byte(byte(len(s)))
+	e.b = append(append(e.b, s...), 0)
+}
+
+// array marshals the elements of f as an array whose elements have the
+// alignment.
+func (e *encoder) array(alignment int, f func()) {
+	e.uint32(0)
+	length := len(e.b) - 4
+	e.align(alignment)
+	start := len(e.b)
+	f()
+	binary.LittleEndian.PutUint32(e.b[length:], uint32(len(e.b)-start))
+}
+
+// stringMap marshals an a{ss}.
+func (e *encoder) stringMap(m map[string]string) {
+	e.array(8, func() {
+		for k, v := range m {
+			e.align(8)
+			e.string(k)
+			e.string(v)
+		}
+	})
+}
+
+// decoder unmarshals D-Bus values, its errors are sticky.
+type decoder struct {
+	b     []byte
+	off   int
+	order binary.ByteOrder
+	err   error
+}
+
+func (d *decoder) align(n int) {
+	for d.off%n != 0 {
+		d.off++
+	}
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || d.off+n > len(d.b) {
+		d.err = fmt.Errorf("truncated D-Bus message")
+		return nil
+	}
+	b := d.b[d.off : d.off+n]
+	d.off += n
+	return b
+}
+
+func (d *decoder) byte() byte {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) uint32() uint32 {
+	d.align(4)
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return d.order.Uint32(b)
+}
+
+func (d *decoder) uint64() uint64 {
+	d.align(8)
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return d.order.Uint64(b)
+}
+
+func (d *decoder) bool() bool {
+	return d.uint32() != 0
+}
+
+func (d *decoder) string() string {
+	n := d.uint32()
+	b := d.next(int(n) + 1)
+	if b == nil {
+		return ""
+	}
+	return string(b[:n])
+}
+
+func (d *decoder) signature() string {
+	n := d.byte()
+	b := d.next(int(n) + 1)
+	if b == nil {
+		return ""
+	}
+	return string(b[:n])
+}
+
+// array calls f for the elements of an array whose elements have the
+// alignment.
+func (d *decoder) array(alignment int, f func()) {
+	n := d.uint32()
+	d.align(alignment)
+	end := d.off + int(n)
+	if end > len(d.b) {
+		d.err = fmt.Errorf("truncated D-Bus message")
+	}
+	for d.err == nil && d.off < end {
+		f()
+	}
+}
+
+func (d *decoder) stringMap() map[string]string {
+	m := make(map[string]string)
+	d.array(8, func() {
+		d.align(8)
+		k := d.string()
+		m[k] = d.string()
+	})
+	return m
+}
+
+// encode returns the marshalled message.
+func (m *message) encode() []byte {
+	var e encoder
+	e.byte('l')
+	e.byte(m.kind)
+	e.byte(0)
+	e.byte(1)
+	e.uint32(uint32(len(m.body)))
+	e.uint32(m.serial)
+
+	field := func(code byte, signature string, value func()) {
+		e.align(8)
+		e.byte(code)
+		e.signature(signature)
+		value()
+	}
+	stringField := func(code byte, signature string, s string) {
+		if s != "" {
+			field(code, signature, func() { e.string(s) })
+		}
+	}
+	e.array(8, func() {
+		stringField(fieldPath, "o", m.path)
+		stringField(fieldInterface, "s", m.iface)
+		stringField(fieldMember, "s", m.member)
+		stringField(fieldErrorName, "s", m.errorName)
+		if m.replySerial != 0 {
+			field(fieldReplySerial, "u", func() { e.uint32(m.replySerial) })
+		}
+		stringField(fieldDestination, "s", m.destination)
+		stringField(fieldSender, "s", m.sender)
+		if m.signature != "" {
+			field(fieldSignature, "g", func() { e.signature(m.signature) })
+		}
+	})
+	e.align(8)
+
+	return append(e.b, m.body...)
+}
+
+// readMessage reads the next message.
+func readMessage(r io.Reader) (*message, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+
+	m := &message{kind: fixed[1]}
+	switch fixed[0] {
+	case 'l':
+		m.order = binary.LittleEndian
+	case 'B':
+		m.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid D-Bus message")
+	}
+	bodyLength := m.order.Uint32(fixed[4:])
+	m.serial = m.order.Uint32(fixed[8:])
+	fieldsLength := m.order.Uint32(fixed[12:])
+	if uint64(bodyLength)+uint64(fieldsLength) > maxMessageSize {
+		return nil, fmt.Errorf("D-Bus message is too large")
+	}
+
+	headerLength := (16 + int(fieldsLength) + 7) &^ 7
+	b := make([]byte, headerLength+int(bodyLength))
+	copy(b, fixed)
+	if _, err := io.ReadFull(r, b[16:]); err != nil {
+		return nil, err
+	}
+
+	d := &decoder{b: b[:16+fieldsLength], off: 12, order: m.order}
+	d.array(8, func() {
+		d.align(8)
+		code := d.byte()
+		switch signature := d.signature(); signature {
+		case "o", "s":
+			s := d.string()
+			switch code {
+			case fieldPath:
+				m.path = s
+			case fieldInterface:
+				m.iface = s
+			case fieldMember:
+				m.member = s
+			case fieldErrorName:
+				m.errorName = s
+			case fieldDestination:
+				m.destination = s
+			case fieldSender:
+				m.sender = s
+			}
+		case "g":
+			s := d.signature()
+			if code == fieldSignature {
+				m.signature = s
+			}
+		case "u":
+			u := d.uint32()
+			if code == fieldReplySerial {
+				m.replySerial = u
+			}
+		default:
+			d.err = fmt.Errorf("unsupported D-Bus header field of type '%s'", signature)
+		}
+	})
+	if d.err != nil {
+		return nil, d.err
+	}
+	m.body = b[headerLength:]
+
+	return m, nil
+}
+
+// bodyDecoder returns the decoder of the body.
+func (m *message) bodyDecoder() *decoder {
+	return &decoder{b: m.body, order: m.order}
+}
+
+// busError is the error reply of a method call.
+type busError struct {
+	name string
+	text string
+}
+
+func (e *busError) Error() string {
+	return e.name + ": " + e.text
+}
+
+// busConn is a connection to a D-Bus message bus.
+type busConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	serial uint32
+}
+
+// systemBusAddress returns the path of the socket of the system bus.
+func systemBusAddress() (string, error) {
+	address := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS")
+	if address == "" {
+		return "/var/run/dbus/system_bus_socket", nil
+	}
+
+	// The first address of the list with a path is used
+	for _, a := range strings.Split(address, ";") {
+		if !strings.HasPrefix(a, "unix:") {
+			continue
+		}
+		for _, kv := range strings.Split(a[len("unix:"):], ",") {
+			if strings.HasPrefix(kv, "path=") {
+				return unescapeAddress(kv[len("path="):])
+			}
+		}
+	}
+	return "", fmt.Errorf("unsupported D-Bus system bus address '%s'", address)
+}
+
+// unescapeAddress replaces the %xx escapes of a value of a D-Bus address.
+func unescapeAddress(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("invalid D-Bus address value '%s'", s)
+		}
+		v, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("invalid D-Bus address value '%s'", s)
+		}
+		b.Write(v)
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// newBusConn authenticates with the uid of the process and connects to the
+// bus.
+func newBusConn(conn net.Conn) (*busConn, error) {
+	c := &busConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := conn.Write([]byte("\x00AUTH EXTERNAL " + uid + "\r\n")); err != nil {
+		return nil, err
+	}
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return nil, fmt.Errorf("D-Bus authentication failed: %s", strings.TrimSpace(line))
+	}
+	if _, err := conn.Write([]byte("BEGIN\r\n")); err != nil {
+		return nil, err
+	}
+
+	if _, err := c.call(&message{
+		path:        "/org/freedesktop/DBus",
+		iface:       "org.freedesktop.DBus",
+		member:      "Hello",
+		destination: "org.freedesktop.DBus",
+	}); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// call sends the method call and returns its reply. The signals, and the
+// replies of other calls, are discarded.
+func (c *busConn) call(m *message) (*message, error) {
+	c.serial++
+	m.kind = typeMethodCall
+	m.serial = c.serial
+	if _, err := c.conn.Write(m.encode()); err != nil {
+		return nil, err
+	}
+
+	for {
+		reply, err := readMessage(c.reader)
+		if err != nil {
+			return nil, err
+		}
+		if reply.replySerial != m.serial {
+			continue
+		}
+
+		switch reply.kind {
+		case typeMethodReturn:
+			return reply, nil
+		case typeError:
+			d := reply.bodyDecoder()
+			text := ""
+			if strings.HasPrefix(reply.signature, "s") {
+				text = d.string()
+			}
+			return nil, &busError{name: reply.errorName, text: text}
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// Package polkit checks the authorizations of the clients of a varlink service
+// with polkit, like the system services which gate their privileged methods
+// with polkit actions. The polkit authority is called on the D-Bus system bus
+// with the peer credentials of the clients.
+package polkit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/varlink/go/varlink"
+)
+
+// The flag of CheckAuthorization() which lets polkit ask the user for the
+// authentication
+const allowUserInteraction = 1
+
+// Authority is a connection to the polkit authority. It can be used by
+// multiple goroutines, their checks are serialized. After an error, the
+// system bus is connected again for the next check.
+type Authority struct {
+	dial  func() (net.Conn, error)
+	mutex sync.Mutex
+	bus   *busConn
+}
+
+// NewAuthority returns a connection to the polkit authority on the system
+// bus of DBUS_SYSTEM_BUS_ADDRESS, or of the default socket.
+func NewAuthority() (*Authority, error) {
+	path, err := systemBusAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Authority{dial: func() (net.Conn, error) { return net.Dial("unix", path) }}
+	if err := a.connect(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// connect connects to the bus, it is called with the mutex held.
+func (a *Authority) connect() error {
+	conn, err := a.dial()
+	if err != nil {
+		return fmt.Errorf("cannot connect to the system bus: %v", err)
+	}
+	bus, err := newBusConn(conn)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("cannot connect to the system bus: %v", err)
+	}
+	a.bus = bus
+	return nil
+}
+
+// Close closes the connection to the system bus.
+func (a *Authority) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.bus == nil {
+		return nil
+	}
+	err := a.bus.conn.Close()
+	a.bus = nil
+	return err
+}
+
+// CheckAuthorization reports whether the process of the credentials is
+// authorized for the polkit action. The details are passed to the
+// authentication agent, like the strings of the message. With interactive,
+// polkit may ask the user of the process to authenticate, which can take a
+// long time, the call waits until ctx is done.
+func (a *Authority) CheckAuthorization(ctx context.Context, creds *varlink.PeerCredentials, action string, details map[string]string, interactive bool) (bool, error) {
+	if creds == nil {
+		return false, fmt.Errorf("no peer credentials")
+	}
+	startTime, err := processStartTime(creds.PID)
+	if err != nil {
+		return false, err
+	}
+
+	var e encoder
+
+	// The subject is a unix-process (sa{sv})
+	e.align(8)
+	e.string("unix-process")
+	e.array(8, func() {
+		e.align(8)
+		e.string("pid")
+		e.signature("u")
+		e.uint32(uint32(creds.PID))
+		e.align(8)
+		e.string("start-time")
+		e.signature("t")
+		e.uint64(startTime)
+		e.align(8)
+		e.string("uid")
+		e.signature("i")
+		e.uint32(creds.UID)
+	})
+	e.string(action)
+	e.stringMap(details)
+	var flags uint32
+	if interactive {
+		flags |= allowUserInteraction
+	}
+	e.uint32(flags)
+	e.string("")
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.bus == nil {
+		if err := a.connect(); err != nil {
+			return false, err
+		}
+	}
+	bus := a.bus
+
+	// The context interrupts the call with the deadline of the connection
+	if deadline, ok := ctx.Deadline(); ok {
+		bus.conn.SetDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			bus.conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	reply, err := bus.call(&message{
+		path:        "/org/freedesktop/PolicyKit1/Authority",
+		iface:       "org.freedesktop.PolicyKit1.Authority",
+		member:      "CheckAuthorization",
+		destination: "org.freedesktop.PolicyKit1",
+		signature:   "(sa{sv})sa{ss}us",
+		body:        e.b,
+	})
+	close(stop)
+	<-stopped
+
+	if ctx.Err() != nil {
+		a.bus.conn.Close()
+		a.bus = nil
+		return false, ctx.Err()
+	}
+	if err != nil {
+		// An error reply of polkit keeps the connection usable
+		if _, ok := err.(*busError); !ok {
+			a.bus.conn.Close()
+			a.bus = nil
+		}
+		return false, fmt.Errorf("CheckAuthorization(): %v", err)
+	}
+	bus.conn.SetDeadline(time.Time{})
+
+	if reply.signature != "(bba{ss})" {
+		return false, fmt.Errorf("CheckAuthorization(): unexpected reply of type '%s'", reply.signature)
+	}
+	d := reply.bodyDecoder()
+	d.align(8)
+	authorized := d.bool()
+	d.bool()
+	d.stringMap()
+	if d.err != nil {
+		return false, fmt.Errorf("CheckAuthorization(): %v", d.err)
+	}
+
+	return authorized, nil
+}
+
+// Authorizer returns an authorizer for varlink.Service.SetAuthorizer() which
+// checks the polkit actions of the methods, like "org.example.power.Reboot"
+// with the action "org.example.power.reboot". The methods without an action
+// are authorized. The calls of a method with an action are denied, if the
+// client did not connect over a unix socket, or polkit does not authorize it.
+// Polkit does not ask the users to authenticate.
+func (a *Authority) Authorizer(actions map[string]string) varlink.Authorizer {
+	return func(ctx context.Context, peer varlink.Peer, interfaceName string, method string, parameters json.RawMessage) error {
+		action, ok := actions[interfaceName+"."+method]
+		if !ok {
+			return nil
+		}
+
+		authorized, err := a.CheckAuthorization(ctx, peer.Credentials, action, nil, false)
+		if err != nil {
+			return err
+		}
+		if !authorized {
+			return fmt.Errorf("%s is not authorized", action)
+		}
+		return nil
+	}
+}
+
+// processStartTime returns the start time of the process in clock ticks
+// since the boot, which identifies the process of the pid for polkit.
+func processStartTime(pid int32) (uint64, error) {
+	b, err := ioutil.ReadFile("/proc/" + strconv.Itoa(int(pid)) + "/stat")
+	if err != nil {
+		return 0, fmt.Errorf("cannot get the start time of process %d: %v", pid, err)
+	}
+
+	// The name of the process in parentheses can contain any character,
+	// the start time is the 20th field after it
+	stat := string(b)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("cannot get the start time of process %d", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
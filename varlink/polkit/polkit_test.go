@@ -0,0 +1,176 @@
+package polkit
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/varlink/go/varlink"
+)
+
+// fakeBus is the system bus with a polkit authority which authorizes the
+// action "org.example.allowed", and fails for "org.example.failed".
+func fakeBus(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "\x00AUTH EXTERNAL ") {
+		t.Errorf("AUTH: %q %v", line, err)
+		return
+	}
+	conn.Write([]byte("OK 0123456789abcdef\r\n"))
+	if line, err := r.ReadString('\n'); err != nil || line != "BEGIN\r\n" {
+		t.Errorf("BEGIN: %q %v", line, err)
+		return
+	}
+
+	var serial uint32
+	reply := func(m *message) {
+		serial++
+		m.serial = serial
+		conn.Write(m.encode())
+	}
+
+	for {
+		m, err := readMessage(r)
+		if err != nil {
+			return
+		}
+
+		// A signal before the reply is skipped
+		reply(&message{kind: typeSignal, path: "/org/freedesktop/DBus", iface: "org.freedesktop.DBus", member: "NameAcquired"})
+
+		switch m.member {
+		case "Hello":
+			var e encoder
+			e.string(":1.1")
+			reply(&message{kind: typeMethodReturn, replySerial: m.serial, signature: "s", body: e.b})
+
+		case "CheckAuthorization":
+			if m.signature != "(sa{sv})sa{ss}us" || m.destination != "org.freedesktop.PolicyKit1" {
+				t.Errorf("CheckAuthorization(): %+v", m)
+			}
+			d := m.bodyDecoder()
+			d.align(8)
+			kind := d.string()
+			subject := make(map[string]uint64)
+			d.array(8, func() {
+				d.align(8)
+				key := d.string()
+				switch d.signature() {
+				case "u", "i":
+					subject[key] = uint64(d.uint32())
+				case "t":
+					subject[key] = d.uint64()
+				}
+			})
+			action := d.string()
+			details := d.stringMap()
+			flags := d.uint32()
+			d.string()
+			if d.err != nil || kind != "unix-process" || subject["pid"] != uint64(os.Getpid()) || subject["uid"] != uint64(os.Getuid()) || subject["start-time"] == 0 {
+				t.Errorf("CheckAuthorization(): %s %v %v", kind, subject, d.err)
+			}
+			if details["message"] != "" && flags != allowUserInteraction {
+				t.Errorf("CheckAuthorization() details: %v %d", details, flags)
+			}
+
+			if action == "org.example.failed" {
+				var e encoder
+				e.string("failed")
+				reply(&message{kind: typeError, replySerial: m.serial, errorName: "org.freedesktop.PolicyKit1.Error.Failed", signature: "s", body: e.b})
+				continue
+			}
+			var e encoder
+			e.align(8)
+			e.bool(action == "org.example.allowed")
+			e.bool(false)
+			e.stringMap(nil)
+			reply(&message{kind: typeMethodReturn, replySerial: m.serial, signature: "(bba{ss})", body: e.b})
+		}
+	}
+}
+
+func TestCheckAuthorization(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the start time of the processes is only read on Linux")
+	}
+
+	dialed := 0
+	a := &Authority{dial: func() (net.Conn, error) {
+		dialed++
+		client, server := net.Pipe()
+		go fakeBus(t, server)
+		return client, nil
+	}}
+	defer a.Close()
+
+	creds := &varlink.PeerCredentials{UID: uint32(os.Getuid()), GID: uint32(os.Getgid()), PID: int32(os.Getpid())}
+	ctx := context.Background()
+	if ok, err := a.CheckAuthorization(ctx, creds, "org.example.allowed", nil, false); err != nil || !ok {
+		t.Fatalf("CheckAuthorization(): %v %v", ok, err)
+	}
+	if ok, err := a.CheckAuthorization(ctx, creds, "org.example.denied", map[string]string{"message": "Reboot"}, true); err != nil || ok {
+		t.Fatalf("CheckAuthorization() of a denied action: %v %v", ok, err)
+	}
+	if _, err := a.CheckAuthorization(ctx, creds, "org.example.failed", nil, false); err == nil || !strings.Contains(err.Error(), "Error.Failed") {
+		t.Fatalf("CheckAuthorization() of a failing action: %v", err)
+	}
+	if _, err := a.CheckAuthorization(ctx, nil, "org.example.allowed", nil, false); err == nil {
+		t.Fatal("CheckAuthorization() without credentials succeeded")
+	}
+	if dialed != 1 {
+		t.Fatalf("system bus was dialed %d times", dialed)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := a.CheckAuthorization(canceled, creds, "org.example.allowed", nil, false); !errors.Is(err, context.Canceled) {
+		t.Fatalf("CheckAuthorization() with a canceled context: %v", err)
+	}
+	if ok, err := a.CheckAuthorization(ctx, creds, "org.example.allowed", nil, false); err != nil || !ok || dialed != 2 {
+		t.Fatalf("CheckAuthorization() after a canceled check: %v %v %d", ok, err, dialed)
+	}
+
+	authorize := a.Authorizer(map[string]string{
+		"org.example.power.Reboot":   "org.example.denied",
+		"org.example.power.Shutdown": "org.example.allowed",
+	})
+	peer := varlink.Peer{Credentials: creds}
+	if err := authorize(ctx, peer, "org.example.power", "Reboot", nil); err == nil {
+		t.Fatal("Reboot was authorized")
+	}
+	if err := authorize(ctx, peer, "org.example.power", "Shutdown", nil); err != nil {
+		t.Fatalf("Shutdown was not authorized: %v", err)
+	}
+	if err := authorize(ctx, varlink.Peer{}, "org.example.power", "Shutdown", nil); err == nil {
+		t.Fatal("Shutdown was authorized without credentials")
+	}
+	if err := authorize(ctx, varlink.Peer{}, "org.example.power", "Status", nil); err != nil {
+		t.Fatalf("Status without an action was not authorized: %v", err)
+	}
+}
+
+func TestSystemBusAddress(t *testing.T) {
+	for address, path := range map[string]string{
+		"":                                   "/var/run/dbus/system_bus_socket",
+		"unix:path=/run/dbus/system_bus":     "/run/dbus/system_bus",
+		"tcp:host=x;unix:guid=1,path=/a%2cb": "/a,b",
+	} {
+		os.Setenv("DBUS_SYSTEM_BUS_ADDRESS", address)
+		if p, err := systemBusAddress(); err != nil || p != path {
+			t.Fatalf("systemBusAddress(%s): %s %v", address, p, err)
+		}
+	}
+	os.Setenv("DBUS_SYSTEM_BUS_ADDRESS", "tcp:host=localhost,port=1")
+	if _, err := systemBusAddress(); err == nil {
+		t.Fatal("systemBusAddress() accepted a tcp address")
+	}
+	os.Unsetenv("DBUS_SYSTEM_BUS_ADDRESS")
+}
@@ -0,0 +1,221 @@
+package varlink
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The default idle time after which a connection is checked before it is
+// handed out again.
+const defaultHealthCheckIdle = 30 * time.Second
+
+// PoolOption configures a pool created with NewPool().
+type PoolOption func(*Pool)
+
+// WithPoolDialOptions sets the options to dial the connections of the pool.
+func WithPoolDialOptions(opts ...DialOption) PoolOption {
+	return func(p *Pool) {
+		p.dialOptions = opts
+	}
+}
+
+// WithHealthCheck sets the time a connection can be idle before Get() checks
+// it with a call to org.varlink.service.GetInfo. A zero duration disables the
+// checks.
+func WithHealthCheck(idle time.Duration) PoolOption {
+	return func(p *Pool) {
+		p.healthCheck = idle
+	}
+}
+
+// WithPoolRetry repeats the failed calls of Pool.CallWithOptions() which are
+// marked with WithIdempotent() according to the policy, over another connection
+// of the pool.
+func WithPoolRetry(policy Retry) PoolOption {
+	return func(p *Pool) {
+		p.retry = &policy
+	}
+}
+
+type idleConnection struct {
+	conn  *Connection
+	since time.Time
+}
+
+// Pool maintains up to a fixed number of connections to the address of a
+// service for concurrent clients. The service handles the calls sent over a
+// connection one after the other, every client checks out a connection for its
+// calls and returns it to the pool afterwards. Connections are dialed on
+// demand, and they are replaced if a call fails with an error other than a
+// varlink error reply.
+type Pool struct {
+	address     string
+	dialOptions []DialOption
+	healthCheck time.Duration
+	retry       *Retry
+
+	// A slot is taken for every checked out connection
+	slots chan struct{}
+
+	mutex  sync.Mutex
+	idle   []idleConnection
+	closed bool
+}
+
+// NewPool returns a pool of at most size connections to the address.
+func NewPool(address string, size int, opts ...PoolOption) (*Pool, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("invalid pool size %d", size)
+	}
+
+	p := &Pool{
+		address:     address,
+		healthCheck: defaultHealthCheckIdle,
+		slots:       make(chan struct{}, size),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	return p, nil
+}
+
+// Get checks out a connection of the pool. It waits until a connection is
+// available, or dials a new connection if the pool is not full. The connection
+// must be returned to the pool with Put().
+func (p *Pool) Get(ctx context.Context) (*Connection, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	for {
+		p.mutex.Lock()
+		if p.closed {
+			p.mutex.Unlock()
+			<-p.slots
+			return nil, fmt.Errorf("pool is closed")
+		}
+		n := len(p.idle)
+		if n == 0 {
+			p.mutex.Unlock()
+			break
+		}
+		ic := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mutex.Unlock()
+
+		if p.healthCheck > 0 && time.Since(ic.since) >= p.healthCheck {
+			if err := checkConnection(ctx, ic.conn); err != nil {
+				ic.conn.Close()
+				continue
+			}
+		}
+
+		return ic.conn, nil
+	}
+
+	c, err := DialContext(ctx, p.address, p.dialOptions...)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// checkConnection calls org.varlink.service.GetInfo to check that the service
+// still answers on the connection.
+func checkConnection(ctx context.Context, c *Connection) error {
+	receive, err := c.SendWithOptions("org.varlink.service.GetInfo", nil, WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	var info struct{}
+	_, err = receive(&info)
+	return err
+}
+
+// Put returns a connection checked out with Get() to the pool, with the error
+// of the last call sent over it. After errors other than a varlink error reply,
+// the state of the connection is undefined, it is closed and replaced by a new
+// connection for a later Get().
+func (p *Pool) Put(c *Connection, err error) {
+	defer func() { <-p.slots }()
+
+	if _, ok := err.(*Error); err != nil && !ok {
+		c.Close()
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		c.Close()
+		return
+	}
+	p.idle = append(p.idle, idleConnection{conn: c, since: time.Now()})
+}
+
+// Do checks out a connection, calls f with it and returns the connection to
+// the pool with the error returned by f.
+func (p *Pool) Do(ctx context.Context, f func(c *Connection) error) error {
+	c, err := p.Get(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = f(c)
+	p.Put(c, err)
+	return err
+}
+
+// Call sends a method call over a connection of the pool and returns the
+// method reply. The context limits the time to check out the connection and
+// the call itself.
+func (p *Pool) Call(ctx context.Context, method string, parameters interface{}, out_parameters interface{}) error {
+	return p.CallWithOptions(ctx, method, parameters, out_parameters)
+}
+
+// CallWithOptions sends a method call like Call(), configured with CallOption
+// values like Connection.CallWithOptions(). Idempotent calls are repeated with
+// the policy of WithPoolRetry().
+func (p *Pool) CallWithOptions(ctx context.Context, method string, parameters interface{}, out_parameters interface{}, opts ...CallOption) error {
+	var o callOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	opts = append(opts[:len(opts):len(opts)], WithContext(ctx))
+
+	for attempt := 1; ; attempt++ {
+		err := p.Do(ctx, func(c *Connection) error {
+			return c.CallWithOptions(method, parameters, out_parameters, opts...)
+		})
+		if err == nil || p.retry == nil || !o.idempotent || !p.retry.again(ctx, o.deadline, attempt, err) {
+			return err
+		}
+	}
+}
+
+// Close closes the idle connections of the pool. The checked out connections
+// are closed when they are returned, later calls to Get() fail.
+func (p *Pool) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var err error
+	for _, ic := range p.idle {
+		if e := ic.conn.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	p.idle = nil
+	p.closed = true
+
+	return err
+}
@@ -0,0 +1,248 @@
+package varlink
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// WithProxy dials the tcp: and tcp+tls: addresses through the proxy of the
+// URL, like for the clients in networks which reach other networks only with
+// a proxy. The proxy is a SOCKS5 proxy like "socks5://proxy:1080", which
+// resolves the host names of the addresses with "socks5h://proxy:1080", or an
+// HTTP proxy with the CONNECT method like "http://proxy:3128". The user and
+// the password of the URL authenticate with the proxy. The proxy is dialed
+// with the dialer of WithDialFunc(), if it is set.
+func WithProxy(proxy *url.URL) DialOption {
+	return func(o *dialOptions) {
+		o.proxy = proxy
+	}
+}
+
+// dialProxy returns a connection to the address through the proxy.
+func dialProxy(ctx context.Context, proxy *url.URL, dial DialFunc, address string) (net.Conn, error) {
+	var port string
+	switch proxy.Scheme {
+	case "socks5", "socks5h":
+		port = "1080"
+	case "http":
+		port = "80"
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme '%s'", proxy.Scheme)
+	}
+	proxyAddress := proxy.Host
+	if proxy.Port() == "" {
+		proxyAddress = net.JoinHostPort(proxy.Hostname(), port)
+	}
+
+	conn, err := dial(ctx, "tcp", proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// Abort the handshake when the context is canceled
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	tunnel := conn
+	if proxy.Scheme == "http" {
+		tunnel, err = connectHTTP(conn, proxy, address)
+	} else {
+		err = connectSOCKS5(ctx, conn, proxy, address)
+	}
+	close(stop)
+	<-stopped
+
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", proxyAddress, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return tunnel, nil
+}
+
+// The replies of a SOCKS5 proxy which failed to connect
+var socks5Errors = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// connectSOCKS5 requests the connection to the address from a SOCKS5 proxy,
+// see RFC 1928 and RFC 1929.
+func connectSOCKS5(ctx context.Context, conn net.Conn, proxy *url.URL, address string) error {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port '%s'", portString)
+	}
+
+	methods := []byte{0}
+	if proxy.User != nil {
+		methods = []byte{2}
+	}
+	if _, err := conn.Write(append([]byte{5, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return err
+	}
+	if b[0] != 5 {
+		return fmt.Errorf("not a SOCKS5 proxy")
+	}
+	switch b[1] {
+	case 0:
+	case 2:
+		if proxy.User == nil {
+			return fmt.Errorf("proxy requires a user and password")
+		}
+		user := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return fmt.Errorf("user or password is too long")
+		}
+		m := append([]byte{1, byte(len(user))}, user...)
+		m = append(append(m, byte(len(password))), password...)
+		if _, err := conn.Write(m); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		if b[1] != 0 {
+			return fmt.Errorf("authentication failed")
+		}
+	default:
+		return fmt.Errorf("proxy does not accept the authentication method")
+	}
+
+	// A socks5h proxy resolves the host name
+	ip := net.ParseIP(host)
+	if ip == nil && proxy.Scheme == "socks5" {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return err
+		}
+		ip = addrs[0].IP
+	}
+
+	m := []byte{5, 1, 0}
+	switch {
+	case ip.To4() != nil:
+		m = append(append(m, 1), ip.To4()...)
+	case ip != nil:
+		m = append(append(m, 4), ip.To16()...)
+	default:
+		if len(host) > 255 {
+			return fmt.Errorf("host name is too long")
+		}
+		m = append(append(m, 3, byte(len(host))), host...)
+	}
+	m = append(m, byte(port>>8), byte(port))
+	if _, err := conn.Write(m); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		reason, ok := socks5Errors[reply[1]]
+		if !ok {
+			reason = fmt.Sprintf("error %d", reply[1])
+		}
+		return fmt.Errorf("cannot connect to %s: %s", address, reason)
+	}
+
+	// The address which the proxy bound follows, it is discarded
+	var length int
+	switch reply[3] {
+	case 1:
+		length = net.IPv4len - 1
+	case 4:
+		length = net.IPv6len - 1
+	case 3:
+		length = int(reply[4])
+	default:
+		return fmt.Errorf("invalid reply of the proxy")
+	}
+	_, err = io.ReadFull(conn, make([]byte, length+2))
+	return err
+}
+
+// connectHTTP requests the connection to the address from an HTTP proxy with
+// the CONNECT method. It returns the connection of the tunnel.
+func connectHTTP(conn net.Conn, proxy *url.URL, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cannot connect to %s: %s", address, resp.Status)
+	}
+
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were read into the reader.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
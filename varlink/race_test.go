@@ -0,0 +1,8 @@
+//go:build race
+// +build race
+
+package varlink
+
+func init() {
+	raceEnabled = true
+}
@@ -0,0 +1,105 @@
+package varlink
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// backoff is the exponentially growing delay between reconnect attempts.
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+}
+
+// WithReconnect re-dials the address when the service closed the connection
+// or the transport failed. The call which noticed the failure returns its
+// error, the next call re-establishes the connection before it is sent. The
+// attempts are delayed exponentially, starting at initial and doubling until
+// max. They continue until a dial succeeds, or the context, deadline or
+// timeout of the call expires.
+func WithReconnect(initial time.Duration, max time.Duration) DialOption {
+	if initial <= 0 {
+		initial = 100 * time.Millisecond
+	}
+	if max < initial {
+		max = initial
+	}
+	return func(o *dialOptions) {
+		o.reconnect = &backoff{initial: initial, max: max}
+	}
+}
+
+// WithReconnectHook sets a function which is called after every attempt to
+// re-dial a connection configured with WithReconnect(). It receives the
+// number of the attempt, starting at 1, and the error of the attempt, which is
+// nil when the connection is re-established.
+func WithReconnectHook(hook func(attempt int, err error)) DialOption {
+	return func(o *dialOptions) {
+		o.reconnectHook = hook
+	}
+}
+
+// redial replaces the broken transport of the connection. It is called with
+// the write mutex held.
+func (c *Connection) redial(o *callOptions) error {
+	ctx := o.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if deadline := o.deadlineFrom(time.Now()); !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	c.mutex.Lock()
+	c.setState(StateReconnecting, nil)
+	c.mutex.Unlock()
+
+	delay := c.dialOptions.reconnect.initial
+	for attempt := 1; ; attempt++ {
+		conn, err := dialTransport(ctx, c.address, c.dialOptions)
+		if c.dialOptions.reconnectHook != nil {
+			c.dialOptions.reconnectHook(attempt, err)
+		}
+		logResult(c.logger, connectionEvent, "varlink reconnect", err, "address", c.address, "attempt", attempt)
+		if err == nil {
+			c.mutex.Lock()
+			defer c.mutex.Unlock()
+
+			if c.closed {
+				conn.Close()
+				return errConnectionClosed
+			}
+			conn = newTransport(conn)
+			c.conn = conn
+			c.reader, c.writer = c.newBuffers(conn)
+			c.reading = false
+			c.partial = nil
+			c.broken = false
+			c.generation++
+			c.setState(StateConnected, nil)
+			return nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			c.mutex.Lock()
+			c.setState(StateDisconnected, err)
+			c.mutex.Unlock()
+			if o.ctx != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("reconnect to %s failed: %v", c.address, err)
+		}
+
+		delay *= 2
+		if delay > c.dialOptions.reconnect.max {
+			delay = c.dialOptions.reconnect.max
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package varlink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// record is a method call and its replies, a line of a recording.
+type record struct {
+	Call    json.RawMessage   `json:"call"`
+	Replies []json.RawMessage `json:"replies"`
+
+	oneway  bool
+	upgrade bool
+	done    bool
+}
+
+// recorder writes the method calls of the connections to a recording.
+type recorder struct {
+	mutex sync.Mutex
+	w     io.Writer
+	err   error
+}
+
+// WithRecorder records the method calls of the connection and their replies
+// to w, one JSON object per line, like for the golden files of the tests of a
+// client. NewReplayConnection() replies to the calls with the recorded
+// replies. The files passed with the calls, and the messages after an
+// upgrade, are not recorded.
+func WithRecorder(w io.Writer) DialOption {
+	r := &recorder{w: w}
+
+	return func(o *dialOptions) {
+		o.recorder = r
+	}
+}
+
+func (r *recorder) write(rec *record) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.err != nil {
+		return
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		r.err = err
+		return
+	}
+	if _, err := r.w.Write(append(b, '\n')); err != nil {
+		r.err = fmt.Errorf("cannot write the recording: %v", err)
+	}
+}
+
+func (r *recorder) error() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.err
+}
+
+// recordingConn is a transport which records its calls and replies.
+type recordingConn struct {
+	net.Conn
+	recorder *recorder
+
+	mutex    sync.Mutex
+	written  []byte
+	read     []byte
+	calls    []*record
+	upgraded bool
+}
+
+func (r *recorder) wrap(conn net.Conn) net.Conn {
+	return &recordingConn{Conn: conn, recorder: r}
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	if err := c.recorder.error(); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Write(b)
+	c.wrote(b[:n])
+	return n, err
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	if err := c.recorder.error(); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Read(b)
+	c.received(b[:n])
+	return n, err
+}
+
+// Close records the calls which are still waiting for replies, with the
+// replies they received.
+func (c *recordingConn) Close() error {
+	c.mutex.Lock()
+	for _, rec := range c.calls {
+		c.recorder.write(rec)
+	}
+	c.calls = nil
+	c.upgraded = true
+	c.mutex.Unlock()
+
+	return c.Conn.Close()
+}
+
+func (c *recordingConn) wrote(b []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.upgraded {
+		return
+	}
+	c.written = append(c.written, b...)
+	for {
+		i := bytes.IndexByte(c.written, 0)
+		if i < 0 {
+			return
+		}
+		message := append([]byte(nil), c.written[:i]...)
+		c.written = c.written[i+1:]
+
+		var call struct {
+			Oneway  bool `json:"oneway"`
+			Upgrade bool `json:"upgrade"`
+		}
+		json.Unmarshal(message, &call)
+		c.calls = append(c.calls, &record{Call: message, oneway: call.Oneway, upgrade: call.Upgrade, done: call.Oneway})
+		c.flush()
+	}
+}
+
+func (c *recordingConn) received(b []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.read = append(c.read, b...)
+	for !c.upgraded {
+		i := bytes.IndexByte(c.read, 0)
+		if i < 0 {
+			return
+		}
+		message := append([]byte(nil), c.read[:i]...)
+		c.read = c.read[i+1:]
+
+		var rec *record
+		for _, r := range c.calls {
+			if !r.done {
+				rec = r
+				break
+			}
+		}
+		if rec == nil {
+			continue
+		}
+
+		var reply struct {
+			Continues bool `json:"continues"`
+		}
+		json.Unmarshal(message, &reply)
+		rec.Replies = append(rec.Replies, message)
+		if !reply.Continues {
+			rec.done = true
+		}
+		c.flush()
+	}
+	c.read = nil
+}
+
+// flush records the completed calls, in the order in which they were sent.
+// The messages after the reply of an upgrade are not recorded.
+func (c *recordingConn) flush() {
+	for len(c.calls) > 0 && c.calls[0].done {
+		rec := c.calls[0]
+		c.calls = c.calls[1:]
+		c.recorder.write(rec)
+		if rec.upgrade {
+			c.upgraded = true
+			c.calls = nil
+			c.written = nil
+		}
+	}
+}
+
+// NewReplayConnection returns a connection which replies to the method calls
+// with the calls and replies of a recording of WithRecorder(). The calls must
+// be the recorded calls, in their order. A call which does not match the next
+// recorded call fails, like the calls after it.
+func NewReplayConnection(r io.Reader) (*Connection, error) {
+	var records []record
+	d := json.NewDecoder(r)
+	for {
+		var rec record
+		err := d.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid recording: %v", err)
+		}
+		records = append(records, rec)
+	}
+
+	conn := &replayConn{records: records}
+	conn.cond = sync.NewCond(&conn.mutex)
+
+	return NewConnectionFromConn(conn), nil
+}
+
+// replayConn is a transport which replies to the calls with the replies of a
+// recording.
+type replayConn struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	records  []record
+	written  []byte
+	replies  bytes.Buffer
+	err      error
+	closed   bool
+	deadline time.Time
+	timer    *time.Timer
+}
+
+type replayAddr struct{}
+
+func (replayAddr) Network() string { return "replay" }
+func (replayAddr) String() string  { return "replay" }
+
+func (c *replayConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	c.written = append(c.written, b...)
+	for {
+		i := bytes.IndexByte(c.written, 0)
+		if i < 0 {
+			break
+		}
+		message := c.written[:i]
+		c.written = c.written[i+1:]
+
+		if len(c.records) == 0 {
+			c.err = fmt.Errorf("call %s is not in the recording", message)
+			break
+		}
+		rec := c.records[0]
+		if !sameJSON(message, rec.Call) {
+			c.err = fmt.Errorf("call %s does not match the recorded call %s", message, rec.Call)
+			break
+		}
+		c.records = c.records[1:]
+		for _, reply := range rec.Replies {
+			c.replies.Write(reply)
+			c.replies.WriteByte(0)
+		}
+	}
+	c.cond.Broadcast()
+
+	if c.err != nil {
+		return 0, c.err
+	}
+	return len(b), nil
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for c.replies.Len() == 0 {
+		switch {
+		case c.closed:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		case !c.deadline.IsZero() && !time.Now().Before(c.deadline):
+			return 0, timeoutError{}
+		}
+		c.cond.Wait()
+	}
+	return c.replies.Read(b)
+}
+
+func (c *replayConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.closed = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *replayConn) LocalAddr() net.Addr  { return replayAddr{} }
+func (c *replayConn) RemoteAddr() net.Addr { return replayAddr{} }
+
+func (c *replayConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline wakes up the waiting reader at the deadline.
+func (c *replayConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.deadline = t
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if !t.IsZero() {
+		c.timer = time.AfterFunc(time.Until(t), func() {
+			c.mutex.Lock()
+			c.cond.Broadcast()
+			c.mutex.Unlock()
+		})
+	}
+	return nil
+}
+
+func (c *replayConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// sameJSON reports whether the JSON values are equal, regardless of the
+// order of their fields.
+func sameJSON(a []byte, b []byte) bool {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
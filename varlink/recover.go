@@ -0,0 +1,34 @@
+package varlink
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+)
+
+// The error reply of a method call which panicked
+const errorInternal = "org.varlink.InternalError"
+
+// recoverCall recovers the panic of a method call, like a nil dereference
+// of a method, and sends the error reply. The connection stays open for the
+// next calls. The panic is logged with its stack with the logger of
+// SetLogger(), or with the log package.
+func (s *Service) recoverCall(c *Call, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	stack := debug.Stack()
+	if s.logger != nil {
+		s.logger.log(errorEvent, "varlink method call panicked", "method", c.Method(), "panic", fmt.Sprint(r), "stack", string(stack))
+	} else {
+		log.Printf("varlink: panic in method call %s: %v\n%s", c.Method(), r, stack)
+	}
+
+	*err = c.sendMessage(&serviceReply{Error: errorInternal})
+	if errors.Is(*err, ErrOneway) {
+		*err = nil
+	}
+}
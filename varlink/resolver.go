@@ -1,5 +1,7 @@
 package varlink
 
+import "context"
+
 // ResolverAddress is the well-known address of the varlink interface resolver,
 // it translates varlink interface names to varlink service addresses.
 const ResolverAddress = "unix:/run/org.varlink.resolver"
@@ -12,6 +14,10 @@ type Resolver struct {
 
 // Resolve resolves a varlink interface name to a varlink address.
 func (r *Resolver) Resolve(iface string) (string, error) {
+	return r.resolve(context.Background(), iface)
+}
+
+func (r *Resolver) resolve(ctx context.Context, iface string) (string, error) {
 	type request struct {
 		Interface string `json:"interface"`
 	}
@@ -25,7 +31,7 @@ func (r *Resolver) Resolve(iface string) (string, error) {
 	}
 
 	var rep reply
-	err := r.conn.Call("org.varlink.resolver.Resolve", &request{Interface: iface}, &rep)
+	err := r.conn.CallWithOptions("org.varlink.resolver.Resolve", &request{Interface: iface}, &rep, WithContext(ctx))
 	if err != nil {
 		return "", err
 	}
@@ -79,7 +85,7 @@ func NewResolver(address string) (*Resolver, error) {
 		address = ResolverAddress
 	}
 
-	c, err := NewConnection(address)
+	c, err := DialContext(context.Background(), address)
 	if err != nil {
 		return nil, err
 	}
@@ -90,3 +96,39 @@ func NewResolver(address string) (*Resolver, error) {
 
 	return &r, nil
 }
+
+// Resolve asks the resolver at the well-known ResolverAddress for the address
+// of the service which implements the varlink interface.
+func Resolve(ctx context.Context, iface string) (string, error) {
+	return resolve(ctx, ResolverAddress, iface)
+}
+
+// ResolveAndConnect resolves the address of the service which implements the
+// varlink interface, and connects to it.
+func ResolveAndConnect(ctx context.Context, iface string, opts ...DialOption) (*Connection, error) {
+	return resolveAndConnect(ctx, ResolverAddress, iface, opts...)
+}
+
+func resolve(ctx context.Context, resolverAddress string, iface string) (string, error) {
+	c, err := DialContext(ctx, resolverAddress)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	r := Resolver{
+		address: resolverAddress,
+		conn:    c,
+	}
+
+	return r.resolve(ctx, iface)
+}
+
+func resolveAndConnect(ctx context.Context, resolverAddress string, iface string, opts ...DialOption) (*Connection, error) {
+	address, err := resolve(ctx, resolverAddress, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	return DialContext(ctx, address, opts...)
+}
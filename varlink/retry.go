@@ -0,0 +1,140 @@
+package varlink
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Retry is the policy to repeat failed idempotent calls, see WithRetry() and
+// WithIdempotent().
+type Retry struct {
+	// The maximum number of attempts of a call, including the first one
+	MaxAttempts int
+
+	// The delay before the second attempt, it doubles with every further
+	// attempt up to MaxBackoff. The default is 100ms.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Retryable reports whether a call with the error is repeated. By
+	// default, transport errors are retried, varlink error replies,
+	// timeouts, canceled contexts, aborted streams and closed connections
+	// not.
+	Retryable func(err error) bool
+}
+
+// WithRetry repeats the failed calls marked with WithIdempotent() according to
+// the policy. A call is repeated if it could not be sent, or if it failed
+// before its first reply. The transport of a connection is only replaced with
+// WithReconnect().
+func WithRetry(policy Retry) DialOption {
+	return func(o *dialOptions) {
+		o.retry = &policy
+	}
+}
+
+// WithIdempotent marks the call as idempotent, the service can receive it
+// more than once. It is repeated after failures with the policy of
+// WithRetry() or WithPoolRetry().
+func WithIdempotent() CallOption {
+	return func(o *callOptions) {
+		o.idempotent = true
+	}
+}
+
+func (r *Retry) retryable(err error) bool {
+	if r.Retryable != nil {
+		return r.Retryable(err)
+	}
+
+	if _, ok := err.(*Error); ok {
+		return false
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return false
+	}
+	switch err {
+	case context.Canceled, context.DeadlineExceeded, errConnectionClosed, errConnectionUpgraded, errStreamAborted:
+		return false
+	}
+	return true
+}
+
+// again reports whether the call with the error is repeated after the
+// attempt, and waits for the delay before the next attempt. The deadline of
+// the call can be zero, the context nil.
+func (r *Retry) again(ctx context.Context, deadline time.Time, attempt int, err error) bool {
+	if attempt >= r.MaxAttempts || !r.retryable(err) {
+		return false
+	}
+
+	delay := r.Backoff
+	if delay <= 0 {
+		delay = 100 * time.Millisecond
+	}
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if r.MaxBackoff > 0 && delay >= r.MaxBackoff {
+			delay = r.MaxBackoff
+			break
+		}
+	}
+	if !deadline.IsZero() && time.Now().Add(delay).After(deadline) {
+		return false
+	}
+
+	var done <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// retryCall sends the idempotent call, and repeats it after failures before
+// its first reply.
+func (c *Connection) retryCall(method string, parameters interface{}, o *callOptions) (func(interface{}) (uint64, error), error) {
+	attempt := 0
+	var receive func(interface{}) (uint64, error)
+
+	// send sends the next attempt, until one is sent or the call fails
+	send := func() error {
+		for {
+			attempt++
+			a := *o
+			var err error
+			receive, err = c.traceCall(method, parameters, &a)
+			if err == nil || !c.retry.again(o.ctx, o.deadline, attempt, err) {
+				return err
+			}
+		}
+	}
+
+	if err := send(); err != nil {
+		return nil, err
+	}
+	if o.flags&Oneway != 0 {
+		return receive, nil
+	}
+
+	replied := false
+	return func(out_parameters interface{}) (uint64, error) {
+		for {
+			flags, err := receive(out_parameters)
+			if err == nil || replied || !c.retry.again(o.ctx, o.deadline, attempt, err) {
+				replied = true
+				return flags, err
+			}
+			if err := send(); err != nil {
+				return 0, err
+			}
+		}
+	}, nil
+}
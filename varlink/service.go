@@ -2,14 +2,15 @@ package varlink
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 )
 
@@ -23,18 +24,35 @@ type serviceCall struct {
 	Method     string           `json:"method"`
 	Parameters *json.RawMessage `json:"parameters,omitempty"`
 	More       bool             `json:"more,omitempty"`
-	OneShot    bool             `json:"oneshot,omitempty"`
+	Oneway     bool             `json:"oneway,omitempty"`
+	Upgrade    bool             `json:"upgrade,omitempty"`
+
+	// The name of the oneway flag of older clients
+	OneShot bool `json:"oneshot,omitempty"`
+}
+
+// parseCall decodes the method call of the request.
+func parseCall(request []byte) (serviceCall, error) {
+	var in serviceCall
+	if err := json.Unmarshal(request, &in); err != nil {
+		return in, err
+	}
+	in.Oneway = in.Oneway || in.OneShot
+	return in, nil
 }
 
 type serviceReply struct {
 	Parameters interface{} `json:"parameters,omitempty"`
 	Continues  bool        `json:"continues,omitempty"`
 	Error      string      `json:"error,omitempty"`
+
+	// The files passed along with the reply
+	files []*os.File
 }
 
 // Service represents an active varlink service. In addition to the registered custom varlink Interfaces, every service
 // implements the org.varlink.service interface which allows clients to retrieve information about the
-// running service.
+// running service. A method call which panics gets the error reply org.varlink.InternalError.
 type Service struct {
 	vendor       string
 	product      string
@@ -43,16 +61,54 @@ type Service struct {
 	interfaces   map[string]dispatcher
 	names        []string
 	descriptions map[string]string
+
+	// Guards the interfaces, which are registered while the service runs
+	interfacesMutex sync.RWMutex
+
 	running      bool
-	listener     net.Listener
+	listeners    []net.Listener
 	conncounter  int64
 	mutex        sync.Mutex
 	protocol     string
 	address      string
+	tlsConfig    *tls.Config
+	tcpOptions   *TCPOptions
+	unixOptions  *UnixOptions
+	pipeSecurity string
+	logger       eventLogger
+	encoder      *EncoderOptions
+	idleTimeout  time.Duration
+
+	// The limits, and the served connections and handled calls which
+	// are counted for them
+	limits      Limits
+	servedConns int
+	activeCalls int
+
+	authorizer   Authorizer
+	interceptors []ServiceInterceptor
+
+	// Validates the parameters of the calls, see SetValidation()
+	validator *validator
+
+	// Shuts down the listeners of a running service, after it had no
+	// connections for the idle duration
+	idleTimer    *time.Timer
+	idleDuration time.Duration
+
+	// The connections, and the channel which is closed when they change,
+	// see ShutdownContext()
+	conns    map[*serviceConn]bool
+	changed  chan struct{}
+	draining bool
 }
 
 func (s *Service) getInfo(c Call) error {
-	return c.replyGetInfo(s.vendor, s.product, s.version, s.url, s.names)
+	s.interfacesMutex.RLock()
+	names := s.names
+	s.interfacesMutex.RUnlock()
+
+	return c.replyGetInfo(s.vendor, s.product, s.version, s.url, names)
 }
 
 func (s *Service) getInterfaceDescription(c Call, name string) error {
@@ -60,7 +116,9 @@ func (s *Service) getInterfaceDescription(c Call, name string) error {
 		return c.ReplyInvalidParameter("interface")
 	}
 
+	s.interfacesMutex.RLock()
 	description, ok := s.descriptions[name]
+	s.interfacesMutex.RUnlock()
 	if !ok {
 		return c.ReplyInvalidParameter("interface")
 	}
@@ -68,19 +126,38 @@ func (s *Service) getInterfaceDescription(c Call, name string) error {
 	return c.replyGetInterfaceDescription(description)
 }
 
-func (s *Service) handleMessage(writer *bufio.Writer, request []byte) error {
-	var in serviceCall
-
-	err := json.Unmarshal(request, &in)
+func (s *Service) handleMessage(writer *bufio.Writer, request []byte) (err error) {
+	return s.handleCall(&serviceConn{writer: writer}, request)
+}
 
+// handleCall handles the method call of the request on the connection.
+func (s *Service) handleCall(sc *serviceConn, request []byte) (err error) {
+	in, err := parseCall(request)
 	if err != nil {
 		return err
 	}
 
+	s.mutex.Lock()
+	sc.more = in.More
+	s.mutex.Unlock()
+
+	if s.logger != nil {
+		start := time.Now()
+		defer func() {
+			logResult(s.logger, callEvent, "varlink method call", err, "method", in.Method, "duration", time.Since(start))
+		}()
+	}
+
 	c := Call{
-		writer: writer,
-		in:     &in,
+		writer:     sc.writer,
+		writeMutex: &sc.writeMutex,
+		in:         &in,
+		encoder:    s.encoder,
+		conn:       sc,
+		ctx:        sc.callContext(),
+		replies:    &callReplies{},
 	}
+	defer s.recoverCall(&c, &err)
 
 	r := strings.LastIndex(in.Method, ".")
 	if r <= 0 {
@@ -90,106 +167,192 @@ func (s *Service) handleMessage(writer *bufio.Writer, request []byte) error {
 	interfacename := in.Method[:r]
 	methodname := in.Method[r+1:]
 
+	return s.intercept(&c, func(ctx context.Context, c *Call) error {
+		c.ctx = ctx
+		err := s.dispatch(*c, interfacename, methodname)
+		if errors.Is(err, ErrOneway) {
+			// The methods reply to the oneway calls like to the others
+			return nil
+		}
+		return err
+	})
+}
+
+// dispatch authorizes the call and calls the method.
+func (s *Service) dispatch(c Call, interfacename string, methodname string) error {
+	if ok, err := s.authorize(&c, interfacename, methodname); !ok {
+		return err
+	}
+
 	if interfacename == "org.varlink.service" {
 		return s.orgvarlinkserviceDispatch(c, methodname)
 	}
 
 	// Find the interface and method in our service
+	s.interfacesMutex.RLock()
 	iface, ok := s.interfaces[interfacename]
+	s.interfacesMutex.RUnlock()
 	if !ok {
 		return c.ReplyInterfaceNotFound(interfacename)
 	}
 
+	if s.validator != nil {
+		if ok, err := s.validateCall(&c, iface, methodname); !ok {
+			return err
+		}
+	}
+
 	return iface.VarlinkDispatch(c, methodname)
 }
 
-func activationListener() net.Listener {
-	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
-	if err != nil || pid != os.Getpid() {
-		return nil
+// Shutdown shuts down the listeners of a running service.
+func (s *Service) Shutdown() {
+	s.mutex.Lock()
+	s.running = false
+	for _, l := range s.listeners {
+		l.Close()
 	}
+	s.mutex.Unlock()
+}
 
-	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
-	if err != nil || nfds < 1 {
-		return nil
+func (s *Service) handleConnection(conn net.Conn, wg *sync.WaitGroup) {
+	sc := s.addConn(conn)
+	reader := bufio.NewReader(sc.conn)
+	defer func() { s.removeConn(sc); wg.Done() }()
+
+	if !s.acquire(&s.servedConns, s.limits.MaxConnections) {
+		s.rejectConn(sc, reader)
+		sc.close()
+		return
 	}
+	defer s.release(&s.servedConns)
 
-	fd := -1
-
-	// If more than one file descriptor is passed, find the
-	// "varlink" tag. The first file descriptor is always 3.
-	if nfds > 1 {
-		fdnames, set := os.LookupEnv("LISTEN_FDNAMES")
-		if !set {
-			return nil
+	var watched <-chan struct{}
+	for {
+		// The reader is read again, after the watch of the last call
+		// returned
+		if watched != nil {
+			<-watched
 		}
 
-		names := strings.Split(fdnames, ":")
-		if len(names) != nfds {
-			return nil
+		request, err := reader.ReadBytes('\x00')
+		if err != nil || !s.beginCall(sc) {
+			break
 		}
 
-		for i, name := range names {
-			if name == "varlink" {
-				fd = 3 + i
-				break
-			}
+		if s.acquire(&s.activeCalls, s.limits.MaxCalls) {
+			sc.receiveFiles(reader)
+			watched = s.watchCall(sc, reader)
+			err = s.handleCall(sc, request[:len(request)-1])
+			sc.endCall()
+			s.release(&s.activeCalls)
+		} else {
+			err = s.rejectCall(sc, request[:len(request)-1])
 		}
-
-		if fd < 0 {
-			return nil
+		if err != nil {
+			s.endCall(sc)
+			logResult(s.logger, connectionEvent, "varlink connection", err, "remote", conn.RemoteAddr().String())
+			break
+		}
+		if sc.isUpgraded() {
+			// The connection belongs to the protocol of the upgraded
+			// call, until it is closed
+			<-sc.closed
+			s.endCall(sc)
+			break
+		}
+		if !s.endCall(sc) {
+			break
 		}
-
-	} else {
-		fd = 3
 	}
 
-	syscall.CloseOnExec(fd)
+	sc.close()
+}
 
-	file := os.NewFile(uintptr(fd), "varlink")
-	listener, err := net.FileListener(file)
+// ServeConn handles the method calls of the connection, until it is closed.
+// The service does not need to listen, like for the connection of an inetd
+// or a systemd service with Accept=yes, see ServeStdio() and
+// ServeActivatedConn(), or for a connection in the same process.
+func (s *Service) ServeConn(conn net.Conn) {
+	s.countConn()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	s.handleConnection(conn, &wg)
+}
+
+// ServeStdio handles the method calls of the connection on the standard input
+// and output, for a service which is started by the client with an exec:
+// address. The standard input must be a socket.
+func (s *Service) ServeStdio() error {
+	conn, err := net.FileConn(os.Stdin)
 	if err != nil {
-		return nil
+		return fmt.Errorf("ServeStdio(): standard input is not a socket: %v", err)
 	}
+	s.ServeConn(conn)
 
-	return listener
+	return nil
 }
 
-// Shutdown shuts down the listener of a running service.
-func (s *Service) Shutdown() {
-	s.running = false
-	s.mutex.Lock()
-	if s.listener != nil {
-		s.listener.Close()
+// ServeActivatedConn handles the method calls of the connection which systemd
+// passed to a service with Accept=yes, until it is closed. It fails if no
+// connection was passed.
+func (s *Service) ServeActivatedConn() error {
+	file := activationFile()
+	if file == nil {
+		return fmt.Errorf("ServeActivatedConn(): no socket was passed by systemd")
 	}
-	s.mutex.Unlock()
+	conn, err := net.FileConn(file)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("ServeActivatedConn(): %v", err)
+	}
+	s.ServeConn(conn)
+
+	return nil
 }
 
-func (s *Service) handleConnection(conn net.Conn, wg *sync.WaitGroup) {
-	defer func() { s.mutex.Lock(); s.conncounter--; s.mutex.Unlock(); wg.Done() }()
-	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
+func (s *Service) isRunning() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	for {
-		request, err := reader.ReadBytes('\x00')
-		if err != nil {
-			break
-		}
+	return s.running
+}
 
-		err = s.handleMessage(writer, request[:len(request)-1])
-		if err != nil {
-			// FIXME: report error
-			//fmt.Fprintf(os.Stderr, "handleMessage: %v", err)
-			break
-		}
+// countConn counts a new connection, the service is not idle until it is
+// closed.
+func (s *Service) countConn() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.conncounter++
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
 	}
+}
+
+// shutdownIdle shuts down the listeners when the idle timer fires, if the
+// service still has no connections.
+func (s *Service) shutdownIdle() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	conn.Close()
+	if s.conncounter > 0 || !s.running {
+		return
+	}
+	s.running = false
+	for _, l := range s.listeners {
+		l.Close()
+	}
 }
 
 func (s *Service) teardown() {
 	s.mutex.Lock()
-	s.listener = nil
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+		s.idleTimer = nil
+	}
+	s.listeners = nil
 	s.running = false
 	s.protocol = ""
 	s.address = ""
@@ -198,6 +361,9 @@ func (s *Service) teardown() {
 
 func (s *Service) parseAddress(address string) error {
 	words := strings.SplitN(address, ":", 2)
+	if len(words) != 2 {
+		return fmt.Errorf("invalid address '%s'", address)
+	}
 	s.protocol = words[0]
 	s.address = words[1]
 
@@ -209,10 +375,8 @@ func (s *Service) parseAddress(address string) error {
 
 	switch s.protocol {
 	case "unix":
-		break
-	case "tcp":
-		break
-
+		return checkUnixAddress(s.address)
+	case "tcp", "tcp+tls", "vsock", "npipe":
 	default:
 		return fmt.Errorf("Unknown protocol")
 	}
@@ -220,112 +384,331 @@ func (s *Service) parseAddress(address string) error {
 	return nil
 }
 
-func getListener(protocol string, address string) (net.Listener, error) {
-	l := activationListener()
-	if l == nil {
-		if protocol == "unix" && address[0] != '@' {
-			os.Remove(address)
-		}
+func getListener(protocol string, address string, tcpOptions *TCPOptions, unixOptions *UnixOptions, pipeSecurity string) (net.Listener, error) {
+	switch protocol {
+	case "vsock":
+		return listenVsock(address)
+	case "tcp":
+		return listenTCP(address, tcpOptions)
+	case "unix":
+		return listenUnix(address, unixOptions)
+	case "npipe":
+		return listenPipe(address, pipeSecurity)
+	default:
+		return net.Listen(protocol, address)
+	}
+}
 
-		var err error
-		l, err = net.Listen(protocol, address)
-		if err != nil {
-			return nil, err
-		}
+// Listen starts a Service. With a timeout, it returns after the timeout
+// passed without connections.
+//
+// Deprecated: Listen can only be stopped with Shutdown(), use RunContext()
+// and SetIdleTimeout().
+func (s *Service) Listen(address string, timeout time.Duration) error {
+	return s.listen(context.Background(), address, timeout)
+}
 
-		if protocol == "unix" && address[0] != '@' {
-			l.(*net.UnixListener).SetUnlinkOnClose(true)
-		}
+// RunContext runs the service at the address until ctx is done, like for a
+// service which stops at a signal or with the other goroutines of an
+// errgroup. When ctx is done, the listener and the connections are closed
+// like with a ShutdownContext() whose context is done, and RunContext returns
+// nil after the calls which were handled returned. Without connections, it
+// returns after the timeout of SetIdleTimeout(). On Windows, npipe: addresses
+// listen on a named pipe, see SetPipeSecurity().
+func (s *Service) RunContext(ctx context.Context, address string) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-
-	return l, nil
+	return s.listen(ctx, address, s.idleTimeout)
 }
 
-func (s *Service) refreshTimeout(timeout time.Duration) error {
-	switch s.protocol {
-	case "unix":
-		if err := s.listener.(*net.UnixListener).SetDeadline(time.Now().Add(timeout)); err != nil {
-			return err
-		}
+// RunAddresses runs the service at all the addresses until ctx is done, like
+// RunContext(), like for a service with a unix socket for root and another
+// one for the users, or a unix socket and a TCP port. The connections of the
+// addresses share the limits and the idle timeout of the service. When one of
+// the listeners fails, the service is shut down and the error is returned.
+// The sockets which systemd passed to the process are not used, see
+// RunActivated().
+func (s *Service) RunAddresses(ctx context.Context, addresses ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(addresses) == 0 {
+		return fmt.Errorf("RunAddresses(): no addresses")
+	}
 
-	case "tcp":
-		if err := s.listener.(*net.TCPListener).SetDeadline(time.Now().Add(timeout)); err != nil {
+	s.mutex.Lock()
+	if s.running {
+		s.mutex.Unlock()
+		return fmt.Errorf("RunAddresses(): already running")
+	}
+	s.mutex.Unlock()
+
+	var listeners []serviceListener
+	for _, address := range addresses {
+		l, err := s.listenAddress(address, false)
+		if err != nil {
+			for _, l := range listeners {
+				l.listener.Close()
+			}
+			s.teardown()
 			return err
 		}
+		listeners = append(listeners, l)
 	}
 
-	return nil
+	return s.serve(ctx, listeners, s.idleTimeout)
 }
 
-// Listen starts a Service.
-func (s *Service) Listen(address string, timeout time.Duration) error {
-	var wg sync.WaitGroup
-	defer func() { s.teardown(); wg.Wait() }()
+// RunActivated runs the service on the listening sockets which systemd
+// passed to the process until ctx is done, like RunContext(). With names,
+// only the sockets with the FileDescriptorName= of the names are served, like
+// for a socket unit which listens on a unix socket and a TCP port for the
+// service, and on other sockets for other uses. Without names, all sockets
+// are served. The sockets are served without TLS.
+func (s *Service) RunActivated(ctx context.Context, names ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	s.mutex.Lock()
 	if s.running {
 		s.mutex.Unlock()
-		return fmt.Errorf("Listen(): already running")
+		return fmt.Errorf("RunActivated(): already running")
 	}
 	s.mutex.Unlock()
 
-	s.parseAddress(address)
+	listeners, err := activationListeners(names)
+	if err != nil {
+		return fmt.Errorf("RunActivated(): %v", err)
+	}
+	for i, l := range listeners {
+		listeners[i].listener = tuneListener(l.listener, s.tcpOptions)
+		listeners[i].accept = listeners[i].listener
+	}
 
-	l, err := getListener(s.protocol, s.address)
+	return s.serve(ctx, listeners, s.idleTimeout)
+}
+
+// SetIdleTimeout sets the timeout of RunContext() and RunActivated(), they
+// return when the service had no connections, and so no calls in flight, for
+// the timeout, like a socket activated service which exits when it is idle
+// and is started again for the next connection. The timeout starts when the
+// last connection is closed.
+func (s *Service) SetIdleTimeout(timeout time.Duration) error {
+	if s.running {
+		return fmt.Errorf("service is already running")
+	}
+	s.idleTimeout = timeout
+
+	return nil
+}
+
+func (s *Service) listen(ctx context.Context, address string, timeout time.Duration) error {
+	s.mutex.Lock()
+	if s.running {
+		s.mutex.Unlock()
+		return fmt.Errorf("Listen(): already running")
+	}
+	s.mutex.Unlock()
+
+	l, err := s.listenAddress(address, true)
 	if err != nil {
+		s.teardown()
 		return err
 	}
 
+	return s.serve(ctx, []serviceListener{l}, timeout)
+}
+
+// listenAddress returns the listener of the address. With activation, the
+// socket which systemd passed to the process is used instead, if there is one.
+func (s *Service) listenAddress(address string, activation bool) (serviceListener, error) {
+	if err := s.parseAddress(address); err != nil {
+		return serviceListener{}, fmt.Errorf("Listen(): %v", err)
+	}
+
+	network := s.protocol
+	if network == "tcp+tls" {
+		if s.tlsConfig == nil {
+			return serviceListener{}, fmt.Errorf("Listen(): %s requires a TLS configuration", address)
+		}
+		network = "tcp"
+	}
+
+	var l net.Listener
+	if activation {
+		l = activationListener()
+	}
+	if l != nil {
+		l = tuneListener(l, s.tcpOptions)
+	} else {
+		var err error
+		l, err = getListener(network, s.address, s.tcpOptions, s.unixOptions, s.pipeSecurity)
+		if err != nil {
+			return serviceListener{}, err
+		}
+	}
+
+	// The deadline of the accept timeout is set on the TCP listener
+	accept := l
+	if s.protocol == "tcp+tls" {
+		accept = tls.NewListener(l, s.tlsConfig)
+	}
+
+	return serviceListener{listener: l, accept: accept, address: address}, nil
+}
+
+// serviceListener is a listener of a running service. The connections are
+// accepted with accept, like a TLS listener on top of the listener.
+type serviceListener struct {
+	listener net.Listener
+	accept   net.Listener
+	address  string
+}
+
+// serve accepts the connections of the listeners until the service is shut
+// down, ctx is done, one of the listeners fails, or the service had no
+// connections for the timeout. The listeners are closed when it returns.
+func (s *Service) serve(ctx context.Context, listeners []serviceListener, timeout time.Duration) error {
+	var wg sync.WaitGroup
+	defer func() { s.teardown(); wg.Wait() }()
+
 	s.mutex.Lock()
-	s.listener = l
+	for _, l := range listeners {
+		s.listeners = append(s.listeners, l.listener)
+	}
 	s.running = true
+	if timeout != 0 {
+		s.idleDuration = timeout
+		s.idleTimer = time.AfterFunc(timeout, s.shutdownIdle)
+		if s.conncounter > 0 {
+			s.idleTimer.Stop()
+		}
+	}
 	s.mutex.Unlock()
 
-	for s.running {
-		if timeout != 0 {
-			if err := s.refreshTimeout(timeout); err != nil {
-				return err
+	if ctx.Done() != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				s.ShutdownContext(ctx)
+			case <-stop:
 			}
-		}
-		conn, err := l.Accept()
+		}()
+	}
+
+	results := make(chan error, len(listeners))
+	for _, l := range listeners {
+		logResult(s.logger, connectionEvent, "varlink listening", nil, "address", l.address)
+		go func(l serviceListener) {
+			results <- s.acceptConns(l, &wg)
+		}(l)
+	}
+
+	// The first listener which returns stops the others
+	err := <-results
+	s.Shutdown()
+	for i := 1; i < len(listeners); i++ {
+		<-results
+	}
+
+	return err
+}
+
+func (s *Service) acceptConns(l serviceListener, wg *sync.WaitGroup) error {
+	for s.isRunning() {
+		conn, err := l.accept.Accept()
 		if err != nil {
-			if err.(net.Error).Timeout() {
-				s.mutex.Lock()
-				if s.conncounter == 0 {
-					s.mutex.Unlock()
-					return nil
-				}
-				s.mutex.Unlock()
-				continue
-			}
-			if !s.running {
+			if !s.isRunning() {
 				return nil
 			}
 			return err
 		}
-		s.mutex.Lock()
-		s.conncounter++
-		s.mutex.Unlock()
+		s.countConn()
+		logResult(s.logger, connectionEvent, "varlink connection", nil, "remote", conn.RemoteAddr().String())
 		wg.Add(1)
-		go s.handleConnection(conn, &wg)
+		go s.handleConnection(conn, wg)
 	}
 
 	return nil
 }
 
-// RegisterInterface registers a varlink.Interface containing struct to the Service
+// RegisterInterface registers a varlink.Interface containing struct to the Service.
+// An interface can be registered while the service is running, like by the
+// plugins of a service, GetInfo() lists it and the calls are dispatched to it
+// after RegisterInterface() returned.
 func (s *Service) RegisterInterface(iface dispatcher) error {
 	name := iface.VarlinkGetName()
+	description := iface.VarlinkGetDescription()
+
+	s.interfacesMutex.Lock()
+	defer s.interfacesMutex.Unlock()
+
 	if _, ok := s.interfaces[name]; ok {
 		return fmt.Errorf("interface '%s' already registered", name)
 	}
+	s.interfaces[name] = iface
+	s.descriptions[name] = description
+	s.names = append(s.names, name)
+
+	return nil
+}
+
+// UnregisterInterface removes the interface of the name from the service. The
+// calls of the interface which are in flight are handled, the later calls
+// get the error reply org.varlink.service.InterfaceNotFound.
+func (s *Service) UnregisterInterface(name string) error {
+	if name == "org.varlink.service" {
+		return fmt.Errorf("interface '%s' cannot be unregistered", name)
+	}
+
+	s.interfacesMutex.Lock()
+	defer s.interfacesMutex.Unlock()
+
+	if _, ok := s.interfaces[name]; !ok {
+		return fmt.Errorf("interface '%s' is not registered", name)
+	}
+	delete(s.interfaces, name)
+	delete(s.descriptions, name)
+	if s.validator != nil {
+		s.validator.forget(name)
+	}
+
+	// The replies of GetInfo() in flight keep the old names
+	names := make([]string, 0, len(s.names)-1)
+	for _, n := range s.names {
+		if n != name {
+			names = append(names, n)
+		}
+	}
+	s.names = names
+
+	return nil
+}
 
+// SetTLSConfig sets the configuration of the TLS server for tcp+tls: addresses.
+// Clients are required to authenticate with a certificate by setting the
+// ClientAuth and ClientCAs of the configuration, the methods get the verified
+// certificate with Call.PeerCertificate().
+func (s *Service) SetTLSConfig(config *tls.Config) error {
 	if s.running {
 		return fmt.Errorf("service is already running")
 	}
-	s.interfaces[name] = iface
-	s.descriptions[name] = iface.VarlinkGetDescription()
-	s.names = append(s.names, name)
+	s.tlsConfig = config
+
+	return nil
+}
+
+// SetEncoderOptions sets the options of the JSON encoding of the replies of
+// the service.
+func (s *Service) SetEncoderOptions(options EncoderOptions) error {
+	if s.running {
+		return fmt.Errorf("service is already running")
+	}
+	s.encoder = &options
 
 	return nil
 }
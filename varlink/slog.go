@@ -0,0 +1,165 @@
+//go:build go1.21
+// +build go1.21
+
+package varlink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// LogLevels are the levels of the events logged with WithLogger() and
+// Service.SetLogger().
+type LogLevels struct {
+	// The start and end of method calls
+	Calls slog.Level
+	// Dials, reconnects, listening services and accepted connections
+	Connections slog.Level
+	// Failed calls, dials and connections
+	Errors slog.Level
+}
+
+// DefaultLogLevels logs the events of connections at the info level, calls at
+// the debug level and errors at the warn level.
+var DefaultLogLevels = LogLevels{
+	Calls:       slog.LevelDebug,
+	Connections: slog.LevelInfo,
+	Errors:      slog.LevelWarn,
+}
+
+type slogLogger struct {
+	logger *slog.Logger
+	levels LogLevels
+}
+
+func (l *slogLogger) log(kind eventKind, msg string, args ...interface{}) {
+	l.logger.Log(context.Background(), l.level(kind), msg, args...)
+}
+
+func (l *slogLogger) level(kind eventKind) slog.Level {
+	switch kind {
+	case callEvent:
+		return l.levels.Calls
+	case connectionEvent:
+		return l.levels.Connections
+	}
+	return l.levels.Errors
+}
+
+type slogSpan struct {
+	logger *slogLogger
+	ctx    context.Context
+}
+
+// StartCall logs the start of a method call.
+func (l *slogLogger) StartCall(ctx context.Context, call *CallInfo) CallSpan {
+	l.logger.Log(ctx, l.levels.Calls, "varlink call", "method", call.Method, "address", call.Address)
+	return slogSpan{logger: l, ctx: ctx}
+}
+
+// End logs the end of a method call.
+func (s slogSpan) End(call *CallInfo) {
+	args := []interface{}{"method", call.Method, "address", call.Address, "duration", call.Duration, "replies", call.Replies}
+	if call.Err != nil {
+		s.logger.logger.Log(s.ctx, s.logger.levels.Errors, "varlink call failed", append(args, "error", call.Err)...)
+		return
+	}
+	s.logger.logger.Log(s.ctx, s.logger.levels.Calls, "varlink call finished", args...)
+}
+
+// WithLogger logs the dial, the reconnects and the method calls of the
+// connection with the logger, at the levels of the events.
+func WithLogger(logger *slog.Logger, levels LogLevels) DialOption {
+	l := &slogLogger{logger: logger, levels: levels}
+	return func(o *dialOptions) {
+		o.logger = l
+		o.tracers = append(o.tracers, l)
+	}
+}
+
+// SetLogger logs the listening address, the accepted connections and the
+// method calls of the service with the logger, at the levels of the events.
+func (s *Service) SetLogger(logger *slog.Logger, levels LogLevels) error {
+	if s.running {
+		return fmt.Errorf("service is already running")
+	}
+	s.logger = &slogLogger{logger: logger, levels: levels}
+
+	return nil
+}
+
+// CallLogOptions configure the logging of the method calls by LogCalls().
+type CallLogOptions struct {
+	// The level of the calls which succeeded, and of the calls with an
+	// error reply or which closed the connection
+	Level      slog.Level
+	ErrorLevel slog.Level
+
+	// Log the parameters of the calls
+	Parameters bool
+
+	// Redact returns the parameters of the method which are logged, like
+	// the parameters with their passwords and tokens removed. Without it,
+	// the parameters are logged as they were received.
+	Redact func(method string, parameters json.RawMessage) json.RawMessage
+}
+
+// LogCalls returns an interceptor for Service.Use() which logs the method
+// calls of the service when they are handled, with their method, the peer of
+// the call, the duration, the number of the replies and the name of an error
+// reply. The calls which were denied by the interceptors before it are not
+// logged.
+func LogCalls(logger *slog.Logger, options CallLogOptions) ServiceInterceptor {
+	return func(ctx context.Context, call *Call, next CallHandler) error {
+		start := time.Now()
+		if call.replies == nil {
+			call.replies = &callReplies{}
+		}
+
+		err := next(ctx, call)
+
+		level := options.Level
+		args := []interface{}{"method", call.Method()}
+		args = append(args, peerArgs(call)...)
+		args = append(args, "duration", time.Since(start), "replies", call.replies.count)
+		if call.replies.err != "" {
+			level = options.ErrorLevel
+			args = append(args, "error", call.replies.err)
+		}
+		if err != nil {
+			level = options.ErrorLevel
+			args = append(args, "failure", err)
+		}
+		if options.Parameters && call.in.Parameters != nil {
+			parameters := *call.in.Parameters
+			if options.Redact != nil {
+				parameters = options.Redact(call.Method(), parameters)
+			}
+			args = append(args, "parameters", parameters)
+		}
+		logger.Log(ctx, level, "varlink method call", args...)
+
+		return err
+	}
+}
+
+// peerArgs returns the logged attributes of the peer of the call.
+func peerArgs(call *Call) []interface{} {
+	addr := call.RemoteAddr()
+	if addr == nil {
+		return nil
+	}
+
+	args := []interface{}{"peer", addr.String()}
+	peer := call.Peer()
+	if peer.Credentials != nil {
+		args = append(args, "uid", peer.Credentials.UID, "pid", peer.Credentials.PID)
+	}
+	if peer.TLS != nil && len(peer.TLS.PeerCertificates) > 0 {
+		args = append(args, "subject", peer.TLS.PeerCertificates[0].Subject.String())
+	}
+	return args
+}
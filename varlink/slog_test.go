@@ -0,0 +1,149 @@
+//go:build go1.21
+// +build go1.21
+
+package varlink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogger(t *testing.T) {
+	address := "unix:varlinkinternal_TestLogger"
+	var serviceLog, clientLog bytes.Buffer
+	levels := LogLevels{Calls: slog.LevelDebug, Connections: slog.LevelInfo, Errors: slog.LevelError}
+
+	service, err := NewService("Varlink", "Varlink Test", "1", "https://github.com/varlink/go/varlink")
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+	handler := slog.NewTextHandler(&serviceLog, &slog.HandlerOptions{Level: slog.LevelDebug})
+	if err := service.SetLogger(slog.New(handler), levels); err != nil {
+		t.Fatalf("SetLogger(): %v", err)
+	}
+
+	servererror := make(chan error)
+	go func() {
+		servererror <- service.Listen(address, 0)
+	}()
+	time.Sleep(time.Second / 5)
+
+	handler = slog.NewTextHandler(&clientLog, &slog.HandlerOptions{Level: slog.LevelDebug})
+	c, err := DialContext(context.Background(), address, WithLogger(slog.New(handler), levels))
+	if err != nil {
+		t.Fatalf("DialContext(): %v", err)
+	}
+	if err := c.GetInfo(nil, nil, nil, nil, nil); err != nil {
+		t.Fatalf("GetInfo(): %v", err)
+	}
+	if err := c.Call("org.example.missing.Ping", nil, nil); err == nil {
+		t.Fatal("Call() of a missing interface succeeded")
+	}
+	c.Close()
+
+	if err := service.SetLogger(slog.Default(), DefaultLogLevels); err == nil {
+		t.Fatal("SetLogger() succeeded on a running service")
+	}
+	service.Shutdown()
+	if err := <-servererror; err != nil {
+		t.Fatalf("service.Listen(): %v", err)
+	}
+
+	if _, err := DialContext(context.Background(), "unix:varlinkinternal_TestLogger_missing", WithLogger(slog.New(handler), levels)); err == nil {
+		t.Fatal("DialContext() of a missing socket succeeded")
+	}
+
+	for _, line := range []string{
+		`level=INFO msg="varlink dial" address=unix:varlinkinternal_TestLogger`,
+		`level=DEBUG msg="varlink call" method=org.varlink.service.GetInfo`,
+		`level=DEBUG msg="varlink call finished" method=org.varlink.service.GetInfo address=unix:varlinkinternal_TestLogger duration=`,
+		`level=ERROR msg="varlink call failed" method=org.example.missing.Ping`,
+		`error=org.varlink.service.InterfaceNotFound`,
+		`level=ERROR msg="varlink dial failed" address=unix:varlinkinternal_TestLogger_missing`,
+	} {
+		if !strings.Contains(clientLog.String(), line) {
+			t.Fatalf("client log is missing %q:\n%s", line, clientLog.String())
+		}
+	}
+
+	for _, line := range []string{
+		`level=INFO msg="varlink listening" address=unix:varlinkinternal_TestLogger`,
+		`level=INFO msg="varlink connection"`,
+		`level=DEBUG msg="varlink method call" method=org.varlink.service.GetInfo duration=`,
+		`level=DEBUG msg="varlink method call" method=org.example.missing.Ping`,
+	} {
+		if !strings.Contains(serviceLog.String(), line) {
+			t.Fatalf("service log is missing %q:\n%s", line, serviceLog.String())
+		}
+	}
+}
+
+// logLines passes the records of a slog handler to the test, which are
+// logged after the replies.
+type logLines chan string
+
+func (l logLines) Write(b []byte) (int, error) {
+	l <- string(b)
+	return len(b), nil
+}
+
+func TestLogCalls(t *testing.T) {
+	log := make(logLines, 10)
+	service, err := NewService("Varlink", "Varlink Test", "1", "https://github.com/varlink/go/varlink")
+	if err != nil {
+		t.Fatalf("NewService(): %v", err)
+	}
+	logger := slog.New(slog.NewTextHandler(log, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	err = service.Use(LogCalls(logger, CallLogOptions{
+		Level:      slog.LevelDebug,
+		ErrorLevel: slog.LevelWarn,
+		Parameters: true,
+		Redact: func(method string, parameters json.RawMessage) json.RawMessage {
+			if method == "org.varlink.service.GetInterfaceDescription" {
+				return json.RawMessage(`{"interface":"redacted"}`)
+			}
+			return parameters
+		},
+	}))
+	if err != nil {
+		t.Fatalf("Use(): %v", err)
+	}
+
+	c := NewPipe(service)
+	if err := c.GetInfo(nil, nil, nil, nil, nil); err != nil {
+		t.Fatalf("GetInfo(): %v", err)
+	}
+	if _, err := c.GetInterfaceDescription("org.varlink.service"); err != nil {
+		t.Fatalf("GetInterfaceDescription(): %v", err)
+	}
+	if err := c.Call("org.example.missing.Ping", map[string]int{"n": 1}, nil); err == nil {
+		t.Fatal("Call() of a missing interface succeeded")
+	}
+	c.Close()
+
+	var lines []string
+	for len(lines) < 3 {
+		select {
+		case line := <-log:
+			lines = append(lines, line)
+		case <-time.After(time.Second):
+			t.Fatalf("logged calls: %q", lines)
+		}
+	}
+	for i, expected := range [][]string{
+		{"level=DEBUG", "method=org.varlink.service.GetInfo", "peer=pipe", "replies=1", "duration="},
+		{"level=DEBUG", "method=org.varlink.service.GetInterfaceDescription", `parameters="{\"interface\":\"redacted\"}"`},
+		{"level=WARN", "method=org.example.missing.Ping", "replies=1", "error=org.varlink.service.InterfaceNotFound", `parameters="{\"n\":1}"`},
+	} {
+		for _, s := range expected {
+			if !strings.Contains(lines[i], s) {
+				t.Fatalf("logged call without %s: %s", s, lines[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package varlink
+
+// ConnectionState is the state of the transport of a connection.
+type ConnectionState int
+
+// The states of a connection. A connection is connected after it was dialed,
+// disconnected after a failure of its transport, reconnecting while it
+// re-dials the address with WithReconnect(), and closed after Close().
+const (
+	StateConnected ConnectionState = iota
+	StateDisconnected
+	StateReconnecting
+	StateClosed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+type stateChange struct {
+	state ConnectionState
+	err   error
+}
+
+// WithStateHook sets a function which is called with every new state of the
+// connection, starting with StateConnected after the dial. The error is the
+// failure which disconnected the connection, or the last failed attempt to
+// reconnect. The function is called from another goroutine, one state after
+// the other, it can use the connection.
+func WithStateHook(hook func(state ConnectionState, err error)) DialOption {
+	return func(o *dialOptions) {
+		o.stateHook = hook
+	}
+}
+
+// setState records a new state of the connection and passes it to the state
+// hook. It is called with the mutex held.
+func (c *Connection) setState(state ConnectionState, err error) {
+	if c.stateHook == nil || state == c.state || c.state == StateClosed {
+		return
+	}
+	c.queueState(state, err)
+}
+
+// queueState queues the state for the state hook. It is called with the mutex
+// held.
+func (c *Connection) queueState(state ConnectionState, err error) {
+	c.state = state
+	c.states = append(c.states, stateChange{state: state, err: err})
+	if len(c.states) == 1 {
+		go c.dispatchStates()
+	}
+}
+
+// dispatchStates calls the state hook with the queued states.
+func (c *Connection) dispatchStates() {
+	c.mutex.Lock()
+	for len(c.states) > 0 {
+		s := c.states[0]
+		c.mutex.Unlock()
+
+		c.stateHook(s.state, s.err)
+
+		c.mutex.Lock()
+		c.states = c.states[1:]
+	}
+	c.mutex.Unlock()
+}
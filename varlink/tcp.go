@@ -0,0 +1,96 @@
+package varlink
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// TCPOptions tune the sockets of the tcp: and tcp+tls: addresses of a
+// service. The zero value keeps the defaults of Go.
+type TCPOptions struct {
+	// The period of the keepalive probes of the connections. Zero is the
+	// default period of Go, a negative period disables the keepalives.
+	KeepAlive time.Duration
+
+	// Delay the small writes of the connections with Nagle's algorithm,
+	// instead of sending them right away with TCP_NODELAY
+	Delay bool
+
+	// Listen only on IPv4, like for an address with a host name which
+	// resolves to IPv4 and IPv6 addresses
+	IPv4Only bool
+
+	// Listen only on IPv6, like for the address "[::]:12345" which
+	// accepts IPv4 connections too by default
+	IPv6Only bool
+}
+
+// SetTCPOptions sets the options of the tcp: and tcp+tls: listeners of the
+// service, and of its connections. The connections of the activated TCP
+// sockets get the options too, and their listeners keep the options which
+// systemd set.
+func (s *Service) SetTCPOptions(options TCPOptions) error {
+	if s.running {
+		return fmt.Errorf("service is already running")
+	}
+	if options.IPv4Only && options.IPv6Only {
+		return fmt.Errorf("IPv4Only and IPv6Only exclude each other")
+	}
+	s.tcpOptions = &options
+
+	return nil
+}
+
+// listenTCP listens on the address with the options. The IPv6 sockets of
+// "tcp6" are IPV6_V6ONLY.
+func listenTCP(address string, o *TCPOptions) (net.Listener, error) {
+	network := "tcp"
+	switch {
+	case o == nil:
+	case o.IPv4Only:
+		network = "tcp4"
+	case o.IPv6Only:
+		network = "tcp6"
+	}
+
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return tuneListener(l, o), nil
+}
+
+// tuneListener returns the listener which sets the options of the accepted
+// TCP connections.
+func tuneListener(l net.Listener, o *TCPOptions) net.Listener {
+	if t, ok := l.(*net.TCPListener); ok && o != nil {
+		return &tcpListener{TCPListener: t, options: *o}
+	}
+	return l
+}
+
+// tcpListener is a TCP listener which sets the options of its connections.
+type tcpListener struct {
+	*net.TCPListener
+	options TCPOptions
+}
+
+func (l *tcpListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+
+	// The keepalives with the default period are set by Go
+	if l.options.KeepAlive < 0 {
+		conn.SetKeepAlive(false)
+	} else if l.options.KeepAlive > 0 {
+		conn.SetKeepAlivePeriod(l.options.KeepAlive)
+	}
+	if l.options.Delay {
+		conn.SetNoDelay(false)
+	}
+
+	return conn, nil
+}
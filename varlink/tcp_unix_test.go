@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package varlink
+
+import "syscall"
+
+// tcpSockopts returns TCP_NODELAY and SO_KEEPALIVE of the socket.
+func tcpSockopts(fd uintptr) (int, int) {
+	nodelay, _ := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	keepalive, _ := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+	return nodelay, keepalive
+}
@@ -0,0 +1,10 @@
+package varlink
+
+import "syscall"
+
+// tcpSockopts returns TCP_NODELAY and SO_KEEPALIVE of the socket.
+func tcpSockopts(fd uintptr) (int, int) {
+	nodelay, _ := syscall.GetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	keepalive, _ := syscall.GetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+	return nodelay, keepalive
+}
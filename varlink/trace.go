@@ -0,0 +1,269 @@
+package varlink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// TraceContextParameter is the parameter of a method call which passes the
+// trace context of the client, like the W3C traceparent and tracestate of an
+// OpenTelemetry span, as an object of strings. Its name cannot clash with the
+// parameters of the interfaces, whose names have no dots.
+const TraceContextParameter = "org.varlink.trace"
+
+// CallInfo describes a traced method call. The duration, the number of
+// replies, the size of the messages and the error are set when the span of
+// the call ends.
+type CallInfo struct {
+	Method  string
+	Address string
+	Flags   uint64
+	Start   time.Time
+
+	Duration      time.Duration
+	Replies       int
+	BytesSent     int
+	BytesReceived int
+	Err           error
+}
+
+// CallSpan is the span of a traced method call.
+type CallSpan interface {
+	// End is called after the last reply of the call, or its error.
+	End(call *CallInfo)
+}
+
+// Tracer starts a span for every method call of a connection, like an
+// OpenTelemetry client span with the method as name, and the address, the
+// number of replies and the error as attributes. The context is the one of
+// WithContext(), or the background context.
+type Tracer interface {
+	StartCall(ctx context.Context, call *CallInfo) CallSpan
+}
+
+// WithTracer traces the method calls of the connection, in addition to the
+// tracers of earlier options. Calls changed or repeated by interceptors are
+// traced like they are sent. The span of a call with the More flag ends when
+// its last reply is received, oneway calls end when they are sent.
+func WithTracer(tracer Tracer) DialOption {
+	return func(o *dialOptions) {
+		o.tracers = append(o.tracers, tracer)
+	}
+}
+
+// WithTraceContext passes the trace context to the service in the
+// TraceContextParameter of the call, like the carrier of an OpenTelemetry
+// propagator with the span of the call. The parameters of the call must be an
+// object, or nil.
+func WithTraceContext(carrier map[string]string) CallOption {
+	return func(o *callOptions) {
+		o.traceContext = carrier
+	}
+}
+
+// traceParameters are the parameters of a call with the trace context.
+type traceParameters struct {
+	parameters interface{}
+	carrier    map[string]string
+	encoder    *EncoderOptions
+}
+
+func (p traceParameters) MarshalJSON() ([]byte, error) {
+	carrier, err := json.Marshal(p.carrier)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	b.WriteString(`{"` + TraceContextParameter + `":`)
+	b.Write(carrier)
+
+	if p.parameters != nil {
+		var buf bytes.Buffer
+		if err := p.encoder.encode(&buf, p.parameters); err != nil {
+			return nil, err
+		}
+		object := bytes.TrimSpace(buf.Bytes()[:buf.Len()-1])
+		if string(object) != "null" {
+			if len(object) < 2 || object[0] != '{' {
+				return nil, fmt.Errorf("parameters with a trace context must be an object")
+			}
+			if fields := bytes.TrimSpace(object[1 : len(object)-1]); len(fields) > 0 {
+				b.WriteByte(',')
+				b.Write(fields)
+			}
+		}
+	}
+	b.WriteByte('}')
+
+	return b.Bytes(), nil
+}
+
+// traceCall sends the call, and traces it with the tracers of the connection.
+func (c *Connection) traceCall(method string, parameters interface{}, o *callOptions) (func(interface{}) (uint64, error), error) {
+	if len(c.tracers) == 0 {
+		return c.sendCall(method, parameters, o)
+	}
+
+	ctx := o.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	info := &CallInfo{
+		Method:  method,
+		Address: c.address,
+		Flags:   o.flags,
+		Start:   time.Now(),
+	}
+	spans := make([]CallSpan, len(c.tracers))
+	for i, tracer := range c.tracers {
+		spans[i] = tracer.StartCall(ctx, info)
+	}
+	end := func(err error) {
+		info.Duration = time.Since(info.Start)
+		info.BytesSent = o.sentBytes
+		info.BytesReceived = o.receivedBytes
+		info.Err = err
+		for _, span := range spans {
+			span.End(info)
+		}
+	}
+
+	receive, err := c.sendCall(method, parameters, o)
+	if err != nil {
+		end(err)
+		return nil, err
+	}
+	if o.flags&Oneway != 0 {
+		end(nil)
+		return receive, nil
+	}
+
+	ended := false
+	return func(out_parameters interface{}) (uint64, error) {
+		flags, err := receive(out_parameters)
+		if ended {
+			return flags, err
+		}
+
+		if err == nil {
+			info.Replies++
+		}
+		if err != nil || flags&Continues == 0 {
+			ended = true
+			end(err)
+		}
+		return flags, err
+	}, nil
+}
+
+// ServiceCallInfo describes a traced method call of a service. The duration,
+// the number of replies and the errors are set when the span of the call
+// ends.
+type ServiceCallInfo struct {
+	Interface string
+	Method    string
+	Flags     uint64
+	Peer      Peer
+	Address   string
+	Start     time.Time
+
+	// The trace context of the client, from the TraceContextParameter of
+	// the call, or nil
+	TraceContext map[string]string
+
+	Duration time.Duration
+	Replies  int
+
+	// The name of the error reply, and the error which closed the
+	// connection
+	Error string
+	Err   error
+}
+
+// ServiceSpan is the span of a traced method call of a service.
+type ServiceSpan interface {
+	// End is called after the method returned.
+	End(call *ServiceCallInfo)
+}
+
+// ServiceTracer starts a span for every dispatched method call of a service,
+// like an OpenTelemetry server span, with the interface and the method as
+// name, the peer and the error reply as attributes, and the trace context of
+// the client as its remote parent. The returned context is the context of the
+// call, Call.Context().
+type ServiceTracer interface {
+	StartCall(ctx context.Context, call *ServiceCallInfo) (context.Context, ServiceSpan)
+}
+
+// TraceCalls returns an interceptor for Service.Use() which traces the method
+// calls of the service. The TraceContextParameter is removed from the
+// parameters of the calls, before they are passed to the methods.
+func TraceCalls(tracer ServiceTracer) ServiceInterceptor {
+	return func(ctx context.Context, call *Call, next CallHandler) error {
+		if call.replies == nil {
+			call.replies = &callReplies{}
+		}
+
+		info := &ServiceCallInfo{
+			Interface:    call.Interface(),
+			Method:       call.MethodName(),
+			Peer:         call.Peer(),
+			Start:        time.Now(),
+			TraceContext: removeTraceContext(call.in),
+		}
+		if call.in.More {
+			info.Flags |= More
+		}
+		if call.in.Oneway {
+			info.Flags |= Oneway
+		}
+		if addr := call.RemoteAddr(); addr != nil {
+			info.Address = addr.String()
+		}
+
+		ctx, span := tracer.StartCall(ctx, info)
+		err := next(ctx, call)
+
+		info.Duration = time.Since(info.Start)
+		info.Replies = call.replies.count
+		info.Error = call.replies.err
+		info.Err = err
+		span.End(info)
+
+		return err
+	}
+}
+
+// removeTraceContext removes the TraceContextParameter from the parameters of
+// the call, and returns it.
+func removeTraceContext(in *serviceCall) map[string]string {
+	if in.Parameters == nil || !bytes.Contains(*in.Parameters, []byte(`"`+TraceContextParameter+`"`)) {
+		return nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(*in.Parameters, &fields); err != nil {
+		return nil
+	}
+	raw, ok := fields[TraceContextParameter]
+	if !ok {
+		return nil
+	}
+	delete(fields, TraceContextParameter)
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return nil
+	}
+	parameters := json.RawMessage(b)
+	in.Parameters = &parameters
+
+	// An invalid trace context is ignored
+	var carrier map[string]string
+	json.Unmarshal(raw, &carrier)
+	return carrier
+}
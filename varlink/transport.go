@@ -0,0 +1,64 @@
+package varlink
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var (
+	transportsMutex sync.RWMutex
+	transports      = make(map[string]DialFunc)
+)
+
+// The protocols of the addresses which are dialed by the package.
+var builtinProtocols = map[string]bool{
+	"unix":    true,
+	"tcp":     true,
+	"tcp+tls": true,
+	"vsock":   true,
+	"npipe":   true,
+	"exec":    true,
+	"bridge":  true,
+}
+
+// RegisterTransport registers the dialer of the addresses with the protocol,
+// like "myscheme" for "myscheme:address". NewConnection(), DialContext() and
+// the connections of a Pool dial these addresses with the dialer, unless the
+// connection has a dialer of WithDialFunc(). It is meant to be called from the
+// init function of the package which provides the transport. It panics if the
+// protocol is registered twice, or if it is one of the protocols of this
+// package.
+func RegisterTransport(protocol string, dial DialFunc) {
+	transportsMutex.Lock()
+	defer transportsMutex.Unlock()
+
+	if protocol == "" || dial == nil {
+		panic("varlink: RegisterTransport with an empty protocol or a nil dialer")
+	}
+	if builtinProtocols[protocol] {
+		panic(fmt.Sprintf("varlink: RegisterTransport of the built-in protocol %s", protocol))
+	}
+	if _, ok := transports[protocol]; ok {
+		panic(fmt.Sprintf("varlink: RegisterTransport called twice for protocol %s", protocol))
+	}
+	transports[protocol] = dial
+}
+
+// isAddress reports whether the address starts with a protocol of this
+// package or of RegisterTransport().
+func isAddress(address string) bool {
+	words := strings.SplitN(address, ":", 2)
+	if len(words) != 2 {
+		return false
+	}
+	return builtinProtocols[words[0]] || registeredTransport(words[0]) != nil
+}
+
+// registeredTransport returns the registered dialer of the protocol, or nil.
+func registeredTransport(protocol string) DialFunc {
+	transportsMutex.RLock()
+	defer transportsMutex.RUnlock()
+
+	return transports[protocol]
+}
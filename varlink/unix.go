@@ -0,0 +1,176 @@
+package varlink
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// The size of sun_path of struct sockaddr_un.
+const unixPathMax = len(syscall.RawSockaddrUnix{}.Path)
+
+// checkUnixAddress checks the path of a unix: address. An address starting
+// with '@' names a socket in the abstract namespace of Linux, the '@' is
+// replaced by the leading NUL byte of the name. Abstract names are not NUL
+// terminated and may use all of sun_path, file system paths need the
+// terminating NUL byte.
+func checkUnixAddress(address string) error {
+	if address == "" {
+		return fmt.Errorf("invalid unix address, expected a path or an @abstract name")
+	}
+
+	if address[0] != '@' {
+		if len(address) >= unixPathMax {
+			return fmt.Errorf("unix socket path '%s' is longer than %d bytes", address, unixPathMax-1)
+		}
+		return nil
+	}
+
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("abstract unix socket address '%s' is not supported on %s", address, runtime.GOOS)
+	}
+	if len(address) == 1 {
+		return fmt.Errorf("invalid abstract unix socket address, expected a name after '@'")
+	}
+	if len(address) > unixPathMax {
+		return fmt.Errorf("abstract unix socket name '%s' is longer than %d bytes", address, unixPathMax-1)
+	}
+
+	return nil
+}
+
+// UnixOptions set the permissions of the socket files of the unix: addresses
+// of a service. The zero value keeps the defaults, the socket file is created
+// with the permissions of the umask, and the directory of the socket must
+// exist. The abstract sockets have no file, the options do not apply.
+type UnixOptions struct {
+	// The permissions of the socket file, like 0660 for the group of the
+	// socket. The socket file is created with the umask, before it gets
+	// the permissions.
+	Mode os.FileMode
+
+	// The owner and the group of the socket file, as names or numeric IDs
+	Owner string
+	Group string
+
+	// Create the missing directories of the socket file with the
+	// permissions, like 0755 for a directory in /run
+	DirectoryMode os.FileMode
+}
+
+// SetUnixOptions sets the options of the socket files of the unix: listeners
+// of the service. The activated sockets keep the permissions which systemd
+// set.
+func (s *Service) SetUnixOptions(options UnixOptions) error {
+	if s.running {
+		return fmt.Errorf("service is already running")
+	}
+	if options.Mode&^os.ModePerm != 0 || options.DirectoryMode&^os.ModePerm != 0 {
+		return fmt.Errorf("invalid permissions")
+	}
+	s.unixOptions = &options
+
+	return nil
+}
+
+// listenUnix listens on the unix socket address with the options. The socket
+// file is removed when the listener is closed. The socket file of a service
+// which did not remove it, like after a crash, is replaced, the socket of a
+// running service is not.
+func listenUnix(address string, o *UnixOptions) (net.Listener, error) {
+	if address[0] == '@' {
+		return net.Listen("unix", address)
+	}
+
+	if o != nil && o.DirectoryMode != 0 {
+		if err := os.MkdirAll(filepath.Dir(address), o.DirectoryMode); err != nil {
+			return nil, err
+		}
+	}
+	if err := removeStaleSocket(address); err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", address)
+	if err != nil {
+		return nil, err
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(true)
+
+	if o != nil {
+		if err := o.apply(address); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// removeStaleSocket removes the socket file of the address if no service
+// accepts connections on it. Files which are not sockets are not removed.
+func removeStaleSocket(address string) error {
+	info, err := os.Lstat(address)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("'%s' exists and is not a socket", address)
+	}
+
+	conn, err := net.DialTimeout("unix", address, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("unix socket '%s' is in use by another service", address)
+	}
+	if os.IsPermission(err) {
+		return fmt.Errorf("unix socket '%s' cannot be probed: %v", address, err)
+	}
+
+	return os.Remove(address)
+}
+
+// apply sets the owner, the group and the permissions of the socket file.
+func (o *UnixOptions) apply(address string) error {
+	uid, gid := -1, -1
+	if o.Owner != "" {
+		id, err := strconv.Atoi(o.Owner)
+		if err != nil {
+			u, err := user.Lookup(o.Owner)
+			if err != nil {
+				return err
+			}
+			id, _ = strconv.Atoi(u.Uid)
+		}
+		uid = id
+	}
+	if o.Group != "" {
+		id, err := strconv.Atoi(o.Group)
+		if err != nil {
+			g, err := user.LookupGroup(o.Group)
+			if err != nil {
+				return err
+			}
+			id, _ = strconv.Atoi(g.Gid)
+		}
+		gid = id
+	}
+
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(address, uid, gid); err != nil {
+			return err
+		}
+	}
+	if o.Mode != 0 {
+		return os.Chmod(address, o.Mode)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package varlink
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// WithUnknownFields sets a function which is called with the fields of a
+// reply which the parameters of the call do not have, like for a client which
+// logs or passes on the data of a newer version of the service. Only the
+// fields of struct parameters are unknown, maps and json.RawMessage
+// parameters receive all fields.
+func WithUnknownFields(f func(fields map[string]json.RawMessage)) CallOption {
+	return func(o *callOptions) {
+		o.unknownFields = f
+	}
+}
+
+// reportUnknownFields calls the function of WithUnknownFields() with the
+// fields of the reply which out_parameters does not decode.
+func reportUnknownFields(m *reply, out_parameters interface{}, f func(map[string]json.RawMessage)) {
+	t := reflect.TypeOf(out_parameters)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return
+	}
+
+	var r struct {
+		Parameters map[string]json.RawMessage `json:"parameters"`
+	}
+	json.Unmarshal(m.message, &r)
+
+	var unknown map[string]json.RawMessage
+	for name, value := range r.Parameters {
+		if decodesField(t, name) {
+			continue
+		}
+		if unknown == nil {
+			unknown = make(map[string]json.RawMessage)
+		}
+		unknown[name] = value
+	}
+	if unknown != nil {
+		f(unknown)
+	}
+}
+
+// decodesField reports whether encoding/json decodes the JSON field into a
+// field of the struct type, or of its embedded structs.
+func decodesField(t reflect.Type, name string) bool {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		tagName := strings.Split(tag, ",")[0]
+
+		if f.Anonymous && tagName == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				if decodesField(ft, name) {
+					return true
+				}
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+
+		fieldName := tagName
+		if fieldName == "" {
+			fieldName = f.Name
+		}
+		if strings.EqualFold(fieldName, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,195 @@
+package varlink
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// errConnectionUpgraded is returned by the calls of a connection which was
+// handed over to the protocol of an upgraded call.
+var errConnectionUpgraded = fmt.Errorf("connection is upgraded")
+
+// UpgradedConn is the transport of a connection after an upgraded call. The
+// data is exchanged in the protocol of the service until the connection is
+// closed, or released for further method calls.
+type UpgradedConn struct {
+	c      *Connection
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Read reads from the connection, starting with the data the service sent
+// right after its reply.
+func (u *UpgradedConn) Read(b []byte) (int, error) {
+	return u.reader.Read(b)
+}
+
+// Write writes to the connection.
+func (u *UpgradedConn) Write(b []byte) (int, error) {
+	return u.conn.Write(b)
+}
+
+// SetDeadline sets the read and write deadlines of the connection.
+func (u *UpgradedConn) SetDeadline(t time.Time) error {
+	return u.conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the connection.
+func (u *UpgradedConn) SetReadDeadline(t time.Time) error {
+	return u.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the connection.
+func (u *UpgradedConn) SetWriteDeadline(t time.Time) error {
+	return u.conn.SetWriteDeadline(t)
+}
+
+// Close closes the connection.
+func (u *UpgradedConn) Close() error {
+	return u.c.Close()
+}
+
+// Release returns the connection to sending method calls, when the protocol
+// of the service has ended and the service reads method calls again. The
+// deadlines set on the UpgradedConn are cleared.
+func (u *UpgradedConn) Release() {
+	u.conn.SetDeadline(time.Time{})
+
+	u.c.mutex.Lock()
+	defer u.c.mutex.Unlock()
+
+	u.c.upgraded = false
+	u.c.lastUsed = time.Now()
+}
+
+// Upgrade sends a method call with the Upgrade flag and receives its reply.
+// After the reply, the connection is handed over to the protocol of the
+// service, like the stream of a console or a file transfer. The calls of
+// other goroutines fail until the returned UpgradedConn is released.
+// Calls cannot be upgraded while other calls of the connection wait for
+// their replies. If the service replies with an error, the connection is
+// not upgraded.
+func (c *Connection) Upgrade(method string, parameters interface{}, out_parameters interface{}, opts ...CallOption) (*UpgradedConn, error) {
+	var o callOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.flags&(More|Oneway) != 0 {
+		return nil, fmt.Errorf("upgraded calls receive a single reply")
+	}
+	o.flags |= Upgrade
+	if c.validator != nil {
+		if err := c.validator.validate(c, method, parameters, &o); err != nil {
+			return nil, err
+		}
+	}
+
+	c.writeMutex.Lock()
+	c.mutex.Lock()
+	err := c.usable()
+	if err == nil && (len(c.calls) > 0 || c.reading) {
+		err = fmt.Errorf("cannot upgrade a connection with pending calls")
+	}
+	if err != nil {
+		c.mutex.Unlock()
+		c.writeMutex.Unlock()
+		return nil, err
+	}
+	c.upgraded = true
+	c.mutex.Unlock()
+
+	receive, err := c.send(method, parameters, &o)
+	c.writeMutex.Unlock()
+	if err == nil {
+		_, err = receive(out_parameters)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err != nil {
+		c.upgraded = false
+		return nil, err
+	}
+
+	return &UpgradedConn{
+		c:      c,
+		conn:   c.conn,
+		reader: c.reader,
+	}, nil
+}
+
+// WantsUpgrade indicates if the calling client hands the connection over to
+// the protocol of the method after the reply, see ReplyUpgrade().
+func (c *Call) WantsUpgrade() bool {
+	return c.in.Upgrade
+}
+
+// ReplyUpgrade sends the reply to a call with the upgrade flag, and hands the
+// connection over to the protocol of the method, like the stream of a console
+// or a file transfer. The returned connection reads the data which the client
+// sent after the call, and is written with the write limits of the service.
+// The service reads no further method calls, the connection stays open until
+// it is closed, also after the method returned. It is counted like the other
+// connections, and it is closed when ShutdownContext() gives up waiting.
+func (c *Call) ReplyUpgrade(parameters interface{}) (io.ReadWriteCloser, error) {
+	if !c.in.Upgrade {
+		return nil, fmt.Errorf("call did not set upgrade")
+	}
+	if c.conn == nil || c.conn.conn == nil || c.conn.reader == nil {
+		return nil, fmt.Errorf("call has no connection")
+	}
+
+	if err := c.sendMessage(&serviceReply{Parameters: parameters}); err != nil {
+		return nil, err
+	}
+
+	c.conn.writeMutex.Lock()
+	defer c.conn.writeMutex.Unlock()
+
+	c.conn.upgraded = true
+	return &upgradedServiceConn{sc: c.conn, reader: c.conn.reader, watched: c.conn.watched}, nil
+}
+
+// isUpgraded returns true if the connection was handed over to an upgraded
+// call.
+func (sc *serviceConn) isUpgraded() bool {
+	sc.writeMutex.Lock()
+	defer sc.writeMutex.Unlock()
+
+	return sc.upgraded
+}
+
+// upgradedServiceConn is the connection of an upgraded call of a service.
+type upgradedServiceConn struct {
+	sc      *serviceConn
+	reader  *bufio.Reader
+	watched <-chan struct{}
+}
+
+// Read reads from the connection, after the watch of the call for the
+// closing of the connection stopped reading.
+func (u *upgradedServiceConn) Read(b []byte) (int, error) {
+	<-u.watched
+	return u.reader.Read(b)
+}
+
+func (u *upgradedServiceConn) Write(b []byte) (int, error) {
+	u.sc.writeMutex.Lock()
+	defer u.sc.writeMutex.Unlock()
+
+	n, err := u.sc.writer.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, u.sc.writer.Flush()
+}
+
+// Close closes the connection, after the buffered writes are written.
+func (u *upgradedServiceConn) Close() error {
+	u.sc.close()
+	return nil
+}
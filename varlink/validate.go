@@ -0,0 +1,145 @@
+package varlink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/varlink/go/varlink/idl"
+)
+
+// validator validates the parameters of method calls against the
+// descriptions of their interfaces.
+type validator struct {
+	mutex      sync.Mutex
+	interfaces map[string]*idl.IDL
+}
+
+// WithValidation validates the parameters of the calls of the connection
+// against the interface descriptions, before the calls are sent. Interfaces
+// which are not passed are requested from the service with GetInterface() at
+// their first call. Calls with invalid parameters fail with an error which
+// wraps the *idl.ValidationError of the invalid field.
+func WithValidation(interfaces ...*idl.IDL) DialOption {
+	v := &validator{interfaces: make(map[string]*idl.IDL)}
+	if service, err := idl.New(orgvarlinkserviceNew().VarlinkGetDescription()); err == nil {
+		v.interfaces[service.Name] = service
+	}
+	for _, i := range interfaces {
+		v.interfaces[i.Name] = i
+	}
+
+	return func(o *dialOptions) {
+		o.validator = v
+	}
+}
+
+// validate validates the parameters of the call. It requests the description
+// of an unknown interface with the context, deadline and timeout of the call.
+func (v *validator) validate(c *Connection, method string, parameters interface{}, o *callOptions) error {
+	dot := strings.LastIndex(method, ".")
+	if dot <= 0 {
+		return fmt.Errorf("invalid method name '%s'", method)
+	}
+	name := method[:dot]
+
+	v.mutex.Lock()
+	description, ok := v.interfaces[name]
+	v.mutex.Unlock()
+	if !ok {
+		opts := []CallOption{WithTimeout(o.timeout), WithDeadline(o.deadline)}
+		if o.ctx != nil {
+			opts = append(opts, WithContext(o.ctx))
+		}
+
+		var err error
+		description, err = c.GetInterface(name, opts...)
+		if err != nil {
+			return err
+		}
+
+		v.mutex.Lock()
+		v.interfaces[name] = description
+		v.mutex.Unlock()
+	}
+
+	b, err := json.Marshal(parameters)
+	if err != nil {
+		return err
+	}
+	if err := description.ValidateIn(method[dot+1:], b); err != nil {
+		return fmt.Errorf("invalid parameters of %s: %w", method, err)
+	}
+	return nil
+}
+
+// SetValidation validates the parameters of the method calls against the
+// descriptions of their interfaces, before they are dispatched. The types,
+// the missing and unknown fields, and the values of enums are validated, the
+// calls with invalid parameters get the error reply
+// org.varlink.service.InvalidParameter with the path of the invalid field,
+// like "disks[2].name". The calls of org.varlink.service are not validated.
+func (s *Service) SetValidation(validate bool) error {
+	if s.running {
+		return fmt.Errorf("service is already running")
+	}
+	s.validator = nil
+	if validate {
+		s.validator = &validator{interfaces: make(map[string]*idl.IDL)}
+	}
+
+	return nil
+}
+
+// serviceInterface returns the parsed description of the registered
+// interface, or nil if it cannot be parsed.
+func (v *validator) serviceInterface(iface dispatcher) *idl.IDL {
+	name := iface.VarlinkGetName()
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	description, ok := v.interfaces[name]
+	if !ok {
+		description, _ = idl.New(iface.VarlinkGetDescription())
+		v.interfaces[name] = description
+	}
+	return description
+}
+
+// forget removes the parsed description of the unregistered interface.
+func (v *validator) forget(name string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	delete(v.interfaces, name)
+}
+
+// validateCall returns false, after the error reply, if the parameters of the
+// call are invalid. The calls of unknown methods are left to the interface.
+func (s *Service) validateCall(c *Call, iface dispatcher, method string) (bool, error) {
+	description := s.validator.serviceInterface(iface)
+	if description == nil {
+		return true, nil
+	}
+	if _, ok := description.Methods[method]; !ok {
+		return true, nil
+	}
+
+	// The trace context of a service without TraceCalls() is not a
+	// parameter of the method
+	in := *c.in
+	removeTraceContext(&in)
+	var parameters json.RawMessage
+	if in.Parameters != nil {
+		parameters = *in.Parameters
+	}
+
+	var e *idl.ValidationError
+	if err := description.ValidateIn(method, parameters); !errors.As(err, &e) {
+		return true, nil
+	}
+	return false, c.ReplyInvalidParameterError(e)
+}
@@ -0,0 +1,72 @@
+package varlink
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The context ID which accepts connections from any context, and the well-known
+// context IDs of the hypervisor, the loopback device and the host.
+const (
+	vmaddrCIDAny        = 0xffffffff
+	vmaddrCIDHypervisor = 0
+	vmaddrCIDLocal      = 1
+	vmaddrCIDHost       = 2
+)
+
+// The port which binds a listener to a free port
+const vmaddrPortAny = 0xffffffff
+
+// vsockAddr is the address of an AF_VSOCK socket.
+type vsockAddr struct {
+	CID  uint32
+	Port uint32
+}
+
+func (a vsockAddr) Network() string {
+	return "vsock"
+}
+
+func (a vsockAddr) String() string {
+	return strconv.FormatUint(uint64(a.CID), 10) + ":" + strconv.FormatUint(uint64(a.Port), 10)
+}
+
+// parseVsockAddress parses the cid:port of a vsock: address. The context ID
+// is a number or one of any, hypervisor, local and host. The port is a number,
+// or any for a listener on a free port.
+func parseVsockAddress(address string) (vsockAddr, error) {
+	words := strings.SplitN(address, ":", 2)
+	if len(words) != 2 {
+		return vsockAddr{}, fmt.Errorf("invalid vsock address '%s', expected cid:port", address)
+	}
+
+	var cid uint64
+	switch words[0] {
+	case "any":
+		cid = vmaddrCIDAny
+	case "hypervisor":
+		cid = vmaddrCIDHypervisor
+	case "local":
+		cid = vmaddrCIDLocal
+	case "host":
+		cid = vmaddrCIDHost
+	default:
+		var err error
+		cid, err = strconv.ParseUint(words[0], 10, 32)
+		if err != nil {
+			return vsockAddr{}, fmt.Errorf("invalid context ID in vsock address '%s'", address)
+		}
+	}
+
+	var port uint64 = vmaddrPortAny
+	if words[1] != "any" {
+		var err error
+		port, err = strconv.ParseUint(words[1], 10, 32)
+		if err != nil {
+			return vsockAddr{}, fmt.Errorf("invalid port in vsock address '%s'", address)
+		}
+	}
+
+	return vsockAddr{CID: uint32(cid), Port: uint32(port)}, nil
+}
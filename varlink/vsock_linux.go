@@ -0,0 +1,291 @@
+//go:build amd64 || arm || arm64 || mips64 || mips64le || ppc64 || ppc64le || riscv64
+// +build amd64 arm arm64 mips64 mips64le ppc64 ppc64le riscv64
+
+package varlink
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// The syscall package has no AF_VSOCK support, the sockets are created and
+// connected with the raw system calls. The architectures without a connect
+// system call, which use socketcall(), are not supported.
+const afVsock = 40
+
+// struct sockaddr_vm
+type rawSockaddrVM struct {
+	Family    uint16
+	Reserved1 uint16
+	Port      uint32
+	CID       uint32
+	Zero      [4]uint8
+}
+
+func sockaddrCall(trap uintptr, fd int, sa *rawSockaddrVM) error {
+	_, _, errno := syscall.Syscall(trap, uintptr(fd), uintptr(unsafe.Pointer(sa)), unsafe.Sizeof(*sa))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func localVsockAddr(fd int) vsockAddr {
+	var sa rawSockaddrVM
+	n := uint32(unsafe.Sizeof(sa))
+	syscall.Syscall(syscall.SYS_GETSOCKNAME, uintptr(fd), uintptr(unsafe.Pointer(&sa)), uintptr(unsafe.Pointer(&n)))
+	return vsockAddr{CID: sa.CID, Port: sa.Port}
+}
+
+// vsockConn is a connected AF_VSOCK socket. The non-blocking socket is
+// registered with the runtime poller by os.NewFile, it supports deadlines like
+// the connections of the net package.
+type vsockConn struct {
+	*os.File
+	local  vsockAddr
+	remote vsockAddr
+}
+
+func (c *vsockConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *vsockConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func dialVsock(ctx context.Context, protocol string, address string) (net.Conn, error) {
+	addr, err := parseVsockAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	opError := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "vsock", Addr: addr, Err: err}
+	}
+
+	fd, err := syscall.Socket(afVsock, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, opError(os.NewSyscallError("socket", err))
+	}
+
+	sa := rawSockaddrVM{Family: afVsock, Port: addr.Port, CID: addr.CID}
+	err = sockaddrCall(syscall.SYS_CONNECT, fd, &sa)
+	if err != nil && err != syscall.EINPROGRESS {
+		syscall.Close(fd)
+		return nil, opError(os.NewSyscallError("connect", err))
+	}
+
+	f := os.NewFile(uintptr(fd), "vsock:"+address)
+	if err == syscall.EINPROGRESS {
+		err = waitConnected(ctx, f)
+		if err != nil {
+			f.Close()
+			return nil, opError(err)
+		}
+	}
+
+	return &vsockConn{File: f, local: localVsockAddr(fd), remote: addr}, nil
+}
+
+// waitConnected waits until the connect of the non-blocking socket finished.
+func waitConnected(ctx context.Context, f *os.File) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		f.SetWriteDeadline(deadline)
+	}
+
+	// Abort the connect when the context is canceled
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			f.SetWriteDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	// The socket is writable when the connect finished
+	var connectErr error
+	started := false
+	err = rc.Write(func(fd uintptr) bool {
+		if !started {
+			started = true
+			return false
+		}
+		v, err := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_ERROR)
+		if err != nil {
+			connectErr = os.NewSyscallError("getsockopt", err)
+		} else if v != 0 {
+			connectErr = os.NewSyscallError("connect", syscall.Errno(v))
+		}
+		return true
+	})
+	close(stop)
+	<-stopped
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+	if connectErr != nil {
+		return connectErr
+	}
+
+	return f.SetWriteDeadline(time.Time{})
+}
+
+// vsockListener accepts connections on an AF_VSOCK socket.
+type vsockListener struct {
+	f    *os.File
+	addr vsockAddr
+}
+
+func listenVsock(address string) (net.Listener, error) {
+	addr, err := parseVsockAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	opError := func(err error) error {
+		return &net.OpError{Op: "listen", Net: "vsock", Addr: addr, Err: err}
+	}
+
+	fd, err := syscall.Socket(afVsock, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, opError(os.NewSyscallError("socket", err))
+	}
+
+	sa := rawSockaddrVM{Family: afVsock, Port: addr.Port, CID: addr.CID}
+	err = sockaddrCall(syscall.SYS_BIND, fd, &sa)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, opError(os.NewSyscallError("bind", err))
+	}
+
+	err = syscall.Listen(fd, syscall.SOMAXCONN)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, opError(os.NewSyscallError("listen", err))
+	}
+
+	return &vsockListener{
+		f:    os.NewFile(uintptr(fd), "vsock:"+address),
+		addr: localVsockAddr(fd),
+	}, nil
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	rc, err := l.f.SyscallConn()
+	if err != nil {
+		return nil, &net.OpError{Op: "accept", Net: "vsock", Addr: l.addr, Err: err}
+	}
+
+	var nfd int
+	var sa rawSockaddrVM
+	var acceptErr error
+	err = rc.Read(func(fd uintptr) bool {
+		n := uint32(unsafe.Sizeof(sa))
+		r, _, errno := syscall.Syscall6(syscall.SYS_ACCEPT4, fd, uintptr(unsafe.Pointer(&sa)), uintptr(unsafe.Pointer(&n)),
+			syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0, 0)
+		switch errno {
+		case 0:
+			nfd = int(r)
+		case syscall.EAGAIN, syscall.EINTR:
+			return false
+		default:
+			acceptErr = os.NewSyscallError("accept4", errno)
+		}
+		return true
+	})
+	if err == nil {
+		err = acceptErr
+	}
+	if err != nil {
+		return nil, &net.OpError{Op: "accept", Net: "vsock", Addr: l.addr, Err: err}
+	}
+
+	remote := vsockAddr{CID: sa.CID, Port: sa.Port}
+	return &vsockConn{
+		File:   os.NewFile(uintptr(nfd), "vsock:"+remote.String()),
+		local:  l.addr,
+		remote: remote,
+	}, nil
+}
+
+func (l *vsockListener) Close() error {
+	return l.f.Close()
+}
+
+func (l *vsockListener) Addr() net.Addr {
+	return l.addr
+}
+
+// SetDeadline sets the deadline of Accept().
+func (l *vsockListener) SetDeadline(t time.Time) error {
+	return l.f.SetDeadline(t)
+}
+
+// SyscallConn returns the raw socket of the listener.
+func (l *vsockListener) SyscallConn() (syscall.RawConn, error) {
+	return l.f.SyscallConn()
+}
+
+// fileVsockListener returns a listener on a duplicate of the AF_VSOCK socket
+// of the file, like of a socket passed by systemd, which net.FileListener()
+// does not support.
+func fileVsockListener(f syscall.Conn) (net.Listener, error) {
+	var sa rawSockaddrVM
+	var nfd int
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		n := uint32(unsafe.Sizeof(sa))
+		_, _, errno := syscall.Syscall(syscall.SYS_GETSOCKNAME, fd, uintptr(unsafe.Pointer(&sa)), uintptr(unsafe.Pointer(&n)))
+		if errno != 0 {
+			sockErr = os.NewSyscallError("getsockname", errno)
+			return
+		}
+		if sa.Family != afVsock {
+			sockErr = fmt.Errorf("socket is not an AF_VSOCK socket")
+			return
+		}
+
+		syscall.ForkLock.RLock()
+		nfd, sockErr = syscall.Dup(int(fd))
+		if sockErr == nil {
+			syscall.CloseOnExec(nfd)
+		}
+		syscall.ForkLock.RUnlock()
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The non-blocking socket is registered with the runtime poller
+	if err := syscall.SetNonblock(nfd, true); err != nil {
+		syscall.Close(nfd)
+		return nil, os.NewSyscallError("setnonblock", err)
+	}
+	addr := vsockAddr{CID: sa.CID, Port: sa.Port}
+	return &vsockListener{f: os.NewFile(uintptr(nfd), "vsock:"+addr.String()), addr: addr}, nil
+}
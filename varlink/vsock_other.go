@@ -0,0 +1,24 @@
+//go:build !linux || !(amd64 || arm || arm64 || mips64 || mips64le || ppc64 || ppc64le || riscv64)
+// +build !linux !amd64,!arm,!arm64,!mips64,!mips64le,!ppc64,!ppc64le,!riscv64
+
+package varlink
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+)
+
+func dialVsock(ctx context.Context, protocol string, address string) (net.Conn, error) {
+	return nil, fmt.Errorf("vsock is not supported on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+func listenVsock(address string) (net.Listener, error) {
+	return nil, fmt.Errorf("vsock is not supported on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+func fileVsockListener(f syscall.Conn) (net.Listener, error) {
+	return nil, fmt.Errorf("vsock is not supported on %s/%s", runtime.GOOS, runtime.GOARCH)
+}